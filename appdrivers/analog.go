@@ -0,0 +1,129 @@
+package appdrivers
+
+import (
+	"fmt"
+	"github.com/spirilis/smacbase"
+	"log"
+	"sync"
+)
+
+/* analog is a parameterized driver for the whole class of simple sensors which report one signed 16-bit value:
+ *   devID (uint16 LE), rawValue (int16 LE)
+ * on a program ID of the user's choosing.  The reading is value = rawValue*Scale + Offset, in Unit.
+ */
+
+// AnalogSensor decodes scaled 16-bit readings on a single program ID
+type AnalogSensor struct {
+	Name     string
+	Program  uint16
+	Scale    float64
+	Offset   float64
+	Unit     string
+	Logger   LogText
+	LastSeen map[uint16]float64 // Last scaled value by device ID; guarded by mutex once registered, read it via GetByDevice
+
+	mutex         sync.Mutex
+	callbackMutex sync.Mutex
+	callbacks     []func(AnalogReading)
+	decodeErrorHooks
+}
+
+// AnalogReading is a single decoded AnalogSensor sample
+type AnalogReading struct {
+	DeviceID uint16
+	SrcAddr  uint32
+	Rssi     int8
+	Raw      int16
+	Value    float64 // Raw*Scale + Offset
+	Unit     string
+}
+
+// NewAnalogSensor creates an AnalogSensor for progID, logging to stdout by default, and binds it to a Link.
+func NewAnalogSensor(l *smacbase.LinkMgr, progID uint16, name string, scale, offset float64, unit string) *AnalogSensor {
+	a := newAnalogSensor(progID, name, scale, offset, unit)
+	l.RegisterDriver(a)
+	return a
+}
+
+func newAnalogSensor(progID uint16, name string, scale, offset float64, unit string) *AnalogSensor {
+	a := new(AnalogSensor)
+	a.Name = name
+	a.Program = progID
+	a.Scale = scale
+	a.Offset = offset
+	a.Unit = unit
+	a.Logger = GenericStdout{}
+	a.LastSeen = make(map[uint16]float64)
+	a.OnReading(a.logReading)
+	return a
+}
+
+// Receive implements smacbase.FrameReceiver
+func (a *AnalogSensor) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	if progID != a.Program {
+		if !a.decodeError(progID, srcAddr, fmt.Sprintf("wrong progID, expected %04X", a.Program)) {
+			log.Printf("AnalogSensor(%s).Receive: received frame for wrong progID=%04X, expected %04X", a.Name, progID, a.Program)
+		}
+		return true
+	}
+	if len(payload) != 4 {
+		if !a.decodeError(progID, srcAddr, fmt.Sprintf("payload length %d, expected 4", len(payload))) {
+			log.Printf("AnalogSensor(%s).Receive: received frame with invalid payload length, expected 4 bytes", a.Name)
+		}
+		return false
+	}
+
+	var r AnalogReading
+	r.DeviceID = uint16(payload[0]) | (uint16(payload[1]) << 8)
+	r.Raw = int16(uint16(payload[2]) | (uint16(payload[3]) << 8))
+	r.SrcAddr = srcAddr
+	r.Rssi = rssi
+	r.Value = float64(r.Raw)*a.Scale + a.Offset
+	r.Unit = a.Unit
+
+	a.mutex.Lock()
+	a.LastSeen[r.DeviceID] = r.Value
+	a.mutex.Unlock()
+	a.callbackMutex.Lock()
+	callbacks := a.callbacks
+	a.callbackMutex.Unlock()
+	for _, f := range callbacks {
+		f(r)
+	}
+	return false
+}
+
+// OnReading registers f to be called with every successfully decoded sample.  The Logger output is registered as
+// the first callback.
+func (a *AnalogSensor) OnReading(f func(AnalogReading)) {
+	if f == nil {
+		return
+	}
+	a.callbackMutex.Lock()
+	a.callbacks = append(a.callbacks, f)
+	a.callbackMutex.Unlock()
+}
+
+// logReading is the default OnReading callback, printing the sample to Logger
+func (a *AnalogSensor) logReading(r AnalogReading) {
+	if a.Logger == nil {
+		return
+	}
+	a.Logger.Printf("%s RX: Device ID %04X - %.2f %s (raw=%d) [srcAddr=%08X RSSI=%d]\n", a.Name, r.DeviceID, r.Value, r.Unit, r.Raw, r.SrcAddr, r.Rssi)
+}
+
+// GetByDevice implements QueryDevice, returning the last scaled value (float64) seen from devID
+func (a *AnalogSensor) GetByDevice(devID uint16) (interface{}, error) {
+	a.mutex.Lock()
+	v, ok := a.LastSeen[devID]
+	a.mutex.Unlock()
+	if !ok {
+		return nil, NotFound(fmt.Sprintf("No %s reading available for DeviceID=%04X", a.Name, devID))
+	}
+	return v, nil
+}
+
+// ProgramIDs implements smacbase.ProgramDriver
+func (a *AnalogSensor) ProgramIDs() []uint16 {
+	return []uint16{a.Program}
+}
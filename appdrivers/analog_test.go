@@ -0,0 +1,63 @@
+package appdrivers
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAnalogSensor(t *testing.T) {
+	a := newAnalogSensor(0x3000, "Soil", 0.5, -10, "%")
+	buf := new(BufferLog)
+	a.Logger = buf
+	var readings []AnalogReading
+	a.OnReading(func(r AnalogReading) { readings = append(readings, r) })
+
+	// devID=0x0007, raw=-4 (0xFFFC) -> -4*0.5 - 10 = -12
+	a.Receive(nil, -70, 0xBACE0007, 0x3000, []byte{0x07, 0x00, 0xFC, 0xFF})
+
+	if len(readings) != 1 || readings[0].Raw != -4 || readings[0].Value != -12 || readings[0].DeviceID != 7 {
+		t.Fatalf("Unexpected readings: %+v", readings)
+	}
+	lines := buf.Lines()
+	expected := "Soil RX: Device ID 0007 - -12.00 % (raw=-4) [srcAddr=BACE0007 RSSI=-70]\n"
+	if len(lines) != 1 || lines[0] != expected {
+		t.Errorf("Unexpected log output %q, want %q", lines, expected)
+	}
+	v, err := a.GetByDevice(7)
+	if err != nil || v.(float64) != -12 {
+		t.Errorf("GetByDevice returned %v, %v", v, err)
+	}
+	if _, err := a.GetByDevice(8); err == nil {
+		t.Errorf("GetByDevice found a device which never reported")
+	}
+
+	a.Receive(nil, -70, 0xBACE0007, 0x3000, []byte{0x07, 0x00, 0xFC})
+	if len(readings) != 1 {
+		t.Errorf("Short payload produced a reading")
+	}
+}
+
+func TestAnalogSensorConcurrentAccess(t *testing.T) {
+	a := newAnalogSensor(0x3000, "Soil", 1, 0, "%")
+	a.Logger = nil
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			a.Receive(nil, -60, 0x12345678, 0x3000, []byte{0x07, 0x00, uint8(i), 0x00})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		a.GetByDevice(0x0007)
+	}
+	wg.Wait()
+
+	if v, err := a.GetByDevice(0x0007); err != nil || v.(float64) != 199 {
+		t.Errorf("Expected the last analog reading of 199, got %v, %v", v, err)
+	}
+	if _, err := a.GetByDevice(0x0008); err == nil {
+		t.Errorf("GetByDevice found an unseen device")
+	}
+}
@@ -0,0 +1,41 @@
+package appdrivers
+
+import (
+	"sync"
+)
+
+/* decodeerror.go lets applications hear about frames a driver rejects as malformed (wrong program ID, bad payload
+ * length...), e.g. to surface them in their own monitoring, instead of those going to the log.
+ */
+
+// DecodeErrorFunc is called with the program ID and source address of a frame a driver rejected, and why
+type DecodeErrorFunc func(progID uint16, addr uint32, reason string)
+
+// decodeErrorHooks holds a driver's OnDecodeError callbacks; the drivers embed it
+type decodeErrorHooks struct {
+	decodeErrorMutex sync.Mutex
+	decodeErrorFuncs []DecodeErrorFunc
+}
+
+// OnDecodeError registers f to be called for every frame the driver rejects.  Rejected frames go to the global logger
+// only while no callback is registered, so an application taking them over doesn't get them logged twice.
+func (h *decodeErrorHooks) OnDecodeError(f DecodeErrorFunc) {
+	if f == nil {
+		return
+	}
+	h.decodeErrorMutex.Lock()
+	h.decodeErrorFuncs = append(h.decodeErrorFuncs, f)
+	h.decodeErrorMutex.Unlock()
+}
+
+// decodeError reports a rejected frame to the OnDecodeError callbacks, returning false if there are none, in which case
+// the driver logs it instead
+func (h *decodeErrorHooks) decodeError(progID uint16, addr uint32, reason string) bool {
+	h.decodeErrorMutex.Lock()
+	funcs := h.decodeErrorFuncs
+	h.decodeErrorMutex.Unlock()
+	for _, f := range funcs {
+		f(progID, addr, reason)
+	}
+	return len(funcs) > 0
+}
@@ -0,0 +1,61 @@
+package appdrivers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestOnDecodeError(t *testing.T) {
+	var got []string
+	record := func(progID uint16, addr uint32, reason string) {
+		got = append(got, fmt.Sprintf("%04X %08X %s", progID, addr, reason))
+	}
+
+	th := &TemperatureHumidity{LastSeenTemp: make(map[uint16]int16), LastSeenHum: make(map[uint16]uint8)}
+	th.OnDecodeError(record)
+	th.Receive(nil, -60, 0x12345678, 0x2002, []byte{0x42, 0x00})
+	th.Receive(nil, -60, 0x12345678, 0x2001, nil)
+
+	sd := newSchemaDecoder()
+	sd.OnDecodeError(record)
+	sd.Receive(nil, -60, 0xBACE0001, 0x2100, []byte{0x01, 0x00})
+
+	ping := PingHandler{Logger: NullLog{}, DecodeError: record}
+	ping.Receive(nil, -60, 0xBACE0002, 0x2003, []byte{0x01})
+
+	expected := []string{
+		"2002 12345678 payload length 2, expected 6",
+		"2001 12345678 wrong progID, expected 2002",
+		"2100 BACE0001 no schema registered",
+		"2003 BACE0002 payload length 1, expected 4",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected decode errors:\n got %q\nwant %q", got, expected)
+	}
+}
+
+func TestDecodeErrorLogging(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// Without a callback, rejected frames are logged
+	th := &TemperatureHumidity{LastSeenTemp: make(map[uint16]int16), LastSeenHum: make(map[uint16]uint8)}
+	th.Receive(nil, -60, 0x12345678, 0x2002, []byte{0x42, 0x00})
+	if logged.Len() == 0 {
+		t.Errorf("Rejected frame was not logged")
+	}
+
+	// Once the application takes them over, they aren't
+	logged.Reset()
+	th.OnDecodeError(func(uint16, uint32, string) {})
+	th.Receive(nil, -60, 0x12345678, 0x2002, []byte{0x42, 0x00})
+	ping := PingHandler{Logger: NullLog{}, DecodeError: func(uint16, uint32, string) {}}
+	ping.Receive(nil, -60, 0xBACE0002, 0x2003, []byte{0x01})
+	if logged.Len() != 0 {
+		t.Errorf("Rejected frames logged despite a DecodeErrorFunc: %q", logged.String())
+	}
+}
@@ -0,0 +1,71 @@
+package appdrivers
+
+import (
+	"fmt"
+	"github.com/spirilis/smacbase"
+	"strings"
+)
+
+/* describe.go centralizes the one-line, human-readable rendering of received frames for monitors and debug tools.
+ * Known program IDs are decoded with the same decoders the drivers use; anything else becomes a hex dump.
+ */
+
+// DescribeFrame renders f as a one-line summary prefixed with its Direction, e.g.
+//
+//	RX: 12345678 TempHum dev=0042 25.0C 50.2%RH dewpt 13.9C [HEATER] RSSI=-60
+//	RX: 12345678 Prog=7777 payload=[01 02 03] RSSI=-60
+//	TX: 12345678 Prog=2002(TempHum) payload=[42] RSSI=0
+func DescribeFrame(f *smacbase.NpiRadioFrame) string {
+	var desc string
+	switch f.Program {
+	case smacbase.ProgDeviceID:
+		if len(f.Data) >= 2 {
+			devID := uint16(f.Data[0]) | (uint16(f.Data[1]) << 8)
+			if len(f.Data) == 2 {
+				desc = fmt.Sprintf("DeviceID inquiry dev=%04X", devID)
+			} else {
+				desc = fmt.Sprintf("DeviceID dev=%04X %q", devID, string(f.Data[2:]))
+			}
+		}
+	case smacbase.ProgThermocouple:
+		if r, ok := decodeThermocouple(f.Address, f.Rssi, f.Data); ok {
+			desc = fmt.Sprintf("Thermocouple dev=%04X TC=%.0fC ambient=%.0fC", r.DeviceID, r.Thermocouple.Celsius(), r.Ambient.Celsius())
+		}
+	case smacbase.ProgTempHum:
+		if r, _, _, ok := decodeTempHum(f.Address, f.Rssi, f.Data); ok {
+			desc = fmt.Sprintf("TempHum dev=%04X %v %.1f%%RH", r.DeviceID, r.Temperature, r.Humidity)
+			if r.DewpointValid {
+				desc += fmt.Sprintf(" dewpt %v", r.Dewpoint)
+			}
+			if r.HeaterOn {
+				desc += " [HEATER]"
+			}
+		}
+	case smacbase.ProgPingReq, smacbase.ProgPingReply:
+		if len(f.Data) == 4 {
+			kind := "Ping echo-request"
+			if f.Program == smacbase.ProgPingReply {
+				kind = "Ping echo-reply"
+			}
+			token, value := decodePing(f.Data)
+			desc = fmt.Sprintf("%s token=%04X value=%04X", kind, token, value)
+		}
+	}
+	if desc == "" { // Unknown program ID, or a known one with a malformed payload
+		desc = fmt.Sprintf("Prog=%04X", f.Program)
+		if name := smacbase.ProgramName(f.Program); name != "" {
+			desc += "(" + name + ")"
+		}
+		desc += fmt.Sprintf(" payload=[%s]", hexBytes(f.Data))
+	}
+	return fmt.Sprintf("%s: %08X %s RSSI=%d", f.Direction, f.Address, desc, f.Rssi)
+}
+
+// hexBytes renders b as space-separated hex bytes
+func hexBytes(b []byte) string {
+	parts := make([]string, len(b))
+	for i, v := range b {
+		parts[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,34 @@
+package appdrivers
+
+import (
+	"github.com/spirilis/smacbase"
+	"testing"
+)
+
+func TestDescribeFrame(t *testing.T) {
+	cases := []struct {
+		prog uint16
+		data []byte
+		want string
+	}{
+		{0x2002, []byte{0x42, 0x00, 200, 0x00, 128, 0x01}, "RX: 12345678 TempHum dev=0042 25.0C 50.2%RH dewpt 13.9C [HEATER] RSSI=-60"},
+		{0x2002, []byte{0x42, 0x00, 200, 0x00, 0, 0x00}, "RX: 12345678 TempHum dev=0042 25.0C 0.0%RH RSSI=-60"},
+		{0x2001, []byte{0x07, 0x00, 0x64, 0x00, 0x16, 0x00, 0x00}, "RX: 12345678 Thermocouple dev=0007 TC=100C ambient=22C RSSI=-60"},
+		{0x2000, []byte{0x07, 0x00, 'S', 'h', 'e', 'd'}, "RX: 12345678 DeviceID dev=0007 \"Shed\" RSSI=-60"},
+		{0x2003, []byte{0x04, 0x03, 0x02, 0x01}, "RX: 12345678 Ping echo-request token=0304 value=0102 RSSI=-60"},
+		{0x7777, []byte{0x01, 0xAB}, "RX: 12345678 Prog=7777 payload=[01 AB] RSSI=-60"},
+		{0x2002, []byte{0x42}, "RX: 12345678 Prog=2002(TempHum) payload=[42] RSSI=-60"},
+	}
+	for _, c := range cases {
+		f := &smacbase.NpiRadioFrame{Address: 0x12345678, Program: c.prog, Rssi: -60, Data: c.data}
+		if got := DescribeFrame(f); got != c.want {
+			t.Errorf("DescribeFrame(%04X):\n got %q\nwant %q", c.prog, got, c.want)
+		}
+	}
+
+	f := &smacbase.NpiRadioFrame{Address: 0x12345678, Program: 0x7777, Data: []byte{0x01}}
+	f.Direction = smacbase.DirTX
+	if got, want := DescribeFrame(f), "TX: 12345678 Prog=7777 payload=[01] RSSI=0"; got != want {
+		t.Errorf("DescribeFrame(TX):\n got %q\nwant %q", got, want)
+	}
+}
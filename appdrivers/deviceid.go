@@ -1,8 +1,14 @@
 package appdrivers
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/spirilis/smacbase"
+	"io"
 	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
 /* deviceid is responsible for receiving Device ID registrations (ProgID=0x2000) and
@@ -11,25 +17,46 @@ import (
 
 // DeviceIdRegistration is passed to other DeviceID-aware objects for lookup purposes
 type DeviceIdRegistration struct {
-	Registrations map[uint16]string
+	Registrations map[uint16]string // Guarded by mutex once the driver is registered; read it via GetByDevice or Sorted
+	OnPrune       func(DeviceEntry) // Optional; called for each registration removed by PruneOlderThan
+
+	mutex       sync.Mutex
+	lastSeen    map[uint16]time.Time
+	lastAddress map[uint16]uint32
+	decodeErrorHooks
+}
+
+// DeviceEntry describes a single registered device, suitable for display or for provisioning another base station
+// (see Export and Import)
+type DeviceEntry struct {
+	ID          uint16
+	Description string
+	LastSeen    time.Time // Zero if the device was never heard from directly, e.g. it was only provisioned by Import
+	Address     uint32    // Last-known source address of the device's registration frame
 }
 
 // NewDeviceIdRegistration is the canonical way to create a DeviceIdRegistration and bind it to a Link.
 func NewDeviceIdRegistration(l *smacbase.LinkMgr) *DeviceIdRegistration {
 	d := new(DeviceIdRegistration)
 	d.Registrations = make(map[uint16]string)
-	l.RegisterProgramHandler(0x2000, d)
+	d.lastSeen = make(map[uint16]time.Time)
+	d.lastAddress = make(map[uint16]uint32)
+	l.RegisterDriver(d)
 	return d
 }
 
 // Receive implements smacbase.FrameReceiver
 func (d *DeviceIdRegistration) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
-	if progID != 0x2000 {
-		log.Printf("DeviceIdRegistration.Receive: received an invalid frame with progID=%04X, expected 0x2000", progID)
+	if progID != smacbase.ProgDeviceID {
+		if !d.decodeError(progID, srcAddr, "wrong progID, expected 2000") {
+			log.Printf("DeviceIdRegistration.Receive: received an invalid frame with progID=%04X, expected 0x2000", progID)
+		}
 		return true // Error, not intended for us?
 	}
 	if len(payload) < 2 {
-		log.Printf("DeviceIdRegistration.Receive: received a frame with payload size < 2, invalid packet")
+		if !d.decodeError(progID, srcAddr, fmt.Sprintf("payload length %d, expected at least 2", len(payload))) {
+			log.Printf("DeviceIdRegistration.Receive: received a frame with payload size < 2, invalid packet")
+		}
 		return false // bad packet, stop processing it
 	}
 	var deviceID uint16
@@ -38,14 +65,181 @@ func (d *DeviceIdRegistration) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr u
 	deviceID = uint16(payload[0]) | (uint16(payload[1]) << 8)
 	deviceDescription = string(payload[2:])
 
+	d.mutex.Lock()
 	d.Registrations[deviceID] = deviceDescription
+	d.lastSeen[deviceID] = time.Now()
+	d.lastAddress[deviceID] = srcAddr
+	d.mutex.Unlock()
 	return false
 }
 
 // GetByDevice is used by other appdrivers and implements QueryDevice
 func (d *DeviceIdRegistration) GetByDevice(devID uint16) (interface{}, error) {
-	if d.Registrations[devID] == "" {
+	d.mutex.Lock()
+	desc := d.Registrations[devID]
+	d.mutex.Unlock()
+	if desc == "" {
 		return "", NotFound("DeviceID Not Found")
 	}
-	return d.Registrations[devID], nil
+	return desc, nil
+}
+
+// Sorted returns every registered device ordered by device ID, for stable display
+func (d *DeviceIdRegistration) Sorted() []DeviceEntry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.sorted()
+}
+
+func (d *DeviceIdRegistration) sorted() []DeviceEntry {
+	entries := make([]DeviceEntry, 0, len(d.Registrations))
+	for id, desc := range d.Registrations {
+		entries = append(entries, DeviceEntry{
+			ID:          id,
+			Description: desc,
+			LastSeen:    d.lastSeen[id],
+			Address:     d.lastAddress[id],
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// Remove forgets devID's registration, e.g. for a decommissioned node
+func (d *DeviceIdRegistration) Remove(devID uint16) {
+	d.mutex.Lock()
+	d.remove(devID)
+	d.mutex.Unlock()
+}
+
+func (d *DeviceIdRegistration) remove(devID uint16) {
+	delete(d.Registrations, devID)
+	delete(d.lastSeen, devID)
+	delete(d.lastAddress, devID)
+}
+
+// PruneOlderThan removes every registration not refreshed within the last age, calling OnPrune (if set) for each, and
+// returns how many were removed.  Keeps ghost devices from lingering in long-running deployments.  Provisioned
+// entries which have never been heard from (zero LastSeen) are kept.
+func (d *DeviceIdRegistration) PruneOlderThan(age time.Duration) int {
+	return d.prune(time.Now().Add(-age))
+}
+
+// prune removes registrations last seen before cutoff
+func (d *DeviceIdRegistration) prune(cutoff time.Time) int {
+	var pruned []DeviceEntry
+	d.mutex.Lock()
+	for _, e := range d.sorted() {
+		if !e.LastSeen.IsZero() && e.LastSeen.Before(cutoff) {
+			pruned = append(pruned, e)
+			d.remove(e.ID)
+		}
+	}
+	d.mutex.Unlock()
+	if d.OnPrune != nil {
+		for _, e := range pruned {
+			d.OnPrune(e)
+		}
+	}
+	return len(pruned)
+}
+
+// Export returns every registered device, ordered by device ID, for seeding another base station with Import
+func (d *DeviceIdRegistration) Export() []DeviceEntry {
+	return d.Sorted()
+}
+
+// Import merges entries into the registrations, e.g. from a provisioning file.  Where a device is already registered,
+// whichever entry was seen most recently wins; an entry with a zero LastSeen only fills in unknown devices.
+func (d *DeviceIdRegistration) Import(entries []DeviceEntry) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, e := range entries {
+		if _, known := d.Registrations[e.ID]; known && !e.LastSeen.After(d.lastSeen[e.ID]) {
+			continue
+		}
+		d.Registrations[e.ID] = e.Description
+		d.lastSeen[e.ID] = e.LastSeen
+		d.lastAddress[e.ID] = e.Address
+	}
+}
+
+// ExportJSON writes Export's entries to w as a JSON array
+func (d *DeviceIdRegistration) ExportJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(d.Export())
+}
+
+// ImportJSON reads a JSON array of entries from r, as written by ExportJSON, and merges them with Import
+func (d *DeviceIdRegistration) ImportJSON(r io.Reader) error {
+	var entries []DeviceEntry
+	err := json.NewDecoder(r).Decode(&entries)
+	if err != nil {
+		return err
+	}
+	d.Import(entries)
+	return nil
+}
+
+// ProgramIDs implements smacbase.ProgramDriver
+func (d *DeviceIdRegistration) ProgramIDs() []uint16 {
+	return []uint16{smacbase.ProgDeviceID}
+}
+
+// DefaultInquiryInterval is the minimum time between device-description inquiries to the same device ID
+const DefaultInquiryInterval = time.Minute
+
+// DeviceInquirer sends device-description inquiries (ProgID=0x2000 with the 2-byte device ID as payload) to nodes
+// whose device ID isn't registered yet, rate-limited per device so a chatty unknown node isn't asked on every sample.
+type DeviceInquirer struct {
+	Interval time.Duration
+
+	mutex       sync.Mutex
+	lastInquiry map[uint16]time.Time
+}
+
+// NewDeviceInquirer creates a DeviceInquirer which asks each device at most once per interval
+func NewDeviceInquirer(interval time.Duration) *DeviceInquirer {
+	d := new(DeviceInquirer)
+	d.Interval = interval
+	d.lastInquiry = make(map[uint16]time.Time)
+	return d
+}
+
+// Inquire asks the node at addr to announce the description for devID and triggers TX, unless devID was already
+// asked within the last Interval.  It's called from FrameReceiver.Receive, so the inquiry is queued with SendAsync
+// and RunTxAsync rather than holding up dispatch while the PHY or the MCU is busy.  Returns true if an inquiry was
+// queued.
+func (d *DeviceInquirer) Inquire(l *smacbase.LinkMgr, addr uint32, devID uint16) bool {
+	if !d.allow(devID, time.Now()) {
+		return false
+	}
+	payload := make([]byte, 2)
+	payload[0] = uint8(devID)
+	payload[1] = uint8(devID >> 8)
+	err := l.SendAsync(addr, smacbase.ProgDeviceID, payload, nil)
+	if err == nil {
+		err = l.RunTxAsync(func(sent int, err error) {
+			if err != nil {
+				log.Printf("DeviceInquirer.Inquire: RunTx error: %v", err)
+			} else if sent == 0 {
+				log.Printf("DeviceInquirer.Inquire: inquiry for device %04X to %08X was not transmitted", devID, addr)
+			}
+		})
+	}
+	if err != nil {
+		log.Printf("DeviceInquirer.Inquire: can't queue inquiry for device %04X to %08X: %v", devID, addr, err)
+		return false
+	}
+	return true
+}
+
+// allow reports whether devID may be asked at time now, recording the inquiry if so
+func (d *DeviceInquirer) allow(devID uint16, now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if last, ok := d.lastInquiry[devID]; ok && now.Sub(last) < d.Interval {
+		return false
+	}
+	d.lastInquiry[devID] = now
+	return true
 }
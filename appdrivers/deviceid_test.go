@@ -0,0 +1,121 @@
+package appdrivers
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeviceInquirerRateLimit(t *testing.T) {
+	d := NewDeviceInquirer(time.Minute)
+	now := time.Now()
+
+	if !d.allow(0x1234, now) {
+		t.Errorf("First inquiry for a device was suppressed")
+	}
+	if d.allow(0x1234, now.Add(30*time.Second)) {
+		t.Errorf("Second inquiry within the interval was allowed")
+	}
+	if !d.allow(0x5678, now.Add(30*time.Second)) {
+		t.Errorf("Inquiry for a different device was suppressed")
+	}
+	if !d.allow(0x1234, now.Add(61*time.Second)) {
+		t.Errorf("Inquiry after the interval elapsed was suppressed")
+	}
+}
+
+func TestDeviceIdPrune(t *testing.T) {
+	d := new(DeviceIdRegistration)
+	d.Registrations = make(map[uint16]string)
+	d.lastSeen = make(map[uint16]time.Time)
+	d.lastAddress = make(map[uint16]uint32)
+	now := time.Now()
+	d.Receive(nil, -60, 0xDEAD0001, 0x2000, []byte{0x01, 0x00, 'o', 'l', 'd'})
+	d.Receive(nil, -60, 0xDEAD0002, 0x2000, []byte{0x02, 0x00, 'n', 'e', 'w'})
+	d.Receive(nil, -60, 0xDEAD0003, 0x2000, []byte{0x03, 0x00, 'g', 'o', 'n', 'e'})
+	d.lastSeen[0x0001] = now.Add(-2 * time.Hour)
+
+	var pruned []DeviceEntry
+	d.OnPrune = func(e DeviceEntry) { pruned = append(pruned, e) }
+	if n := d.prune(now.Add(-time.Hour)); n != 1 {
+		t.Errorf("Expected 1 registration pruned, got %d", n)
+	}
+	if len(pruned) != 1 || pruned[0].ID != 0x0001 || pruned[0].Description != "old" || pruned[0].Address != 0xDEAD0001 {
+		t.Errorf("Unexpected OnPrune calls: %+v", pruned)
+	}
+
+	d.Remove(0x0003)
+	entries := d.Sorted()
+	if len(entries) != 1 || entries[0].ID != 0x0002 {
+		t.Errorf("Expected only device 0002 to remain, got %+v", entries)
+	}
+}
+
+func TestDeviceIdConcurrentAccess(t *testing.T) {
+	d := new(DeviceIdRegistration)
+	d.Registrations = make(map[uint16]string)
+	d.lastSeen = make(map[uint16]time.Time)
+	d.lastAddress = make(map[uint16]uint32)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() { // Stands in for the dispatch goroutine
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			d.Receive(nil, -60, 0xDEAD0001, 0x2000, []byte{uint8(i % 8), 0x00, 'n', 'o', 'd', 'e'})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		d.GetByDevice(uint16(i % 8))
+		d.Sorted()
+		if i%50 == 0 {
+			d.PruneOlderThan(time.Hour)
+		}
+	}
+	wg.Wait()
+	if len(d.Sorted()) != 8 {
+		t.Errorf("Expected 8 registrations, got %+v", d.Sorted())
+	}
+}
+
+func TestDeviceIdExportImport(t *testing.T) {
+	src := new(DeviceIdRegistration)
+	src.Registrations = make(map[uint16]string)
+	src.lastSeen = make(map[uint16]time.Time)
+	src.lastAddress = make(map[uint16]uint32)
+	src.Receive(nil, -60, 0xDEAD0001, 0x2000, []byte{0x01, 0x00, 'S', 'h', 'e', 'd'})
+	src.Receive(nil, -60, 0xDEAD0002, 0x2000, []byte{0x02, 0x00, 'G', 'a', 'r', 'a', 'g', 'e'})
+
+	var buf bytes.Buffer
+	if err := src.ExportJSON(&buf); err != nil {
+		t.Fatalf("ExportJSON error: %v", err)
+	}
+
+	dst := new(DeviceIdRegistration)
+	dst.Registrations = make(map[uint16]string)
+	dst.lastSeen = make(map[uint16]time.Time)
+	dst.lastAddress = make(map[uint16]uint32)
+	dst.Receive(nil, -60, 0xDEAD0009, 0x2000, []byte{0x02, 0x00, 'B', 'a', 'r', 'n'}) // Heard more recently: kept
+	dst.Import([]DeviceEntry{{ID: 0x0001, Description: "Stale"}, {ID: 0x0003, Description: "Attic"}})
+	if err := dst.ImportJSON(&buf); err != nil {
+		t.Fatalf("ImportJSON error: %v", err)
+	}
+
+	entries := dst.Export()
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 devices after import, got %+v", entries)
+	}
+	if entries[0].Description != "Shed" || entries[0].Address != 0xDEAD0001 {
+		t.Errorf("Exported entry did not replace the never-seen one: %+v", entries[0])
+	}
+	if entries[1].Description != "Barn" || entries[1].Address != 0xDEAD0009 {
+		t.Errorf("Older imported entry replaced a newer one: %+v", entries[1])
+	}
+	if entries[2].Description != "Attic" || !entries[2].LastSeen.IsZero() {
+		t.Errorf("Provisioned entry not imported as never seen: %+v", entries[2])
+	}
+	if n := dst.PruneOlderThan(0); n != 2 {
+		t.Errorf("Expected the 2 heard-from devices pruned and the provisioned one kept, got %d pruned", n)
+	}
+}
@@ -0,0 +1,93 @@
+package appdrivers
+
+import (
+	"github.com/spirilis/smacbase"
+	"sync"
+	"time"
+)
+
+/* lastframe.go remembers the most recent frame of each program ID and from each source address, for dashboards and
+ * debugging which just want "the latest X" without keeping their own last-seen state.
+ */
+
+// LastFrameCache is a firehose handler keeping a copy of the most recent frame per program ID and per source address,
+// FrameMeta included
+type LastFrameCache struct {
+	mutex     sync.Mutex
+	byProgram map[uint16]cachedFrame
+	byAddress map[uint32]cachedFrame
+}
+
+// cachedFrame is a frame as it was received, and when
+type cachedFrame struct {
+	frame    smacbase.NpiRadioFrame
+	received time.Time
+}
+
+// NewLastFrameCache creates a LastFrameCache and registers it in l's firehose.  Frames which an earlier program or
+// address handler consumed (returned false for) never reach the firehose, so aren't cached.
+func NewLastFrameCache(l *smacbase.LinkMgr) *LastFrameCache {
+	c := newLastFrameCache()
+	l.RegisterAllHandler(c)
+	return c
+}
+
+func newLastFrameCache() *LastFrameCache {
+	c := new(LastFrameCache)
+	c.byProgram = make(map[uint16]cachedFrame)
+	c.byAddress = make(map[uint32]cachedFrame)
+	return c
+}
+
+// Receive implements smacbase.FrameReceiver
+func (c *LastFrameCache) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	return c.ReceiveFrame(l, &smacbase.NpiRadioFrame{Address: srcAddr, Program: progID, Rssi: rssi, Data: payload})
+}
+
+// ReceiveFrame implements smacbase.FrameReceiverFull
+func (c *LastFrameCache) ReceiveFrame(l *smacbase.LinkMgr, frame *smacbase.NpiRadioFrame) bool {
+	f := cachedFrame{
+		frame: smacbase.NpiRadioFrame{
+			Address:   frame.Address,
+			Program:   frame.Program,
+			Rssi:      frame.Rssi,
+			Data:      frame.Data,
+			FrameMeta: frame.FrameMeta,
+		},
+		received: time.Now(),
+	}
+	f.frame = f.copy()
+	c.mutex.Lock()
+	c.byProgram[frame.Program] = f
+	c.byAddress[frame.Address] = f
+	c.mutex.Unlock()
+	return true
+}
+
+// LastByProgram returns the most recent frame with program ID progID and when it arrived, or false if none has
+func (c *LastFrameCache) LastByProgram(progID uint16) (smacbase.NpiRadioFrame, time.Time, bool) {
+	c.mutex.Lock()
+	f, ok := c.byProgram[progID]
+	c.mutex.Unlock()
+	return f.copy(), f.received, ok
+}
+
+// LastByAddress returns the most recent frame from srcAddr and when it arrived, or false if none has
+func (c *LastFrameCache) LastByAddress(srcAddr uint32) (smacbase.NpiRadioFrame, time.Time, bool) {
+	c.mutex.Lock()
+	f, ok := c.byAddress[srcAddr]
+	c.mutex.Unlock()
+	return f.copy(), f.received, ok
+}
+
+// copy returns the cached frame with its own copies of the payload and raw bytes, so nobody else can modify them
+func (f cachedFrame) copy() smacbase.NpiRadioFrame {
+	frame := f.frame
+	if frame.Data != nil {
+		frame.Data = append([]byte(nil), frame.Data...)
+	}
+	if frame.Raw != nil {
+		frame.Raw = append([]byte(nil), frame.Raw...)
+	}
+	return frame
+}
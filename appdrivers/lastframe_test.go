@@ -0,0 +1,33 @@
+package appdrivers
+
+import (
+	"testing"
+)
+
+func TestLastFrameCache(t *testing.T) {
+	c := newLastFrameCache()
+	if _, _, ok := c.LastByProgram(0x2002); ok {
+		t.Errorf("Empty cache found a frame")
+	}
+
+	payload := []byte{0x42, 0x00, 200, 0x00}
+	c.Receive(nil, -60, 0xBACE0042, 0x2002, payload)
+	c.Receive(nil, -70, 0xBACE0007, 0x2002, []byte{0x07, 0x00})
+	payload[0] = 0xFF // The sender's buffer being reused mustn't change the cached frame
+
+	f, when, ok := c.LastByProgram(0x2002)
+	if !ok || f.Address != 0xBACE0007 || f.Rssi != -70 || when.IsZero() {
+		t.Errorf("LastByProgram returned %+v at %v, %v", f, when, ok)
+	}
+	f, _, ok = c.LastByAddress(0xBACE0042)
+	if !ok || f.Program != 0x2002 || f.Rssi != -60 || f.Data[0] != 0x42 {
+		t.Errorf("LastByAddress returned %+v, %v", f, ok)
+	}
+	f.Data[1] = 0xFF
+	if f, _, _ = c.LastByAddress(0xBACE0042); f.Data[1] != 0x00 {
+		t.Errorf("Modifying a returned frame changed the cache")
+	}
+	if _, _, ok = c.LastByAddress(0xBACE0001); ok {
+		t.Errorf("LastByAddress found a frame from an unseen address")
+	}
+}
@@ -0,0 +1,91 @@
+package appdrivers
+
+import (
+	"fmt"
+	"github.com/spirilis/smacbase"
+	"sort"
+	"sync"
+)
+
+/* loaders.go maps short driver names ("temphum", "print"...) to the code which instantiates each driver on a link, so
+ * tools can choose which drivers to load from their command line or configuration.
+ */
+
+// DriverLoader instantiates a driver on l, drawing shared dependencies from env
+type DriverLoader func(l *smacbase.LinkMgr, env *DriverEnv)
+
+// DriverEnv carries what the loaders share.  Use one DriverEnv per link.
+type DriverEnv struct {
+	Logger LogText
+
+	devices *DeviceIdRegistration
+}
+
+// Devices returns the device-ID directory, creating it (which registers it on l) the first time
+func (e *DriverEnv) Devices(l *smacbase.LinkMgr) *DeviceIdRegistration {
+	if e.devices == nil {
+		e.devices = NewDeviceIdRegistration(l)
+	}
+	return e.devices
+}
+
+// DefaultDrivers are the drivers LoadDrivers loads when given no names
+var DefaultDrivers = []string{"deviceid", "temphum", "print", "ping"}
+
+var (
+	loaderMutex sync.Mutex
+	loaders     = map[string]DriverLoader{
+		"deviceid": func(l *smacbase.LinkMgr, env *DriverEnv) { env.Devices(l) },
+		// TempHum looks up device descriptions, so it loads deviceid too
+		"temphum": func(l *smacbase.LinkMgr, env *DriverEnv) { NewTemperatureHumidity(l, env.Logger, env.Devices(l)) },
+		"print":   func(l *smacbase.LinkMgr, env *DriverEnv) { l.RegisterAllHandler(&FrameStdout{Logger: env.Logger}) },
+		"ping":    func(l *smacbase.LinkMgr, env *DriverEnv) { l.RegisterDriver(PingHandler{Logger: env.Logger}) },
+	}
+)
+
+// RegisterDriverLoader makes f loadable by name, replacing any loader already registered under it
+func RegisterDriverLoader(name string, f DriverLoader) {
+	loaderMutex.Lock()
+	loaders[name] = f
+	loaderMutex.Unlock()
+}
+
+// LookupDriver returns the loader registered under name
+func LookupDriver(name string) (DriverLoader, bool) {
+	loaderMutex.Lock()
+	defer loaderMutex.Unlock()
+	f, ok := loaders[name]
+	return f, ok
+}
+
+// DriverNames returns the names of every registered loader, sorted
+func DriverNames() []string {
+	loaderMutex.Lock()
+	defer loaderMutex.Unlock()
+	names := make([]string, 0, len(loaders))
+	for name := range loaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadDrivers runs the named loaders in order, or those in DefaultDrivers if names is empty.  Nothing is loaded if any
+// name is unknown.
+func LoadDrivers(l *smacbase.LinkMgr, env *DriverEnv, names []string) error {
+	if len(names) == 0 {
+		names = DefaultDrivers
+	}
+	fs := make([]DriverLoader, len(names))
+	for i, name := range names {
+		f, ok := LookupDriver(name)
+		if !ok {
+			return fmt.Errorf("unknown driver %q (known drivers: %v)", name, DriverNames())
+		}
+		fs[i] = f
+	}
+	for _, f := range fs {
+		f(l, env)
+	}
+	return nil
+}
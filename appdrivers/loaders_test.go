@@ -0,0 +1,42 @@
+package appdrivers
+
+import (
+	"github.com/spirilis/smacbase"
+	"testing"
+)
+
+func newRegistryLink() *smacbase.LinkMgr {
+	l := new(smacbase.LinkMgr)
+	l.RxRegistryProgram = make(map[uint16]smacbase.FrameReceiver)
+	l.RxRegistryAddress = make(map[uint32]smacbase.FrameReceiver)
+	return l
+}
+
+func TestLoadDrivers(t *testing.T) {
+	l := newRegistryLink()
+	if err := LoadDrivers(l, &DriverEnv{Logger: NullLog{}}, []string{"temphum"}); err != nil {
+		t.Fatalf("LoadDrivers error: %v", err)
+	}
+	if len(l.RxRegistryProgram) != 2 || l.RxRegistryProgram[smacbase.ProgTempHum] == nil || l.RxRegistryProgram[smacbase.ProgDeviceID] == nil {
+		t.Errorf("Expected temphum and its deviceid dependency, got %v", l.RxRegistryProgram)
+	}
+
+	l = newRegistryLink()
+	if err := LoadDrivers(l, &DriverEnv{Logger: NullLog{}}, []string{"print", "bogus"}); err == nil {
+		t.Errorf("Unknown driver name accepted")
+	}
+	if len(l.RxFirehose) != 0 {
+		t.Errorf("Drivers were loaded despite an unknown name")
+	}
+
+	env := &DriverEnv{Logger: NullLog{}}
+	if err := LoadDrivers(l, env, nil); err != nil {
+		t.Fatalf("LoadDrivers error: %v", err)
+	}
+	if len(l.RxRegistryProgram) != 3 || len(l.RxFirehose) != 1 || l.RxRegistryProgram[smacbase.ProgPingReq] == nil {
+		t.Errorf("Default drivers not all loaded: programs=%v firehose=%d", l.RxRegistryProgram, len(l.RxFirehose))
+	}
+	if env.Devices(l) != l.RxRegistryProgram[smacbase.ProgDeviceID] {
+		t.Errorf("DriverEnv created a second device-ID directory")
+	}
+}
@@ -3,6 +3,7 @@ package appdrivers
 import (
 	"fmt"
 	"github.com/spirilis/smacbase"
+	"sync"
 )
 
 /* loggable.go defines the LogText interface, whose only method Log() (printf-style arguments) logs text to
@@ -22,18 +23,51 @@ func (g GenericStdout) Printf(f string, v ...interface{}) {
 	fmt.Printf(f, v...)
 }
 
-// FrameStdout is a generic type for printing received packets
+// NullLog is a LogText implementation that discards everything, for muting a driver's output.
+type NullLog struct{}
+
+// Printf implements the LogText interface
+func (n NullLog) Printf(f string, v ...interface{}) {}
+
+// BufferLog is a LogText implementation that captures each formatted line in memory, for tests.
+type BufferLog struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+// Printf implements the LogText interface
+func (b *BufferLog) Printf(f string, v ...interface{}) {
+	b.mutex.Lock()
+	b.lines = append(b.lines, fmt.Sprintf(f, v...))
+	b.mutex.Unlock()
+}
+
+// Lines returns a copy of everything logged so far, one entry per Printf call
+func (b *BufferLog) Lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.lines...)
+}
+
+// Reset discards everything logged so far
+func (b *BufferLog) Reset() {
+	b.mutex.Lock()
+	b.lines = nil
+	b.mutex.Unlock()
+}
+
+// FrameStdout is a generic type for printing received packets, and transmissions echoed by LinkMgr.SetLoopbackTX
 type FrameStdout struct {
 	Logger LogText
 }
 
 // Receive implements smacbase.FrameReceiver
 func (f *FrameStdout) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
-	outStr := fmt.Sprintf("RX: %08X Prog = %04X, payload = [", srcAddr, progID)
-	for _, b := range payload {
-		outStr += fmt.Sprintf("%02X ", b)
-	}
-	outStr += fmt.Sprintf("], RSSI=%d\n", rssi)
-	f.Logger.Printf(outStr)
+	return f.ReceiveFrame(l, &smacbase.NpiRadioFrame{Address: srcAddr, Program: progID, Rssi: rssi, Data: payload})
+}
+
+// ReceiveFrame implements smacbase.FrameReceiverFull, so frames are printed with their actual Direction
+func (f *FrameStdout) ReceiveFrame(l *smacbase.LinkMgr, frame *smacbase.NpiRadioFrame) bool {
+	f.Logger.Printf("%s\n", DescribeFrame(frame))
 	return true
 }
@@ -0,0 +1,136 @@
+package appdrivers
+
+import (
+	"fmt"
+	"github.com/spirilis/smacbase"
+	"log"
+	"sync"
+	"time"
+)
+
+/* nodehealth receives operational telemetry from field nodes on a configurable program ID:
+ *   devID (uint16 LE), battery millivolts (uint16 LE), uptime in seconds (uint32 LE)
+ * and raises low-battery alerts.  An alert fires once when a device drops below LowBatteryMV and re-arms only after
+ * the device recovers to LowBatteryMV + HysteresisMV, so a battery hovering at the threshold doesn't spam alerts.
+ */
+
+// DefaultHysteresisMV is the recovery margin above the low-battery threshold before another alert can fire
+const DefaultHysteresisMV = 100
+
+// NodeHealth tracks battery voltage and uptime reported by nodes
+type NodeHealth struct {
+	Program      uint16
+	LowBatteryMV uint16
+	HysteresisMV uint16
+	Logger       LogText
+	LastSeen     map[uint16]NodeHealthReading // Guarded by mutex once the driver is registered; read it via GetByDevice
+
+	mutex         sync.Mutex
+	lowBattery    map[uint16]bool // Devices currently in the alerted state; guarded by mutex
+	callbackMutex sync.Mutex
+	lowCallbacks  []func(devID uint16, mv uint16)
+	decodeErrorHooks
+}
+
+// NodeHealthReading is a single decoded health report
+type NodeHealthReading struct {
+	DeviceID  uint16
+	SrcAddr   uint32
+	Rssi      int8
+	BatteryMV uint16
+	Uptime    time.Duration
+	Received  time.Time
+}
+
+// NewNodeHealth creates a NodeHealth driver for progID alerting below lowBatteryMV, and binds it to a Link.
+func NewNodeHealth(l *smacbase.LinkMgr, progID uint16, lowBatteryMV uint16, g LogText) *NodeHealth {
+	n := newNodeHealth(progID, lowBatteryMV, g)
+	l.RegisterDriver(n)
+	return n
+}
+
+func newNodeHealth(progID uint16, lowBatteryMV uint16, g LogText) *NodeHealth {
+	n := new(NodeHealth)
+	n.Program = progID
+	n.LowBatteryMV = lowBatteryMV
+	n.HysteresisMV = DefaultHysteresisMV
+	n.Logger = g
+	n.LastSeen = make(map[uint16]NodeHealthReading)
+	n.lowBattery = make(map[uint16]bool)
+	return n
+}
+
+// Receive implements smacbase.FrameReceiver
+func (n *NodeHealth) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	if progID != n.Program {
+		if !n.decodeError(progID, srcAddr, fmt.Sprintf("wrong progID, expected %04X", n.Program)) {
+			log.Printf("NodeHealth.Receive: received frame for wrong progID=%04X, expected %04X", progID, n.Program)
+		}
+		return true
+	}
+	if len(payload) != 8 {
+		if !n.decodeError(progID, srcAddr, fmt.Sprintf("payload length %d, expected 8", len(payload))) {
+			log.Printf("NodeHealth.Receive: received frame with invalid payload length, expected 8 bytes")
+		}
+		return false
+	}
+
+	var r NodeHealthReading
+	r.DeviceID = uint16(payload[0]) | (uint16(payload[1]) << 8)
+	r.BatteryMV = uint16(payload[2]) | (uint16(payload[3]) << 8)
+	uptime := uint32(payload[4]) | (uint32(payload[5]) << 8) | (uint32(payload[6]) << 16) | (uint32(payload[7]) << 24)
+	r.Uptime = time.Duration(uptime) * time.Second
+	r.SrcAddr = srcAddr
+	r.Rssi = rssi
+	r.Received = time.Now()
+	n.mutex.Lock()
+	n.LastSeen[r.DeviceID] = r
+	alert := false
+	if r.BatteryMV < n.LowBatteryMV {
+		alert = !n.lowBattery[r.DeviceID]
+		n.lowBattery[r.DeviceID] = true
+	} else if uint32(r.BatteryMV) >= uint32(n.LowBatteryMV)+uint32(n.HysteresisMV) {
+		delete(n.lowBattery, r.DeviceID)
+	}
+	n.mutex.Unlock()
+
+	if n.Logger != nil {
+		n.Logger.Printf("NodeHealth RX: Device ID %04X - battery %d mV, uptime %v [srcAddr=%08X RSSI=%d]\n", r.DeviceID, r.BatteryMV, r.Uptime, srcAddr, rssi)
+	}
+
+	if alert {
+		n.callbackMutex.Lock()
+		callbacks := n.lowCallbacks
+		n.callbackMutex.Unlock()
+		for _, f := range callbacks {
+			f(r.DeviceID, r.BatteryMV)
+		}
+	}
+	return false
+}
+
+// OnLowBattery registers f to be called when a device's battery first drops below LowBatteryMV
+func (n *NodeHealth) OnLowBattery(f func(devID uint16, mv uint16)) {
+	if f == nil {
+		return
+	}
+	n.callbackMutex.Lock()
+	n.lowCallbacks = append(n.lowCallbacks, f)
+	n.callbackMutex.Unlock()
+}
+
+// GetByDevice implements QueryDevice, returning the last NodeHealthReading seen from devID
+func (n *NodeHealth) GetByDevice(devID uint16) (interface{}, error) {
+	n.mutex.Lock()
+	r, ok := n.LastSeen[devID]
+	n.mutex.Unlock()
+	if !ok {
+		return nil, NotFound(fmt.Sprintf("No health report available for DeviceID=%04X", devID))
+	}
+	return r, nil
+}
+
+// ProgramIDs implements smacbase.ProgramDriver
+func (n *NodeHealth) ProgramIDs() []uint16 {
+	return []uint16{n.Program}
+}
@@ -0,0 +1,64 @@
+package appdrivers
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func healthPayload(devID, mv uint16, uptime uint32) []byte {
+	return []byte{uint8(devID), uint8(devID >> 8), uint8(mv), uint8(mv >> 8),
+		uint8(uptime), uint8(uptime >> 8), uint8(uptime >> 16), uint8(uptime >> 24)}
+}
+
+func TestNodeHealthLowBattery(t *testing.T) {
+	n := newNodeHealth(0x3001, 3000, NullLog{})
+	var alerts []uint16
+	n.OnLowBattery(func(devID uint16, mv uint16) { alerts = append(alerts, mv) })
+
+	// 3100 ok, 2950 alert, 2900 still low, 3050 within hysteresis, 2990 no re-alert, 3100 re-arm, 2800 alert
+	for _, mv := range []uint16{3100, 2950, 2900, 3050, 2990, 3100, 2800} {
+		n.Receive(nil, -50, 0xBACE0001, 0x3001, healthPayload(0x0011, mv, 3600))
+	}
+	if len(alerts) != 2 || alerts[0] != 2950 || alerts[1] != 2800 {
+		t.Errorf("Unexpected low-battery alerts: %v", alerts)
+	}
+
+	v, err := n.GetByDevice(0x0011)
+	if err != nil {
+		t.Fatalf("GetByDevice error: %v", err)
+	}
+	r := v.(NodeHealthReading)
+	if r.BatteryMV != 2800 || r.Uptime != time.Hour || r.SrcAddr != 0xBACE0001 {
+		t.Errorf("Unexpected health reading: %+v", r)
+	}
+}
+
+func TestNodeHealthConcurrentAccess(t *testing.T) {
+	n := newNodeHealth(0x3001, 3000, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			// Alternate either side of the threshold so the low-battery state is written too
+			n.Receive(nil, -60, 0x12345678, 0x3001, healthPayload(0x0007, uint16(2900+i%2*300), uint32(i)))
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		n.GetByDevice(0x0007)
+	}
+	wg.Wait()
+
+	v, err := n.GetByDevice(0x0007)
+	if err != nil {
+		t.Fatalf("GetByDevice error: %v", err)
+	}
+	if r := v.(NodeHealthReading); r.BatteryMV != 3200 || r.Uptime != 199*time.Second {
+		t.Errorf("Unexpected last reading %+v", r)
+	}
+	if _, err = n.GetByDevice(0x0008); err == nil {
+		t.Errorf("GetByDevice found an unseen device")
+	}
+}
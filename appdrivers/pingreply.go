@@ -1,36 +1,180 @@
 package appdrivers
 
 import (
+	"errors"
+	"fmt"
 	"github.com/spirilis/smacbase"
 	"log"
+	"sync"
+	"time"
 )
 
 /* Ping reply implements a listener for Ping echo-requests (0x2003) and responds with an outbound packet
  * using echo-reply (0x2004) with an immediate control frame to issue TX.
+ *
+ * Ping payload (both directions):
+ *   token (uint16 LE) - chosen by the requester to match the reply to its request; echoed unchanged
+ *   value (uint16 LE) - arbitrary; echoed unchanged
  */
 
 // PingHandler type doesn't do much; it just responds to ping requests
 type PingHandler struct {
-	Logger LogText
+	Logger      LogText
+	DecodeError DecodeErrorFunc // Optional; called for each malformed frame instead of logging it (cf. OnDecodeError)
 }
 
 // Receive implements FrameReceiver
 func (p PingHandler) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
-	if progID != 0x2003 {
-		log.Printf("PingHandler.Receive: Handling invalid packet with progID=%04X", progID)
+	if progID != smacbase.ProgPingReq {
+		if !p.decodeError(progID, srcAddr, "wrong progID, expected 2003") {
+			log.Printf("PingHandler.Receive: Handling invalid packet with progID=%04X", progID)
+		}
 		return true
 	}
 	if len(payload) != 4 {
-		log.Printf("PingHandler.Receive: Received ping echo-request with payload size = %d (expected 4)", len(payload))
+		if !p.decodeError(progID, srcAddr, fmt.Sprintf("payload length %d, expected 4", len(payload))) {
+			log.Printf("PingHandler.Receive: Received ping echo-request with payload size = %d (expected 4)", len(payload))
+		}
+		return false
 	}
 
-	var pingVal uint32
-	pingVal = uint32(payload[0]) | (uint32(payload[1]) << 8) | (uint32(payload[2]) << 16) | (uint32(payload[3]) << 24)
-	p.Logger.Printf("PingHandler.Receive: Responding to echo-request from src=%08X, payload = %04X, RSSI=%d\n", srcAddr, pingVal, rssi)
-	l.Send(srcAddr, 0x2004, payload)
-	err := l.RunTx()
+	token, value := decodePing(payload)
+	p.Logger.Printf("PingHandler.Receive: Responding to echo-request from src=%08X, token=%04X value=%04X, RSSI=%d\n", srcAddr, token, value, rssi)
+	// Reply asynchronously; waiting on the PHY or the MCU here would hold up every other frame's dispatch
+	err := l.SendAsync(srcAddr, smacbase.ProgPingReply, payload, nil)
+	if err == nil {
+		err = l.RunTxAsync(func(sent int, err error) {
+			if err != nil {
+				p.Logger.Printf("PingHandler.Receive: RunTx error: %v\n", err)
+			} else if sent == 0 {
+				p.Logger.Printf("PingHandler.Receive: echo-reply to %08X was not transmitted\n", srcAddr)
+			}
+		})
+	}
 	if err != nil {
-		p.Logger.Printf("PingHandler.Receive: RunTx error: %v\n", err)
+		p.Logger.Printf("PingHandler.Receive: can't queue echo-reply to %08X: %v\n", srcAddr, err)
 	}
 	return false
 }
+
+// decodeError reports a rejected frame to DecodeError, returning false if it's unset
+func (p PingHandler) decodeError(progID uint16, addr uint32, reason string) bool {
+	if p.DecodeError == nil {
+		return false
+	}
+	p.DecodeError(progID, addr, reason)
+	return true
+}
+
+// ProgramIDs implements smacbase.ProgramDriver
+func (p PingHandler) ProgramIDs() []uint16 {
+	return []uint16{smacbase.ProgPingReq}
+}
+
+// decodePing splits a 4-byte ping payload into its token and value
+func decodePing(payload []byte) (token, value uint16) {
+	token = uint16(payload[0]) | (uint16(payload[1]) << 8)
+	value = uint16(payload[2]) | (uint16(payload[3]) << 8)
+	return token, value
+}
+
+// ErrPingTimeout is returned by Pinger.Ping when no echo-reply bearing its token arrives in time
+var ErrPingTimeout = errors.New("ping timed out")
+
+// Pinger sends echo-requests to nodes and measures the round-trip time, matching replies to requests by token so
+// concurrent pings (to the same node or different ones) can't be confused.
+type Pinger struct {
+	link    *smacbase.LinkMgr
+	mutex   sync.Mutex
+	next    uint16
+	pending map[uint16]chan struct{}
+	decodeErrorHooks
+}
+
+// NewPinger creates a Pinger and registers it with l as the handler for echo-replies
+func NewPinger(l *smacbase.LinkMgr) *Pinger {
+	p := newPinger()
+	p.link = l
+	l.RegisterDriver(p)
+	return p
+}
+
+func newPinger() *Pinger {
+	p := new(Pinger)
+	p.pending = make(map[uint16]chan struct{})
+	return p
+}
+
+// Ping sends an echo-request carrying value to addr and waits up to timeout for the matching echo-reply, returning
+// the round-trip time.
+func (p *Pinger) Ping(addr uint32, value uint16, timeout time.Duration) (time.Duration, error) {
+	token, replied := p.register()
+	defer p.forget(token)
+
+	payload := []byte{uint8(token), uint8(token >> 8), uint8(value), uint8(value >> 8)}
+	start := time.Now()
+	err := p.link.Send(addr, smacbase.ProgPingReq, payload)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = p.link.RunTx(); err != nil {
+		return 0, err
+	}
+	select {
+	case <-replied:
+		return time.Since(start), nil
+	case <-time.After(timeout):
+		return 0, ErrPingTimeout
+	}
+}
+
+// register allocates a token not already awaiting a reply
+func (p *Pinger) register() (uint16, chan struct{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		p.next++
+		if _, busy := p.pending[p.next]; !busy {
+			break
+		}
+	}
+	ch := make(chan struct{})
+	p.pending[p.next] = ch
+	return p.next, ch
+}
+
+func (p *Pinger) forget(token uint16) {
+	p.mutex.Lock()
+	delete(p.pending, token)
+	p.mutex.Unlock()
+}
+
+// Receive implements smacbase.FrameReceiver, completing the Ping whose token the echo-reply carries
+func (p *Pinger) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	if progID != smacbase.ProgPingReply {
+		if !p.decodeError(progID, srcAddr, "wrong progID, expected 2004") {
+			log.Printf("Pinger.Receive: Handling invalid packet with progID=%04X", progID)
+		}
+		return true
+	}
+	if len(payload) != 4 {
+		if !p.decodeError(progID, srcAddr, fmt.Sprintf("payload length %d, expected 4", len(payload))) {
+			log.Printf("Pinger.Receive: Received ping echo-reply with payload size = %d (expected 4)", len(payload))
+		}
+		return false
+	}
+	token, _ := decodePing(payload)
+	p.mutex.Lock()
+	ch := p.pending[token]
+	delete(p.pending, token) // A duplicate reply mustn't close ch twice
+	p.mutex.Unlock()
+	if ch != nil {
+		close(ch)
+	}
+	return false
+}
+
+// ProgramIDs implements smacbase.ProgramDriver
+func (p *Pinger) ProgramIDs() []uint16 {
+	return []uint16{smacbase.ProgPingReply}
+}
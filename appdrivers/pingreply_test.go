@@ -0,0 +1,34 @@
+package appdrivers
+
+import (
+	"testing"
+)
+
+func TestPingerMatchesToken(t *testing.T) {
+	p := newPinger()
+	t1, c1 := p.register()
+	t2, c2 := p.register()
+	if t1 == t2 {
+		t.Fatalf("Concurrent pings were given the same token %04X", t1)
+	}
+
+	// Both pings went to the same node; only the reply bearing t2's token completes t2
+	p.Receive(nil, -50, 0xBACE0002, 0x2004, []byte{uint8(t2), uint8(t2 >> 8), 0x34, 0x12})
+	select {
+	case <-c2:
+	default:
+		t.Errorf("Reply with token %04X did not complete its ping", t2)
+	}
+	select {
+	case <-c1:
+		t.Errorf("Reply with token %04X completed the ping with token %04X", t2, t1)
+	default:
+	}
+
+	// A duplicate reply is ignored rather than closing the channel again
+	p.Receive(nil, -50, 0xBACE0002, 0x2004, []byte{uint8(t2), uint8(t2 >> 8), 0x34, 0x12})
+	p.forget(t1)
+	if len(p.pending) != 0 {
+		t.Errorf("Expected no pending pings, got %d", len(p.pending))
+	}
+}
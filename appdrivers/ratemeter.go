@@ -0,0 +1,163 @@
+package appdrivers
+
+import (
+	"github.com/spirilis/smacbase"
+	"sync"
+	"time"
+)
+
+/* ratemeter.go tracks how many frames each source address has sent within a sliding time window, purely from arrival
+ * times, to spot a stuck transmitter (rate too high) or a dying node (rate too low).
+ */
+
+// DefaultRateWindow is the sliding window NewRateMeter uses
+const DefaultRateWindow = time.Minute
+
+// RateState classifies a device's frame rate against a RateMeter's thresholds
+type RateState int
+
+// RateStates
+const (
+	RateNormal RateState = iota
+	RateHigh             // More than RateMeter.High frames in the window, e.g. a stuck transmitter
+	RateLow              // Fewer than RateMeter.Low frames in the window, e.g. a dying node
+)
+
+// RateMeter is an audit handler counting each source address's frames within the last Window.  Set High and/or Low
+// (frames per Window; 0 disables each) and register OnThreshold callbacks to hear when a device crosses them.
+type RateMeter struct {
+	Window time.Duration
+	High   float64
+	Low    float64
+
+	mutex     sync.Mutex
+	devices   map[uint32]*rateSeries
+	callbacks []func(addr uint32, rate float64, state RateState)
+}
+
+// rateSeries holds one address's arrival times within the window, oldest first
+type rateSeries struct {
+	arrivals  []time.Time
+	firstSeen time.Time
+	state     RateState
+}
+
+// NewRateMeter creates a RateMeter with a window of DefaultRateWindow and registers it as an audit handler on l, so it
+// counts every frame regardless of what other handlers do with it.
+func NewRateMeter(l *smacbase.LinkMgr) *RateMeter {
+	m := newRateMeter()
+	l.RegisterAuditHandler(m)
+	return m
+}
+
+func newRateMeter() *RateMeter {
+	m := new(RateMeter)
+	m.Window = DefaultRateWindow
+	m.devices = make(map[uint32]*rateSeries)
+	return m
+}
+
+// Receive implements smacbase.FrameReceiver
+func (m *RateMeter) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	m.observe(srcAddr, time.Now())
+	return true
+}
+
+// OnThreshold registers f to be called whenever a device's rate moves between RateNormal, RateHigh and RateLow.  A
+// device is only judged RateLow once it has been tracked for a whole Window.
+func (m *RateMeter) OnThreshold(f func(addr uint32, rate float64, state RateState)) {
+	if f == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.callbacks = append(m.callbacks, f)
+	m.mutex.Unlock()
+}
+
+// Rate returns how many frames addr sent within the last Window
+func (m *RateMeter) Rate(addr uint32) float64 {
+	return m.rate(addr, time.Now())
+}
+
+// Check re-evaluates every tracked device against the thresholds.  A node which has gone quiet sends nothing to
+// trigger an evaluation, so call Check periodically (e.g. every few seconds) for RateLow to be noticed.
+func (m *RateMeter) Check() {
+	m.check(time.Now())
+}
+
+// Forget stops tracking addr, e.g. for a decommissioned node which would otherwise be reported as RateLow
+func (m *RateMeter) Forget(addr uint32) {
+	m.mutex.Lock()
+	delete(m.devices, addr)
+	m.mutex.Unlock()
+}
+
+func (m *RateMeter) observe(addr uint32, now time.Time) {
+	m.mutex.Lock()
+	s := m.devices[addr]
+	if s == nil {
+		s = &rateSeries{firstSeen: now}
+		m.devices[addr] = s
+	}
+	s.arrivals = append(s.arrivals, now)
+	notify := m.evaluate(addr, s, now)
+	m.mutex.Unlock()
+	notify()
+}
+
+func (m *RateMeter) rate(addr uint32, now time.Time) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.devices[addr]
+	if s == nil {
+		return 0
+	}
+	m.expire(s, now)
+	return float64(len(s.arrivals))
+}
+
+func (m *RateMeter) check(now time.Time) {
+	var notifies []func()
+	m.mutex.Lock()
+	for addr, s := range m.devices {
+		notifies = append(notifies, m.evaluate(addr, s, now))
+	}
+	m.mutex.Unlock()
+	for _, notify := range notifies {
+		notify()
+	}
+}
+
+// expire drops arrivals which have slid out of the window
+func (m *RateMeter) expire(s *rateSeries, now time.Time) {
+	cutoff := now.Add(-m.Window)
+	i := 0
+	for i < len(s.arrivals) && !s.arrivals[i].After(cutoff) {
+		i++
+	}
+	s.arrivals = s.arrivals[i:]
+}
+
+// evaluate updates s's state, returning the function which runs the OnThreshold callbacks (once the mutex is released)
+// if it changed
+func (m *RateMeter) evaluate(addr uint32, s *rateSeries, now time.Time) func() {
+	m.expire(s, now)
+	rate := float64(len(s.arrivals))
+	state := RateNormal
+	switch {
+	case m.High > 0 && rate > m.High:
+		state = RateHigh
+	case m.Low > 0 && rate < m.Low && now.Sub(s.firstSeen) >= m.Window:
+		state = RateLow
+	}
+	if state == s.state {
+		return func() {}
+	}
+	s.state = state
+	callbacks := m.callbacks
+	return func() {
+		for _, f := range callbacks {
+			f(addr, rate, state)
+		}
+	}
+}
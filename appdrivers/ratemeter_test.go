@@ -0,0 +1,43 @@
+package appdrivers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateMeter(t *testing.T) {
+	m := newRateMeter()
+	m.Window = time.Minute
+	m.High = 5
+	m.Low = 2
+	var events []string
+	m.OnThreshold(func(addr uint32, rate float64, state RateState) {
+		events = append(events, fmt.Sprintf("%08X %g %d", addr, rate, state))
+	})
+
+	start := time.Now()
+	for i := 0; i < 6; i++ { // 6 frames in 6 seconds: a stuck transmitter
+		m.observe(0xBACE0001, start.Add(time.Duration(i)*time.Second))
+	}
+	if r := m.rate(0xBACE0001, start.Add(10*time.Second)); r != 6 {
+		t.Errorf("Expected a rate of 6, got %g", r)
+	}
+	m.check(start.Add(60*time.Second + 500*time.Millisecond)) // The first frame has slid out: back to normal
+	m.check(start.Add(2 * time.Minute))                       // Silent for a whole window: too low
+
+	m.observe(0xBACE0002, start.Add(2*time.Minute)) // Brand new device: not judged low until it has had a full window
+	m.check(start.Add(2*time.Minute + 30*time.Second))
+	if r := m.rate(0xBACE0002, start.Add(3*time.Minute+time.Second)); r != 0 {
+		t.Errorf("Expected the old frame to have expired, got a rate of %g", r)
+	}
+
+	expected := []string{
+		"BACE0001 6 1",
+		"BACE0001 5 0",
+		"BACE0001 0 2",
+	}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected threshold events:\n got %q\nwant %q", events, expected)
+	}
+}
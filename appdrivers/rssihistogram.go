@@ -0,0 +1,108 @@
+package appdrivers
+
+import (
+	"fmt"
+	"github.com/spirilis/smacbase"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+/* rssihistogram.go tracks the distribution of received signal strength per source address and exposes it in the
+ * Prometheus text exposition format, so marginal links show up on link-quality dashboards before they drop out.
+ * No Prometheus client library is needed; mount the RSSIHistogram as an http.Handler (e.g. at /metrics) or write it
+ * into an existing exporter's output with WriteMetrics.
+ */
+
+// RSSIBuckets are the default histogram upper bounds in dBm, spanning the range seen on sub-GHz links
+var RSSIBuckets = []int{-120, -110, -100, -90, -80, -70, -60, -50, -40, -30, -20, -10, 0}
+
+// RSSIHistogram is an audit handler recording the RSSI of every received frame, by source address
+type RSSIHistogram struct {
+	Buckets []int // Upper bounds in dBm, ascending; fixed once the first frame is observed
+
+	mutex sync.Mutex
+	addrs map[uint32]*rssiSeries
+}
+
+// rssiSeries is the histogram for one source address
+type rssiSeries struct {
+	counts []uint64 // Non-cumulative, one per bucket plus +Inf
+	sum    int64
+	count  uint64
+}
+
+// NewRSSIHistogram creates an RSSIHistogram with the default buckets and registers it as an audit handler on l, so
+// it sees every frame regardless of what other handlers do with it.  Note that with SetLoopbackTX enabled, echoed
+// transmissions are counted too (as 0 dBm against their destination).
+func NewRSSIHistogram(l *smacbase.LinkMgr) *RSSIHistogram {
+	h := newRSSIHistogram()
+	l.RegisterAuditHandler(h)
+	return h
+}
+
+func newRSSIHistogram() *RSSIHistogram {
+	h := new(RSSIHistogram)
+	h.Buckets = RSSIBuckets
+	h.addrs = make(map[uint32]*rssiSeries)
+	return h
+}
+
+// Receive implements smacbase.FrameReceiver
+func (h *RSSIHistogram) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	h.Observe(srcAddr, rssi)
+	return true
+}
+
+// Observe records one RSSI sample for addr
+func (h *RSSIHistogram) Observe(addr uint32, rssi int8) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.addrs[addr]
+	if s == nil {
+		s = &rssiSeries{counts: make([]uint64, len(h.Buckets)+1)}
+		h.addrs[addr] = s
+	}
+	i := sort.SearchInts(h.Buckets, int(rssi)) // First bucket whose bound is >= rssi; len(Buckets) means +Inf
+	s.counts[i]++
+	s.sum += int64(rssi)
+	s.count++
+}
+
+// WriteMetrics writes the smac_rssi_dbm histogram in the Prometheus text exposition format, ordered by address
+func (h *RSSIHistogram) WriteMetrics(w io.Writer) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	addrs := make([]uint32, 0, len(h.addrs))
+	for addr := range h.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	_, err := fmt.Fprintf(w, "# HELP smac_rssi_dbm RSSI of received frames, by source address.\n# TYPE smac_rssi_dbm histogram\n")
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		s := h.addrs[addr]
+		var cumulative uint64
+		for i, bound := range h.Buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "smac_rssi_dbm_bucket{address=\"%08X\",le=\"%d\"} %d\n", addr, bound, cumulative)
+		}
+		fmt.Fprintf(w, "smac_rssi_dbm_bucket{address=\"%08X\",le=\"+Inf\"} %d\n", addr, s.count)
+		fmt.Fprintf(w, "smac_rssi_dbm_sum{address=\"%08X\"} %d\n", addr, s.sum)
+		_, err = fmt.Fprintf(w, "smac_rssi_dbm_count{address=\"%08X\"} %d\n", addr, s.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler, serving WriteMetrics for a Prometheus scrape
+func (h *RSSIHistogram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	h.WriteMetrics(w)
+}
@@ -0,0 +1,40 @@
+package appdrivers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRSSIHistogram(t *testing.T) {
+	h := newRSSIHistogram()
+	h.Buckets = []int{-100, -80, -60}
+	h.Receive(nil, -90, 0xBACE0002, 0x2002, nil)
+	h.Receive(nil, -80, 0xBACE0001, 0x2002, nil) // On a bound: counted in that bucket
+	h.Receive(nil, -50, 0xBACE0001, 0x2002, nil) // Above every bound: +Inf only
+	h.Receive(nil, -110, 0xBACE0001, 0x2002, nil)
+
+	var buf bytes.Buffer
+	if err := h.WriteMetrics(&buf); err != nil {
+		t.Fatalf("WriteMetrics error: %v", err)
+	}
+	expected := strings.Join([]string{
+		"# HELP smac_rssi_dbm RSSI of received frames, by source address.",
+		"# TYPE smac_rssi_dbm histogram",
+		`smac_rssi_dbm_bucket{address="BACE0001",le="-100"} 1`,
+		`smac_rssi_dbm_bucket{address="BACE0001",le="-80"} 2`,
+		`smac_rssi_dbm_bucket{address="BACE0001",le="-60"} 2`,
+		`smac_rssi_dbm_bucket{address="BACE0001",le="+Inf"} 3`,
+		`smac_rssi_dbm_sum{address="BACE0001"} -240`,
+		`smac_rssi_dbm_count{address="BACE0001"} 3`,
+		`smac_rssi_dbm_bucket{address="BACE0002",le="-100"} 0`,
+		`smac_rssi_dbm_bucket{address="BACE0002",le="-80"} 1`,
+		`smac_rssi_dbm_bucket{address="BACE0002",le="-60"} 1`,
+		`smac_rssi_dbm_bucket{address="BACE0002",le="+Inf"} 1`,
+		`smac_rssi_dbm_sum{address="BACE0002"} -90`,
+		`smac_rssi_dbm_count{address="BACE0002"} 1`,
+	}, "\n") + "\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected metrics output:\n%s\nwant:\n%s", buf.String(), expected)
+	}
+}
@@ -0,0 +1,329 @@
+package appdrivers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/spirilis/smacbase"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* schema.go is a generic, configuration-driven decoder for node payloads.  Instead of writing a driver per message
+ * type, describe the payload's fields in a PayloadSchema and register it for a program ID (optionally overridden for
+ * individual device IDs, whose firmware may pack the same program differently).  The device ID is taken from the
+ * first two payload bytes (Little-Endian), as with every other SMac sensor program.
+ *
+ * Decoded field values are:
+ *   FieldUint8/16/32         - uint64
+ *   FieldInt8/16/32          - int64
+ *   FieldFloat32             - float64
+ *   any numeric with Scale   - float64, raw*Scale + Bias
+ *   FieldBytes               - []byte (a copy)
+ *   FieldString              - string, with trailing NULs trimmed
+ */
+
+// FieldType selects how a SchemaField's bytes are interpreted
+type FieldType uint8
+
+const (
+	FieldUint8 FieldType = iota
+	FieldInt8
+	FieldUint16
+	FieldInt16
+	FieldUint32
+	FieldInt32
+	FieldFloat32
+	FieldBytes
+	FieldString
+)
+
+// size returns the fixed width of t in bytes, or 0 for the variable-length types
+func (t FieldType) size() int {
+	switch t {
+	case FieldUint8, FieldInt8:
+		return 1
+	case FieldUint16, FieldInt16:
+		return 2
+	case FieldUint32, FieldInt32, FieldFloat32:
+		return 4
+	}
+	return 0
+}
+
+// SchemaField describes one named value within a payload
+type SchemaField struct {
+	Name      string
+	Offset    int // Byte offset into the payload
+	Type      FieldType
+	BigEndian bool    // Multi-byte numerics are Little-Endian unless set
+	Length    int     // FieldBytes/FieldString only: byte count, or 0 for the rest of the payload
+	Scale     float64 // Numerics only: if non-zero, the value is reported as raw*Scale + Bias
+	Bias      float64
+}
+
+// PayloadSchema describes the layout of one kind of payload
+type PayloadSchema struct {
+	Name   string
+	Fields []SchemaField
+}
+
+// minLength returns the shortest payload which holds every field
+func (s PayloadSchema) minLength() int {
+	var n int
+	for _, f := range s.Fields {
+		end := f.Offset + f.Type.size() + f.Length
+		if end > n {
+			n = end
+		}
+	}
+	return n
+}
+
+// validate checks s for mistakes which would otherwise only show up as garbage readings
+func (s PayloadSchema) validate() error {
+	if len(s.Fields) == 0 {
+		return errors.New("schema " + s.Name + " has no fields")
+	}
+	names := make(map[string]bool)
+	for _, f := range s.Fields {
+		if f.Name == "" {
+			return errors.New("schema " + s.Name + " has a field with no name")
+		}
+		if names[f.Name] {
+			return errors.New("schema " + s.Name + " has more than one field named " + f.Name)
+		}
+		names[f.Name] = true
+		if f.Type > FieldString {
+			return fmt.Errorf("schema %s field %s has unknown type %d", s.Name, f.Name, f.Type)
+		}
+		if f.Offset < 0 || f.Length < 0 {
+			return fmt.Errorf("schema %s field %s has a negative offset or length", s.Name, f.Name)
+		}
+		if f.Type.size() != 0 && f.Length != 0 {
+			return fmt.Errorf("schema %s field %s: Length only applies to FieldBytes and FieldString", s.Name, f.Name)
+		}
+	}
+	return nil
+}
+
+// decode extracts every field of s from payload
+func (s PayloadSchema) decode(payload []byte) (map[string]interface{}, error) {
+	if len(payload) < s.minLength() {
+		return nil, fmt.Errorf("payload of %d bytes is too short for schema %s (needs %d)", len(payload), s.Name, s.minLength())
+	}
+	values := make(map[string]interface{}, len(s.Fields))
+	for _, f := range s.Fields {
+		var order binary.ByteOrder = binary.LittleEndian
+		if f.BigEndian {
+			order = binary.BigEndian
+		}
+		b := payload[f.Offset:]
+		var v interface{}
+		switch f.Type {
+		case FieldUint8:
+			v = uint64(b[0])
+		case FieldInt8:
+			v = int64(int8(b[0]))
+		case FieldUint16:
+			v = uint64(order.Uint16(b))
+		case FieldInt16:
+			v = int64(int16(order.Uint16(b)))
+		case FieldUint32:
+			v = uint64(order.Uint32(b))
+		case FieldInt32:
+			v = int64(int32(order.Uint32(b)))
+		case FieldFloat32:
+			v = float64(math.Float32frombits(order.Uint32(b)))
+		case FieldBytes, FieldString:
+			if f.Length > 0 {
+				b = b[:f.Length]
+			}
+			if f.Type == FieldString {
+				v = strings.TrimRight(string(b), "\x00")
+			} else {
+				v = append([]byte(nil), b...)
+			}
+		}
+		if f.Scale != 0 {
+			switch raw := v.(type) {
+			case uint64:
+				v = float64(raw)*f.Scale + f.Bias
+			case int64:
+				v = float64(raw)*f.Scale + f.Bias
+			case float64:
+				v = raw*f.Scale + f.Bias
+			}
+		}
+		values[f.Name] = v
+	}
+	return values, nil
+}
+
+// SchemaReading is one payload decoded by a SchemaDecoder
+type SchemaReading struct {
+	Schema   string // PayloadSchema.Name
+	Program  uint16
+	DeviceID uint16
+	SrcAddr  uint32
+	Rssi     int8
+	Fields   map[string]interface{}
+}
+
+// SchemaDecoder is a FrameReceiver which decodes payloads according to registered PayloadSchemas
+type SchemaDecoder struct {
+	Logger LogText
+
+	link          *smacbase.LinkMgr
+	mutex         sync.Mutex
+	schemas       map[uint16]PayloadSchema
+	deviceSchemas map[uint16]map[uint16]PayloadSchema // By program ID, then device ID
+
+	callbackMutex sync.Mutex
+	callbacks     []func(SchemaReading)
+	decodeErrorHooks
+}
+
+// NewSchemaDecoder creates a SchemaDecoder, logging to stdout by default, which registers itself with l as the handler
+// for each program ID given a schema.
+func NewSchemaDecoder(l *smacbase.LinkMgr) *SchemaDecoder {
+	d := newSchemaDecoder()
+	d.link = l
+	return d
+}
+
+func newSchemaDecoder() *SchemaDecoder {
+	d := new(SchemaDecoder)
+	d.Logger = GenericStdout{}
+	d.schemas = make(map[uint16]PayloadSchema)
+	d.deviceSchemas = make(map[uint16]map[uint16]PayloadSchema)
+	d.OnReading(d.logReading)
+	return d
+}
+
+// RegisterSchema decodes progID's payloads with schema, replacing any schema previously registered for it
+func (d *SchemaDecoder) RegisterSchema(progID uint16, schema PayloadSchema) error {
+	if err := schema.validate(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.schemas[progID] = schema
+	d.mutex.Unlock()
+	if d.link != nil {
+		d.link.RegisterProgramHandler(progID, d)
+	}
+	return nil
+}
+
+// RegisterDeviceSchema decodes progID's payloads from devID with schema in preference to the program's schema, for
+// nodes whose firmware lays the program out differently.
+func (d *SchemaDecoder) RegisterDeviceSchema(progID, devID uint16, schema PayloadSchema) error {
+	if err := schema.validate(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	if d.deviceSchemas[progID] == nil {
+		d.deviceSchemas[progID] = make(map[uint16]PayloadSchema)
+	}
+	d.deviceSchemas[progID][devID] = schema
+	d.mutex.Unlock()
+	if d.link != nil {
+		d.link.RegisterProgramHandler(progID, d)
+	}
+	return nil
+}
+
+// lookup returns the schema for a payload on progID from devID
+func (d *SchemaDecoder) lookup(progID, devID uint16) (PayloadSchema, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if s, ok := d.deviceSchemas[progID][devID]; ok {
+		return s, true
+	}
+	s, ok := d.schemas[progID]
+	return s, ok
+}
+
+// Receive implements smacbase.FrameReceiver
+func (d *SchemaDecoder) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	if len(payload) < 2 {
+		if !d.decodeError(progID, srcAddr, fmt.Sprintf("payload length %d, expected at least 2", len(payload))) {
+			log.Printf("SchemaDecoder.Receive: received frame for progID=%04X with payload size < 2, invalid packet", progID)
+		}
+		return false
+	}
+	devID := uint16(payload[0]) | (uint16(payload[1]) << 8)
+	schema, ok := d.lookup(progID, devID)
+	if !ok {
+		if !d.decodeError(progID, srcAddr, "no schema registered") {
+			log.Printf("SchemaDecoder.Receive: no schema registered for progID=%04X", progID)
+		}
+		return true // Not for us
+	}
+	fields, err := schema.decode(payload)
+	if err != nil {
+		if !d.decodeError(progID, srcAddr, err.Error()) {
+			log.Printf("SchemaDecoder.Receive: device %04X: %v", devID, err)
+		}
+		return false
+	}
+
+	r := SchemaReading{Schema: schema.Name, Program: progID, DeviceID: devID, SrcAddr: srcAddr, Rssi: rssi, Fields: fields}
+	d.callbackMutex.Lock()
+	callbacks := d.callbacks
+	d.callbackMutex.Unlock()
+	for _, f := range callbacks {
+		f(r)
+	}
+	return false
+}
+
+// OnReading registers f to be called with every successfully decoded payload.  The Logger output is registered as
+// the first callback.
+func (d *SchemaDecoder) OnReading(f func(SchemaReading)) {
+	if f == nil {
+		return
+	}
+	d.callbackMutex.Lock()
+	d.callbacks = append(d.callbacks, f)
+	d.callbackMutex.Unlock()
+}
+
+// logReading is the default OnReading callback, printing the fields to Logger in name order
+func (d *SchemaDecoder) logReading(r SchemaReading) {
+	if d.Logger == nil {
+		return
+	}
+	names := make([]string, 0, len(r.Fields))
+	for name := range r.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%v", name, r.Fields[name])
+	}
+	d.Logger.Printf("%s RX: Device ID %04X - %s [srcAddr=%08X RSSI=%d]\n", r.Schema, r.DeviceID, strings.Join(parts, " "), r.SrcAddr, r.Rssi)
+}
+
+// ProgramIDs implements smacbase.ProgramDriver
+func (d *SchemaDecoder) ProgramIDs() []uint16 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	seen := make(map[uint16]bool)
+	var progs []uint16
+	for p := range d.schemas {
+		seen[p] = true
+		progs = append(progs, p)
+	}
+	for p := range d.deviceSchemas {
+		if !seen[p] {
+			progs = append(progs, p)
+		}
+	}
+	sort.Slice(progs, func(i, j int) bool { return progs[i] < progs[j] })
+	return progs
+}
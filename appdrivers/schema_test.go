@@ -0,0 +1,76 @@
+package appdrivers
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSchemaDecoder(t *testing.T) {
+	d := newSchemaDecoder()
+	buf := new(BufferLog)
+	d.Logger = buf
+	var readings []SchemaReading
+	d.OnReading(func(r SchemaReading) { readings = append(readings, r) })
+
+	err := d.RegisterSchema(0x3100, PayloadSchema{Name: "Weather", Fields: []SchemaField{
+		{Name: "temp", Offset: 2, Type: FieldInt16, Scale: 0.1},
+		{Name: "pressure", Offset: 4, Type: FieldUint32, BigEndian: true},
+		{Name: "site", Offset: 8, Type: FieldString},
+	}})
+	if err != nil {
+		t.Fatalf("RegisterSchema error: %v", err)
+	}
+	// Device 0009's firmware sends an unscaled temperature and a raw status byte instead
+	err = d.RegisterDeviceSchema(0x3100, 0x0009, PayloadSchema{Name: "WeatherV1", Fields: []SchemaField{
+		{Name: "temp", Offset: 2, Type: FieldInt8},
+		{Name: "status", Offset: 3, Type: FieldBytes, Length: 1},
+	}})
+	if err != nil {
+		t.Fatalf("RegisterDeviceSchema error: %v", err)
+	}
+
+	// devID=0x0001, temp=-25 (0xFFE7) -> -2.5, pressure=101325 (0x00018BCD), site="roof\0"
+	d.Receive(nil, -80, 0xBACE0001, 0x3100, []byte{0x01, 0x00, 0xE7, 0xFF, 0x00, 0x01, 0x8B, 0xCD, 'r', 'o', 'o', 'f', 0})
+	d.Receive(nil, -81, 0xBACE0009, 0x3100, []byte{0x09, 0x00, 0xF6, 0x5A})
+	d.Receive(nil, -82, 0xBACE0001, 0x3100, []byte{0x01, 0x00, 0xE7}) // too short
+
+	if len(readings) != 2 {
+		t.Fatalf("Expected 2 readings, got %+v", readings)
+	}
+	r := readings[0]
+	if r.Schema != "Weather" || r.DeviceID != 1 || r.Fields["pressure"] != uint64(101325) || r.Fields["site"] != "roof" {
+		t.Errorf("Unexpected reading %+v", r)
+	}
+	if temp, ok := r.Fields["temp"].(float64); !ok || temp < -2.5001 || temp > -2.4999 {
+		t.Errorf("Expected scaled temp -2.5, got %v", r.Fields["temp"])
+	}
+	r = readings[1]
+	if r.Schema != "WeatherV1" || r.Fields["temp"] != int64(-10) || !bytes.Equal(r.Fields["status"].([]byte), []byte{0x5A}) {
+		t.Errorf("Per-device schema not applied: %+v", r)
+	}
+
+	lines := buf.Lines()
+	expected := "WeatherV1 RX: Device ID 0009 - status=[90] temp=-10 [srcAddr=BACE0009 RSSI=-81]\n"
+	if len(lines) != 2 || lines[1] != expected {
+		t.Errorf("Unexpected log output %q, want %q", lines, expected)
+	}
+	if progs := d.ProgramIDs(); len(progs) != 1 || progs[0] != 0x3100 {
+		t.Errorf("Unexpected ProgramIDs %v", progs)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	bad := []PayloadSchema{
+		{Name: "empty"},
+		{Name: "dup", Fields: []SchemaField{{Name: "a", Type: FieldUint8}, {Name: "a", Offset: 1, Type: FieldUint8}}},
+		{Name: "unnamed", Fields: []SchemaField{{Type: FieldUint8}}},
+		{Name: "type", Fields: []SchemaField{{Name: "a", Type: FieldString + 1}}},
+		{Name: "length", Fields: []SchemaField{{Name: "a", Type: FieldUint16, Length: 2}}},
+	}
+	d := newSchemaDecoder()
+	for _, s := range bad {
+		if err := d.RegisterSchema(0x3100, s); err == nil {
+			t.Errorf("Schema %s was accepted", s.Name)
+		}
+	}
+}
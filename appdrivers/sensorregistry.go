@@ -0,0 +1,132 @@
+package appdrivers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* sensorregistry.go joins what the individual drivers know about each device (its registered description, its latest
+ * temperature/humidity and thermocouple readings) into one per-device status, for status dumps and dashboards.
+ */
+
+// DeviceStatus is everything known about one device.  Readings it hasn't sent are nil.
+type DeviceStatus struct {
+	ID           uint16
+	Description  string    // From its DeviceID registration; empty if it hasn't registered
+	Address      uint32    // Source address of its most recent frame
+	Rssi         int8      // RSSI of its most recent sensor reading
+	LastSeen     time.Time // When its most recent frame (registration or reading) arrived
+	TempHum      *TempHumReading
+	Thermocouple *ThermocoupleReading
+}
+
+// SensorRegistry tracks the latest readings from the sensor drivers it is attached to.  It is safe for concurrent
+// use, e.g. Snapshot from an HTTP handler while frames are being dispatched.
+type SensorRegistry struct {
+	Devices *DeviceIdRegistration // May be nil, in which case descriptions are left empty
+
+	mutex   sync.Mutex
+	sensors map[uint16]*sensorStatus
+}
+
+// sensorStatus is the part of a DeviceStatus the SensorRegistry collects itself
+type sensorStatus struct {
+	address      uint32
+	rssi         int8
+	lastSeen     time.Time
+	tempHum      *TempHumReading
+	thermocouple *ThermocoupleReading
+}
+
+// NewSensorRegistry creates a SensorRegistry taking descriptions from devs and readings from th and tc.  Any of them
+// may be nil.
+func NewSensorRegistry(devs *DeviceIdRegistration, th *TemperatureHumidity, tc *ThermocoupleStdout) *SensorRegistry {
+	r := new(SensorRegistry)
+	r.Devices = devs
+	r.sensors = make(map[uint16]*sensorStatus)
+	if th != nil {
+		th.OnReading(r.observeTempHum)
+	}
+	if tc != nil {
+		tc.OnReading(r.observeThermocouple)
+	}
+	return r
+}
+
+// observeTempHum is the OnReading callback for a TemperatureHumidity
+func (r *SensorRegistry) observeTempHum(reading TempHumReading) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.sensor(reading.DeviceID, reading.SrcAddr, reading.Rssi)
+	s.tempHum = &reading
+}
+
+// observeThermocouple is the OnReading callback for a ThermocoupleStdout
+func (r *SensorRegistry) observeThermocouple(reading ThermocoupleReading) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.sensor(reading.DeviceID, reading.SrcAddr, reading.Rssi)
+	s.thermocouple = &reading
+}
+
+// sensor returns devID's entry, updated for a reading just received; r.mutex must be held
+func (r *SensorRegistry) sensor(devID uint16, srcAddr uint32, rssi int8) *sensorStatus {
+	s := r.sensors[devID]
+	if s == nil {
+		s = new(sensorStatus)
+		r.sensors[devID] = s
+	}
+	s.address = srcAddr
+	s.rssi = rssi
+	s.lastSeen = time.Now()
+	return s
+}
+
+// Snapshot returns the status of every device which has registered or sent a reading, ordered by device ID
+func (r *SensorRegistry) Snapshot() []DeviceStatus {
+	byID := make(map[uint16]*DeviceStatus)
+	if r.Devices != nil {
+		for _, e := range r.Devices.Sorted() {
+			byID[e.ID] = &DeviceStatus{ID: e.ID, Description: e.Description, Address: e.Address, LastSeen: e.LastSeen}
+		}
+	}
+
+	r.mutex.Lock()
+	for id, s := range r.sensors {
+		st := byID[id]
+		if st == nil {
+			st = &DeviceStatus{ID: id}
+			byID[id] = st
+		}
+		st.Rssi = s.rssi
+		if s.lastSeen.After(st.LastSeen) {
+			st.Address = s.address
+			st.LastSeen = s.lastSeen
+		}
+		if s.tempHum != nil {
+			th := *s.tempHum
+			st.TempHum = &th
+		}
+		if s.thermocouple != nil {
+			tc := *s.thermocouple
+			st.Thermocouple = &tc
+		}
+	}
+	r.mutex.Unlock()
+
+	statuses := make([]DeviceStatus, 0, len(byID))
+	for _, st := range byID {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// ServeHTTP implements http.Handler, serving the Snapshot as JSON (e.g. mounted at /devices)
+func (r *SensorRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Snapshot())
+}
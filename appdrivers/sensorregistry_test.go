@@ -0,0 +1,65 @@
+package appdrivers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSensorRegistry(t *testing.T) {
+	devs := &DeviceIdRegistration{
+		Registrations: make(map[uint16]string),
+		lastSeen:      make(map[uint16]time.Time),
+		lastAddress:   make(map[uint16]uint32),
+	}
+	th := &TemperatureHumidity{
+		DeviceIdHandler: devs,
+		LastSeenTemp:    make(map[uint16]int16),
+		LastSeenHum:     make(map[uint16]uint8),
+	}
+	tc := &ThermocoupleStdout{SeenNodes: make(map[uint16]int16)}
+	r := NewSensorRegistry(devs, th, tc)
+
+	devs.Receive(nil, -50, 0xBACE0042, 0x2000, []byte{0x42, 0x00, 'G', 'a', 'r', 'a', 'g', 'e'})
+	devs.Receive(nil, -50, 0xBACE0009, 0x2000, []byte{0x09, 0x00, 'Q', 'u', 'i', 'e', 't'})
+
+	// Readings arrive while snapshots are being taken
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			th.Receive(nil, -60, 0xBACE0042, 0x2002, []byte{0x42, 0x00, 200, 0x00, 128, 0x00})
+			tc.Receive(nil, -70, 0xBACE0007, 0x2001, []byte{0x07, 0x00, 0x64, 0x00, 0x16, 0x00, 0x00})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		r.Snapshot()
+	}
+	wg.Wait()
+
+	s := r.Snapshot()
+	if len(s) != 3 || s[0].ID != 0x0007 || s[1].ID != 0x0009 || s[2].ID != 0x0042 {
+		t.Fatalf("Unexpected devices: %+v", s)
+	}
+	if s[0].Description != "" || s[0].Thermocouple == nil || s[0].Thermocouple.Thermocouple.Celsius() != 100 ||
+		s[0].TempHum != nil || s[0].Rssi != -70 || s[0].Address != 0xBACE0007 {
+		t.Errorf("Unregistered thermocouple device: %+v", s[0])
+	}
+	if s[1].Description != "Quiet" || s[1].TempHum != nil || s[1].Thermocouple != nil || s[1].LastSeen.IsZero() {
+		t.Errorf("Registered device without readings: %+v", s[1])
+	}
+	if s[2].Description != "Garage" || s[2].TempHum == nil || s[2].TempHum.Temperature.Celsius() != 25 ||
+		s[2].Rssi != -60 || s[2].LastSeen.Before(s[1].LastSeen) {
+		t.Errorf("Registered temphum device: %+v", s[2])
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/devices", nil))
+	var served []DeviceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || len(served) != 3 {
+		t.Errorf("ServeHTTP returned %q (%v)", rec.Body.String(), err)
+	}
+}
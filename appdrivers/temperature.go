@@ -0,0 +1,51 @@
+package appdrivers
+
+import (
+	"fmt"
+	"math"
+)
+
+/* temperature.go provides a unit-safe temperature value, so drivers hand out readings which say what they are rather
+ * than bare integers (whole degrees? Q12.3?) or floats (Celsius? Fahrenheit?).
+ */
+
+// Temperature is a temperature in thousandths of a degree Celsius
+type Temperature int32
+
+// TemperatureFromQ12_3 converts a sensor's raw signed Q12.3 value (eighths of a degree Celsius) to a Temperature
+func TemperatureFromQ12_3(raw int16) Temperature {
+	return Temperature(int32(raw) * 125)
+}
+
+// TemperatureFromCelsius converts degrees Celsius to a Temperature, rounding to the nearest thousandth of a degree.
+// Values beyond the range of a Temperature (including the infinities) are clamped to it; NaN gives the minimum.
+func TemperatureFromCelsius(c float64) Temperature {
+	m := math.Round(c * 1000)
+	if m > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if m < math.MinInt32 || math.IsNaN(m) {
+		return math.MinInt32
+	}
+	return Temperature(m)
+}
+
+// Celsius returns t in degrees Celsius
+func (t Temperature) Celsius() float64 {
+	return float64(t) / 1000
+}
+
+// Fahrenheit returns t in degrees Fahrenheit
+func (t Temperature) Fahrenheit() float64 {
+	return t.Celsius()*9/5 + 32
+}
+
+// Kelvin returns t in kelvins
+func (t Temperature) Kelvin() float64 {
+	return t.Celsius() + 273.15
+}
+
+// String formats t in degrees Celsius to one decimal place, e.g. "25.0C"
+func (t Temperature) String() string {
+	return fmt.Sprintf("%.1fC", t.Celsius())
+}
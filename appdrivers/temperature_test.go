@@ -0,0 +1,31 @@
+package appdrivers
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTemperature(t *testing.T) {
+	cases := []struct {
+		t                   Temperature
+		celsius, fahrenheit float64
+		kelvin              float64
+		str                 string
+	}{
+		{TemperatureFromQ12_3(200), 25, 77, 298.15, "25.0C"},
+		{TemperatureFromQ12_3(-3), -0.375, 31.325, 272.775, "-0.4C"},
+		{TemperatureFromCelsius(-40), -40, -40, 233.15, "-40.0C"},
+		{TemperatureFromCelsius(100.0004), 100, 212, 373.15, "100.0C"},
+	}
+	for _, c := range cases {
+		if math.Abs(c.t.Celsius()-c.celsius) > 1e-9 || math.Abs(c.t.Fahrenheit()-c.fahrenheit) > 1e-9 ||
+			math.Abs(c.t.Kelvin()-c.kelvin) > 1e-9 || c.t.String() != c.str {
+			t.Errorf("%d: got %g C, %g F, %g K, %q; want %g C, %g F, %g K, %q", int32(c.t),
+				c.t.Celsius(), c.t.Fahrenheit(), c.t.Kelvin(), c.t.String(), c.celsius, c.fahrenheit, c.kelvin, c.str)
+		}
+	}
+
+	if TemperatureFromCelsius(math.Inf(-1)) != math.MinInt32 || TemperatureFromCelsius(math.Inf(1)) != math.MaxInt32 {
+		t.Errorf("Infinite temperatures not clamped")
+	}
+}
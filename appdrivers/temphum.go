@@ -5,11 +5,12 @@ import (
 	"github.com/spirilis/smacbase"
 	"log"
 	"math"
+	"sync"
 )
 
 /* Temphum is based around a TI HDC1080 temperature + humidity sensor, albeit values doctored a bit.
  * Temperature is conveyed in a Signed 16-bit integer in Q12.3, so dividing by 8 gives the whole degrees C.
- * Multiply by 9/5 and add (32*8), then divide by 8 to get whole degrees F (with good precision)
+ * Readings carry it as a Temperature (see TemperatureFromQ12_3), which handles conversion to degrees F.
  *
  * Humidity is a fraction in Q8 format, i.e. 0 = 0% humidity, 255 = 100% humidity.
  *
@@ -19,88 +20,195 @@ import (
 // TemperatureHumidity holds and handles 0x2002 packets
 type TemperatureHumidity struct {
 	DeviceIdHandler QueryDevice
+	Inquirer        *DeviceInquirer
 	Logger          LogText
-	LastSeenTemp    map[uint16]int16
+	LastSeenTemp    map[uint16]int16 // Guarded by mutex once the driver is registered; read them via GetByDevice
 	LastSeenHum     map[uint16]uint8
+
+	mutex         sync.Mutex
+	callbackMutex sync.Mutex
+	callbacks     []func(TempHumReading)
+	decodeErrorHooks
+}
+
+// TempHumReading is a single decoded 0x2002 sample
+type TempHumReading struct {
+	DeviceID    uint16
+	Description string // From the DeviceIdHandler; empty if the device hasn't registered yet
+	SrcAddr     uint32
+	Rssi        int8
+	Temperature Temperature
+	Humidity    float64 // Relative humidity, 0-100%
+	Dewpoint    Temperature
+	HeatIndex   Temperature
+	HeaterOn    bool
+
+	// DewpointValid is false for a reading of 0% RH, where there is no dewpoint; Dewpoint is then left at 0
+	DewpointValid bool
 }
 
 // NewTemperatureHumidity is the canonical way to create a TemperatureHumidity instance and bind it to a Link.
 func NewTemperatureHumidity(l *smacbase.LinkMgr, g LogText, devIDHandler QueryDevice) *TemperatureHumidity {
 	h := new(TemperatureHumidity)
 	h.DeviceIdHandler = devIDHandler
+	h.Inquirer = NewDeviceInquirer(DefaultInquiryInterval)
 	h.Logger = g
 	h.LastSeenTemp = make(map[uint16]int16)
 	h.LastSeenHum = make(map[uint16]uint8)
+	h.OnReading(h.logReading)
 
-	l.RegisterProgramHandler(0x2002, h)
+	l.RegisterDriver(h)
 	return h
 }
 
 // Receive implements smacbase.FrameReceiver
 func (t *TemperatureHumidity) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
-	if progID != 0x2002 {
-		log.Printf("TemperatureHumidity.Receive: received frame for wrong progID=%04X, expected 0x2002", progID)
+	if progID != smacbase.ProgTempHum {
+		if !t.decodeError(progID, srcAddr, "wrong progID, expected 2002") {
+			log.Printf("TemperatureHumidity.Receive: received frame for wrong progID=%04X, expected 0x2002", progID)
+		}
 		return true // not sure why this packet was received here but keep processing
 	}
-	if len(payload) != 6 {
-		log.Printf("TemperatureHumidity.Receive: received frame with invalid payload length, expected 6 bytes")
+	reading, temp, hum, ok := decodeTempHum(srcAddr, rssi, payload)
+	if !ok {
+		if !t.decodeError(progID, srcAddr, fmt.Sprintf("payload length %d, expected 6", len(payload))) {
+			log.Printf("TemperatureHumidity.Receive: received frame with invalid payload length, expected 6 bytes")
+		}
 		return false // quit processing a bad packet
 	}
+	devid := reading.DeviceID
 
-	var temp int16
-	var hum uint8
-	var devid, tmp uint16
-	var heaterOn string
-	var fTemp, fHum, fDewpt float64 // For dewpoint calculation
-	devid = uint16(payload[0]) | (uint16(payload[1]) << 8)
+	t.mutex.Lock()
+	t.LastSeenTemp[devid] = temp
+	t.LastSeenHum[devid] = hum
+	t.mutex.Unlock()
+	devDesc, err := t.DeviceIdHandler.GetByDevice(devid)
+	if err != nil {
+		if _, ok := err.(NotFound); ok {
+			// Send an inquiry to this device asking for its device description; we won't have it for this sample but maybe next one.
+			t.Inquirer.Inquire(l, srcAddr, devid)
+		}
+	}
+	reading.Description, _ = devDesc.(string)
+	t.callbackMutex.Lock()
+	callbacks := t.callbacks
+	t.callbackMutex.Unlock()
+	for _, f := range callbacks {
+		f(reading)
+	}
+	return false
+}
+
+// decodeTempHum parses a 0x2002 payload, also returning the raw Q12.3 temperature and Q8 humidity.  ok is false if
+// the payload is malformed.  Description is left empty.
+func decodeTempHum(srcAddr uint32, rssi int8, payload []byte) (r TempHumReading, temp int16, hum uint8, ok bool) {
+	if len(payload) != 6 {
+		return r, 0, 0, false
+	}
+
+	var tmp uint16
+	var fTemp, fHum float64
+	r.DeviceID = uint16(payload[0]) | (uint16(payload[1]) << 8)
 	tmp = uint16(payload[2]) | (uint16(payload[3]) << 8)
 	temp = int16(tmp)
 	hum = uint8(payload[4])
 	if payload[5]&0x01 != 0 {
-		heaterOn = " [HEATER]"
+		r.HeaterOn = true
 	}
 
-	// Calculate dewpoint
-	fTemp = float64(temp) / 8.0
+	r.Temperature = TemperatureFromQ12_3(temp)
+	fTemp = r.Temperature.Celsius()
 	fHum = float64(hum) / 255.0
+
+	r.SrcAddr = srcAddr
+	r.Rssi = rssi
+	r.Humidity = fHum * 100.0
+	if hum != 0 {
+		r.Dewpoint = TemperatureFromCelsius(Dewpoint(fTemp, fHum))
+		r.DewpointValid = true
+	}
+	r.HeatIndex = TemperatureFromCelsius(HeatIndex(fTemp, fHum))
+	return r, temp, hum, true
+}
+
+// Dewpoint returns the dewpoint in degrees Celsius for air at tempC with relative humidity rhFraction (0-1), using the
+// Magnus approximation.  A relative humidity of 0 gives -Inf; TempHumReading marks it with DewpointValid instead.
+func Dewpoint(tempC, rhFraction float64) float64 {
 	// TD: =243.04*(LN(RH/100)+((17.625*T)/(243.04+T)))/(17.625-LN(RH/100)-((17.625*T)/(243.04+T)))
 	// ^ From http://andrew.rsmas.miami.edu/bmcnoldy/Humidity.html
-	fDewpt = 243.04 * (math.Log(fHum) + ((17.625 * fTemp) / (243.04 + fTemp))) / (17.625 - math.Log(fHum) - ((17.625 * fTemp) / (243.04 + fTemp)))
+	gamma := math.Log(rhFraction) + (17.625*tempC)/(243.04+tempC)
+	return 243.04 * gamma / (17.625 - gamma)
+}
 
-	t.LastSeenTemp[devid] = temp
-	t.LastSeenHum[devid] = hum
-	devDesc, err := t.DeviceIdHandler.GetByDevice(devid)
-	if err != nil {
-		if _, ok := err.(NotFound); ok {
-			// Send an inquiry to this device asking for its device description; we won't have it for this sample but maybe next one.
-			payload := make([]byte, 2)
-			payload[0] = uint8(devid)
-			payload[1] = uint8(devid >> 8)
-			err = l.Send(srcAddr, 0x2000, payload) // don't actually care about the error here, this is an optional operation
-			if err == nil {
-				l.RunTx()
-			}
+// HeatIndex returns the apparent ("feels like") temperature in degrees Celsius for air at tempC with relative humidity
+// rhFraction (0-1), per the US National Weather Service algorithm: Steadman's simple formula below about 80 degF,
+// otherwise the Rothfusz regression with its low- and high-humidity adjustments.
+func HeatIndex(tempC, rhFraction float64) float64 {
+	// From https://www.wpc.ncep.noaa.gov/html/heatindex_equation.shtml, which works in degF and RH percent
+	t := tempC*9.0/5.0 + 32.0
+	rh := rhFraction * 100.0
+	hi := 0.5 * (t + 61.0 + (t-68.0)*1.2 + rh*0.094)
+	if (hi+t)/2.0 >= 80.0 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+			0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+		if rh < 13.0 && t >= 80.0 && t <= 112.0 {
+			hi -= (13.0 - rh) / 4.0 * math.Sqrt((17.0-math.Abs(t-95.0))/17.0)
+		} else if rh > 85.0 && t >= 80.0 && t <= 87.0 {
+			hi += (rh - 85.0) / 10.0 * (87.0 - t) / 5.0
 		}
 	}
-	t.Logger.Printf("TempHum RX: [%s] - %.1f degF, %.1f%% RH, Dewpt %.1f degF%s [RSSI=%d]\n", devDesc,
-		(fTemp*9.0/5.0)+32.0,
-		fHum*100.0,
-		(fDewpt*9.0/5.0)+32.0,
+	return (hi - 32.0) * 5.0 / 9.0
+}
+
+// OnReading registers f to be called with every successfully decoded sample.  NewTemperatureHumidity registers the
+// Logger output as the first callback.
+func (t *TemperatureHumidity) OnReading(f func(TempHumReading)) {
+	if f == nil {
+		return
+	}
+	t.callbackMutex.Lock()
+	t.callbacks = append(t.callbacks, f)
+	t.callbackMutex.Unlock()
+}
+
+// logReading is the default OnReading callback, printing the sample to Logger
+func (t *TemperatureHumidity) logReading(r TempHumReading) {
+	if t.Logger == nil {
+		return
+	}
+	var heaterOn string
+	if r.HeaterOn {
+		heaterOn = " [HEATER]"
+	}
+	dewpoint := "n/a"
+	if r.DewpointValid {
+		dewpoint = fmt.Sprintf("%.1f degF", r.Dewpoint.Fahrenheit())
+	}
+	t.Logger.Printf("TempHum RX: [%s] - %.1f degF, %.1f%% RH, Dewpt %s%s [RSSI=%d]\n", r.Description,
+		r.Temperature.Fahrenheit(),
+		r.Humidity,
+		dewpoint,
 		heaterOn,
-		rssi)
-	return false
+		r.Rssi)
 }
 
 // GetByDevice implements QueryDevice, returns a []int16 where position #0 is temperature in Celsius * 8, #1 is relative humidity in integer percentage (0-100)
 func (t *TemperatureHumidity) GetByDevice(devID uint16) (interface{}, error) {
-	var collection []int16
-
-	if t.LastSeenTemp[devID] == 0 && t.LastSeenHum[devID] == 0 {
+	t.mutex.Lock()
+	temp, hum := t.LastSeenTemp[devID], t.LastSeenHum[devID]
+	t.mutex.Unlock()
+	if temp == 0 && hum == 0 {
 		return nil, NotFound(fmt.Sprintf("No information available for DeviceID=%04X", devID))
 	}
 
-	collection[0] = t.LastSeenTemp[devID]
-	collection[1] = int16(t.LastSeenHum[devID]*100) / 255
+	collection := make([]int16, 2)
+	collection[0] = temp
+	collection[1] = int16(int(hum) * 100 / 255)
 
 	return collection, nil
 }
+
+// ProgramIDs implements smacbase.ProgramDriver
+func (t *TemperatureHumidity) ProgramIDs() []uint16 {
+	return []uint16{smacbase.ProgTempHum}
+}
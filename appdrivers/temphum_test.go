@@ -0,0 +1,194 @@
+package appdrivers
+
+import (
+	"github.com/spirilis/smacbase"
+	"io"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTemperatureHumidityLog(t *testing.T) {
+	devs := &DeviceIdRegistration{Registrations: map[uint16]string{0x0042: "Garage"}}
+	buf := new(BufferLog)
+	th := &TemperatureHumidity{
+		DeviceIdHandler: devs,
+		Logger:          buf,
+		LastSeenTemp:    make(map[uint16]int16),
+		LastSeenHum:     make(map[uint16]uint8),
+	}
+	th.OnReading(th.logReading)
+	var readings []TempHumReading
+	th.OnReading(func(r TempHumReading) { readings = append(readings, r) })
+
+	// devID=0x0042, temp=200 (25.0 degC), hum=128 (50.2% RH), heater on
+	th.Receive(nil, -60, 0x12345678, 0x2002, []byte{0x42, 0x00, 200, 0x00, 128, 0x01})
+
+	lines := buf.Lines()
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 log line, got %d: %q", len(lines), lines)
+	}
+	expected := "TempHum RX: [Garage] - 77.0 degF, 50.2% RH, Dewpt 57.1 degF [HEATER] [RSSI=-60]\n"
+	if lines[0] != expected {
+		t.Errorf("Unexpected log line:\n got %q\nwant %q", lines[0], expected)
+	}
+	if th.LastSeenTemp[0x0042] != 200 || th.LastSeenHum[0x0042] != 128 {
+		t.Errorf("LastSeen values not recorded: temp=%d hum=%d", th.LastSeenTemp[0x0042], th.LastSeenHum[0x0042])
+	}
+
+	if len(readings) != 1 {
+		t.Fatalf("Expected 1 reading callback, got %d", len(readings))
+	}
+	r := readings[0]
+	if r.DeviceID != 0x0042 || r.Description != "Garage" || r.SrcAddr != 0x12345678 || r.Rssi != -60 ||
+		r.Temperature.Celsius() != 25.0 || !r.HeaterOn {
+		t.Errorf("Unexpected reading: %+v", r)
+	}
+
+	if !r.DewpointValid {
+		t.Errorf("Dewpoint not marked valid at 50%% RH")
+	}
+
+	// 0% RH has no dewpoint
+	buf.Reset()
+	th.Receive(nil, -60, 0x12345678, 0x2002, []byte{0x42, 0x00, 200, 0x00, 0, 0x00})
+	expected = "TempHum RX: [Garage] - 77.0 degF, 0.0% RH, Dewpt n/a [RSSI=-60]\n"
+	if lines = buf.Lines(); len(lines) != 1 || lines[0] != expected {
+		t.Errorf("Unexpected log lines at 0%% RH:\n got %q\nwant %q", lines, expected)
+	}
+	if r = readings[len(readings)-1]; r.DewpointValid || r.Dewpoint != 0 {
+		t.Errorf("Expected no dewpoint at 0%% RH, got %v (valid=%v)", r.Dewpoint, r.DewpointValid)
+	}
+
+	buf.Reset()
+	th.Receive(nil, -60, 0x12345678, 0x2002, []byte{0x42, 0x00})
+	if len(buf.Lines()) != 0 {
+		t.Errorf("Malformed frame was logged: %q", buf.Lines())
+	}
+	if len(readings) != 2 {
+		t.Errorf("Malformed frame produced a reading callback")
+	}
+}
+
+// pipePHY is a PHY whose received bytes are whatever the test writes to it; everything the LinkMgr writes is discarded
+type pipePHY struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func newPipePHY() *pipePHY {
+	r, w := io.Pipe()
+	return &pipePHY{r: r, w: w}
+}
+
+func (p *pipePHY) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipePHY) Write(b []byte) (int, error) { return len(b), nil }
+func (p *pipePHY) Close() error                { return p.r.Close() }
+
+// inject delivers a frame as if the MCU had received it over the air
+func (p *pipePHY) inject(addr uint32, program uint16, data []byte) {
+	f := smacbase.NewRadioFrame(addr, program, data)
+	f.EmitRSSI = true
+	p.w.Write(f.Serialize())
+}
+
+// injectControl delivers a control message from the MCU
+func (p *pipePHY) injectControl(cmd uint8) {
+	b := []byte{0xBA, cmd, smacbase.CONTROL_STATUS_OK, 0}
+	p.w.Write(append(b, smacbase.XorBuffer(b[1:])))
+}
+
+func TestTemperatureHumidityInquiryWhileSquelched(t *testing.T) {
+	phy := newPipePHY()
+	l, err := smacbase.NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return phy, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	squelched := make(chan struct{}, 1)
+	l.RegisterControlObserver(func(rep smacbase.NpiControl) {
+		if rep.Command == smacbase.CONTROL_SQUELCH_HOST {
+			squelched <- struct{}{}
+		}
+	})
+	phy.injectControl(smacbase.CONTROL_SQUELCH_HOST)
+	select {
+	case <-squelched:
+	case <-time.After(time.Second):
+		t.Fatalf("Squelch never processed")
+	}
+
+	NewTemperatureHumidity(l, new(NullLog), &DeviceIdRegistration{Registrations: map[uint16]string{}})
+	frames, unsubscribe := l.Subscribe(4)
+	defer unsubscribe()
+
+	// An unregistered device makes temphum inquire; the writer can't transmit it, so the next frame would wait behind
+	// RunTx's reply timeout if the inquiry were sent from the dispatch goroutine
+	phy.inject(0x12345678, smacbase.ProgTempHum, []byte{0x42, 0x00, 200, 0x00, 128, 0x00})
+	phy.inject(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case f := <-frames:
+			if f.Address == 0xDEADBEEF {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Dispatch stalled behind temphum's device inquiry while squelched")
+		}
+	}
+}
+
+func TestTemperatureHumidityConcurrentAccess(t *testing.T) {
+	th := &TemperatureHumidity{
+		DeviceIdHandler: &DeviceIdRegistration{Registrations: map[uint16]string{0x0042: "Garage"}},
+		LastSeenTemp:    make(map[uint16]int16),
+		LastSeenHum:     make(map[uint16]uint8),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			th.Receive(nil, -60, 0x12345678, 0x2002, []byte{0x42, 0x00, uint8(i), 0x00, 128, 0x00})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		th.GetByDevice(0x0042)
+	}
+	wg.Wait()
+
+	v, err := th.GetByDevice(0x0042)
+	if err != nil {
+		t.Fatalf("GetByDevice error: %v", err)
+	}
+	if c := v.([]int16); c[0] != 199 || c[1] != 50 {
+		t.Errorf("Unexpected GetByDevice result %v", c)
+	}
+	if _, err = th.GetByDevice(0x0043); err == nil {
+		t.Errorf("GetByDevice found an unseen device")
+	}
+}
+
+func TestDewpointHeatIndex(t *testing.T) {
+	cases := []struct {
+		tempC, rh      float64
+		dewpt, heatIdx float64 // Degrees Celsius
+	}{
+		{25.0, 0.50, 13.9, 24.9}, // Mild: Steadman formula
+		{20.0, 0.80, 16.4, 20.1},
+		{32.22, 0.70, 26.0, 41.1}, // 90 degF, 70% RH: NWS heat index chart reads 105-106 degF
+		{40.0, 0.10, 2.6, 36.7},   // Dry heat: low-humidity adjustment applies
+		{29.0, 0.90, 27.2, 37.2},  // Humid: high-humidity adjustment applies
+	}
+	for _, c := range cases {
+		if dp := Dewpoint(c.tempC, c.rh); math.Abs(dp-c.dewpt) > 0.1 {
+			t.Errorf("Dewpoint(%g, %g) = %.2f, want %.1f", c.tempC, c.rh, dp, c.dewpt)
+		}
+		if hi := HeatIndex(c.tempC, c.rh); math.Abs(hi-c.heatIdx) > 0.1 {
+			t.Errorf("HeatIndex(%g, %g) = %.2f, want %.1f", c.tempC, c.rh, hi, c.heatIdx)
+		}
+	}
+}
@@ -3,12 +3,27 @@ package appdrivers
 import (
 	"fmt"
 	"github.com/spirilis/smacbase"
+	"sync"
 )
 
 // ThermocoupleStdout is an SMac handler that receives temperature data, and relays it directly to stdout.  Duh.
 type ThermocoupleStdout struct {
 	Link      *smacbase.LinkMgr
-	SeenNodes map[uint16]int16 // Map of logical device IDs and last seen thermocouple value
+	SeenNodes map[uint16]int16 // Map of logical device IDs and last seen thermocouple value; guarded by mutex, read it via GetByDevice
+
+	mutex         sync.Mutex
+	callbackMutex sync.Mutex
+	callbacks     []func(ThermocoupleReading)
+	decodeErrorHooks
+}
+
+// ThermocoupleReading is a single decoded 0x2001 sample
+type ThermocoupleReading struct {
+	DeviceID     uint16
+	SrcAddr      uint32
+	Rssi         int8
+	Thermocouple Temperature
+	Ambient      Temperature // Cold junction
 }
 
 // NewThermocoupleStdout creates a new instance and attaches it to the link.
@@ -16,20 +31,43 @@ func NewThermocoupleStdout(l *smacbase.LinkMgr) *ThermocoupleStdout {
 	ts := new(ThermocoupleStdout)
 	ts.Link = l
 	ts.SeenNodes = make(map[uint16]int16)
+	ts.OnReading(printThermocoupleReading)
 
-	l.RegisterProgramHandler(0x2001, ts)
+	l.RegisterDriver(ts)
 	return ts
 }
 
 // Receive implements smacbase.FrameReceiver - returns true if LinkMgr should continue parsing after this
 func (ts *ThermocoupleStdout) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
 	// Extract thermocouple data
-	if progID != 0x2001 {
+	if progID != smacbase.ProgThermocouple {
+		ts.decodeError(progID, srcAddr, "wrong progID, expected 2001")
 		return true // apparently this packet wasn't intended for us, so, continue processing
 	}
-	if len(payload) != 7 {
+	reading, ok := decodeThermocouple(srcAddr, rssi, payload)
+	if !ok {
+		ts.decodeError(progID, srcAddr, fmt.Sprintf("payload length %d, expected 7", len(payload)))
 		return false // stop processing further, as this packet is malformed.
 	}
+
+	ts.mutex.Lock()
+	ts.SeenNodes[reading.DeviceID] = int16(reading.Thermocouple.Celsius())
+	ts.mutex.Unlock()
+
+	ts.callbackMutex.Lock()
+	callbacks := ts.callbacks
+	ts.callbackMutex.Unlock()
+	for _, f := range callbacks {
+		f(reading)
+	}
+	return true // continue processing as there may be other intelligent apps using it
+}
+
+// decodeThermocouple parses a 0x2001 payload; ok is false if it is malformed
+func decodeThermocouple(srcAddr uint32, rssi int8, payload []byte) (ThermocoupleReading, bool) {
+	if len(payload) != 7 {
+		return ThermocoupleReading{}, false
+	}
 	var tmp, devid uint16 // Using a uint16 temporary to avoid mangling conversion with sign-extends
 	var tc, amb int16
 	devid = uint16(payload[0]) | (uint16(payload[1]) << 8)
@@ -37,9 +75,38 @@ func (ts *ThermocoupleStdout) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr ui
 	tc = int16(tmp)
 	tmp = uint16(payload[4]) | (uint16(payload[5]) << 8)
 	amb = int16(tmp)
+	return ThermocoupleReading{DeviceID: devid, SrcAddr: srcAddr, Rssi: rssi,
+		Thermocouple: TemperatureFromCelsius(float64(tc)), Ambient: TemperatureFromCelsius(float64(amb))}, true
+}
 
-	ts.SeenNodes[devid] = tc
+// OnReading registers f to be called with every successfully decoded sample.  NewThermocoupleStdout registers the
+// stdout printer as the first callback.
+func (ts *ThermocoupleStdout) OnReading(f func(ThermocoupleReading)) {
+	if f == nil {
+		return
+	}
+	ts.callbackMutex.Lock()
+	ts.callbacks = append(ts.callbacks, f)
+	ts.callbackMutex.Unlock()
+}
 
-	fmt.Printf("Device ID %04X: TC = %d Celsius, Ambient = %d Celsius (srcAddr = %08X, RSSI=%d)\n", devid, tc, amb, srcAddr, rssi)
-	return true // continue processing as there may be other intelligent apps using it
+// printThermocoupleReading is the default OnReading callback
+func printThermocoupleReading(r ThermocoupleReading) {
+	fmt.Printf("Device ID %04X: TC = %.0f Celsius, Ambient = %.0f Celsius (srcAddr = %08X, RSSI=%d)\n", r.DeviceID, r.Thermocouple.Celsius(), r.Ambient.Celsius(), r.SrcAddr, r.Rssi)
+}
+
+// GetByDevice implements QueryDevice, returning the last seen thermocouple temperature (int16, degrees Celsius)
+func (ts *ThermocoupleStdout) GetByDevice(devID uint16) (interface{}, error) {
+	ts.mutex.Lock()
+	tc, ok := ts.SeenNodes[devID]
+	ts.mutex.Unlock()
+	if !ok {
+		return nil, NotFound(fmt.Sprintf("No information available for DeviceID=%04X", devID))
+	}
+	return tc, nil
+}
+
+// ProgramIDs implements smacbase.ProgramDriver
+func (ts *ThermocoupleStdout) ProgramIDs() []uint16 {
+	return []uint16{smacbase.ProgThermocouple}
 }
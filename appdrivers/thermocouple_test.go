@@ -0,0 +1,30 @@
+package appdrivers
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestThermocoupleConcurrentAccess(t *testing.T) {
+	ts := &ThermocoupleStdout{SeenNodes: make(map[uint16]int16)}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			ts.Receive(nil, -60, 0x12345678, 0x2001, []byte{0x07, 0x00, uint8(i), 0x00, 0x16, 0x00, 0x00})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		ts.GetByDevice(0x0007)
+	}
+	wg.Wait()
+
+	if v, err := ts.GetByDevice(0x0007); err != nil || v.(int16) != 199 {
+		t.Errorf("Expected the last thermocouple reading of 199, got %v, %v", v, err)
+	}
+	if _, err := ts.GetByDevice(0x0008); err == nil {
+		t.Errorf("GetByDevice found an unseen device")
+	}
+}
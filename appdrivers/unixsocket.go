@@ -0,0 +1,172 @@
+package appdrivers
+
+import (
+	"encoding/json"
+	"github.com/spirilis/smacbase"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/* unixsocket.go fans received frames out to local processes over a Unix domain socket, one JSON object per line, for
+ * multi-process setups on one host (e.g. a collector plus separate analyzers) which don't want HTTP or gRPC.  Clients
+ * just connect and read lines; anything they send is ignored.
+ */
+
+// DefaultUnixClientDepth is how many frames are queued per UnixSocketPublisher client before its frames are dropped
+const DefaultUnixClientDepth = 64
+
+// UnixFrameEvent is the JSON object written to UnixSocketPublisher clients for each frame.  Data is base64-encoded.
+type UnixFrameEvent struct {
+	Address   uint32    `json:"address"`
+	Program   uint16    `json:"program"`
+	Rssi      int8      `json:"rssi"`
+	Data      []byte    `json:"data"`
+	Received  time.Time `json:"received"`
+	Direction string    `json:"direction"` // "RX", or "TX" for transmissions echoed by LinkMgr.SetLoopbackTX
+}
+
+// UnixSocketPublisher is a firehose handler streaming every frame it sees to the clients connected to its socket.  A
+// client which can't keep up loses frames (counted in Drops) without holding up the dispatch loop or other clients.
+type UnixSocketPublisher struct {
+	Path        string
+	ClientDepth int // Frames queued per client; changes only affect clients connecting afterwards
+
+	listener net.Listener
+	mutex    sync.Mutex
+	clients  map[*unixClient]struct{}
+	drops    uint64
+	closed   bool
+}
+
+// unixClient is one connection and the queue of encoded lines waiting to be written to it
+type unixClient struct {
+	conn  net.Conn
+	lines chan []byte
+}
+
+// NewUnixSocketPublisher listens on a Unix socket at path, replacing any stale socket file left there, and starts
+// accepting clients.  Register it with LinkMgr.RegisterAllHandler to start publishing.
+func NewUnixSocketPublisher(path string) (*UnixSocketPublisher, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(UnixSocketPublisher)
+	p.Path = path
+	p.ClientDepth = DefaultUnixClientDepth
+	p.listener = ln
+	p.clients = make(map[*unixClient]struct{})
+	go p.accept()
+	return p, nil
+}
+
+// accept hands each new connection its own writer goroutine until the listener is closed
+func (p *UnixSocketPublisher) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		c := &unixClient{conn: conn, lines: make(chan []byte, p.ClientDepth)}
+		p.clients[c] = struct{}{}
+		p.mutex.Unlock()
+		go p.serve(c)
+	}
+}
+
+// serve writes c's queued lines until the queue is closed or a write fails
+func (p *UnixSocketPublisher) serve(c *unixClient) {
+	defer c.conn.Close()
+	for line := range c.lines {
+		if _, err := c.conn.Write(line); err != nil {
+			p.drop(c)
+			return
+		}
+	}
+}
+
+// drop forgets a client whose connection has failed
+func (p *UnixSocketPublisher) drop(c *unixClient) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.clients[c]; ok {
+		delete(p.clients, c)
+		close(c.lines)
+	}
+}
+
+// Receive implements smacbase.FrameReceiver
+func (p *UnixSocketPublisher) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	return p.ReceiveFrame(l, &smacbase.NpiRadioFrame{Address: srcAddr, Program: progID, Rssi: rssi, Data: payload})
+}
+
+// ReceiveFrame implements smacbase.FrameReceiverFull
+func (p *UnixSocketPublisher) ReceiveFrame(l *smacbase.LinkMgr, frame *smacbase.NpiRadioFrame) bool {
+	p.Publish(UnixFrameEvent{Address: frame.Address, Program: frame.Program, Rssi: frame.Rssi, Data: frame.Data,
+		Received: time.Now(), Direction: frame.Direction.String()})
+	return true
+}
+
+// Publish queues ev for every connected client
+func (p *UnixSocketPublisher) Publish(ev UnixFrameEvent) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("UnixSocketPublisher: can't encode frame from %08X: %v", ev.Address, err)
+		return
+	}
+	line = append(line, '\n')
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for c := range p.clients {
+		select {
+		case c.lines <- line:
+		default:
+			p.drops++
+		}
+	}
+}
+
+// Clients reports how many clients are connected
+func (p *UnixSocketPublisher) Clients() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.clients)
+}
+
+// Drops reports how many frames have been dropped across all clients for falling behind
+func (p *UnixSocketPublisher) Drops() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.drops
+}
+
+// Close stops accepting clients, disconnects the existing ones once their queued frames are written, and removes
+// the socket file.  Deregister the publisher from the LinkMgr separately.
+func (p *UnixSocketPublisher) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	for c := range p.clients {
+		delete(p.clients, c)
+		close(c.lines)
+	}
+	p.mutex.Unlock()
+	err := p.listener.Close()
+	os.Remove(p.Path)
+	return err
+}
@@ -0,0 +1,63 @@
+package appdrivers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocketPublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smac.sock")
+	p, err := NewUnixSocketPublisher(path)
+	if err != nil {
+		t.Fatalf("NewUnixSocketPublisher error: %v", err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for p.Clients() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if p.Clients() != 1 {
+		t.Fatalf("Clients() = %d, want 1", p.Clients())
+	}
+
+	p.Receive(nil, -42, 0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("Read error: %v", err)
+	}
+	var ev UnixFrameEvent
+	if err := json.Unmarshal(line, &ev); err != nil {
+		t.Fatalf("Bad event %q: %v", line, err)
+	}
+	if ev.Address != 0xDEADBEEF || ev.Program != 0x6933 || ev.Rssi != -42 || string(ev.Data) != "SIXTY NINE" ||
+		ev.Direction != "RX" {
+		t.Errorf("Event mismatch: %+v", ev)
+	}
+
+	// A client which isn't taking frames loses them without holding up the others
+	stuck := &unixClient{lines: make(chan []byte)}
+	p.mutex.Lock()
+	p.clients[stuck] = struct{}{}
+	p.mutex.Unlock()
+	p.Receive(nil, -42, 0xDEADBEEF, 0x6933, nil)
+	if p.Drops() != 1 {
+		t.Errorf("Drops() = %d, want 1", p.Drops())
+	}
+
+	p.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Socket file still present after Close: %v", err)
+	}
+}
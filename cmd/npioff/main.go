@@ -19,12 +19,19 @@ func main() {
 	link, err := smacbase.NewLinkMgr(*serialPath, *baudRate)
 	if err != nil {
 		fmt.Printf("Error opening NPI link: %v\n", err)
+		if hint := smacbase.DescribeOpenError(err, *serialPath); hint != "" {
+			fmt.Println(hint)
+		}
 		os.Exit(1)
 	}
 
 	fmt.Printf("Deconfiguring base station...")
-	// Send a dummy control frame to clear out any badness in the UART buffers
-	link.CtrlForget(smacbase.CONTROL_UNSQUELCH_HOST, nil)
+	// Clear out any badness in the UART buffers
+	err = link.Flush()
+	if err != nil {
+		fmt.Printf("Error flushing NPI link: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Disable RX
 	err = link.On(false)
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spirilis/smacbase"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"os"
+)
+
+// smacident prints what the base station on --device is (firmware, radio configuration, addresses) and exits; it's
+// the quickest way to confirm a dongle is alive and talking.  With --identify it also blinks the dongle's LEDs, to
+// find which one it is in a rack of several.
+
+var (
+	serialPath = kingpin.Flag("device", "Path to serial port device").Required().String()
+	baudRate   = kingpin.Flag("baud", "Serial port baudrate").Default("115200").Uint()
+	asJSON     = kingpin.Flag("json", "Print the station info as JSON").Bool()
+	identify   = kingpin.Flag("identify", "Also blink the base station's LEDs for this long, to find it physically").Duration()
+)
+
+func main() {
+	kingpin.Version("0.1")
+	kingpin.Parse()
+
+	link, err := smacbase.NewLinkMgr(*serialPath, *baudRate)
+	if err != nil {
+		fmt.Printf("Error opening NPI link: %v\n", err)
+		if hint := smacbase.DescribeOpenError(err, *serialPath); hint != "" {
+			fmt.Println(hint)
+		}
+		os.Exit(1)
+	}
+	defer link.Close()
+
+	// Clear out any badness in the UART buffers
+	err = link.Flush()
+	if err != nil {
+		fmt.Printf("No response from the base station: %v\n", err)
+		fmt.Printf("Check that %s is running the NPI firmware and the --baud setting matches it\n", *serialPath)
+		link.Close()
+		os.Exit(1)
+	}
+
+	info, err := link.Info()
+	if *asJSON {
+		out, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Println(info)
+	}
+	if err != nil {
+		fmt.Printf("Warning: some queries failed, so the information above is incomplete: %v\n", err)
+		link.Close()
+		os.Exit(1)
+	}
+
+	if *identify > 0 {
+		fmt.Printf("Blinking LEDs for %v...\n", *identify)
+		err = link.Identify(*identify)
+		if err != nil {
+			fmt.Printf("Identify failed: %v\n", err)
+			link.Close()
+			os.Exit(1)
+		}
+	}
+}
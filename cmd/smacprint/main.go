@@ -6,79 +6,56 @@ import (
 	"github.com/spirilis/smacbase/appdrivers"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"os"
+	"strings"
 )
 
 var (
 	serialPath = kingpin.Flag("device", "Path to serial port device").Required().String()
 	baudRate   = kingpin.Flag("baud", "Serial port baudrate").Default("115200").Uint()
 	centerFreq = kingpin.Flag("freq", "RF center frequency").Default("902800000").Uint32()
+	dryRun     = kingpin.Flag("dry-run", "Show the frames that would be sent to the base station, then exit").Bool()
+	drivers    = kingpin.Flag("driver", "Driver to load; repeat for several ("+strings.Join(appdrivers.DriverNames(), ", ")+
+		"; default "+strings.Join(appdrivers.DefaultDrivers, ", ")+")").Strings()
 )
 
 func main() {
 	kingpin.Version("0.1")
 	kingpin.Parse()
-
-	link, err := smacbase.NewLinkMgr(*serialPath, *baudRate)
-	if err != nil {
-		fmt.Printf("Error opening NPI link: %v\n", err)
-		os.Exit(1)
+	for _, name := range *drivers {
+		if _, ok := appdrivers.LookupDriver(name); !ok {
+			fmt.Printf("Unknown driver %q; choose from %s\n", name, strings.Join(appdrivers.DriverNames(), ", "))
+			os.Exit(1)
+		}
 	}
 
-	fmt.Printf("Registering frame receiver drivers...")
 	stdoutLogger := appdrivers.GenericStdout{}
-	deviceIdHandler := appdrivers.NewDeviceIdRegistration(link)
-	appdrivers.NewTemperatureHumidity(link, stdoutLogger, deviceIdHandler)
-	printHandler := &appdrivers.FrameStdout{Logger: stdoutLogger}
-	link.RegisterAllHandler(printHandler)
-	pingHandler := appdrivers.PingHandler{Logger: stdoutLogger}
-	link.RegisterProgramHandler(0x2003, pingHandler)
-	fmt.Println("done")
-
-	fmt.Printf("Configuring base station...")
-	// Send a dummy control frame to clear out any badness in the UART buffers
-	link.CtrlForget(smacbase.CONTROL_UNSQUELCH_HOST, nil)
-
-	// Set base station addr, enable RX
-	err = link.SetAlternateAddress(0xBACE0001)
-	if _, ok := err.(smacbase.CtrlTimeout); ok {
-		// Try once more
-		err = link.SetAlternateAddress(0xBACE0001)
-	}
-	if err != nil {
-		fmt.Printf("Error setting alternate addr: %v\n", err)
-		os.Exit(1)
-	}
-	err = link.On(true)
-	if _, ok := err.(smacbase.CtrlTimeout); ok {
-		// Try once more
-		err = link.On(true)
-	}
-	if err != nil {
-		fmt.Printf("Error switching RX on: %v\n", err)
-		os.Exit(1)
+	cfg := smacbase.DefaultBaseStationConfig()
+	cfg.Frequency = *centerFreq
+	cfg.Setup = func(link *smacbase.LinkMgr) {
+		fmt.Printf("Registering frame receiver drivers...")
+		appdrivers.LoadDrivers(link, &appdrivers.DriverEnv{Logger: stdoutLogger}, *drivers) // Names checked above
+		fmt.Println("done")
+		fmt.Printf("Configuring base station...")
 	}
 
-	// Set center frequency to 902.8MHz
-	err = link.SetFrequency(*centerFreq)
-	if _, ok := err.(smacbase.CtrlTimeout); ok {
-		// Try once more
-		err = link.SetFrequency(*centerFreq)
-	}
-	if err != nil {
-		fmt.Printf("Error changing center frequency: %v\n", err)
-		os.Exit(1)
-	}
-	// Set TX power to 12dBm
-	err = link.SetPower(12)
-	if _, ok := err.(smacbase.CtrlTimeout); ok {
-		// Try once more
-		err = link.SetPower(12)
+	if *dryRun {
+		cfg.DryRun = os.Stdout
+		fmt.Println()
 	}
+
+	link, err := smacbase.StartBaseStation(*serialPath, *baudRate, cfg)
 	if err != nil {
-		fmt.Printf("Error changing TX power: %v\n", err)
+		fmt.Printf("Error starting base station: %v\n", err)
+		if hint := smacbase.DescribeOpenError(err, *serialPath); hint != "" {
+			fmt.Println(hint)
+		}
 		os.Exit(1)
 	}
 	fmt.Println("done")
+	if *dryRun {
+		link.Close()
+		return
+	}
 	// main() doesn't do anything useful but we need to stay running for the rest of the goroutines to stay alive
 	dummyChan := make(chan struct{})
 	select {
@@ -0,0 +1,118 @@
+//go:build smacgrpc
+// +build smacgrpc
+
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"github.com/spirilis/smacbase"
+	"github.com/spirilis/smacbase/grpcserver/smacpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/* grpc.go is the gRPC transport for Server.  It needs the smacpb stubs (`go generate ./grpcserver`) and
+ * google.golang.org/grpc, so it is only built with the smacgrpc build tag:
+ *
+ *	gs := grpc.NewServer()
+ *	grpcserver.NewServer(l, devs).RegisterGRPC(gs)
+ *	gs.Serve(listener)
+ */
+
+// GRPCServer implements smacpb.SmacServer by converting each RPC's messages and calling the Server method of the
+// same name
+type GRPCServer struct {
+	smacpb.UnimplementedSmacServer
+	Server *Server
+}
+
+// NewGRPCServer wraps s for registration with smacpb.RegisterSmacServer
+func NewGRPCServer(s *Server) *GRPCServer {
+	return &GRPCServer{Server: s}
+}
+
+// RegisterGRPC registers the Smac service, backed by s, on reg (e.g. a *grpc.Server)
+func (s *Server) RegisterGRPC(reg grpc.ServiceRegistrar) {
+	smacpb.RegisterSmacServer(reg, NewGRPCServer(s))
+}
+
+// SubscribeFrames implements smacpb.SmacServer, streaming frames until the client goes away
+func (g *GRPCServer) SubscribeFrames(req *smacpb.SubscribeRequest, stream smacpb.Smac_SubscribeFramesServer) error {
+	err := g.Server.SubscribeFrames(stream.Context(), func(ev *FrameEvent) error {
+		return stream.Send(frameEventToPB(ev))
+	})
+	return grpcError(err)
+}
+
+// Send implements smacpb.SmacServer
+func (g *GRPCServer) Send(ctx context.Context, req *smacpb.SendRequest) (*smacpb.SendReply, error) {
+	if req.Program > 0xFFFF {
+		return nil, status.Errorf(codes.InvalidArgument, "program %X exceeds 16 bits", req.Program)
+	}
+	sent, err := g.Server.Send(req.Address, uint16(req.Program), req.Data)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &smacpb.SendReply{Transmitted: int32(sent)}, nil
+}
+
+// GetRadio implements smacpb.SmacServer
+func (g *GRPCServer) GetRadio(ctx context.Context, req *smacpb.GetRadioRequest) (*smacpb.RadioState, error) {
+	r, err := g.Server.GetRadio()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &smacpb.RadioState{
+		RxOn:         r.RxOn,
+		Frequency:    r.Frequency,
+		PowerDbm:     int32(r.Power),
+		TxIntervalMs: uint32(r.TxIntervalMS),
+	}, nil
+}
+
+// ListDevices implements smacpb.SmacServer
+func (g *GRPCServer) ListDevices(ctx context.Context, req *smacpb.ListDevicesRequest) (*smacpb.DeviceList, error) {
+	list := new(smacpb.DeviceList)
+	for _, e := range g.Server.ListDevices() {
+		d := &smacpb.Device{Id: uint32(e.ID), Description: e.Description, Address: e.Address}
+		if !e.LastSeen.IsZero() {
+			d.LastSeenUnixNano = e.LastSeen.UnixNano()
+		}
+		list.Devices = append(list.Devices, d)
+	}
+	return list, nil
+}
+
+// frameEventToPB converts a FrameEvent to its message
+func frameEventToPB(ev *FrameEvent) *smacpb.FrameEvent {
+	pb := &smacpb.FrameEvent{
+		Address:          ev.Address,
+		Program:          uint32(ev.Program),
+		Rssi:             int32(ev.Rssi),
+		Data:             ev.Data,
+		ReceivedUnixNano: ev.Received.UnixNano(),
+		Dropped:          ev.Dropped,
+	}
+	if ev.Direction == smacbase.DirTX {
+		pb.Direction = smacpb.Direction_DIRECTION_TX
+	}
+	return pb
+}
+
+// grpcError gives err a gRPC status code where one fits; anything else is left for gRPC to report as Unknown
+func grpcError(err error) error {
+	var timeout smacbase.CtrlTimeout
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, smacbase.ErrPayloadTooLarge):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &timeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return err
+}
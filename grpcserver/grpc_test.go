@@ -0,0 +1,98 @@
+//go:build smacgrpc
+// +build smacgrpc
+
+package grpcserver
+
+import (
+	"context"
+	"github.com/spirilis/smacbase"
+	"github.com/spirilis/smacbase/grpcserver/smacpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestClient serves s over an in-memory listener and returns a client connected to it
+func newTestClient(t *testing.T, s *Server) smacpb.SmacClient {
+	lis := bufconn.Listen(1 << 16)
+	gs := grpc.NewServer()
+	s.RegisterGRPC(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return smacpb.NewSmacClient(conn)
+}
+
+func TestGRPCSubscribeFrames(t *testing.T) {
+	s, phy := newTestServer(t)
+	client := newTestClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.SubscribeFrames(ctx, new(smacpb.SubscribeRequest))
+	if err != nil {
+		t.Fatalf("SubscribeFrames error: %v", err)
+	}
+
+	// Keep injecting until the server-side handler is registered and the frame comes through
+	events := make(chan *smacpb.FrameEvent, 16)
+	go func() {
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				close(events)
+				return
+			}
+			events <- ev
+		}
+	}()
+	deadline := time.After(time.Second)
+	for {
+		phy.inject(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+		select {
+		case ev := <-events:
+			if ev.Address != 0xDEADBEEF || ev.Program != 0x6933 || ev.Rssi != -42 || string(ev.Data) != "SIXTY NINE" ||
+				ev.Direction != smacpb.Direction_DIRECTION_RX || ev.ReceivedUnixNano == 0 {
+				t.Errorf("Unexpected event %+v", ev)
+			}
+			cancel()
+			return
+		case <-deadline:
+			t.Fatalf("Frame was not streamed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestGRPCSendInvalid(t *testing.T) {
+	s, _ := newTestServer(t)
+	client := newTestClient(t, s)
+	_, err := client.Send(context.Background(), &smacpb.SendRequest{Address: 0xDEADBEEF, Program: 0x10000})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a 17-bit program, got %v", err)
+	}
+	_, err = client.Send(context.Background(), &smacpb.SendRequest{Address: 0xDEADBEEF, Program: 0x6933,
+		Data: make([]byte, smacbase.MaxPayload+1)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an oversized payload, got %v", err)
+	}
+}
+
+func TestGRPCListDevices(t *testing.T) {
+	s, _ := newTestServer(t)
+	client := newTestClient(t, s)
+	list, err := client.ListDevices(context.Background(), new(smacpb.ListDevicesRequest))
+	if err != nil || len(list.Devices) != 0 {
+		t.Errorf("ListDevices without a registry = %+v, %v", list, err)
+	}
+}
@@ -0,0 +1,158 @@
+package grpcserver
+
+import (
+	"context"
+	"github.com/spirilis/smacbase"
+	"github.com/spirilis/smacbase/appdrivers"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* grpcserver holds the service logic behind smac.proto, kept free of generated code so it can be exercised without
+ * the gRPC toolchain.  The gRPC transport is in grpc.go, built only with the smacgrpc tag: it needs the stubs, which
+ * are generated into grpcserver/smacpb (see the go:generate directive below), and google.golang.org/grpc.  Its
+ * GRPCServer implements smacpb.SmacServer by converting each request, calling the Server method of the same name
+ * and converting the result; SubscribeFrames is driven by the stream's Context and Send.
+ */
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/spirilis/smacbase/grpcserver --go-grpc_out=. --go-grpc_opt=module=github.com/spirilis/smacbase/grpcserver smac.proto
+
+// DefaultStreamDepth is how many frames are queued per SubscribeFrames client before its frames start being dropped
+const DefaultStreamDepth = 64
+
+// Server implements the Smac service over a LinkMgr
+type Server struct {
+	Link        *smacbase.LinkMgr
+	Devices     *appdrivers.DeviceIdRegistration // May be nil, in which case ListDevices is always empty
+	StreamDepth int
+
+	drops uint64 // Frames dropped across all SubscribeFrames clients, updated atomically
+}
+
+// FrameEvent mirrors the FrameEvent message
+type FrameEvent struct {
+	Address   uint32
+	Program   uint16
+	Rssi      int8
+	Data      []byte
+	Received  time.Time
+	Direction smacbase.Direction // DirTX for transmissions echoed by LinkMgr.SetLoopbackTX
+	Dropped   uint64             // Frames this client lost to a full queue since its previous FrameEvent
+}
+
+// RadioState mirrors the RadioState message
+type RadioState struct {
+	RxOn         bool
+	Frequency    uint32
+	Power        int8
+	TxIntervalMS uint16
+}
+
+// NewServer creates a Server for l, listing devices from devs (which may be nil)
+func NewServer(l *smacbase.LinkMgr, devs *appdrivers.DeviceIdRegistration) *Server {
+	s := new(Server)
+	s.Link = l
+	s.Devices = devs
+	s.StreamDepth = DefaultStreamDepth
+	return s
+}
+
+// SubscribeFrames calls send for every received frame until ctx is canceled (returning ctx.Err()), send fails
+// (returning its error) or the LinkMgr is closed (returning nil).  Each client gets its own queue of StreamDepth
+// frames; when a client can't keep up, its excess frames are dropped without affecting other clients or the dispatch
+// loop.  The client learns of them through FrameEvent.Dropped, and Drops totals them for the Server.
+func (s *Server) SubscribeFrames(ctx context.Context, send func(*FrameEvent) error) error {
+	c := &streamClient{frames: make(chan *FrameEvent, s.StreamDepth), server: s}
+	s.Link.RegisterAuditHandler(c)
+	defer s.Link.DeregisterHandler(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.Link.NpiDied:
+			return nil
+		case ev := <-c.frames:
+			ev.Dropped = c.takeDropped()
+			if err := send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Drops returns how many frames have been dropped across all SubscribeFrames clients because they fell behind
+func (s *Server) Drops() uint64 {
+	return atomic.LoadUint64(&s.drops)
+}
+
+// streamClient is the audit handler queueing frames for one SubscribeFrames call
+type streamClient struct {
+	frames chan *FrameEvent
+	server *Server
+
+	mutex   sync.Mutex
+	dropped uint64 // Since the last FrameEvent sent
+}
+
+// Receive implements smacbase.FrameReceiver
+func (c *streamClient) Receive(l *smacbase.LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	return c.ReceiveFrame(l, &smacbase.NpiRadioFrame{Address: srcAddr, Program: progID, Rssi: rssi, Data: payload})
+}
+
+// ReceiveFrame implements smacbase.FrameReceiverFull, so the event carries the frame's Direction
+func (c *streamClient) ReceiveFrame(l *smacbase.LinkMgr, n *smacbase.NpiRadioFrame) bool {
+	ev := &FrameEvent{
+		Address:   n.Address,
+		Program:   n.Program,
+		Rssi:      n.Rssi,
+		Data:      append([]byte(nil), n.Data...),
+		Received:  time.Now(),
+		Direction: n.Direction,
+	}
+	select {
+	case c.frames <- ev:
+	default:
+		c.mutex.Lock()
+		c.dropped++
+		c.mutex.Unlock()
+		atomic.AddUint64(&c.server.drops, 1)
+	}
+	return true
+}
+
+// takeDropped returns the drops since it was last called
+func (c *streamClient) takeDropped() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	d := c.dropped
+	c.dropped = 0
+	return d
+}
+
+// Send queues a frame for addr and triggers transmission, returning the number of frames the MCU reports transmitted
+// (smacbase.RunTxUnknown if the firmware doesn't say)
+func (s *Server) Send(addr uint32, program uint16, data []byte) (int, error) {
+	err := s.Link.Send(addr, program, data)
+	if err != nil {
+		return 0, err
+	}
+	return s.Link.RunTx()
+}
+
+// GetRadio reports the current radio parameters
+func (s *Server) GetRadio() (RadioState, error) {
+	rxOn, freq, power, tick, err := s.Link.GetRadio()
+	if err != nil {
+		return RadioState{}, err
+	}
+	return RadioState{RxOn: rxOn, Frequency: freq, Power: power, TxIntervalMS: tick}, nil
+}
+
+// ListDevices returns every registered device, ordered by device ID
+func (s *Server) ListDevices() []appdrivers.DeviceEntry {
+	if s.Devices == nil {
+		return nil
+	}
+	return s.Devices.Sorted()
+}
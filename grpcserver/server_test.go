@@ -0,0 +1,200 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"github.com/spirilis/smacbase"
+	"github.com/spirilis/smacbase/appdrivers"
+	"io"
+	"testing"
+	"time"
+)
+
+// pipePHY is a PHY whose received bytes are whatever the test writes to it; everything the LinkMgr writes is discarded
+type pipePHY struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func newPipePHY() *pipePHY {
+	r, w := io.Pipe()
+	return &pipePHY{r: r, w: w}
+}
+
+func (p *pipePHY) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipePHY) Write(b []byte) (int, error) { return len(b), nil }
+func (p *pipePHY) Close() error                { return p.r.Close() }
+
+// inject delivers a frame as if the MCU had received it over the air
+func (p *pipePHY) inject(addr uint32, program uint16, data []byte) {
+	f := smacbase.NewRadioFrame(addr, program, data)
+	f.Rssi = -42
+	f.EmitRSSI = true
+	p.w.Write(f.Serialize())
+}
+
+func newTestServer(t *testing.T) (*Server, *pipePHY) {
+	phy := newPipePHY()
+	l, err := smacbase.NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return phy, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return NewServer(l, nil), phy
+}
+
+// subscribe runs SubscribeFrames in the background, returning a channel which receives its return value
+func subscribe(ctx context.Context, s *Server, send func(*FrameEvent) error) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- s.SubscribeFrames(ctx, send) }()
+	return result
+}
+
+// waitSubscribed waits until SubscribeFrames has registered its handler, so frames injected afterwards reach it
+func waitSubscribed(phy *pipePHY, events <-chan *FrameEvent) *FrameEvent {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		phy.inject(0xDEADBEEF, 0x0001, nil)
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func TestSubscribeFramesCancel(t *testing.T) {
+	s, phy := newTestServer(t)
+	events := make(chan *FrameEvent, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := subscribe(ctx, s, func(ev *FrameEvent) error {
+		events <- ev
+		return nil
+	})
+	if waitSubscribed(phy, events) == nil {
+		t.Fatalf("SubscribeFrames never delivered a frame")
+	}
+
+	phy.inject(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	for {
+		select {
+		case ev := <-events:
+			if ev.Program != 0x6933 {
+				continue // Another of waitSubscribed's probes
+			}
+			if ev.Address != 0xDEADBEEF || ev.Rssi != -42 || string(ev.Data) != "SIXTY NINE" ||
+				ev.Direction != smacbase.DirRX || ev.Dropped != 0 {
+				t.Errorf("Unexpected event %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Frame was not streamed")
+		}
+		break
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("SubscribeFrames did not return after cancel")
+	}
+}
+
+func TestSubscribeFramesSendError(t *testing.T) {
+	s, phy := newTestServer(t)
+	gone := errors.New("client went away")
+	events := make(chan *FrameEvent, 1)
+	result := subscribe(context.Background(), s, func(ev *FrameEvent) error {
+		events <- ev
+		return gone
+	})
+	if waitSubscribed(phy, events) == nil {
+		t.Fatalf("SubscribeFrames never delivered a frame")
+	}
+	select {
+	case err := <-result:
+		if err != gone {
+			t.Errorf("Expected the send error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("SubscribeFrames did not return after send failed")
+	}
+}
+
+func TestSubscribeFramesDrops(t *testing.T) {
+	s, phy := newTestServer(t)
+	s.StreamDepth = 1
+	events := make(chan *FrameEvent, 16)
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribe(ctx, s, func(ev *FrameEvent) error {
+		events <- ev
+		if ev.Program == 0x6934 {
+			<-release // A slow client
+		}
+		return nil
+	})
+	if waitSubscribed(phy, events) == nil {
+		t.Fatalf("SubscribeFrames never delivered a frame")
+	}
+	phy.inject(0xDEADBEEF, 0x6934, nil)
+	for ev := range events {
+		if ev.Program == 0x6934 {
+			break // The client is now stuck sending it
+		}
+	}
+
+	for i := 0; i < 4; i++ { // One fits in the queue; the rest are dropped
+		phy.inject(0xDEADBEEF, 0x6933, []byte{byte(i)})
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Drops() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s.Drops() != 3 {
+		t.Fatalf("Drops() = %d, want 3", s.Drops())
+	}
+	close(release)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Program != 0x6933 {
+				continue
+			}
+			if ev.Dropped != 3 || ev.Data[0] != 0 {
+				t.Errorf("Expected the queued frame reporting 3 drops, got %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Queued frame was not streamed")
+		}
+		break
+	}
+	if st := s.Link.Stats(); st.InboxDrops != 0 {
+		t.Errorf("Client drops were counted in the LinkMgr's InboxDrops (%d)", st.InboxDrops)
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	s, phy := newTestServer(t)
+	if devs := s.ListDevices(); len(devs) != 0 {
+		t.Errorf("ListDevices without a registry = %+v", devs)
+	}
+
+	s.Devices = appdrivers.NewDeviceIdRegistration(s.Link)
+	phy.inject(0xBACE0042, smacbase.ProgDeviceID, []byte{0x42, 0x00, 'G', 'a', 'r', 'a', 'g', 'e'})
+	phy.inject(0xBACE0009, smacbase.ProgDeviceID, []byte{0x09, 0x00, 'Q', 'u', 'i', 'e', 't'})
+	deadline := time.Now().Add(time.Second)
+	for len(s.ListDevices()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	devs := s.ListDevices()
+	if len(devs) != 2 || devs[0].ID != 0x0009 || devs[0].Description != "Quiet" ||
+		devs[1].ID != 0x0042 || devs[1].Description != "Garage" || devs[1].LastSeen.IsZero() {
+		t.Errorf("Unexpected devices %+v", devs)
+	}
+}
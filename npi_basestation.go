@@ -0,0 +1,71 @@
+package smacbase
+
+import (
+	"fmt"
+	"io"
+)
+
+// npi_basestation.go - One-call startup of a configured base station
+
+// BaseStationConfig is everything StartBaseStation needs beyond the serial port itself
+type BaseStationConfig struct {
+	RadioConfig
+
+	// Setup, if set, is called once the link is open but before the radio is configured and RX switched on, so
+	// handlers registered there see every frame from the start.
+	Setup func(l *LinkMgr)
+
+	Options []Option // Passed along to NewLinkMgr
+
+	// DryRun, if set, replaces the serial port with a DryRunPHY logging here: the frames StartBaseStation (and
+	// anything done with the returned link) would send are shown rather than sent.
+	DryRun io.Writer
+}
+
+// DefaultBaseStationConfig returns the settings smacprint has always used: alternate address 0xBACE0001,
+// 902.8MHz, 12dBm, RX on.
+func DefaultBaseStationConfig() BaseStationConfig {
+	return BaseStationConfig{
+		RadioConfig: RadioConfig{
+			AlternateAddress: 0xBACE0001,
+			Frequency:        902800000,
+			Power:            12,
+			RxOn:             true,
+		},
+	}
+}
+
+// StartBaseStation opens the NPI link on path, flushes it, runs cfg.Setup and applies cfg's radio settings (with
+// retries), returning a link ready for use.  On failure the link is closed and the error says which step failed.
+func StartBaseStation(path string, baud uint, cfg BaseStationConfig) (*LinkMgr, error) {
+	if cfg.DryRun != nil {
+		return startBaseStation(func() (io.ReadWriteCloser, error) {
+			return NewDryRunPHY(cfg.DryRun), nil
+		}, cfg)
+	}
+	return startBaseStation(func() (io.ReadWriteCloser, error) {
+		return NewSerialPHY(path, baud, cfg.Options...)
+	}, cfg)
+}
+
+func startBaseStation(open PhyOpener, cfg BaseStationConfig) (*LinkMgr, error) {
+	l, err := NewLinkMgrPHY(open, cfg.Options...)
+	if err != nil {
+		return nil, err
+	}
+	// Clear out any badness in the UART buffers
+	err = l.Flush()
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("StartBaseStation: %w", err)
+	}
+	if cfg.Setup != nil {
+		cfg.Setup(l)
+	}
+	err = l.ApplyRadioConfig(cfg.RadioConfig)
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("StartBaseStation error configuring radio: %w", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,59 @@
+//go:build linux && (386 || amd64 || arm || arm64 || riscv64)
+// +build linux
+// +build 386 amd64 arm arm64 riscv64
+
+package smacbase
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+// npi_baud_linux.go - Line speed handling for serial PHYs on Linux.  The termios2 ioctl numbers below use the
+// asm-generic encoding; architectures with their own ioctl layout (mips, ppc64, sparc...) get npi_baud_other.go.
+
+// termios2 mirrors the kernel's struct termios2, which (unlike struct termios) carries arbitrary line speeds
+type termios2 struct {
+	cIflag  uint32
+	cOflag  uint32
+	cCflag  uint32
+	cLflag  uint32
+	cLine   uint8
+	cCc     [19]uint8
+	cIspeed uint32
+	cOspeed uint32
+}
+
+// ioctl numbers and c_cflag bits for termios2, as used by the go-serial library itself.  Only valid for the
+// architectures in this file's build constraint.
+const (
+	tcgets2  = 0x802C542A
+	tcsetsw2 = 0x402C542C // TCSETS2 after draining pending output
+	cbaud    = 0x100F
+	bother   = 0x1000
+)
+
+// setBaudRate changes the line speed of a serial port opened by NewSerialPHY.  Pending output is drained first so a
+// frame mid-write isn't garbled by the change.
+func setBaudRate(phy io.ReadWriteCloser, baud uint) error {
+	f, ok := phy.(interface{ Fd() uintptr })
+	if !ok {
+		return errors.New("PHY does not expose a file descriptor; cannot set baud rate")
+	}
+	var t termios2
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), tcgets2, uintptr(unsafe.Pointer(&t)))
+	if errno != 0 {
+		return errno
+	}
+	t.cCflag &^= cbaud
+	t.cCflag |= bother
+	t.cIspeed = uint32(baud)
+	t.cOspeed = uint32(baud)
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), tcsetsw2, uintptr(unsafe.Pointer(&t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || riscv64)
+// +build !linux !386,!amd64,!arm,!arm64,!riscv64
+
+package smacbase
+
+import (
+	"errors"
+	"io"
+)
+
+// npi_baud_other.go - Changing the line speed is only implemented where the termios2 ioctls in npi_baud_linux.go
+// are known to be right
+
+// setBaudRate is unsupported on this platform
+func setBaudRate(phy io.ReadWriteCloser, baud uint) error {
+	return errors.New("Changing the baud rate is not supported on this platform")
+}
@@ -0,0 +1,148 @@
+package smacbase
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// npi_dryrun.go - A PHY which shows what would be sent to the MCU instead of sending it, for previewing changes
+
+// DryRunPHY stands in for the NPI microcontroller without touching any hardware: each frame written to it is decoded
+// and logged to Log, and control requests are answered with CONTROL_STATUS_OK and an empty reply so the LinkMgr's
+// setters (SetFrequency, On, RunTx...) succeed.  GET_CAPABILITIES and GET_FLOW_STATE, which Flush and reconnection
+// ask on their own, are answered as firmware with no optional features and no flow control in effect.  Other queries
+// which need reply data, such as GetRadio, fail with a ReplySizeError.  No OTA frames are ever received.
+type DryRunPHY struct {
+	Log io.Writer
+
+	mutex    sync.Mutex
+	fromHost []byte
+	toHost   []byte
+	more     chan struct{}
+	closed   chan struct{}
+}
+
+// NewDryRunPHY creates a DryRunPHY logging to w; use it with NewLinkMgrPHY, or set BaseStationConfig.DryRun
+func NewDryRunPHY(w io.Writer) *DryRunPHY {
+	p := new(DryRunPHY)
+	p.Log = w
+	p.more = make(chan struct{}, 1)
+	p.closed = make(chan struct{})
+	return p
+}
+
+// dryRunControlNames labels the logged control requests
+var dryRunControlNames = map[uint8]string{
+	CONTROL_UNSQUELCH_HOST:     "UNSQUELCH_HOST",
+	CONTROL_SQUELCH_HOST:       "SQUELCH_HOST",
+	CONTROL_GET_RF:             "GET_RF",
+	CONTROL_SET_CENTERFREQ:     "SET_CENTERFREQ",
+	CONTROL_SET_TXPOWER:        "SET_TXPOWER",
+	CONTROL_SET_RF_ON:          "SET_RF_ON",
+	CONTROL_SET_ALTERNATE_ADDR: "SET_ALTERNATE_ADDR",
+	CONTROL_GET_ADDRESSES:      "GET_ADDRESSES",
+	CONTROL_RUN_TX:             "RUN_TX",
+	CONTROL_SET_TX_TICK:        "SET_TX_TICK",
+	CONTROL_GET_IDENTIFIER:     "GET_IDENTIFIER",
+	CONTROL_SET_LEDS:           "SET_LEDS",
+	CONTROL_GET_CAPABILITIES:   "GET_CAPABILITIES",
+	CONTROL_GET_FLOW_STATE:     "GET_FLOW_STATE",
+	CONTROL_LOG_MESSAGE:        "LOG_MESSAGE",
+	CONTROL_GET_MODULATION:     "GET_MODULATION",
+	CONTROL_SET_MODULATION:     "SET_MODULATION",
+}
+
+// dryRunReplies holds the reply data for the control requests DryRunPHY answers with more than an empty reply
+var dryRunReplies = map[uint8][]byte{
+	CONTROL_GET_CAPABILITIES: {0, 0, 0, 0}, // No capability bits
+	CONTROL_GET_FLOW_STATE:   {0},          // Unsquelched
+}
+
+// Read blocks until a control reply is pending, as a quiet MCU would
+func (p *DryRunPHY) Read(b []byte) (int, error) {
+	for {
+		p.mutex.Lock()
+		if len(p.toHost) > 0 {
+			n := copy(b, p.toHost)
+			p.toHost = p.toHost[n:]
+			p.mutex.Unlock()
+			return n, nil
+		}
+		p.mutex.Unlock()
+		select {
+		case <-p.more:
+		case <-p.closed:
+			return 0, errors.New("DryRunPHY closed")
+		}
+	}
+}
+
+// Write logs each complete frame in b instead of sending it
+func (p *DryRunPHY) Write(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, errors.New("DryRunPHY closed")
+	default:
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.fromHost = append(p.fromHost, b...)
+	for len(p.fromHost) > 0 {
+		var frameLen int
+		switch p.fromHost[0] {
+		case 0xBD:
+			if len(p.fromHost) < 3 {
+				return len(b), nil
+			}
+			frameLen = 4 + int(p.fromHost[2])
+		case 0xAE:
+			if len(p.fromHost) < 9 {
+				return len(b), nil
+			}
+			frameLen = 10 + int(p.fromHost[8])
+		default:
+			fmt.Fprintf(p.Log, "dry-run: stray byte %02X\n", p.fromHost[0])
+			p.fromHost = p.fromHost[1:]
+			continue
+		}
+		if len(p.fromHost) < frameLen {
+			return len(b), nil
+		}
+		frame := p.fromHost[:frameLen]
+		p.fromHost = p.fromHost[frameLen:]
+		if frame[0] == 0xAE {
+			f := decodeRadioFrame(frame, FrameFormatBasic)
+			fmt.Fprintf(p.Log, "dry-run: OTA dst=%08X prog=%04X data=[% X] wire=[% X]\n", f.Address, f.Program, f.Data, frame)
+			continue
+		}
+		cmd := frame[1]
+		name := dryRunControlNames[cmd]
+		if name == "" {
+			name = "UNKNOWN"
+		}
+		fmt.Fprintf(p.Log, "dry-run: CTRL %s(%02X) data=[% X] wire=[% X]\n", name, cmd, frame[3:len(frame)-1], frame)
+		if cmd == CONTROL_SQUELCH_HOST {
+			continue // An OK reply would squelch our own writer
+		}
+		data := dryRunReplies[cmd]
+		reply := append([]byte{0xBA, cmd, CONTROL_STATUS_OK, uint8(len(data))}, data...)
+		p.toHost = append(p.toHost, append(reply, XorBuffer(reply[1:]))...)
+		select {
+		case p.more <- struct{}{}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+// Close implements io.Closer
+func (p *DryRunPHY) Close() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	return nil
+}
@@ -1,10 +1,17 @@
 package smacbase
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -16,27 +23,82 @@ import (
  *
  * API:
  *
- * NewLinkMgr(phyPath, baudRate) (*LinkMgr, error) - Starts the PHY and LinkMgr goroutines; live NPI link is available upon successful return
- * *LinkMgr.Send(addr, progID, data) error - Submit an OTA frame (error only if PHY died)
- * *LinkMgr.RegisterProgramHandler(progID, handler) - Register a handler (object implementing FrameReceiver) to process RX frames with progID
+ * NewLinkMgr(phyPath, baudRate, opts...) (*LinkMgr, error) - Starts the PHY and LinkMgr goroutines; live NPI link is available upon successful return
+ * NewLinkMgrPHY(opener, opts...) (*LinkMgr, error) - Same as NewLinkMgr, atop any io.ReadWriteCloser PHY returned by opener
+ * DescribeOpenError(err, path) string - Operator advice for a failed serial port open (ErrPortNotFound/ErrPortPermission/ErrPortBusy)
+ * StartBaseStation(path, baud, cfg BaseStationConfig) (*LinkMgr, error) - Open, flush and configure a base station in one call
+ * NewDryRunPHY(w) *DryRunPHY - A PHY for NewLinkMgrPHY which logs the frames that would be sent instead of sending them
+ * *LinkMgr.EnableAutoReconnect(backoff) - Re-open the PHY after a fault (retrying with exponential backoff) instead of declaring the link dead
+ * *LinkMgr.Send(addr, progID, data) error - Submit an OTA frame to addr (error if PHY died or data exceeds MaxPayloadSize()); the firmware picks the source address
+ * *LinkMgr.SendContext(ctx, addr, progID, data) error - Like Send, returning ctx.Err() if ctx is done while waiting for room in the TX queue
+ * *LinkMgr.SendAck(addr, progID, data) error - Like Send, but waits for the PHY write to complete and reports its failure
+ * *LinkMgr.SetLoopbackTX(enabled) - Also pass each transmitted frame through RX dispatch (marked DirTX) for a bidirectional view
+ * *LinkMgr.SendMulti(addr, progID, payloads) error - Submit several OTA frames to addr contiguously (no other sends to addr interleave)
+ * *LinkMgr.SendAsync(addr, progID, data, done) / RunTxAsync(done) error - Send/RunTx from inside a FrameReceiver without blocking RX dispatch
+ * *LinkMgr.MaxPayloadSize() int - Largest payload Send will accept
+ * *LinkMgr.SendRaw(bytes) error - Write bytes to the PHY verbatim (debugging only; requires LinkMgr.AllowRawSend)
+ * *LinkMgr.Request(addr, reqProg, data, respProg, timeout) (*NpiRadioFrame, error) - Send a frame + RunTx, then wait for addr's reply bearing respProg
+ * *LinkMgr.WaitForFrame(ctx, addr) (*NpiRadioFrame, error) - Wait for the next frame from addr (or until ctx is done)
+ * *LinkMgr.RegisterProgramHandler(progID, handler) - Register a handler (object implementing FrameReceiver, or FrameReceiverFull for the whole *NpiRadioFrame) to process RX frames with progID
+ * *LinkMgr.RegisterDriver(driver) - Register a ProgramDriver as the handler for each progID listed by its ProgramIDs() method
+ * *LinkMgr.RegisterProgramRangeHandler(lo, hi, handler) - Register a handler for every progID in lo-hi (inclusive), consulted after exact progID matches
  * *LinkMgr.RegisterAddressHandler(addr, handler) - Register a handler to process RX frames coming from a specific IEEE address
+ * *LinkMgr.RegisterAddressMaskHandler(addr, mask, handler) - Register a handler for every address matching addr under mask, consulted when no exact address handler matches
+ * *LinkMgr.Inbox(addr, depth) (<-chan *NpiRadioFrame, func()) - Queue addr's frames on a channel for pull-style consumption; call the func to stop
+ * *LinkMgr.Subscribe(depth) (<-chan *NpiRadioFrame, func()) - Queue every frame on a channel (never short-circuited); call the func to stop
  * *LinkMgr.RegisterAllHandler(handler) - Add a handler to the "Firehose", which sees all frames unless a previous handler returned false (i.e. "do not process further")
+ * *LinkMgr.RegisterAuditHandler(handler) - Add a handler which sees every frame after the chain above, even if a handler returned false
+ * *LinkMgr.SetDispatchOrder(order) - Offer frames to address handlers before program handlers (DispatchAddressFirst) or after (the default); see FrameReceiver
+ * *LinkMgr.Register{Program,Address,All}HandlerContext(ctx, ...) - As above, but deregistered automatically once ctx is done
  * *LinkMgr.Ctrl(cmd uint8, data []byte) (status uint8, reply []byte, error) - Send a Control frame and wait for reply, returned as status & reply data.
+ * *LinkMgr.CtrlWithTimeout(cmd, data, timeout) - Like Ctrl, with its own reply timeout instead of the LinkMgr.DefaultCtrlTimeout field (3s if unset)
+ * *LinkMgr.CtrlContext(ctx, cmd, data) - Like Ctrl, also returning ctx.Err() as soon as ctx is done
+ * *LinkMgr.TryCtrl(cmd, data) - Like Ctrl, but fails with ErrTooManyPendingControls instead of waiting for an in-flight slot
+ * *LinkMgr.CtrlForget(cmd, data) error - Send a Control frame without waiting for the reply (still waits for room in the CtrlTX queue)
+ * *LinkMgr.TryCtrlForget(cmd, data) error - Like CtrlForget, but fails with ErrCtrlQueueFull instead of waiting
+ * *LinkMgr.SetMaxPendingControls(n) - Limit concurrently outstanding Ctrl() requests (default DefaultMaxPendingControls)
+ * *LinkMgr.CancelPendingControls() - Make every in-flight Ctrl() return ErrCanceled now instead of waiting out its timeout
+ * *LinkMgr.Flush() error - Unsquelch and resynchronize the link after opening it (clears UART cruft), then detect the OTA frame format
+ * *LinkMgr.Unsquelch() - Force-clear host-side flow control if the MCU's unsquelch went missing (see also WithMaxSquelch)
+ * *LinkMgr.SetBaudRate(baud) error - Change the serial PHY's line speed in place (serial PHYs on Linux x86, ARM and RISC-V only)
+ * *LinkMgr.Stats() Stats - Snapshot of link counters (frames received, frames dropped for bad checksum/length, Ctrl()
+ *     round-trip latency overall and per command, etc.)
+ * *LinkMgr.RXBacklog() / TXBacklog() int - Frames queued for the handlers / the PHY writer (high RX backlog = slow handlers)
+ * *LinkMgr.UnsolicitedControl() <-chan NpiControl - Control replies nobody was waiting for (e.g. MCU async notifications)
+ * *LinkMgr.MCUMessages() <-chan string - Debug text the firmware sends asynchronously (CONTROL_LOG_MESSAGE)
+ * *LinkMgr.RegisterControlObserver(func(NpiControl)) - Observe every control reply from the MCU, after RunNPI has handled it
+ * *LinkMgr.Health() HealthStatus - Link up/down, time since last frame & control reply, reconnects; suitable for a liveness probe
  *
- * *LinkMgr.DeregisterHandler(handler) - Remove the specified handler from ALL handler registries, including firehose (only way to remove one from firehose)
+ * *LinkMgr.SetDispatchTrace(enabled) - Record which handlers each received frame went to and what they returned (debugging)
+ * *LinkMgr.DispatchTraces() <-chan DispatchTrace - The per-frame traces recorded while SetDispatchTrace is enabled
+ *
+ * *LinkMgr.Registrations() RegistrySnapshot - Copy of every handler registry, e.g. to save the handler topology
+ * *LinkMgr.ReplaceRegistry(reg) - Atomically swap in a whole new set of registries (frames see all old or all new handlers)
+ * *LinkMgr.PauseDispatch() / ResumeDispatch() - Hold received frames in FrameRX instead of handing them to the handlers, e.g. while reconfiguring several of them
+ *
+ * *LinkMgr.DeregisterHandler(handler) - Remove the specified handler from ALL handler registries, including firehose and audit (only way to remove one from those)
  * *LinkMgr.DeregisterProgramHandler(progID) - Remove the handler for a specific progID
+ * *LinkMgr.DeregisterProgramRangeHandler(lo, hi) - Remove the handler(s) for a specific progID range
  * *LinkMgr.DeregisterAddressHandler(addr) - Remove the handler for a specific IEEE address
+ * *LinkMgr.DeregisterAddressMaskHandler(addr, mask) - Remove the handler(s) for a specific address/mask
  *
  * High-level Control API:
  * *LinkMgr.GetRadio() (bool, uint32, int8, uint16) - Returns RX ON/OFF, Center Frequency, TXpower (dBm), Auto-TX tick interval (ms)
  * *LinkMgr.GetAddresses() (uint32, uint32) - Returns IEEE address, Alternate address (or 0 if not set)
+ * *LinkMgr.GetCapabilities() (Capabilities, error) - Returns the firmware's optional feature flags (ErrCapabilitiesUnsupported on old firmware)
  * *LinkMgr.GetIdentifier() (string) - Returns the NPI microcontroller's compiled ID string
+ * *LinkMgr.Info() (StationInfo) - Identifier, radio config and addresses in one call (partial results on a *StationInfoError)
+ * *LinkMgr.GetFlowControlState() (bool) - Returns whether the MCU has the host squelched (re-syncs the PHY writer; checked on reconnect)
  * *LinkMgr.SetAlternateAddress(uint32) - Sets the secondary radio address, or disables it if 0
  * *LinkMgr.SetFrequency(uint32) (error) - Sets the RF center frequency
+ * *LinkMgr.SetFrequencyMHz(float64) (error) - Sets the RF center frequency in MHz, checked against SupportedBands
  * *LinkMgr.SetPower(int8) (error) - Sets the TX power in dBm (supported values -10, 0-12, 14 if NPI firmware compiled with CCFG_FORCE_VDDR_HH=1)
+ * *LinkMgr.GetModulation() (ModulationMode) / SetModulation(ModulationMode) - Radio data rate/modulation, e.g. Long Range Mode (ErrModulationUnsupported if the firmware can't)
  * *LinkMgr.SetTxInterval(uint16) - Sets the interval (in milliseconds) between automatic ticks of the TX request, or disables it with 0
- * *LinkMgr.RunTx() - Manually trigger a TX if any frames are waiting in the TX queue
+ * *LinkMgr.RunTx() (int) - Manually trigger a TX if any frames are waiting in the TX queue; returns the count transmitted (RunTxUnknown on older firmware)
  * *LinkMgr.On(bool) - Switch RX on/off
+ * *LinkMgr.Identify(time.Duration) - Blink the LEDs for a while so an operator can find this base station, then restore them
+ * *LinkMgr.ApplyRadioConfig(RadioConfig) - Apply alternate address, frequency, power and RX on/off in one go; re-applied after a reconnect
  *
  * ^ All these control API functions have an additional (error) argument at the end of their reply set, or if there is no reply set listed, it's the only argument.
  *   This will inform the user if the NPI PHY faulted or if there was a non-OK status code returned by the NPI microcontroller.
@@ -51,14 +113,97 @@ type LinkMgr struct {
 	CtrlTX  chan *NpiControl
 	NpiDied chan struct{}
 
+	AllowRawSend bool // Must be set for SendRaw to work; it can put arbitrary (malformed) bytes on the wire
+	DebugCtrl    bool // Log the reply bytes of control commands the MCU refuses (see CtrlStatusError)
+
+	// DefaultCtrlTimeout is how long Ctrl, and every control call built on it (GetRadio, SetFrequency...), waits for
+	// the MCU's reply; 0 means 3 seconds.  Set it before issuing control requests.
+	DefaultCtrlTimeout time.Duration
+
+	// Per-destination send serialization (Send, SendMulti)
+	destMutex sync.Mutex
+	destLocks map[uint32]*destinationLock
+
 	// Registry of RX frame receivers
 	registryMutex     sync.Mutex
 	RxRegistryProgram map[uint16]FrameReceiver
+	RxRegistryRange   []ProgramRangeHandler // Consulted in registration order after RxRegistryProgram
 	RxRegistryAddress map[uint32]FrameReceiver
-	RxFirehose        []FrameReceiver // All frames process through this list after the Program, Address-specific handlers have run
+	RxRegistryMask    []AddressMaskHandler // Consulted in registration order when no RxRegistryAddress entry matches
+	RxFirehose        []FrameReceiver      // All frames process through this list after the Program, Address-specific handlers have run
+	RxAudit           []FrameReceiver      // Always run after the chain above, regardless of short-circuit
+	waiters           []*frameWaiter       // One-shot observers (e.g. Request) offered each frame before the registries
+
+	stats       *NpiStats
+	unsolicited chan NpiControl
+	mcuMessages chan string
+	unsquelch   chan struct{}    // Unsquelch requests for the PHY writer; see Unsquelch
+	flowTX      chan *NpiControl // CONTROL_GET_FLOW_STATE requests, which bypass CtrlTX; see GetFlowControlState
+
+	ctrlTap       chan NpiControl    // Every control reply, from RunNPI; fanned out to ctrlObservers
+	loopbackTX    bool               // Guarded by registryMutex; see SetLoopbackTX
+	dispatchTrace bool               // Guarded by registryMutex; see SetDispatchTrace
+	dispatchOrder DispatchOrder      // Guarded by registryMutex; see SetDispatchOrder
+	traces        chan DispatchTrace // See DispatchTraces
+	ctrlObservers []func(NpiControl) // Guarded by registryMutex
+
+	asyncOnce sync.Once
+	async     chan func() // SendAsync/RunTxAsync operations for runAsync; created on first use
+
+	capabilities *Capabilities      // Cached by GetCapabilities; nil until firmware has reported them
+	rxFormat     *frameFormatSwitch // OTA frame layout the reader parses, following CapFrameLQI
+
+	ledMutex sync.Mutex
+	ledsOff  bool // As last set with SetLEDs, for Identify to restore
+
+	pauseMutex sync.Mutex
+	resumed    chan struct{} // Non-nil while dispatch is paused; closed by ResumeDispatch
+
+	ctrlCancelMutex sync.Mutex
+	ctrlCancel      chan struct{} // Closed by CancelPendingControls; replaced lazily for subsequent Ctrl calls
+
+	ctrlSemMutex sync.Mutex
+	ctrlSem      chan struct{} // One token per in-flight Ctrl; capacity is the SetMaxPendingControls limit
+
+	// PHY session management; see npi_reconnect.go
+	sessionMutex sync.Mutex
+	openPhy      PhyOpener
+	phyOpts      []Option
+	sessionUp    bool             // A RunNPI session is running over an open PHY
+	reconnect    ReconnectBackoff // Zero = NpiDied closes on the first PHY fault
+	// Progress of the current outage, for Health
+	reconnectAttempts int          // Failed reconnect attempts so far
+	nextReconnect     time.Time    // Zero while the session is up
+	radioConfig       *RadioConfig // Last configuration passed to ApplyRadioConfig, re-applied after a reconnect
+}
+
+// frameWaiter is a one-shot observer for the next frame satisfying match
+type frameWaiter struct {
+	match func(*NpiRadioFrame) bool
+	ch    chan *NpiRadioFrame
 }
 
 // FrameReceiver is an interface used to handle incoming RX frames.
+//
+// Each received frame is offered to the registered handlers in this order, one frame at a time on a single goroutine:
+//
+//  1. the program handler registered for its exact program ID, if any
+//  2. each program range handler covering its program ID, in registration order
+//  3. the address handler registered for its exact source address or, only if there is none, each address mask
+//     handler matching it, in registration order
+//  4. each firehose handler (RegisterAllHandler), in registration order
+//  5. each audit handler (RegisterAuditHandler), in registration order
+//
+// Handlers must not block for long: the next frame isn't dispatched until they return.  In particular, use SendAsync
+// and RunTxAsync rather than Send and RunTx to transmit from within Receive.
+//
+// A handler returning false skips every remaining handler in steps 1-4, so e.g. a program handler which consumes a
+// frame hides it from the address handler and the firehose.  Audit handlers always see the frame and their return
+// value is ignored.  SetDispatchOrder(DispatchAddressFirst) swaps steps 1-2 with step 3.
+//
+// The registries identify a handler by comparing it with ==, e.g. in DeregisterHandler and the Register*Context
+// methods, so a handler must be of a comparable type: a pointer, or a value type without slice, map or func fields.
+// Comparing two handlers of the same non-comparable type panics.
 type FrameReceiver interface {
 	// Receive is called automatically by the LinkMgr with a pointer to the LinkMgr (for sending frames or controlling the link),
 	// the RSSI, the SrcAddr, ProgramID, data payload, and the implementation should return a bool for whether the LinkMgr
@@ -66,32 +211,142 @@ type FrameReceiver interface {
 	Receive(*LinkMgr, int8, uint32, uint16, []byte) bool
 }
 
-// NewLinkMgr gets the ball rolling and starts the PHY in a goroutine (RunNPI), along with its RX manager
-func NewLinkMgr(phyPath string, baudRate uint) (*LinkMgr, error) {
-	phy, err := NewSerialPHY(phyPath, baudRate)
+// FrameReceiverFull is an optional extension of FrameReceiver for handlers wanting the whole received frame, including
+// its FrameMeta (LQI, Direction, raw bytes), rather than its fields one by one.  When a registered handler implements
+// it, ReceiveFrame is called in place of Receive, at the same point in dispatch and with the same meaning for its
+// return value.  The frame is shared with the other handlers: don't modify it, and copy anything kept after returning.
+type FrameReceiverFull interface {
+	FrameReceiver
+	ReceiveFrame(*LinkMgr, *NpiRadioFrame) bool
+}
+
+// ProgramDriver is a FrameReceiver which declares the program IDs it handles, so it can be wired up with RegisterDriver
+type ProgramDriver interface {
+	FrameReceiver
+	ProgramIDs() []uint16
+}
+
+// ProgramRangeHandler binds a FrameReceiver to an inclusive block of program IDs
+type ProgramRangeHandler struct {
+	Lo, Hi  uint16
+	Handler FrameReceiver
+}
+
+// AddressMaskHandler binds a FrameReceiver to every address matching Address under Mask
+type AddressMaskHandler struct {
+	Address, Mask uint32
+	Handler       FrameReceiver
+}
+
+// NewLinkMgr gets the ball rolling and starts the PHY in a goroutine (RunNPI), along with its RX manager.
+// Any opts are passed along to NewSerialPHY and RunNPI.
+func NewLinkMgr(phyPath string, baudRate uint, opts ...Option) (*LinkMgr, error) {
+	return NewLinkMgrPHY(func() (io.ReadWriteCloser, error) {
+		return NewSerialPHY(phyPath, baudRate, opts...)
+	}, opts...)
+}
+
+// PhyOpener opens (or re-opens, for automatic reconnection) the PHY underneath a LinkMgr
+type PhyOpener func() (io.ReadWriteCloser, error)
+
+// NewLinkMgrPHY is like NewLinkMgr but runs atop any PHY, such as a test harness.  The opener is retained so
+// EnableAutoReconnect can re-open the PHY after a fault.
+func NewLinkMgrPHY(open PhyOpener, opts ...Option) (*LinkMgr, error) {
+	phy, err := open()
 	if err != nil {
-		return nil, errors.New("NewLinkMgr error creating PHY: " + err.Error())
+		return nil, newPhyOpenError(err)
 	}
 
+	cfg := newNpiOptions(opts)
 	l := new(LinkMgr)
-	l.FrameTX = make(chan *NpiRadioFrame)
-	l.FrameRX = make(chan *NpiRadioFrame)
-	l.CtrlTX = make(chan *NpiControl)
+	l.FrameTX = make(chan *NpiRadioFrame, cfg.txDepth)
+	l.FrameRX = make(chan *NpiRadioFrame, cfg.rxDepth)
+	l.CtrlTX = make(chan *NpiControl, cfg.ctrlDepth)
 	l.NpiDied = make(chan struct{})
-	l.Phy = phy
+	l.stats = NewNpiStats()
+	l.unsolicited = make(chan NpiControl, 16)
+	l.mcuMessages = make(chan string, 64)
+	l.unsquelch = make(chan struct{}, 1)
+	l.flowTX = make(chan *NpiControl, 1)
+	l.ctrlTap = make(chan NpiControl, 64)
+	l.traces = make(chan DispatchTrace, 64)
+	l.rxFormat = new(frameFormatSwitch)
+	l.rxFormat.store(cfg.frameFormat)
+	l.openPhy = open
+	l.phyOpts = append([]Option{WithStats(l.stats), WithUnsolicitedControl(l.unsolicited), WithMCUMessages(l.mcuMessages),
+		withForceUnsquelch(l.unsquelch), withFlowStateRequests(l.flowTX), withControlTap(l.ctrlTap),
+		withFrameFormatSwitch(l.rxFormat)}, opts...)
 
 	l.RxRegistryProgram = make(map[uint16]FrameReceiver)
 	l.RxRegistryAddress = make(map[uint32]FrameReceiver)
 
-	go RunNPI(phy, l.FrameTX, l.FrameRX, l.CtrlTX, l.NpiDied)
+	ready := l.startSession(phy)
+	go l.runControlObservers()
 	// Launch a goroutine which dispatches received RX frames
 	err = l.ExecRxHandler()
 	if err != nil {
 		return nil, errors.New("NewLinkMgr error starting RX Handler: " + err.Error())
 	}
+	<-ready // Don't hand back a LinkMgr whose first Send or Ctrl could stall waiting on goroutine startup
+	if cfg.ready != nil {
+		close(cfg.ready) // startSession gave RunNPI its own ready channel in place of the caller's
+	}
 	return l, nil
 }
 
+// Sentinels for common PHY-open failures; test with errors.Is on the error from NewLinkMgr.  The underlying error
+// (e.g. the *os.PathError from the serial library) remains reachable with errors.As.
+var (
+	ErrPortNotFound   = errors.New("serial port does not exist")
+	ErrPortPermission = errors.New("permission denied opening serial port")
+	ErrPortBusy       = errors.New("serial port is busy")
+)
+
+// phyOpenError wraps a PHY-open failure, matching one of the ErrPort* sentinels where the cause is recognized
+type phyOpenError struct {
+	sentinel error
+	err      error
+}
+
+func newPhyOpenError(err error) error {
+	e := &phyOpenError{err: err}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		e.sentinel = ErrPortNotFound
+	case errors.Is(err, os.ErrPermission):
+		e.sentinel = ErrPortPermission
+	case errors.Is(err, syscall.EBUSY):
+		e.sentinel = ErrPortBusy
+	}
+	return e
+}
+
+func (e *phyOpenError) Error() string {
+	return fmt.Sprintf("NewLinkMgr error creating PHY: %v", e.err)
+}
+
+func (e *phyOpenError) Unwrap() error {
+	return e.err
+}
+
+func (e *phyOpenError) Is(target error) bool {
+	return e.sentinel != nil && target == e.sentinel
+}
+
+// DescribeOpenError returns advice for an operator whose serial port at path failed to open with err (one of the
+// ErrPort* sentinels), or "" if there's nothing more useful to say than err itself
+func DescribeOpenError(err error, path string) string {
+	switch {
+	case errors.Is(err, ErrPortNotFound):
+		return "Check the --device path; is the dongle plugged in?"
+	case errors.Is(err, ErrPortPermission):
+		return fmt.Sprintf("Check your permissions on %s (e.g. membership in the dialout group)", path)
+	case errors.Is(err, ErrPortBusy):
+		return fmt.Sprintf("Another program has %s open", path)
+	}
+	return ""
+}
+
 // Close will stop the NPI link
 func (l *LinkMgr) Close() error {
 	select {
@@ -103,27 +358,500 @@ func (l *LinkMgr) Close() error {
 	return nil
 }
 
-// Send is used by clients to transmit a radio frame over the air
+// ErrPayloadTooLarge is returned by Send when the payload won't fit in a single OTA frame
+var ErrPayloadTooLarge = errors.New("payload exceeds maximum OTA frame payload size")
+
+// MaxPayloadSize returns the largest data payload Send will accept, so callers can size their chunks accordingly
+func (l *LinkMgr) MaxPayloadSize() int {
+	return MaxPayload
+}
+
+// Send is used by clients to transmit a radio frame over the air to dstAddr.  The source address of the transmitted
+// frame is chosen by the NPI firmware, not the host.  It blocks while FrameTX is full, e.g. while the MCU has the
+// host squelched, so FrameReceivers should use SendAsync instead: blocking in Receive stalls all RX dispatch.
 func (l *LinkMgr) Send(dstAddr uint32, program uint16, data []byte) error {
+	return l.SendContext(context.Background(), dstAddr, program, data)
+}
+
+// SendContext is Send, giving up with ctx.Err() if ctx is done before the frame is accepted into FrameTX, including
+// while it waits behind another Send to the same dstAddr
+func (l *LinkMgr) SendContext(ctx context.Context, dstAddr uint32, program uint16, data []byte) error {
+	unlock, err := l.lockDestinationContext(ctx, dstAddr)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return l.sendContext(ctx, dstAddr, program, data, nil)
+}
+
+// SendAck is like Send but waits until the PHY writer has actually written the frame, returning the write error if it
+// failed.  Note a squelched link (MCU flow control) delays the return until the MCU unsquelches.
+func (l *LinkMgr) SendAck(dstAddr uint32, program uint16, data []byte) error {
+	unlock := l.lockDestination(dstAddr)
+	defer unlock()
+	result := make(chan error, 1)
+	err := l.send(dstAddr, program, data, func(err error) { result <- err })
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-result:
+		if err != nil {
+			return fmt.Errorf("NPI PHY write failed: %w", err)
+		}
+		return nil
+	case <-l.NpiDied:
+		return errors.New("NPI PHY link faulted")
+	}
+}
+
+// SendMulti transmits several frames to dstAddr back-to-back.  No other Send or SendMulti to the same dstAddr is
+// interleaved between them, so multi-frame messages reach the node contiguously; sends to other addresses proceed
+// concurrently.  Every payload is size-checked before any frame is submitted.
+func (l *LinkMgr) SendMulti(dstAddr uint32, program uint16, payloads [][]byte) error {
+	for _, data := range payloads {
+		if len(data) > l.MaxPayloadSize() {
+			return ErrPayloadTooLarge
+		}
+	}
+	unlock := l.lockDestination(dstAddr)
+	defer unlock()
+	for _, data := range payloads {
+		err := l.send(dstAddr, program, data, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send submits a single frame to the PHY writer; txDone (may be nil) becomes the frame's TxDone callback
+func (l *LinkMgr) send(dstAddr uint32, program uint16, data []byte, txDone func(error)) error {
+	return l.sendContext(context.Background(), dstAddr, program, data, txDone)
+}
+
+// sendContext is send, abandoning the wait for room in FrameTX once ctx is done or the link dies
+func (l *LinkMgr) sendContext(ctx context.Context, dstAddr uint32, program uint16, data []byte, txDone func(error)) error {
 	// Do a quick select to see if l.NpiDied was closed
 	select {
 	case <-l.NpiDied:
 		return errors.New("NPI PHY link faulted")
 	default:
 	}
+	if len(data) > l.MaxPayloadSize() {
+		return ErrPayloadTooLarge
+	}
 	// Send a new frame to the SMac NPI microcontroller
 	radioFrame := NewRadioFrame(dstAddr, program, data)
-	l.FrameTX <- radioFrame
-	return nil
+	l.registryMutex.Lock()
+	loopback := l.loopbackTX
+	l.registryMutex.Unlock()
+	if loopback {
+		txDone = l.loopbackTxDone(radioFrame, txDone)
+	}
+	radioFrame.TxDone = txDone
+	select {
+	case l.FrameTX <- radioFrame:
+		return nil
+	case <-l.NpiDied:
+		return errors.New("NPI PHY link faulted")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrAsyncQueueFull is returned by SendAsync and RunTxAsync when too many operations are already waiting their turn
+var ErrAsyncQueueFull = errors.New("async send queue full")
+
+// asyncQueueDepth is how many SendAsync/RunTxAsync operations may wait for the async worker
+const asyncQueueDepth = 64
+
+// SendAsync is Send for use inside FrameReceiver.Receive (e.g. to answer a request), where blocking would stall
+// every other frame's dispatch.  The frame is queued for a background worker, which performs it and any other
+// SendAsync and RunTxAsync calls one at a time in the order they were made.  Each frame is sent with SendAck, so the
+// worker moves on only once the PHY has written it, and done (if not nil) is called with SendAck's result.  data is
+// copied, so the caller may reuse it.  SendAsync itself never blocks: it fails with ErrPayloadTooLarge or, when the
+// worker is too far behind (e.g. while the MCU has the host squelched), ErrAsyncQueueFull.  Operations still queued
+// when the link closes are discarded without calling done.
+func (l *LinkMgr) SendAsync(dstAddr uint32, program uint16, data []byte, done func(error)) error {
+	if len(data) > l.MaxPayloadSize() {
+		return ErrPayloadTooLarge
+	}
+	data = append([]byte(nil), data...)
+	return l.queueAsync(func() {
+		err := l.SendAck(dstAddr, program, data)
+		if done != nil {
+			done(err)
+		}
+	})
+}
+
+// RunTxAsync is RunTx for use inside FrameReceiver.Receive; see SendAsync.  It runs once every SendAsync made before
+// it has been written to the PHY, so their frames are included in the transmission.  done (if not nil) is called
+// with RunTx's results.
+func (l *LinkMgr) RunTxAsync(done func(int, error)) error {
+	return l.queueAsync(func() {
+		sent, err := l.RunTx()
+		if done != nil {
+			done(sent, err)
+		}
+	})
+}
+
+// queueAsync hands op to the async worker, starting it if need be
+func (l *LinkMgr) queueAsync(op func()) error {
+	select {
+	case <-l.NpiDied:
+		return errors.New("NPI PHY link faulted")
+	default:
+	}
+	l.asyncOnce.Do(func() {
+		l.async = make(chan func(), asyncQueueDepth)
+		go l.runAsync()
+	})
+	select {
+	case l.async <- op:
+		return nil
+	default:
+		return ErrAsyncQueueFull
+	}
+}
+
+// runAsync performs queued SendAsync/RunTxAsync operations in order until the link is closed
+func (l *LinkMgr) runAsync() {
+	for {
+		select {
+		case <-l.NpiDied:
+			return
+		case op := <-l.async:
+			op()
+		}
+	}
+}
+
+// SetLoopbackTX makes every frame subsequently transmitted with Send (and its variants) also pass through the RX
+// dispatch path once the PHY has written it, marked with Direction DirTX, so firehose and audit handlers, loggers and
+// Subscribe channels see both directions of traffic.  Echoes skip the one-shot waiters (WaitForFrame, Request) and the
+// program, range, address and mask handlers (Inbox included), which would take them for the node's own frames.
+// FrameReceivers aren't given the direction; the address is the frame's destination and the RSSI is 0.  Frames sent
+// with SendRaw are never echoed.  Off by default.
+func (l *LinkMgr) SetLoopbackTX(enabled bool) {
+	l.registryMutex.Lock()
+	l.loopbackTX = enabled
+	l.registryMutex.Unlock()
+}
+
+// loopbackTxDone wraps txDone so a copy of frame, as it stands now, is queued for RX dispatch once it's been written.
+// This runs on the PHY writer, so the copy is dropped rather than waiting for room in FrameRX.
+func (l *LinkMgr) loopbackTxDone(frame *NpiRadioFrame, txDone func(error)) func(error) {
+	echo := NewRadioFrame(frame.Address, frame.Program, append([]byte(nil), frame.Data...))
+	echo.Direction = DirTX
+	return func(err error) {
+		if err == nil {
+			select {
+			case l.FrameRX <- echo:
+			default:
+				l.stats.update(func(s *Stats) { s.LoopbackDrops++ })
+			}
+		}
+		if txDone != nil {
+			txDone(err)
+		}
+	}
+}
+
+// destinationLock serializes sends to a single destination address.  It is a 1-slot semaphore rather than a mutex so
+// a waiter can give up when its context is done.
+type destinationLock struct {
+	held chan struct{}
+	refs int
+}
+
+// lockDestination takes the per-destination send lock for addr and returns the function which releases it.  Locks
+// are discarded once nobody holds or waits on them, so the map only tracks destinations with sends in progress.
+func (l *LinkMgr) lockDestination(addr uint32) func() {
+	unlock, _ := l.lockDestinationContext(context.Background(), addr)
+	return unlock
+}
+
+// lockDestinationContext is lockDestination, giving up with ctx.Err() if ctx is done before the lock is free
+func (l *LinkMgr) lockDestinationContext(ctx context.Context, addr uint32) (func(), error) {
+	l.destMutex.Lock()
+	if l.destLocks == nil {
+		l.destLocks = make(map[uint32]*destinationLock)
+	}
+	d := l.destLocks[addr]
+	if d == nil {
+		d = &destinationLock{held: make(chan struct{}, 1)}
+		l.destLocks[addr] = d
+	}
+	d.refs++
+	l.destMutex.Unlock()
+
+	release := func() {
+		l.destMutex.Lock()
+		d.refs--
+		if d.refs == 0 {
+			delete(l.destLocks, addr)
+		}
+		l.destMutex.Unlock()
+	}
+	select {
+	case d.held <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-d.held
+		release()
+	}, nil
+}
+
+// RequestTimeout is an error denoting timeout in Request()
+type RequestTimeout string
+
+func (r RequestTimeout) Error() string { return string(r) }
+
+// Request sends an OTA frame with program reqProg to dstAddr, triggers TX, and waits up to timeout for the first frame
+// from dstAddr carrying program respProg.  The reply is still passed through the handler registries as usual.
+func (l *LinkMgr) Request(dstAddr uint32, reqProg uint16, data []byte, respProg uint16, timeout time.Duration) (*NpiRadioFrame, error) {
+	w := l.addWaiter(func(f *NpiRadioFrame) bool {
+		return f.Address == dstAddr && f.Program == respProg
+	})
+	defer l.removeWaiter(w)
+
+	err := l.Send(dstAddr, reqProg, data)
+	if err != nil {
+		return nil, err
+	}
+	_, err = l.RunTx()
+	if err != nil {
+		return nil, err
+	}
+
+	tck := time.After(timeout)
+	select {
+	case <-l.NpiDied:
+		return nil, errors.New("NPI PHY link faulted")
+	case f := <-w.ch:
+		return f, nil
+	case <-tck:
+		return nil, RequestTimeout("Request TIMEOUT")
+	}
+}
+
+// WaitForFrame blocks until the next frame from addr is received, returning it, or until ctx is done (returning
+// ctx.Err()).  Only frames received after the call count.  Like Request, it observes the frame without consuming it;
+// the handler registries still process it as usual.
+func (l *LinkMgr) WaitForFrame(ctx context.Context, addr uint32) (*NpiRadioFrame, error) {
+	w := l.addWaiter(func(f *NpiRadioFrame) bool {
+		return f.Address == addr
+	})
+	defer l.removeWaiter(w)
+
+	select {
+	case <-l.NpiDied:
+		return nil, errors.New("NPI PHY link faulted")
+	case f := <-w.ch:
+		return f, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// addWaiter registers a one-shot observer for the next frame satisfying match
+func (l *LinkMgr) addWaiter(match func(*NpiRadioFrame) bool) *frameWaiter {
+	w := &frameWaiter{match: match, ch: make(chan *NpiRadioFrame, 1)}
+	l.registryMutex.Lock()
+	l.waiters = append(l.waiters, w)
+	l.registryMutex.Unlock()
+	return w
+}
+
+// removeWaiter forgets w if it hasn't fired yet
+func (l *LinkMgr) removeWaiter(w *frameWaiter) {
+	l.registryMutex.Lock()
+	defer l.registryMutex.Unlock()
+	for i, v := range l.waiters {
+		if v == w {
+			l.waiters = append(l.waiters[:i:i], l.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// ErrRawSendDisabled is returned by SendRaw unless LinkMgr.AllowRawSend is set
+var ErrRawSendDisabled = errors.New("SendRaw requires LinkMgr.AllowRawSend")
+
+// SendRaw writes b to the PHY verbatim, with no framing or checksum, in sequence with frames from Send.  This is
+// intended for protocol experimentation such as fuzzing the MCU's parser, and requires AllowRawSend to be set.
+func (l *LinkMgr) SendRaw(b []byte) error {
+	if !l.AllowRawSend {
+		return ErrRawSendDisabled
+	}
+	// Do a quick select to see if l.NpiDied was closed
+	select {
+	case <-l.NpiDied:
+		return errors.New("NPI PHY link faulted")
+	default:
+	}
+	radioFrame := new(NpiRadioFrame)
+	radioFrame.raw = make([]byte, len(b))
+	copy(radioFrame.raw, b)
+	select {
+	case l.FrameTX <- radioFrame:
+		return nil
+	case <-l.NpiDied:
+		return errors.New("NPI PHY link faulted")
+	}
+}
+
+// UnsolicitedControl returns a channel carrying control replies that arrived with no Ctrl() waiting for them, such
+// as asynchronous notifications from the MCU.  Replies are dropped (but still counted in Stats) if it isn't drained.
+func (l *LinkMgr) UnsolicitedControl() <-chan NpiControl {
+	return l.unsolicited
+}
+
+// MCUMessages returns a channel carrying the debug text the firmware sends unprompted as CONTROL_LOG_MESSAGE frames,
+// one message per frame.  These don't show up on UnsolicitedControl.  Messages are dropped (counted in
+// Stats().MCUMessageDrops) if it isn't drained.
+func (l *LinkMgr) MCUMessages() <-chan string {
+	return l.mcuMessages
+}
+
+// RegisterControlObserver adds a function to be called with every control reply from the MCU (solicited or not,
+// flow control included) after RunNPI has dispatched it, e.g. for a protocol analyzer.  Observers run in their own
+// goroutine, in registration order; if they fall behind, replies are dropped rather than stalling RunNPI (counted in
+// Stats().CtrlObserverDrops).  The Reply slice is shared with the Ctrl caller, so treat it as read-only.
+func (l *LinkMgr) RegisterControlObserver(observer func(NpiControl)) {
+	if observer == nil {
+		return
+	}
+	l.registryMutex.Lock()
+	l.ctrlObservers = append(l.ctrlObservers, observer)
+	l.registryMutex.Unlock()
+}
+
+// runControlObservers feeds control replies tapped from RunNPI to the registered observers until the link is closed
+func (l *LinkMgr) runControlObservers() {
+	for {
+		select {
+		case <-l.NpiDied:
+			return
+		case rep := <-l.ctrlTap:
+			l.registryMutex.Lock()
+			observers := l.ctrlObservers
+			l.registryMutex.Unlock()
+			for _, observer := range observers {
+				observer(rep)
+			}
+		}
+	}
+}
+
+// SetBaudRate changes the line speed of the open serial PHY without tearing down the LinkMgr.  Output already queued
+// to the port is drained before the change.  This is specific to PHYs opened by NewSerialPHY on Linux x86, ARM or
+// RISC-V; any other PHY or platform returns an error.  The MCU side must be switched to the same rate separately, and a
+// PHY re-opened by auto-reconnect comes back at the rate given to NewLinkMgr.
+func (l *LinkMgr) SetBaudRate(baud uint) error {
+	if baud == 0 {
+		return errors.New("SetBaudRate: invalid baud rate 0")
+	}
+	l.sessionMutex.Lock()
+	defer l.sessionMutex.Unlock()
+	return setBaudRate(l.Phy, baud)
+}
+
+// Stats returns a snapshot of the link counters
+func (l *LinkMgr) Stats() Stats {
+	s := l.stats.Snapshot()
+	s.RXBacklog = l.RXBacklog()
+	s.TXBacklog = l.TXBacklog()
+	return s
+}
+
+// RXBacklog returns the number of received frames waiting for the handlers.  A backlog that stays high means the
+// registered handlers are too slow to keep up with the radio.
+func (l *LinkMgr) RXBacklog() int {
+	return len(l.FrameRX)
+}
+
+// TXBacklog returns the number of frames waiting to be written to the PHY, e.g. while the MCU has squelched the host
+func (l *LinkMgr) TXBacklog() int {
+	return len(l.FrameTX)
 }
 
 // CtrlTimeout is an error denoting timeout in Ctrl()
 type CtrlTimeout string
 
+// fallbackCtrlTimeout applies when LinkMgr.DefaultCtrlTimeout is unset
+const fallbackCtrlTimeout = 3 * time.Second
+
 func (c CtrlTimeout) Error() string { return string(c) }
 
-// Ctrl submits a control frame to the NPI microcontroller, then returns the (status, return data) reply.
+// DefaultMaxPendingControls is the default limit on concurrently outstanding Ctrl requests
+const DefaultMaxPendingControls = 4
+
+// ErrTooManyPendingControls is returned by TryCtrl when SetMaxPendingControls requests are already in flight
+var ErrTooManyPendingControls = errors.New("too many control requests in flight")
+
+// SetMaxPendingControls bounds how many Ctrl requests may be outstanding at once; further Ctrl calls wait for a slot
+// (TryCtrl fails instead).  Requests already in flight are unaffected by a change.  n < 1 is treated as 1.
+func (l *LinkMgr) SetMaxPendingControls(n int) {
+	if n < 1 {
+		n = 1
+	}
+	l.ctrlSemMutex.Lock()
+	l.ctrlSem = make(chan struct{}, n)
+	l.ctrlSemMutex.Unlock()
+}
+
+// ctrlSlots returns the current in-flight semaphore, creating it with the default limit if need be
+func (l *LinkMgr) ctrlSlots() chan struct{} {
+	l.ctrlSemMutex.Lock()
+	defer l.ctrlSemMutex.Unlock()
+	if l.ctrlSem == nil {
+		l.ctrlSem = make(chan struct{}, DefaultMaxPendingControls)
+	}
+	return l.ctrlSem
+}
+
+// trackCtrlSlot counts a slot just taken from sem in Stats().CtrlInFlight, returning the function which releases it
+func (l *LinkMgr) trackCtrlSlot(sem chan struct{}) func() {
+	l.stats.update(func(s *Stats) { s.CtrlInFlight++ })
+	return func() {
+		<-sem
+		l.stats.update(func(s *Stats) { s.CtrlInFlight-- })
+	}
+}
+
+// Ctrl submits a control frame to the NPI microcontroller, then returns the (status, return data) reply.  It blocks
+// for an in-flight slot (see SetMaxPendingControls), for room in the CtrlTX queue and then for the reply, giving up
+// only if the link dies, the request is canceled or the reply takes longer than DefaultCtrlTimeout.
+//
+// Replies carry no request ID, so once a call has given up its reply is treated as lost.  Should it turn up late
+// while another call with the same command is waiting, that call gets it as its own answer, and its real reply is
+// then taken the same way or reported as unsolicited.  Keep DefaultCtrlTimeout well above the MCU's worst-case
+// response time where a stale reply would matter.
 func (l *LinkMgr) Ctrl(cmd uint8, data []byte) (uint8, []byte, error) {
+	return l.CtrlWithTimeout(cmd, data, l.DefaultCtrlTimeout)
+}
+
+// CtrlWithTimeout is Ctrl, waiting at most timeout for the reply (once the request is submitted) rather than
+// DefaultCtrlTimeout.  A timeout of 0 or less means DefaultCtrlTimeout.
+func (l *LinkMgr) CtrlWithTimeout(cmd uint8, data []byte, timeout time.Duration) (uint8, []byte, error) {
+	return l.ctrlContext(context.Background(), cmd, data, timeout)
+}
+
+// CtrlContext is Ctrl, also giving up with ctx.Err() as soon as ctx is done, at any stage of the call.  The reply
+// timeout still applies; ctx can only shorten it.
+func (l *LinkMgr) CtrlContext(ctx context.Context, cmd uint8, data []byte) (uint8, []byte, error) {
+	return l.ctrlContext(ctx, cmd, data, l.DefaultCtrlTimeout)
+}
+
+// ctrlContext implements Ctrl, CtrlWithTimeout and CtrlContext
+func (l *LinkMgr) ctrlContext(ctx context.Context, cmd uint8, data []byte, timeout time.Duration) (uint8, []byte, error) {
 	// Do a quick select to see if l.NpiDied was closed
 	select {
 	case <-l.NpiDied:
@@ -131,21 +859,108 @@ func (l *LinkMgr) Ctrl(cmd uint8, data []byte) (uint8, []byte, error) {
 	default:
 	}
 
+	canceled := l.ctrlCancelChan()
+	sem := l.ctrlSlots()
+	select {
+	case sem <- struct{}{}:
+	case <-l.NpiDied:
+		return cmd, nil, errors.New("NPI PHY link faulted")
+	case <-canceled:
+		return cmd, nil, ErrCanceled
+	case <-ctx.Done():
+		return cmd, nil, ctx.Err()
+	}
+	defer l.trackCtrlSlot(sem)()
+	return l.ctrl(ctx, cmd, data, canceled, timeout)
+}
+
+// TryCtrl is like Ctrl, but fails with ErrTooManyPendingControls rather than waiting for an in-flight slot
+func (l *LinkMgr) TryCtrl(cmd uint8, data []byte) (uint8, []byte, error) {
+	select {
+	case <-l.NpiDied:
+		return cmd, nil, errors.New("NPI PHY link faulted")
+	default:
+	}
+
+	canceled := l.ctrlCancelChan()
+	sem := l.ctrlSlots()
+	select {
+	case sem <- struct{}{}:
+	default:
+		return cmd, nil, ErrTooManyPendingControls
+	}
+	defer l.trackCtrlSlot(sem)()
+	return l.ctrl(context.Background(), cmd, data, canceled, l.DefaultCtrlTimeout)
+}
+
+// ctrl performs one control round-trip once the caller holds an in-flight slot
+func (l *LinkMgr) ctrl(ctx context.Context, cmd uint8, data []byte, canceled chan struct{}, timeout time.Duration) (uint8, []byte, error) {
+	if timeout <= 0 {
+		timeout = l.DefaultCtrlTimeout
+	}
+	if timeout <= 0 {
+		timeout = fallbackCtrlTimeout
+	}
 	cmdFrame := NewControl(cmd, data)
-	l.CtrlTX <- cmdFrame
-	tck := time.After(time.Second * 3)
+	tx := l.ctrlChan(cmd)
+	select {
+	case tx <- cmdFrame:
+	case <-l.NpiDied:
+		return cmd, nil, errors.New("NPI PHY link faulted")
+	case <-canceled:
+		return cmd, nil, ErrCanceled
+	case <-ctx.Done():
+		return cmd, nil, ctx.Err()
+	}
+	sent := time.Now()
+	tck := time.After(timeout)
 	select {
 	case <-l.NpiDied:
 		return cmd, nil, errors.New("NPI PHY link faulted")
+	case <-canceled:
+		cmdFrame.abandon()
+		return cmd, nil, ErrCanceled
+	case <-ctx.Done():
+		cmdFrame.abandon()
+		return cmd, nil, ctx.Err()
 	case <-cmdFrame.PendChan:
+		l.stats.recordCtrlLatency(cmd, time.Since(sent))
+		l.stats.update(func(s *Stats) { s.LastCtrlReply = time.Now() })
 		return cmdFrame.Status, cmdFrame.Reply, nil
 	case <-tck:
 		// Timeout
+		cmdFrame.abandon()
 		return cmd, nil, CtrlTimeout("Ctrl TIMEOUT")
 	}
 }
 
-// CtrlForget sends a control frame and returns immediately, ignoring the results
+// ErrCanceled is returned by Ctrl calls aborted by CancelPendingControls
+var ErrCanceled = errors.New("control request canceled")
+
+// ctrlCancelChan returns the channel CancelPendingControls will close to abort the Ctrl calls now starting
+func (l *LinkMgr) ctrlCancelChan() chan struct{} {
+	l.ctrlCancelMutex.Lock()
+	defer l.ctrlCancelMutex.Unlock()
+	if l.ctrlCancel == nil {
+		l.ctrlCancel = make(chan struct{})
+	}
+	return l.ctrlCancel
+}
+
+// CancelPendingControls makes every Ctrl call currently waiting (to submit its request or for the reply) return
+// ErrCanceled immediately, e.g. for a fast shutdown.  Ctrl calls made afterward are unaffected.  A reply which
+// arrives later for a canceled request is discarded.
+func (l *LinkMgr) CancelPendingControls() {
+	l.ctrlCancelMutex.Lock()
+	defer l.ctrlCancelMutex.Unlock()
+	if l.ctrlCancel != nil {
+		close(l.ctrlCancel)
+		l.ctrlCancel = nil
+	}
+}
+
+// CtrlForget sends a control frame without waiting for the reply, which is ignored.  It does block until the request
+// fits in the CtrlTX queue (see WithCtrlQueueDepth); use TryCtrlForget where even that is unacceptable.
 func (l *LinkMgr) CtrlForget(cmd uint8, data []byte) error {
 	// Do a quick select to see if l.NpiDied was closed
 	select {
@@ -154,35 +969,313 @@ func (l *LinkMgr) CtrlForget(cmd uint8, data []byte) error {
 	default:
 	}
 
-	cmdFrame := NewControl(cmd, data)
-	l.CtrlTX <- cmdFrame
+	tx := l.ctrlChan(cmd)
+	select {
+	case tx <- newForgetControl(cmd, data):
+	case <-l.NpiDied:
+		return errors.New("NPI PHY link faulted")
+	}
+	return nil
+}
+
+// ErrCtrlQueueFull is returned by TryCtrlForget when the CtrlTX queue has no room
+var ErrCtrlQueueFull = errors.New("control TX queue is full")
+
+// TryCtrlForget is like CtrlForget, but fails with ErrCtrlQueueFull rather than waiting for room in the CtrlTX queue
+func (l *LinkMgr) TryCtrlForget(cmd uint8, data []byte) error {
+	select {
+	case <-l.NpiDied:
+		return errors.New("NPI PHY link faulted")
+	default:
+	}
+
+	select {
+	case l.ctrlChan(cmd) <- newForgetControl(cmd, data):
+		return nil
+	default:
+		return ErrCtrlQueueFull
+	}
+}
+
+// newForgetControl builds a control frame nobody will wait on.  It starts out abandoned, so RunNPI's reply registry
+// treats it like a timed-out Ctrl: its reply is absorbed if it comes, and it is dropped from the queue if not.
+func newForgetControl(cmd uint8, data []byte) *NpiControl {
+	n := NewControl(cmd, data)
+	n.abandon()
+	return n
+}
+
+// ctrlChan returns the channel a request for cmd is handed to RunNPI on: CtrlTX, except for CONTROL_GET_FLOW_STATE,
+// which must reach the MCU even when the writer is squelched and CtrlTX is backed up behind it
+func (l *LinkMgr) ctrlChan(cmd uint8) chan *NpiControl {
+	if cmd == CONTROL_GET_FLOW_STATE && l.flowTX != nil {
+		return l.flowTX
+	}
+	return l.CtrlTX
+}
+
+// Flush brings the link to a known state, e.g. right after opening a serial port which may hold partial frames in
+// either direction.  An unsquelch is sent (which also terminates any partial frame the MCU's parser is holding and
+// clears host-side flow control), then a GET_RF round-trip is attempted up to 3 times to prove both ends are
+// parsing frames in sync again.  Finally GetCapabilities is asked which OTA frame layout the firmware emits (see
+// CapFrameLQI), so received frames parse correctly whichever firmware build is attached.
+func (l *LinkMgr) Flush() error {
+	err := l.CtrlForget(CONTROL_UNSQUELCH_HOST, nil)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		_, _, err = l.Ctrl(CONTROL_GET_RF, nil)
+		if _, ok := err.(CtrlTimeout); !ok {
+			break
+		}
+	}
+	if err != nil {
+		return errors.New("Flush error: " + err.Error())
+	}
+	l.detectFrameFormat()
 	return nil
 }
 
-// RegisterProgramHandler adds a FrameReceiver to the program ID registry for handling RX frames.
-func (l *LinkMgr) RegisterProgramHandler(progID uint16, handler FrameReceiver) {
-	l.registryMutex.Lock()
-	l.RxRegistryProgram[progID] = handler
-	l.registryMutex.Unlock()
+// detectFrameFormat has GetCapabilities select the reader's frame format.  Should the query fail, the format in use
+// is kept.
+func (l *LinkMgr) detectFrameFormat() {
+	if _, err := l.GetCapabilities(); err != nil && err != ErrCapabilitiesUnsupported {
+		log.Printf("LinkMgr: can't detect the OTA frame format: %v", err)
+	}
+}
+
+// Unsquelch clears host-side flow control without waiting for the MCU, for when its unsquelch was lost and sends are
+// piling up (see TXBacklog).  Unlike Flush, nothing is sent to the MCU first, since a squelched writer couldn't send
+// it.  A no-op if the writer isn't squelched.
+func (l *LinkMgr) Unsquelch() {
+	select {
+	case l.unsquelch <- struct{}{}:
+	default: // One is already pending
+	}
+}
+
+// RegisterProgramHandler adds a FrameReceiver to the program ID registry for handling RX frames.
+// As with all the Register* methods, registering a nil handler is a no-op; use the Deregister* methods to remove one.
+func (l *LinkMgr) RegisterProgramHandler(progID uint16, handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	l.registryMutex.Lock()
+	l.RxRegistryProgram[progID] = handler
+	l.registryMutex.Unlock()
+}
+
+// RegisterDriver registers d as the program handler for each of its declared program IDs
+func (l *LinkMgr) RegisterDriver(d ProgramDriver) {
+	if d == nil {
+		return
+	}
+	for _, progID := range d.ProgramIDs() {
+		l.RegisterProgramHandler(progID, d)
+	}
+}
+
+// RegisterProgramRangeHandler adds a FrameReceiver for every program ID in the inclusive range lo-hi.  Range handlers
+// are consulted after the exact-match program handler and before the address handler; overlapping ranges dispatch in
+// registration order.
+func (l *LinkMgr) RegisterProgramRangeHandler(lo, hi uint16, handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	l.registryMutex.Lock()
+	l.RxRegistryRange = append(l.RxRegistryRange, ProgramRangeHandler{Lo: lo, Hi: hi, Handler: handler})
+	l.registryMutex.Unlock()
+}
+
+// RegisterAddressHandler adds a FrameReceiver to the address registry for handling RX frames.
+func (l *LinkMgr) RegisterAddressHandler(addr uint32, handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	l.registryMutex.Lock()
+	l.RxRegistryAddress[addr] = handler
+	l.registryMutex.Unlock()
+}
+
+// RegisterAddressMaskHandler adds a FrameReceiver for every source address where (address & mask) == (addr & mask),
+// e.g. addr=0xBACE0000 mask=0xFFFF0000 for a whole subnet.  Mask handlers are only consulted when no exact-match
+// address handler exists for the frame; overlapping masks dispatch in registration order.
+func (l *LinkMgr) RegisterAddressMaskHandler(addr, mask uint32, handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	l.registryMutex.Lock()
+	l.RxRegistryMask = append(l.RxRegistryMask, AddressMaskHandler{Address: addr & mask, Mask: mask, Handler: handler})
+	l.registryMutex.Unlock()
+}
+
+// inboxHandler forwards frames from the dispatch loop into a buffered channel drained by an Inbox caller
+type inboxHandler struct {
+	mutex  sync.Mutex
+	ch     chan *NpiRadioFrame
+	closed bool
+	stats  *NpiStats
+}
+
+// Receive implements FrameReceiver
+func (h *inboxHandler) Receive(l *LinkMgr, rssi int8, srcAddr uint32, progID uint16, payload []byte) bool {
+	return h.ReceiveFrame(l, &NpiRadioFrame{Address: srcAddr, Program: progID, Rssi: rssi, Data: payload})
+}
+
+// ReceiveFrame implements FrameReceiverFull, queueing a copy of otaFrame with its FrameMeta (e.g. Direction) intact
+func (h *inboxHandler) ReceiveFrame(l *LinkMgr, otaFrame *NpiRadioFrame) bool {
+	n := &NpiRadioFrame{Address: otaFrame.Address, Program: otaFrame.Program, Rssi: otaFrame.Rssi, Data: otaFrame.Data,
+		FrameMeta: otaFrame.FrameMeta}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return true
+	}
+	select {
+	case h.ch <- n:
+	default:
+		h.stats.update(func(s *Stats) { s.InboxDrops++ })
+	}
+	return true
+}
+
+func (h *inboxHandler) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.closed {
+		h.closed = true
+		close(h.ch)
+	}
+}
+
+// Inbox registers an address handler for addr which queues its frames (up to depth of them) on the returned channel,
+// so a slow consumer drains them on its own goroutine instead of stalling the dispatch loop.  Frames arriving while
+// the inbox is full are dropped and counted in Stats().InboxDrops.  Like RegisterAddressHandler, it replaces any
+// handler already registered for addr.  Call the returned function to deregister the inbox and close the channel.
+func (l *LinkMgr) Inbox(addr uint32, depth int) (<-chan *NpiRadioFrame, func()) {
+	h := &inboxHandler{ch: make(chan *NpiRadioFrame, depth), stats: l.stats}
+	l.RegisterAddressHandler(addr, h)
+	return h.ch, func() {
+		l.DeregisterHandler(h)
+		h.close()
+	}
+}
+
+// Subscribe is the all-frames analog of Inbox: every received frame (registered as an audit handler, so it is seen
+// even when a handler consumes it) is queued on the returned channel, up to depth of them, dropping and counting in
+// Stats().InboxDrops when full.  Call the returned function to unsubscribe and close the channel.
+func (l *LinkMgr) Subscribe(depth int) (<-chan *NpiRadioFrame, func()) {
+	h := &inboxHandler{ch: make(chan *NpiRadioFrame, depth), stats: l.stats}
+	l.RegisterAuditHandler(h)
+	return h.ch, func() {
+		l.DeregisterHandler(h)
+		h.close()
+	}
+}
+
+// RegisterAllHandler adds a universal frame handler to the "Firehose"
+func (l *LinkMgr) RegisterAllHandler(handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	l.registryMutex.Lock()
+	defer l.registryMutex.Unlock()
+	for _, hndl := range l.RxFirehose {
+		if hndl == handler {
+			return // No need to add since we already have it in the firehose?
+		}
+	}
+	l.RxFirehose = append(l.RxFirehose, handler)
+}
+
+// RegisterAuditHandler adds a handler which sees every frame after the normal handler chain completes, even when an
+// earlier handler returned false.  Its own return value is ignored.  Intended for logging and metrics.
+func (l *LinkMgr) RegisterAuditHandler(handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	l.registryMutex.Lock()
+	defer l.registryMutex.Unlock()
+	for _, hndl := range l.RxAudit {
+		if hndl == handler {
+			return
+		}
+	}
+	l.RxAudit = append(l.RxAudit, handler)
+}
+
+// RegisterProgramHandlerContext is RegisterProgramHandler, with the registration undone once ctx is done.  If handler
+// has been replaced for progID in the meantime, the replacement is left alone.  As with the other Register*Context
+// methods, handler must be comparable (see FrameReceiver); a handler of a non-comparable type panics here.
+func (l *LinkMgr) RegisterProgramHandlerContext(ctx context.Context, progID uint16, handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	requireComparable("RegisterProgramHandlerContext", handler)
+	l.RegisterProgramHandler(progID, handler)
+	l.deregisterOnDone(ctx, func() {
+		if l.RxRegistryProgram[progID] == handler {
+			delete(l.RxRegistryProgram, progID)
+		}
+	})
+}
+
+// RegisterAddressHandlerContext is RegisterAddressHandler, with the registration undone once ctx is done.  If handler
+// has been replaced for addr in the meantime, the replacement is left alone.
+func (l *LinkMgr) RegisterAddressHandlerContext(ctx context.Context, addr uint32, handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	requireComparable("RegisterAddressHandlerContext", handler)
+	l.RegisterAddressHandler(addr, handler)
+	l.deregisterOnDone(ctx, func() {
+		if l.RxRegistryAddress[addr] == handler {
+			delete(l.RxRegistryAddress, addr)
+		}
+	})
+}
+
+// RegisterAllHandlerContext is RegisterAllHandler, with handler removed from the firehose once ctx is done
+func (l *LinkMgr) RegisterAllHandlerContext(ctx context.Context, handler FrameReceiver) {
+	if handler == nil {
+		return
+	}
+	requireComparable("RegisterAllHandlerContext", handler)
+	l.RegisterAllHandler(handler)
+	l.deregisterOnDone(ctx, func() {
+		var newFirehose []FrameReceiver
+		for _, hndl := range l.RxFirehose {
+			if hndl != handler {
+				newFirehose = append(newFirehose, hndl)
+			}
+		}
+		l.RxFirehose = newFirehose
+	})
 }
 
-// RegisterAddressHandler adds a FrameReceiver to the address registry for handling RX frames.
-func (l *LinkMgr) RegisterAddressHandler(addr uint32, handler FrameReceiver) {
-	l.registryMutex.Lock()
-	l.RxRegistryAddress[addr] = handler
-	l.registryMutex.Unlock()
+// requireComparable panics, in the registering caller's goroutine, if handler can't be found again with == once its
+// context is done; otherwise the panic would come later from deregisterOnDone's goroutine and take the process down
+func requireComparable(op string, handler FrameReceiver) {
+	if !reflect.TypeOf(handler).Comparable() {
+		panic(fmt.Sprintf("smacbase: %s: handler type %T is not comparable; register a pointer to it instead", op, handler))
+	}
 }
 
-// RegisterAllHandler adds a universal frame handler to the "Firehose"
-func (l *LinkMgr) RegisterAllHandler(handler FrameReceiver) {
-	l.registryMutex.Lock()
-	defer l.registryMutex.Unlock()
-	for _, hndl := range l.RxFirehose {
-		if hndl == handler {
-			return // No need to add since we already have it in the firehose?
+// deregisterOnDone runs remove under registryMutex once ctx is done, unless the LinkMgr is closed first
+func (l *LinkMgr) deregisterOnDone(ctx context.Context, remove func()) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.registryMutex.Lock()
+			remove()
+			l.registryMutex.Unlock()
+		case <-l.NpiDied:
 		}
-	}
-	l.RxFirehose = append(l.RxFirehose, handler)
+	}()
 }
 
 // DeregisterHandler searches all the registries to delete a handler
@@ -193,16 +1286,34 @@ func (l *LinkMgr) DeregisterHandler(handler FrameReceiver) bool {
 	l.registryMutex.Lock()
 	for k, v := range l.RxRegistryProgram {
 		if handler == v {
-			l.RxRegistryProgram[k] = nil
+			delete(l.RxRegistryProgram, k)
 			didPurge = true
 		}
 	}
+	var newRange []ProgramRangeHandler
+	for _, r := range l.RxRegistryRange {
+		if r.Handler != handler {
+			newRange = append(newRange, r)
+		} else {
+			didPurge = true
+		}
+	}
+	l.RxRegistryRange = newRange
 	for k, v := range l.RxRegistryAddress {
 		if handler == v {
-			l.RxRegistryAddress[k] = nil
+			delete(l.RxRegistryAddress, k)
+			didPurge = true
+		}
+	}
+	var newMask []AddressMaskHandler
+	for _, m := range l.RxRegistryMask {
+		if m.Handler != handler {
+			newMask = append(newMask, m)
+		} else {
 			didPurge = true
 		}
 	}
+	l.RxRegistryMask = newMask
 	var newFirehose []FrameReceiver
 	for _, hndl := range l.RxFirehose {
 		if hndl != handler {
@@ -212,6 +1323,15 @@ func (l *LinkMgr) DeregisterHandler(handler FrameReceiver) bool {
 		}
 	}
 	l.RxFirehose = newFirehose
+	var newAudit []FrameReceiver
+	for _, hndl := range l.RxAudit {
+		if hndl != handler {
+			newAudit = append(newAudit, hndl)
+		} else {
+			didPurge = true
+		}
+	}
+	l.RxAudit = newAudit
 	l.registryMutex.Unlock()
 	return didPurge
 }
@@ -223,13 +1343,35 @@ func (l *LinkMgr) DeregisterProgramHandler(progID uint16) bool {
 
 	l.registryMutex.Lock()
 	if l.RxRegistryProgram[progID] != nil {
-		l.RxRegistryProgram[progID] = nil
+		delete(l.RxRegistryProgram, progID)
 		didPurge = true
 	}
 	l.registryMutex.Unlock()
 	return didPurge
 }
 
+// DeregisterProgramRangeHandler removes every range handler registered for exactly lo-hi
+func (l *LinkMgr) DeregisterProgramRangeHandler(lo, hi uint16) bool {
+	var didPurge bool
+	didPurge = false
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	l.registryMutex.Lock()
+	var newRange []ProgramRangeHandler
+	for _, r := range l.RxRegistryRange {
+		if r.Lo != lo || r.Hi != hi {
+			newRange = append(newRange, r)
+		} else {
+			didPurge = true
+		}
+	}
+	l.RxRegistryRange = newRange
+	l.registryMutex.Unlock()
+	return didPurge
+}
+
 // DeregisterAddressHandler removes the handler for the specified address, if present
 func (l *LinkMgr) DeregisterAddressHandler(addr uint32) bool {
 	var didPurge bool
@@ -237,14 +1379,123 @@ func (l *LinkMgr) DeregisterAddressHandler(addr uint32) bool {
 
 	l.registryMutex.Lock()
 	if l.RxRegistryAddress[addr] != nil {
-		l.RxRegistryAddress[addr] = nil
+		delete(l.RxRegistryAddress, addr)
 		didPurge = true
 	}
 	l.registryMutex.Unlock()
 	return didPurge
 }
 
-// ExecRxHandler spawns a goroutine that monitors inbound RX frames
+// DeregisterAddressMaskHandler removes every mask handler registered for exactly addr/mask
+func (l *LinkMgr) DeregisterAddressMaskHandler(addr, mask uint32) bool {
+	var didPurge bool
+	didPurge = false
+
+	l.registryMutex.Lock()
+	var newMask []AddressMaskHandler
+	for _, m := range l.RxRegistryMask {
+		if m.Address != addr&mask || m.Mask != mask {
+			newMask = append(newMask, m)
+		} else {
+			didPurge = true
+		}
+	}
+	l.RxRegistryMask = newMask
+	l.registryMutex.Unlock()
+	return didPurge
+}
+
+// DispatchTrace records, in order, every handler a received frame was dispatched to and what each returned.  See
+// SetDispatchTrace.
+type DispatchTrace struct {
+	Frame *NpiRadioFrame
+	Steps []DispatchStep
+}
+
+// DispatchStep is one handler invocation within a DispatchTrace
+type DispatchStep struct {
+	Stage   string // Registry the handler was found in: "program", "range", "address", "mask", "firehose" or "audit"
+	Handler string // The handler's type, e.g. "*appdrivers.TemperatureHumidity"
+	Result  bool   // What it returned; false ends the chain (audit handlers run regardless)
+}
+
+// SetDispatchTrace turns per-frame dispatch tracing on or off.  While it is on, a DispatchTrace of each received frame
+// is sent to the DispatchTraces channel once all its handlers have run, which shows where frames that "vanish" were
+// swallowed.  Tracing is meant for debugging: traces which don't fit in the channel are dropped and counted in
+// Stats().DispatchTraceDrops.
+func (l *LinkMgr) SetDispatchTrace(enabled bool) {
+	l.registryMutex.Lock()
+	l.dispatchTrace = enabled
+	l.registryMutex.Unlock()
+}
+
+// DispatchTraces returns the channel SetDispatchTrace's traces are delivered on
+func (l *LinkMgr) DispatchTraces() <-chan DispatchTrace {
+	return l.traces
+}
+
+// RegistrySnapshot is a copy of every handler registry, for saving and restoring (or wholesale replacing) the handler
+// topology with Registrations and ReplaceRegistry.  Inbox and Subscribe are implemented as registered handlers, so
+// they appear here too.
+type RegistrySnapshot struct {
+	Program  map[uint16]FrameReceiver
+	Range    []ProgramRangeHandler
+	Address  map[uint32]FrameReceiver
+	Mask     []AddressMaskHandler
+	Firehose []FrameReceiver
+	Audit    []FrameReceiver
+}
+
+// copy returns a deep copy of r's maps and slices (the handlers themselves are shared), with nil maps made empty
+func (r RegistrySnapshot) copy() RegistrySnapshot {
+	c := RegistrySnapshot{
+		Program:  make(map[uint16]FrameReceiver, len(r.Program)),
+		Range:    append([]ProgramRangeHandler(nil), r.Range...),
+		Address:  make(map[uint32]FrameReceiver, len(r.Address)),
+		Mask:     append([]AddressMaskHandler(nil), r.Mask...),
+		Firehose: append([]FrameReceiver(nil), r.Firehose...),
+		Audit:    append([]FrameReceiver(nil), r.Audit...),
+	}
+	for k, v := range r.Program {
+		c.Program[k] = v
+	}
+	for k, v := range r.Address {
+		c.Address[k] = v
+	}
+	return c
+}
+
+// Registrations returns a copy of the current handler registries
+func (l *LinkMgr) Registrations() RegistrySnapshot {
+	l.registryMutex.Lock()
+	defer l.registryMutex.Unlock()
+	return RegistrySnapshot{
+		Program:  l.RxRegistryProgram,
+		Range:    l.RxRegistryRange,
+		Address:  l.RxRegistryAddress,
+		Mask:     l.RxRegistryMask,
+		Firehose: l.RxFirehose,
+		Audit:    l.RxAudit,
+	}.copy()
+}
+
+// ReplaceRegistry swaps every handler registry for (a copy of) reg in one step, e.g. to hot-reload the driver
+// configuration: each frame is dispatched entirely to the old handlers or entirely to the new ones, never a mix.
+// A frame already being dispatched when the swap happens finishes with the old handlers.  Any Inbox or Subscribe
+// left out of reg stops receiving frames.
+func (l *LinkMgr) ReplaceRegistry(reg RegistrySnapshot) {
+	c := reg.copy()
+	l.registryMutex.Lock()
+	l.RxRegistryProgram = c.Program
+	l.RxRegistryRange = c.Range
+	l.RxRegistryAddress = c.Address
+	l.RxRegistryMask = c.Mask
+	l.RxFirehose = c.Firehose
+	l.RxAudit = c.Audit
+	l.registryMutex.Unlock()
+}
+
+// ExecRxHandler spawns a goroutine that monitors inbound RX frames, returning once it is running
 func (l *LinkMgr) ExecRxHandler() error {
 	// Do a quick select to see if l.NpiDied was closed
 	select {
@@ -253,48 +1504,266 @@ func (l *LinkMgr) ExecRxHandler() error {
 	default:
 	}
 
+	started := make(chan struct{})
 	go func(l *LinkMgr) {
+		close(started)
 		for {
 			select {
 			case <-l.NpiDied:
 				return
 			case otaFrame := <-l.FrameRX:
-				var handler FrameReceiver
-				l.registryMutex.Lock()
-				handler = l.RxRegistryProgram[otaFrame.Program]
-				l.registryMutex.Unlock()
-				if handler != nil {
-					ret := handler.Receive(l, otaFrame.Rssi, otaFrame.Address, otaFrame.Program, otaFrame.Data)
-					if !ret {
-						continue // Do not attempt processing the frame any more
-					}
-				}
-				l.registryMutex.Lock()
-				handler = l.RxRegistryAddress[otaFrame.Address]
-				l.registryMutex.Unlock()
-				if handler != nil {
-					ret := handler.Receive(l, otaFrame.Rssi, otaFrame.Address, otaFrame.Program, otaFrame.Data)
-					if !ret {
-						continue // Do not attempt processing the frame any more
-					}
-				}
-				l.registryMutex.Lock()
-				firehoseList := l.RxFirehose
-				l.registryMutex.Unlock()
-				for _, handler = range firehoseList {
-					ret := handler.Receive(l, otaFrame.Rssi, otaFrame.Address, otaFrame.Program, otaFrame.Data)
-					if !ret {
-						break // Do not attempt processing the frame any more
-					}
+				if !l.waitDispatchResumed() {
+					return
 				}
+				l.dispatch(otaFrame)
 			}
 		}
 	}(l)
+	<-started
 	return nil
 }
 
+// PauseDispatch stops received frames being handed to the handlers until ResumeDispatch is called, e.g. so several
+// handlers can be reconfigured without a frame seeing some of the changes but not others.  A frame already being
+// dispatched when it is called isn't interrupted.  The link stays up and frames accumulate in FrameRX meanwhile, but
+// once FrameRX is full (see WithQueueDepth) the PHY reader stalls behind it, delaying control replies too (Ctrl calls
+// may time out) and dropping echoed transmissions (Stats().LoopbackDrops), so keep pauses short.  The stall doesn't
+// count against WithFrameGapTimeout, so frames straddling it aren't lost however long the pause.
+func (l *LinkMgr) PauseDispatch() {
+	l.pauseMutex.Lock()
+	defer l.pauseMutex.Unlock()
+	if l.resumed == nil {
+		l.resumed = make(chan struct{})
+	}
+}
+
+// ResumeDispatch resumes handing received frames to the handlers after PauseDispatch, starting with those which
+// accumulated in FrameRX while paused
+func (l *LinkMgr) ResumeDispatch() {
+	l.pauseMutex.Lock()
+	defer l.pauseMutex.Unlock()
+	if l.resumed != nil {
+		close(l.resumed)
+		l.resumed = nil
+	}
+}
+
+// waitDispatchResumed blocks while dispatch is paused, returning false if the link dies meanwhile
+func (l *LinkMgr) waitDispatchResumed() bool {
+	l.pauseMutex.Lock()
+	resumed := l.resumed
+	l.pauseMutex.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-l.NpiDied:
+		return false
+	}
+}
+
+// dispatch runs a received frame through the handler chain, then hands it to every audit handler unconditionally.
+func (l *LinkMgr) dispatch(otaFrame *NpiRadioFrame) {
+	view := l.dispatchView(otaFrame)
+	l.dispatchChain(otaFrame, view)
+
+	for _, handler := range view.audit {
+		if handler != nil {
+			view.run(l, "audit", handler, otaFrame)
+		}
+	}
+	if view.trace != nil {
+		select {
+		case l.traces <- *view.trace:
+		default:
+			l.stats.update(func(s *Stats) { s.DispatchTraceDrops++ })
+		}
+	}
+}
+
+// dispatchTargets holds every handler a frame could be dispatched to, captured in one go so that a registration
+// change (notably ReplaceRegistry) takes effect between frames rather than part-way through one
+type dispatchTargets struct {
+	program  FrameReceiver
+	ranges   []ProgramRangeHandler
+	address  FrameReceiver
+	masks    []AddressMaskHandler
+	firehose []FrameReceiver
+	audit    []FrameReceiver
+	order    DispatchOrder
+	trace    *DispatchTrace // nil unless SetDispatchTrace is enabled
+}
+
+// run delivers otaFrame to handler, recording the step if the frame is being traced
+func (v *dispatchTargets) run(l *LinkMgr, stage string, handler FrameReceiver, otaFrame *NpiRadioFrame) bool {
+	ret := l.deliver(handler, otaFrame)
+	if v.trace != nil {
+		v.trace.Steps = append(v.trace.Steps, DispatchStep{Stage: stage, Handler: fmt.Sprintf("%T", handler), Result: ret})
+	}
+	return ret
+}
+
+// dispatchView offers a received frame to any one-shot waiters, then captures the registries' handlers for it.  A
+// loopback echo (DirTX) is only captured for the firehose and audit handlers; see SetLoopbackTX.
+func (l *LinkMgr) dispatchView(otaFrame *NpiRadioFrame) *dispatchTargets {
+	l.registryMutex.Lock()
+	defer l.registryMutex.Unlock()
+	view := &dispatchTargets{
+		firehose: l.RxFirehose,
+		audit:    l.RxAudit,
+		order:    l.dispatchOrder,
+	}
+	if otaFrame.Direction != DirTX {
+		var pending []*frameWaiter
+		for _, w := range l.waiters {
+			if w.match(otaFrame) {
+				w.ch <- otaFrame // buffered; each waiter fires at most once
+			} else {
+				pending = append(pending, w)
+			}
+		}
+		l.waiters = pending
+		view.program = l.RxRegistryProgram[otaFrame.Program]
+		view.ranges = l.RxRegistryRange
+		view.address = l.RxRegistryAddress[otaFrame.Address]
+		view.masks = l.RxRegistryMask
+	}
+	if l.dispatchTrace {
+		view.trace = &DispatchTrace{Frame: otaFrame}
+	}
+	return view
+}
+
+// deliver hands otaFrame to handler, preferring FrameReceiverFull, and returns its "continue processing" verdict
+func (l *LinkMgr) deliver(handler FrameReceiver, otaFrame *NpiRadioFrame) bool {
+	if fr, ok := handler.(FrameReceiverFull); ok {
+		return fr.ReceiveFrame(l, otaFrame)
+	}
+	return handler.Receive(l, otaFrame.Rssi, otaFrame.Address, otaFrame.Program, otaFrame.Data)
+}
+
+// dispatchChain runs a received frame through the handlers captured in view in the order documented on
+// FrameReceiver.  Any handler returning false ends processing of the frame.  Nil entries (e.g. assigned directly into
+// the exported registry maps) are skipped.
+func (l *LinkMgr) dispatchChain(otaFrame *NpiRadioFrame, view *dispatchTargets) {
+	first, second := view.programStage, view.addressStage
+	if view.order == DispatchAddressFirst {
+		first, second = second, first
+	}
+	if !first(l, otaFrame) || !second(l, otaFrame) {
+		return // Do not attempt processing the frame any more
+	}
+	for _, handler := range view.firehose {
+		if handler == nil {
+			continue
+		}
+		ret := view.run(l, "firehose", handler, otaFrame)
+		if !ret {
+			break // Do not attempt processing the frame any more
+		}
+	}
+}
+
+// programStage offers otaFrame to its exact program handler, then the matching program ranges, returning false if
+// one of them ended processing of the frame
+func (view *dispatchTargets) programStage(l *LinkMgr, otaFrame *NpiRadioFrame) bool {
+	if view.program != nil {
+		ret := view.run(l, "program", view.program, otaFrame)
+		if !ret {
+			return false
+		}
+	}
+	for _, r := range view.ranges {
+		if r.Handler == nil || otaFrame.Program < r.Lo || otaFrame.Program > r.Hi {
+			continue
+		}
+		ret := view.run(l, "range", r.Handler, otaFrame)
+		if !ret {
+			return false
+		}
+	}
+	return true
+}
+
+// addressStage offers otaFrame to its exact address handler or, failing that, the matching address masks, returning
+// false if one of them ended processing of the frame
+func (view *dispatchTargets) addressStage(l *LinkMgr, otaFrame *NpiRadioFrame) bool {
+	if view.address != nil {
+		return view.run(l, "address", view.address, otaFrame)
+	}
+	for _, m := range view.masks {
+		if m.Handler == nil || otaFrame.Address&m.Mask != m.Address {
+			continue
+		}
+		ret := view.run(l, "mask", m.Handler, otaFrame)
+		if !ret {
+			return false
+		}
+	}
+	return true
+}
+
+// DispatchOrder selects whether program or address handlers see a received frame first (see SetDispatchOrder)
+type DispatchOrder uint8
+
+const (
+	DispatchProgramFirst DispatchOrder = iota // Program and program range handlers, then address handlers (default)
+	DispatchAddressFirst                      // Address and address mask handlers, then program handlers
+)
+
+// SetDispatchOrder chooses whether a received frame goes to its program handlers or its address handlers first; the
+// firehose and audit handlers always come last.  Use DispatchAddressFirst when per-device handlers should be able to
+// claim a device's frames before the generic program driver does.  Takes effect from the next frame dispatched.
+func (l *LinkMgr) SetDispatchOrder(order DispatchOrder) {
+	l.registryMutex.Lock()
+	l.dispatchOrder = order
+	l.registryMutex.Unlock()
+}
+
 /* High-level Control API functions */
 
+// ReplySizeError is returned by the high-level Control API when a reply's payload isn't the size the command calls
+// for, which points at mismatched firmware or a corrupted link rather than a timeout or a refusal.  Use errors.As to
+// retrieve it.
+type ReplySizeError struct {
+	Op       string // API method which rejected the reply, e.g. "GetRadio"
+	Command  uint8
+	Expected int
+	Actual   int
+	AtLeast  bool // Expected is a minimum; longer replies (from newer firmware) are accepted
+}
+
+func (e *ReplySizeError) Error() string {
+	if e.AtLeast {
+		return fmt.Sprintf("%s: Reply payload was invalid size of %d (expected at least %d)", e.Op, e.Actual, e.Expected)
+	}
+	return fmt.Sprintf("%s: Reply payload was invalid size of %d (expected %d)", e.Op, e.Actual, e.Expected)
+}
+
+// CtrlStatusError is returned by the high-level Control API when the MCU answers a command with a status other than
+// CONTROL_STATUS_OK.  Some firmware puts diagnostic detail in the reply even then, so it is kept in Reply.  Use
+// errors.As to retrieve it.
+type CtrlStatusError struct {
+	Op      string // API method which issued the command, e.g. "SetFrequency"
+	Command uint8
+	Status  uint8
+	Reply   []byte
+}
+
+func (e *CtrlStatusError) Error() string {
+	return e.Op + " error: " + Status(e.Status)
+}
+
+// ctrlStatusError builds the CtrlStatusError for a refused command, logging the reply bytes if DebugCtrl is set
+func (l *LinkMgr) ctrlStatusError(op string, cmd, stat uint8, rpl []byte) error {
+	if l.DebugCtrl {
+		log.Printf("%s: Command=%02X Status=%s Reply=[% X]", op, cmd, Status(stat), rpl)
+	}
+	return &CtrlStatusError{Op: op, Command: cmd, Status: stat, Reply: rpl}
+}
+
 // GetIdentifier - Request compiled-in identifier string from NPI microcontroller's firmware
 func (l *LinkMgr) GetIdentifier() (string, error) {
 	stat, rpl, err := l.Ctrl(CONTROL_GET_IDENTIFIER, nil)
@@ -302,23 +1771,91 @@ func (l *LinkMgr) GetIdentifier() (string, error) {
 		return "", err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return "", errors.New("GetIdentifier error: " + Status(stat))
+		return "", l.ctrlStatusError("GetIdentifier", CONTROL_GET_IDENTIFIER, stat, rpl)
 	}
 	return string(rpl), nil
 }
 
-// GetRadio - Request current radio parameters
+// ErrCapabilitiesUnsupported is returned by GetCapabilities when the firmware predates CONTROL_GET_CAPABILITIES
+var ErrCapabilitiesUnsupported = errors.New("firmware does not report capabilities")
+
+// GetCapabilities - Ask the firmware which optional features it supports.  The result is cached so helpers such as
+// SetPower can fail fast on unsupported settings, and CapFrameLQI selects the OTA frame layout the reader parses
+// (unless fixed with WithFrameFormat).  Older firmware answers UNKNOWN_CMD, reported as ErrCapabilitiesUnsupported;
+// helpers then don't gate anything and leave it to the firmware to refuse, and frames are parsed as FrameFormatBasic.
+func (l *LinkMgr) GetCapabilities() (Capabilities, error) {
+	stat, rpl, err := l.Ctrl(CONTROL_GET_CAPABILITIES, nil)
+	if err != nil {
+		return 0, err
+	}
+	if stat == CONTROL_STATUS_UNKNOWN_CMD {
+		l.rxFormat.store(FrameFormatBasic) // Firmware this old predates the LQI layout
+		return 0, ErrCapabilitiesUnsupported
+	}
+	if stat != CONTROL_STATUS_OK {
+		return 0, l.ctrlStatusError("GetCapabilities", CONTROL_GET_CAPABILITIES, stat, rpl)
+	}
+	if len(rpl) != 4 {
+		return 0, &ReplySizeError{Op: "GetCapabilities", Command: CONTROL_GET_CAPABILITIES, Expected: 4, Actual: len(rpl)}
+	}
+
+	caps := Capabilities(uint32(rpl[0]) | (uint32(rpl[1]) << 8) | (uint32(rpl[2]) << 16) | (uint32(rpl[3]) << 24))
+	l.sessionMutex.Lock()
+	l.capabilities = &caps
+	l.sessionMutex.Unlock()
+	if caps.Has(CapFrameLQI) {
+		l.rxFormat.store(FrameFormatLQI)
+	} else {
+		l.rxFormat.store(FrameFormatBasic)
+	}
+	return caps, nil
+}
+
+// lacksCapability reports whether GetCapabilities has positively established that the firmware lacks c
+func (l *LinkMgr) lacksCapability(c Capabilities) bool {
+	l.sessionMutex.Lock()
+	defer l.sessionMutex.Unlock()
+	return l.capabilities != nil && !l.capabilities.Has(c)
+}
+
+// GetFlowControlState - Ask the MCU whether it currently has the host squelched.  RunNPI also uses the reply to re-sync
+// its writer, which un-sticks it if an unsquelch was missed: the request skips the CtrlTX queue and in-flight slots
+// (see SetMaxPendingControls), and is written even while squelched.  Firmware which predates CONTROL_GET_FLOW_STATE
+// is assumed to be unsquelched.
+func (l *LinkMgr) GetFlowControlState() (bool, error) {
+	select {
+	case <-l.NpiDied:
+		return false, errors.New("NPI PHY link faulted")
+	default:
+	}
+	stat, rpl, err := l.ctrl(context.Background(), CONTROL_GET_FLOW_STATE, nil, l.ctrlCancelChan(), l.DefaultCtrlTimeout)
+	if err != nil {
+		return false, err
+	}
+	if stat == CONTROL_STATUS_UNKNOWN_CMD {
+		return false, nil
+	}
+	if stat != CONTROL_STATUS_OK {
+		return false, l.ctrlStatusError("GetFlowControlState", CONTROL_GET_FLOW_STATE, stat, rpl)
+	}
+	if len(rpl) != 1 {
+		return false, &ReplySizeError{Op: "GetFlowControlState", Command: CONTROL_GET_FLOW_STATE, Expected: 1, Actual: len(rpl)}
+	}
+	return rpl[0] != 0, nil
+}
+
+// GetRadio - Request current radio parameters.  The reply must be at least 8 bytes; anything after those, which newer
+// firmware may append, is ignored (issue CONTROL_GET_RF with Ctrl to see it).
 func (l *LinkMgr) GetRadio() (bool, uint32, int8, uint16, error) {
 	stat, rpl, err := l.Ctrl(CONTROL_GET_RF, nil)
 	if err != nil {
 		return false, 0, 0, 0, err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return false, 0, 0, 0, errors.New("GetRadio error: " + Status(stat))
+		return false, 0, 0, 0, l.ctrlStatusError("GetRadio", CONTROL_GET_RF, stat, rpl)
 	}
-	if len(rpl) != 8 {
-		errStr := fmt.Sprintf("GetRadio: Reply payload was invalid size of %d (expected 8)", len(rpl))
-		return false, 0, 0, 0, errors.New(errStr)
+	if len(rpl) < 8 {
+		return false, 0, 0, 0, &ReplySizeError{Op: "GetRadio", Command: CONTROL_GET_RF, Expected: 8, Actual: len(rpl), AtLeast: true}
 	}
 
 	var rxOn bool
@@ -337,18 +1874,17 @@ func (l *LinkMgr) GetRadio() (bool, uint32, int8, uint16, error) {
 	return rxOn, cFreq, txPower, txTick, nil
 }
 
-// GetAddresses - get IEEE address and alternate address
+// GetAddresses - get IEEE address and alternate address.  Like GetRadio, it ignores bytes beyond the 8 it understands.
 func (l *LinkMgr) GetAddresses() (uint32, uint32, error) {
 	stat, rpl, err := l.Ctrl(CONTROL_GET_ADDRESSES, nil)
 	if err != nil {
 		return 0, 0, err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return 0, 0, errors.New("GetAddresses error: " + Status(stat))
+		return 0, 0, l.ctrlStatusError("GetAddresses", CONTROL_GET_ADDRESSES, stat, rpl)
 	}
-	if len(rpl) != 8 {
-		errStr := fmt.Sprintf("GetAddresses: Reply payload was invalid size of %d (expected 8)", len(rpl))
-		return 0, 0, errors.New(errStr)
+	if len(rpl) < 8 {
+		return 0, 0, &ReplySizeError{Op: "GetAddresses", Command: CONTROL_GET_ADDRESSES, Expected: 8, Actual: len(rpl), AtLeast: true}
 	}
 
 	var ieeeAddr, altAddr uint32
@@ -357,8 +1893,81 @@ func (l *LinkMgr) GetAddresses() (uint32, uint32, error) {
 	return ieeeAddr, altAddr, nil
 }
 
+// StationInfo describes a base station's NPI microcontroller: its firmware, radio configuration and addresses
+type StationInfo struct {
+	Identifier  string // Firmware identifier string
+	RxOn        bool
+	Frequency   uint32 // RF center frequency in Hz
+	Power       int8   // TX power in dBm
+	TxTick      uint16 // Automatic TX interval in milliseconds; 0 = off
+	IEEEAddress uint32
+	AltAddress  uint32 // 0 = no alternate address
+}
+
+// String renders the StationInfo as a short multi-line summary
+func (s StationInfo) String() string {
+	rx := "off"
+	if s.RxOn {
+		rx = "on"
+	}
+	tick := "off"
+	if s.TxTick != 0 {
+		tick = fmt.Sprintf("%dms", s.TxTick)
+	}
+	alt := "none"
+	if s.AltAddress != 0 {
+		alt = fmt.Sprintf("%08X", s.AltAddress)
+	}
+	return fmt.Sprintf("Firmware:  %s\nRadio:     %.3fMHz, %ddBm, RX %s, TX tick %s\nAddresses: %08X (alternate %s)",
+		s.Identifier, float64(s.Frequency)/1e6, s.Power, rx, tick, s.IEEEAddress, alt)
+}
+
+// StationInfoError lists the queries Info could not complete; the StationInfo returned with it holds the rest
+type StationInfoError struct {
+	Errs []error
+}
+
+func (e *StationInfoError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return "Info: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap exposes the individual failures to errors.Is and errors.As
+func (e *StationInfoError) Unwrap() []error {
+	return e.Errs
+}
+
+// Info gathers the firmware identifier, radio configuration and addresses in one call.  If some of the queries fail,
+// the fields from the others are still filled in and the error is a *StationInfoError.
+func (l *LinkMgr) Info() (StationInfo, error) {
+	var info StationInfo
+	var errs []error
+	var err error
+	info.Identifier, err = l.GetIdentifier()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	info.RxOn, info.Frequency, info.Power, info.TxTick, err = l.GetRadio()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	info.IEEEAddress, info.AltAddress, err = l.GetAddresses()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if errs != nil {
+		return info, &StationInfoError{Errs: errs}
+	}
+	return info, nil
+}
+
 // SetAlternateAddress - configure the secondary address the NPI RF microcontroller will listen to for incoming packets
-// (particularly important for base stations)
+// (particularly important for base stations).  Received frames don't say whether they were addressed to the IEEE or
+// the alternate address (see FrameMeta), so a base station wanting distinct roles per address should give nodes a
+// distinct program ID per role instead.
 func (l *LinkMgr) SetAlternateAddress(addr uint32) error {
 	buf := make([]byte, 4)
 	buf[0] = uint8(addr)
@@ -366,12 +1975,12 @@ func (l *LinkMgr) SetAlternateAddress(addr uint32) error {
 	buf[2] = uint8(addr >> 16)
 	buf[3] = uint8(addr >> 24)
 
-	stat, _, err := l.Ctrl(CONTROL_SET_ALTERNATE_ADDR, buf)
+	stat, rpl, err := l.Ctrl(CONTROL_SET_ALTERNATE_ADDR, buf)
 	if err != nil {
 		return err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return errors.New("SetAlternateAddress error: " + Status(stat))
+		return l.ctrlStatusError("SetAlternateAddress", CONTROL_SET_ALTERNATE_ADDR, stat, rpl)
 	}
 	return nil
 }
@@ -384,25 +1993,65 @@ func (l *LinkMgr) SetFrequency(freq uint32) error {
 	buf[2] = uint8(freq >> 16)
 	buf[3] = uint8(freq >> 24)
 
-	stat, _, err := l.Ctrl(CONTROL_SET_CENTERFREQ, buf)
+	stat, rpl, err := l.Ctrl(CONTROL_SET_CENTERFREQ, buf)
 	if err != nil {
 		return err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return errors.New("SetFrequency error: " + Status(stat))
+		return l.ctrlStatusError("SetFrequency", CONTROL_SET_CENTERFREQ, stat, rpl)
 	}
 	return nil
 }
 
-// SetPower - configure TX power in dBm (valid -10, 0-12, 14 but only under certain firmware builds)
+// FrequencyBand is an inclusive range of center frequencies, in Hz
+type FrequencyBand struct {
+	Lo, Hi uint32
+}
+
+// SupportedBands are the frequency ranges the CC1310's synthesizer covers
+var SupportedBands = []FrequencyBand{
+	{287000000, 351000000},
+	{359000000, 439000000},
+	{431000000, 527000000},
+	{718000000, 878000000},
+	{861000000, 1054000000},
+}
+
+// MHzToHz converts a frequency in MHz (e.g. 902.8) to Hz, rounded to the nearest Hz, rejecting anything outside
+// SupportedBands.
+func MHzToHz(mhz float64) (uint32, error) {
+	hz := math.Round(mhz * 1e6)
+	for _, b := range SupportedBands {
+		if hz >= float64(b.Lo) && hz <= float64(b.Hi) {
+			return uint32(hz), nil
+		}
+	}
+	return 0, fmt.Errorf("%gMHz is outside the supported frequency bands", mhz)
+}
+
+// SetFrequencyMHz - SetFrequency with the frequency given in MHz (e.g. 902.8), which is checked against
+// SupportedBands first
+func (l *LinkMgr) SetFrequencyMHz(mhz float64) error {
+	hz, err := MHzToHz(mhz)
+	if err != nil {
+		return errors.New("SetFrequencyMHz error: " + err.Error())
+	}
+	return l.SetFrequency(hz)
+}
+
+// SetPower - configure TX power in dBm (valid -10, 0-12, 14 but only under certain firmware builds).  If
+// GetCapabilities has shown the firmware lacks CapHighPowerTX, settings above 12dBm are refused without asking it.
 func (l *LinkMgr) SetPower(dbm int8) error {
+	if dbm > 12 && l.lacksCapability(CapHighPowerTX) {
+		return fmt.Errorf("SetPower error: %ddBm requires high-power TX, which this firmware does not support", dbm)
+	}
 	buf := []byte{byte(dbm)}
-	stat, _, err := l.Ctrl(CONTROL_SET_TXPOWER, buf)
+	stat, rpl, err := l.Ctrl(CONTROL_SET_TXPOWER, buf)
 	if err != nil {
 		return err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return errors.New("SetPower error: " + Status(stat))
+		return l.ctrlStatusError("SetPower", CONTROL_SET_TXPOWER, stat, rpl)
 	}
 	return nil
 }
@@ -412,28 +2061,85 @@ func (l *LinkMgr) SetTxInterval(ms uint16) error {
 	buf := make([]byte, 2)
 	buf[0] = uint8(ms)
 	buf[1] = uint8(ms >> 8)
-	stat, _, err := l.Ctrl(CONTROL_SET_TX_TICK, buf)
+	stat, rpl, err := l.Ctrl(CONTROL_SET_TX_TICK, buf)
 	if err != nil {
 		return err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return errors.New("SetTxInterval error: " + Status(stat))
+		return l.ctrlStatusError("SetTxInterval", CONTROL_SET_TX_TICK, stat, rpl)
 	}
 	return nil
 }
 
-// RunTx - Trigger a transmit of any queued outbound RF frames
-func (l *LinkMgr) RunTx() error {
-	stat, _, err := l.Ctrl(CONTROL_RUN_TX, nil)
+// ErrModulationUnsupported is returned by GetModulation and SetModulation when the firmware can't change modulation,
+// whether it predates the commands (UNKNOWN_CMD) or was built without the feature (FEATURE_NOT_IMPLEMENTED)
+var ErrModulationUnsupported = errors.New("firmware does not support changing modulation")
+
+// GetModulation - Request the radio's current data rate/modulation
+func (l *LinkMgr) GetModulation() (ModulationMode, error) {
+	stat, rpl, err := l.Ctrl(CONTROL_GET_MODULATION, nil)
+	if err != nil {
+		return 0, err
+	}
+	if stat == CONTROL_STATUS_UNKNOWN_CMD || stat == CONTROL_STATUS_FEATURE_NOT_IMPLEMENTED {
+		return 0, ErrModulationUnsupported
+	}
+	if stat != CONTROL_STATUS_OK {
+		return 0, l.ctrlStatusError("GetModulation", CONTROL_GET_MODULATION, stat, rpl)
+	}
+	if len(rpl) != 1 {
+		return 0, &ReplySizeError{Op: "GetModulation", Command: CONTROL_GET_MODULATION, Expected: 1, Actual: len(rpl)}
+	}
+	return ModulationMode(rpl[0]), nil
+}
+
+// SetModulation - configure the radio's data rate/modulation, e.g. ModulationLRM5k for range testing.  Nodes only hear
+// frames sent with their own modulation, so switching it cuts the base station off from any which haven't switched too.
+// Modes the protocol doesn't define are refused without asking the firmware.
+func (l *LinkMgr) SetModulation(mode ModulationMode) error {
+	if !mode.Valid() {
+		return fmt.Errorf("SetModulation error: unknown modulation mode %d", uint8(mode))
+	}
+	stat, rpl, err := l.Ctrl(CONTROL_SET_MODULATION, []byte{byte(mode)})
 	if err != nil {
 		return err
 	}
+	if stat == CONTROL_STATUS_UNKNOWN_CMD || stat == CONTROL_STATUS_FEATURE_NOT_IMPLEMENTED {
+		return ErrModulationUnsupported
+	}
 	if stat != CONTROL_STATUS_OK {
-		return errors.New("RunTx error: " + Status(stat))
+		return l.ctrlStatusError("SetModulation", CONTROL_SET_MODULATION, stat, rpl)
 	}
 	return nil
 }
 
+// RunTxUnknown is the transmitted count RunTx reports for firmware whose RUN_TX reply doesn't include one
+const RunTxUnknown = -1
+
+// RunTx - Trigger a transmit of any queued outbound RF frames.  Returns how many frames the MCU reports actually went
+// out (fewer than were queued if some were dropped, e.g. on a busy channel), or RunTxUnknown for firmware which
+// replies without a count.  Like every Ctrl-based call, it waits for the MCU's reply, so FrameReceivers should use
+// RunTxAsync instead.
+func (l *LinkMgr) RunTx() (int, error) {
+	stat, rpl, err := l.Ctrl(CONTROL_RUN_TX, nil)
+	if err != nil {
+		return 0, err
+	}
+	if stat != CONTROL_STATUS_OK {
+		return 0, l.ctrlStatusError("RunTx", CONTROL_RUN_TX, stat, rpl)
+	}
+	switch len(rpl) {
+	case 0:
+		return RunTxUnknown, nil
+	case 1:
+		return int(rpl[0]), nil
+	case 2:
+		return int(uint16(rpl[0]) | (uint16(rpl[1]) << 8)), nil
+	}
+	// Any of 0-2 bytes is valid; Expected reports the longest
+	return 0, &ReplySizeError{Op: "RunTx", Command: CONTROL_RUN_TX, Expected: 2, Actual: len(rpl)}
+}
+
 // On - configure RX on or off
 func (l *LinkMgr) On(onoff bool) error {
 	var val uint8
@@ -443,18 +2149,59 @@ func (l *LinkMgr) On(onoff bool) error {
 		val = 0
 	}
 	buf := []byte{byte(val)}
-	stat, _, err := l.Ctrl(CONTROL_SET_RF_ON, buf)
+	stat, rpl, err := l.Ctrl(CONTROL_SET_RF_ON, buf)
 	if err != nil {
 		return err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return errors.New("On error: " + Status(stat))
+		return l.ctrlStatusError("On", CONTROL_SET_RF_ON, stat, rpl)
 	}
 	return nil
 }
 
 // SetLEDs - Switch the NPI MCU's master enable on/off
 func (l *LinkMgr) SetLEDs(onoff bool) error {
+	err := l.setLEDs(onoff)
+	if err == nil {
+		l.ledMutex.Lock()
+		l.ledsOff = !onoff
+		l.ledMutex.Unlock()
+	}
+	return err
+}
+
+// identifyPattern is the LED enable sequence Identify repeats: on, off, on, off, i.e. a double blink once a second
+var identifyPattern = []time.Duration{150 * time.Millisecond, 150 * time.Millisecond, 150 * time.Millisecond,
+	550 * time.Millisecond}
+
+// Identify double-blinks the NPI MCU's LEDs for d, so an operator can pick out this base station among several, then
+// puts them back as last set with SetLEDs (enabled if it was never called; the firmware can't report their state).
+// It blocks for d.
+func (l *LinkMgr) Identify(d time.Duration) error {
+	deadline := time.Now().Add(d)
+	var err error
+	for i := 0; err == nil && time.Now().Before(deadline); i++ {
+		err = l.setLEDs(i%2 == 0)
+		if err == nil {
+			step := identifyPattern[i%len(identifyPattern)]
+			if left := time.Until(deadline); left < step {
+				step = left
+			}
+			time.Sleep(step)
+		}
+	}
+
+	l.ledMutex.Lock()
+	on := !l.ledsOff
+	l.ledMutex.Unlock()
+	if rerr := l.setLEDs(on); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// setLEDs sends CONTROL_SET_LEDS without recording the state for Identify to restore
+func (l *LinkMgr) setLEDs(onoff bool) error {
 	var val uint8
 	if onoff {
 		val = 1
@@ -462,12 +2209,12 @@ func (l *LinkMgr) SetLEDs(onoff bool) error {
 		val = 0
 	}
 	buf := []byte{byte(val)}
-	stat, _, err := l.Ctrl(CONTROL_SET_LEDS, buf)
+	stat, rpl, err := l.Ctrl(CONTROL_SET_LEDS, buf)
 	if err != nil {
 		return err
 	}
 	if stat != CONTROL_STATUS_OK {
-		return errors.New("SetLEDs error: " + Status(stat))
+		return l.ctrlStatusError("SetLEDs", CONTROL_SET_LEDS, stat, rpl)
 	}
 	return nil
 }
@@ -0,0 +1,282 @@
+package smacbase
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// npi_options.go - Optional tunables for RunNPI and NewLinkMgr
+
+// Option configures optional behavior of the NPI PHY goroutines (and the LinkMgr wrapping them)
+type Option func(*npiOptions)
+
+// npiOptions holds the effective configuration after all Options have been applied
+type npiOptions struct {
+	stats          *NpiStats
+	rawFrames      bool
+	frameFormat    FrameFormat
+	frameFormatSet bool               // WithFrameFormat was given, overriding detection
+	formatSwitch   *frameFormatSwitch // Format detected by the LinkMgr from the firmware's capabilities
+	unsolicited    chan<- NpiControl
+	ctrlTap        chan<- NpiControl // Every control reply, once RunNPI has handled it (see LinkMgr.RegisterControlObserver)
+	mcuMessages    chan<- string     // Text of CONTROL_LOG_MESSAGE frames
+	ready          chan<- struct{}
+	rxDepth        int
+	txDepth        int
+	ctrlDepth      int
+	ctrlReplyDepth int           // Control replies buffered between the PHY reader and RunNPI
+	readBufSize    int           // Bytes requested from the PHY per read
+	readRetries    int           // Consecutive transient read errors tolerated before the PHY is declared faulted
+	readBackoff    time.Duration // Wait before the first retry; doubled for each consecutive retry
+	frameGap       time.Duration // Silence after which a partially received frame is abandoned; 0 = never
+	txGap          time.Duration
+	writeTimeout   time.Duration      // Longest a PHY write may block before the PHY is declared faulted; 0 = no limit
+	maxSquelch     time.Duration      // Longest the writer stays squelched before clearing it itself; 0 = no limit
+	unsquelch      <-chan struct{}    // Host-side forced unsquelch (LinkMgr.Unsquelch)
+	flowRequests   <-chan *NpiControl // CONTROL_GET_FLOW_STATE requests, written even while squelched
+	assertDTR      *bool              // nil leaves the line as the serial driver set it
+	assertRTS      *bool
+}
+
+// Defaults for WithReadRetry
+const (
+	DefaultReadRetries = 3
+	DefaultReadBackoff = 10 * time.Millisecond
+)
+
+// DefaultFrameGapTimeout is the default for WithFrameGapTimeout.  A whole maximum-size frame takes about 23ms at
+// 115200 baud, so a healthy link never pauses this long mid-frame.
+const DefaultFrameGapTimeout = 250 * time.Millisecond
+
+// DefaultReadBufferSize is the default for WithReadBufferSize; enough for over a dozen maximum-size frames per read
+const DefaultReadBufferSize = 4096
+
+// DefaultQueueDepth is the default buffer size of a LinkMgr's FrameRX and FrameTX channels
+const DefaultQueueDepth = 32
+
+// DefaultCtrlQueueDepth is the default buffer size of a LinkMgr's CtrlTX channel
+const DefaultCtrlQueueDepth = 4
+
+// DefaultCtrlReplyBuffer is the default for WithCtrlReplyBuffer
+const DefaultCtrlReplyBuffer = 32
+
+// newNpiOptions applies opts over the defaults
+func newNpiOptions(opts []Option) *npiOptions {
+	o := new(npiOptions)
+	o.rxDepth = DefaultQueueDepth
+	o.txDepth = DefaultQueueDepth
+	o.ctrlDepth = DefaultCtrlQueueDepth
+	o.ctrlReplyDepth = DefaultCtrlReplyBuffer
+	o.readBufSize = DefaultReadBufferSize
+	o.readRetries = DefaultReadRetries
+	o.readBackoff = DefaultReadBackoff
+	o.frameGap = DefaultFrameGapTimeout
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.readBufSize < 1 {
+		o.readBufSize = 1
+	}
+	return o
+}
+
+// WithStats directs RunNPI to record its counters in s
+func WithStats(s *NpiStats) Option {
+	return func(o *npiOptions) {
+		o.stats = s
+	}
+}
+
+// WithRawFrames makes the reader retain a copy of each received OTA frame's exact bytes in FrameMeta.Raw, for
+// protocol debugging.  Off by default to avoid the extra per-frame copy.
+func WithRawFrames(enabled bool) Option {
+	return func(o *npiOptions) {
+		o.rawFrames = enabled
+	}
+}
+
+// WithFrameFormat tells the reader which OTA frame layout the NPI firmware emits.  Firmware builds which append LQI
+// after the RSSI byte need FrameFormatLQI; the default is FrameFormatBasic.  A LinkMgr normally detects the layout
+// itself from CapFrameLQI (see LinkMgr.Flush); giving this option turns that detection off.
+func WithFrameFormat(f FrameFormat) Option {
+	return func(o *npiOptions) {
+		o.frameFormat = f
+		o.frameFormatSet = true
+	}
+}
+
+// frameFormatSwitch holds the frame format a LinkMgr has detected, shared with the reader of each of its sessions
+type frameFormatSwitch struct {
+	format uint32
+}
+
+func (s *frameFormatSwitch) load() FrameFormat {
+	return FrameFormat(atomic.LoadUint32(&s.format))
+}
+
+func (s *frameFormatSwitch) store(f FrameFormat) {
+	atomic.StoreUint32(&s.format, uint32(f))
+}
+
+// withFrameFormatSwitch has the reader follow the format in s unless WithFrameFormat fixes it
+func withFrameFormatSwitch(s *frameFormatSwitch) Option {
+	return func(o *npiOptions) {
+		o.formatSwitch = s
+	}
+}
+
+// rxFrameFormat returns the OTA frame layout the reader should parse right now
+func (o *npiOptions) rxFrameFormat() FrameFormat {
+	if o.formatSwitch != nil && !o.frameFormatSet {
+		return o.formatSwitch.load()
+	}
+	return o.frameFormat
+}
+
+// WithUnsolicitedControl delivers control replies nobody was waiting for (e.g. asynchronous MCU notifications) on ch.
+// Replies are dropped if ch is full, so RunNPI never blocks on it.
+func WithUnsolicitedControl(ch chan<- NpiControl) Option {
+	return func(o *npiOptions) {
+		o.unsolicited = ch
+	}
+}
+
+// WithMCUMessages delivers the text of CONTROL_LOG_MESSAGE frames (firmware debug output) on ch instead of treating
+// them as unsolicited control replies.  Messages are dropped if ch is full (counted in Stats().MCUMessageDrops), so
+// RunNPI never blocks on it.
+func WithMCUMessages(ch chan<- string) Option {
+	return func(o *npiOptions) {
+		o.mcuMessages = ch
+	}
+}
+
+// WithReady has RunNPI close ready once it and its PHY writer are running, i.e. once frames and control requests
+// submitted to it will be picked up promptly.  Passed to NewLinkMgr/NewLinkMgrPHY, ready is closed once the first
+// session is up, just before the constructor returns; sessions started by auto-reconnect don't signal it again.
+func WithReady(ready chan<- struct{}) Option {
+	return func(o *npiOptions) {
+		o.ready = ready
+	}
+}
+
+// WithQueueDepth sets how many frames the LinkMgr's FrameRX and FrameTX channels buffer (0 for unbuffered).  A deeper
+// RX queue rides out bursts while handlers catch up; see LinkMgr.RXBacklog.  Only NewLinkMgr/NewLinkMgrPHY use it.
+func WithQueueDepth(rx, tx int) Option {
+	return func(o *npiOptions) {
+		o.rxDepth = rx
+		o.txDepth = tx
+	}
+}
+
+// WithCtrlQueueDepth sets how many control requests the LinkMgr's CtrlTX channel buffers while RunNPI is busy (0 for
+// unbuffered).  When it is full, Ctrl and CtrlForget wait for room and TryCtrlForget fails.  Only
+// NewLinkMgr/NewLinkMgrPHY use it.
+func WithCtrlQueueDepth(n int) Option {
+	return func(o *npiOptions) {
+		o.ctrlDepth = n
+	}
+}
+
+// WithCtrlReplyBuffer sets how many received control replies are buffered for RunNPI while it is busy, e.g. when the
+// MCU answers a batch of requests at once.  Rather than stall the serial reader, replies which don't fit are dropped
+// (their Ctrl calls time out) and counted in Stats().CtrlReplyDrops.  The MCU's squelch and unsquelch are never
+// dropped; the reader waits for room for those.
+func WithCtrlReplyBuffer(n int) Option {
+	return func(o *npiOptions) {
+		o.ctrlReplyDepth = n
+	}
+}
+
+// WithReadBufferSize sets how many bytes the PHY reader asks for per read (default DefaultReadBufferSize).  Frames
+// are reassembled across reads, so any size works, down to 1; smaller buffers just mean more reads when data arrives
+// in bulk.
+func WithReadBufferSize(n int) Option {
+	return func(o *npiOptions) {
+		o.readBufSize = n
+	}
+}
+
+// WithReadRetry sets how many consecutive transient PHY read errors (EINTR, EAGAIN, timeouts) the reader retries
+// before declaring the PHY faulted, waiting backoff before the first retry and doubling it for each one after.  Other
+// read errors, e.g. the device disappearing, fault the PHY immediately.  retries=0 faults on any read error.
+func WithReadRetry(retries int, backoff time.Duration) Option {
+	return func(o *npiOptions) {
+		o.readRetries = retries
+		o.readBackoff = backoff
+	}
+}
+
+// WithFrameGapTimeout sets how long the line may go quiet in the middle of a received frame before the reader gives up
+// on it (counting it in Stats().RxTruncatedFrames) and hunts for a fresh start character.  Without it, the remainder
+// of a frame cut short by e.g. a glitch is made up from the start of the next one; that fails its checksum and the
+// reader rescans the bytes, but only once the next frame arrives.  Only time the reader spends waiting on the line
+// counts, not time spent blocked delivering frames.  0 disables the check.
+func WithFrameGapTimeout(d time.Duration) Option {
+	return func(o *npiOptions) {
+		o.frameGap = d
+	}
+}
+
+// WithTxInterFrameGap makes the PHY writer leave at least d between consecutive writes (OTA and control frames alike),
+// for MCU firmware or cheap adapters which drop bytes from back-to-back frames.  This caps TX throughput at roughly
+// one frame per d.  The default of 0 writes frames back-to-back.
+func WithTxInterFrameGap(d time.Duration) Option {
+	return func(o *npiOptions) {
+		o.txGap = d
+	}
+}
+
+// WithWriteTimeout declares the PHY faulted (counting it in Stats().TxWriteTimeouts as well as TxWriteErrors) when a
+// single write to it takes longer than d, e.g. because a wedged adapter is holding off flow control.  Without it such a
+// write stalls every transmit indefinitely with no fault reported.  The default of 0 waits indefinitely.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *npiOptions) {
+		o.writeTimeout = d
+	}
+}
+
+// WithMaxSquelch limits how long the MCU can keep the PHY writer squelched.  If no unsquelch arrives within d, e.g.
+// because it was lost to line noise, the writer logs a warning, counts it in Stats().SquelchTimeouts and resumes
+// writing.  The default of 0 waits for the MCU (or LinkMgr.Unsquelch) indefinitely.
+func WithMaxSquelch(d time.Duration) Option {
+	return func(o *npiOptions) {
+		o.maxSquelch = d
+	}
+}
+
+// withControlTap has RunNPI copy every control reply to ch, dropping (and counting) any which don't fit
+func withControlTap(ch chan<- NpiControl) Option {
+	return func(o *npiOptions) {
+		o.ctrlTap = ch
+	}
+}
+
+// withForceUnsquelch lets a LinkMgr clear the writer's squelch from the host side
+func withForceUnsquelch(ch <-chan struct{}) Option {
+	return func(o *npiOptions) {
+		o.unsquelch = ch
+	}
+}
+
+// withFlowStateRequests gives a LinkMgr's flow-state requests a path to the MCU which squelch doesn't block
+func withFlowStateRequests(ch <-chan *NpiControl) Option {
+	return func(o *npiOptions) {
+		o.flowRequests = ch
+	}
+}
+
+// WithAssertDTR sets (true) or clears (false) the DTR line right after NewSerialPHY opens the port.  Useful for
+// USB-serial adapters which wire DTR to the MCU's reset or bootloader pin.  Without it the line is left as opened.
+func WithAssertDTR(assert bool) Option {
+	return func(o *npiOptions) {
+		o.assertDTR = &assert
+	}
+}
+
+// WithAssertRTS sets (true) or clears (false) the RTS line right after NewSerialPHY opens the port.  Without it the
+// line is left as opened.
+func WithAssertRTS(assert bool) Option {
+	return func(o *npiOptions) {
+		o.assertRTS = &assert
+	}
+}
@@ -1,18 +1,26 @@
 package smacbase
 
 import (
+	"errors"
+	"fmt"
 	"github.com/jacobsa/go-serial/serial"
 	"io"
-	//"fmt"
 	"log"
+	"syscall"
+	"time"
 )
 
 // npi_phy.go - Define the serial I/O NPI connection and manage NPI frames
 
-// NewSerialPHY - Open the specified serial port
+// maxFrameLen is the longest possible NPI frame: an LQI-bearing OTA frame with a 255-byte payload
+// (10 header bytes + checksum)
+const maxFrameLen = 11 + 255
+
+// NewSerialPHY - Open the specified serial port.  Of the opts, only WithAssertDTR and WithAssertRTS apply here.
 // TODO: Implement RTS/CTS control lines
-func NewSerialPHY(path string, baud uint) (io.ReadWriteCloser, error) {
-	opts := serial.OpenOptions{
+func NewSerialPHY(path string, baud uint, opts ...Option) (io.ReadWriteCloser, error) {
+	cfg := newNpiOptions(opts)
+	serOpts := serial.OpenOptions{
 		PortName:              path,
 		BaudRate:              baud,
 		DataBits:              8,
@@ -22,83 +30,237 @@ func NewSerialPHY(path string, baud uint) (io.ReadWriteCloser, error) {
 		MinimumReadSize:       1,
 	}
 
-	return serial.Open(opts)
+	phy, err := serial.Open(serOpts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.assertDTR != nil || cfg.assertRTS != nil {
+		err = setControlLines(phy, cfg.assertDTR, cfg.assertRTS)
+		if err != nil {
+			phy.Close()
+			return nil, err
+		}
+	}
+	return phy, nil
 }
 
 // RunNPI is the meat of this application - Handle the serial I/O and marshalling of SMac radio frames to/fro the MCU
 // As the RunNPI framework uses an io.ReadWriteCloser for its PHY, it's a flexible subsystem that can use many different
 // interfaces for its I/O, including software test harnesses that satisfy the io.ReadWriteCloser interface.
-func RunNPI(phy io.ReadWriteCloser, frameXmit chan *NpiRadioFrame, frameRecv chan *NpiRadioFrame, ctrlXmit chan *NpiControl, reportFaulted chan struct{}) {
+func RunNPI(phy io.ReadWriteCloser, frameXmit chan *NpiRadioFrame, frameRecv chan *NpiRadioFrame, ctrlXmit chan *NpiControl, reportFaulted chan struct{}, opts ...Option) {
+	cfg := newNpiOptions(opts)
+
 	// control chan for passing PHY-dead or halt info back and forth with this func
 	childErrRpt := reportFaulted
 
 	// chan for receiving Control frames from npiPhyReader; we get in the middle of this so flow-control control frames
 	// can be intercepted and processed by RunNPI without requiring external intervention
-	ctrlReplies := make(chan NpiControl, 4)
-	ctrlWrites := make(chan *NpiControl, 4)
+	ctrlReplies := make(chan NpiControl, cfg.ctrlReplyDepth)
+
+	// chans handing control frames to npiPhyWriter.  flowWrites carries only flow-state requests, which the writer
+	// services even while squelched so a missed unsquelch can be recovered (see LinkMgr.GetFlowControlState).
+	ctrlWrites := make(chan *NpiControl)
+	flowWrites := make(chan *NpiControl)
 
 	// chan for notifying writer when output needs to be halted (true) or not (false)
 	squelchWrites := make(chan bool)
 
-	// Keeping track of externally-initiated control frames so we can stuff their Reply and close their PendChan
-	var ctrlRegistry map[uint8]*NpiControl
-	ctrlRegistry = make(map[uint8]*NpiControl)
+	// Keeping track of externally-initiated control frames so we can stuff their Reply and close their PendChan.
+	// Several requests for the same command may be in flight; the MCU answers them in order, so each command has a FIFO.
+	var ctrlRegistry map[uint8][]*NpiControl
+	ctrlRegistry = make(map[uint8][]*NpiControl)
 
 	// Launch goroutines for npiPhyReader and npiPhyWriter
-	go npiPhyReader(phy, frameRecv, ctrlReplies, childErrRpt)
-	go npiPhyWriter(phy, squelchWrites, frameXmit, ctrlWrites, childErrRpt)
+	go npiPhyReader(phy, frameRecv, ctrlReplies, childErrRpt, cfg)
+	writerStarted := make(chan struct{})
+	go npiPhyWriter(phy, squelchWrites, frameXmit, ctrlWrites, flowWrites, childErrRpt, writerStarted, cfg)
 
 	defer phy.Close()
 
+	// tap passes a control reply along to any control observers once RunNPI is done with it, never blocking
+	tap := func(rep NpiControl) {
+		if cfg.ctrlTap == nil {
+			return
+		}
+		select {
+		case cfg.ctrlTap <- rep:
+		default:
+			cfg.stats.update(func(s *Stats) { s.CtrlObserverDrops++ })
+		}
+	}
+
+	<-writerStarted
+	if cfg.ready != nil {
+		close(cfg.ready)
+	}
+
+	// Control frames waiting for npiPhyWriter.  RunNPI queues them itself instead of blocking on a squelched writer, so
+	// it keeps handling replies and flow-state requests meanwhile; ctrlXmit isn't read while the queue is full.
+	var pendingWrites, pendingFlow []*NpiControl
+
 	// Main loop with select block running the show
 	for {
+		xmit := ctrlXmit
+		if len(pendingWrites) >= maxPendingCtrlWrites {
+			xmit = nil
+		}
+		var nextWrite, nextFlow *NpiControl
+		var writeCh, flowCh chan<- *NpiControl
+		if len(pendingWrites) > 0 {
+			nextWrite, writeCh = pendingWrites[0], ctrlWrites
+		}
+		if len(pendingFlow) > 0 {
+			nextFlow, flowCh = pendingFlow[0], flowWrites
+		}
 		select {
 		case <-childErrRpt:
 			return
 		case rep := <-ctrlReplies:
 			// Handle internally-sourced control frame replies, such as MCU->Host flow control
-			if rep.Command == CONTROL_SQUELCH_HOST && rep.Status == CONTROL_STATUS_OK {
-				squelchWrites <- true // Tell npiPhyWriter to quit servicing writes
+			if (rep.Command == CONTROL_SQUELCH_HOST || rep.Command == CONTROL_UNSQUELCH_HOST) && rep.Status == CONTROL_STATUS_OK {
+				// Tell npiPhyWriter to quit servicing writes, or that it's clear to write again
+				squelchWrites <- rep.Command == CONTROL_SQUELCH_HOST
+				// The MCU sends these unprompted too, so don't report them as unsolicited, but do answer (or retire)
+				// a host request for the command, e.g. LinkMgr.Flush's UNSQUELCH_HOST
+				if n := popCtrlRequest(ctrlRegistry, rep.Command); n != nil {
+					completeCtrlRequest(n, rep)
+				}
+				tap(rep)
 				continue
 			}
-			if rep.Command == CONTROL_UNSQUELCH_HOST && rep.Status == CONTROL_STATUS_OK {
-				squelchWrites <- false // Tell npiPhyWriter it's clear to write again
+			if rep.Command == CONTROL_LOG_MESSAGE && cfg.mcuMessages != nil {
+				select {
+				case cfg.mcuMessages <- string(rep.Reply):
+				default:
+					cfg.stats.update(func(s *Stats) { s.MCUMessageDrops++ })
+				}
+				tap(rep)
 				continue
 			}
+			if rep.Command == CONTROL_GET_FLOW_STATE {
+				// Re-sync npiPhyWriter with the MCU's idea of flow control, in case a squelch/unsquelch was missed.
+				// Firmware which can't report it is assumed to be unsquelched.
+				squelchWrites <- rep.Status == CONTROL_STATUS_OK && len(rep.Reply) == 1 && rep.Reply[0] != 0
+			}
 
 			// Finally: Check if the control frame reply came from an external request we're tracking
-			if ctrlRegistry[rep.Command] != nil {
-				n := ctrlRegistry[rep.Command]
-				n.Status = rep.Status
-				n.Reply = rep.Reply
-				select {
-				case <-n.PendChan: // do nothing if PendChan is already closed
-				default:
-					close(n.PendChan) // Notify external function that a reply was received for this control cmd
+			if n := popCtrlRequest(ctrlRegistry, rep.Command); n != nil {
+				completeCtrlRequest(n, rep)
+			} else {
+				// Nobody is waiting on this reply; make it visible rather than silently discarding it
+				log.Printf("RunNPI: unsolicited control reply, Command=%02X Status=%s Reply=[% X]", rep.Command, Status(rep.Status), rep.Reply)
+				cfg.stats.update(func(s *Stats) { s.UnsolicitedCtrlReplies++ })
+				if cfg.unsolicited != nil {
+					select {
+					case cfg.unsolicited <- rep:
+					default: // Never stall RunNPI on a slow consumer
+					}
 				}
-				ctrlRegistry[rep.Command] = nil // forget this one now
 			}
-		case n := <-ctrlXmit:
-			ctrlRegistry[n.Command] = n
-			ctrlWrites <- n
+			tap(rep)
+		case n := <-xmit:
+			pushCtrlRequest(ctrlRegistry, n)
+			pendingWrites = append(pendingWrites, n)
+		case n := <-cfg.flowRequests:
+			pushCtrlRequest(ctrlRegistry, n)
+			pendingFlow = append(pendingFlow, n)
+		case writeCh <- nextWrite:
+			pendingWrites[0] = nil
+			pendingWrites = pendingWrites[1:]
+		case flowCh <- nextFlow:
+			pendingFlow[0] = nil
+			pendingFlow = pendingFlow[1:]
+		}
+	}
+}
+
+// maxPendingCtrlWrites is how many control frames RunNPI holds for npiPhyWriter before it stops reading ctrlXmit
+const maxPendingCtrlWrites = 4
+
+// pushCtrlRequest queues n to receive the next reply to its command.  Abandoned requests already queued for it are
+// dropped first: popCtrlRequest would discard them on the way to n anyway, and a command the firmware never answers
+// (e.g. GET_CAPABILITIES on older firmware) would otherwise leave one behind per timed-out Ctrl for the life of the
+// session.
+func pushCtrlRequest(registry map[uint8][]*NpiControl, n *NpiControl) {
+	queue := registry[n.Command][:0]
+	for _, q := range registry[n.Command] {
+		if !q.isAbandoned() {
+			queue = append(queue, q)
 		}
 	}
+	for i := len(queue); i < len(registry[n.Command]); i++ {
+		registry[n.Command][i] = nil
+	}
+	registry[n.Command] = append(queue, n)
+}
+
+// completeCtrlRequest hands rep to the request n and wakes its caller
+func completeCtrlRequest(n *NpiControl, rep NpiControl) {
+	n.Status = rep.Status
+	n.Reply = rep.Reply
+	select {
+	case <-n.PendChan: // do nothing if PendChan is already closed
+	default:
+		close(n.PendChan) // Notify external function that a reply was received for this control cmd
+	}
+}
+
+// popCtrlRequest removes and returns the oldest request for cmd whose caller is still waiting, or nil if there are
+// none.  Requests whose callers gave up (timed out or canceled) are discarded on the way, on the assumption that
+// their replies were lost; otherwise one missing reply would shift every later reply onto the wrong request.  The
+// price is that a reply which was merely late goes to the next request for cmd as its answer (see LinkMgr.Ctrl).  If
+// only abandoned requests remain, the last is returned, so its late reply is absorbed rather than reported as
+// unsolicited.
+func popCtrlRequest(registry map[uint8][]*NpiControl, cmd uint8) *NpiControl {
+	queue := registry[cmd]
+	var n *NpiControl
+	for len(queue) > 0 {
+		n = queue[0]
+		queue[0] = nil
+		queue = queue[1:]
+		if !n.isAbandoned() {
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(registry, cmd)
+	} else {
+		registry[cmd] = queue
+	}
+	return n
 }
 
 // npiPhyReader has the distinguished displeasure of processing every byte coming in from the serial port to parse
 // valid frames out of it, keeping in mind that individual sequences of read bytes might not contain the whole frame
 // or contains parts of the next frame, possibly invalid frames due to invalid checksum, etc.
-func npiPhyReader(phy io.ReadWriteCloser, outFrame chan<- *NpiRadioFrame, ctrlReply chan NpiControl, halt chan struct{}) {
+func npiPhyReader(phy io.ReadWriteCloser, outFrame chan<- *NpiRadioFrame, ctrlReply chan NpiControl, halt chan struct{}, cfg *npiOptions) {
 	var serbuf, serbufBacking, frame []byte
-	serbufBacking = make([]byte, 65536)
-	frame = make([]byte, 256)
+	serbufBacking = make([]byte, cfg.readBufSize)
+	frame = make([]byte, maxFrameLen)
 	var framePos, payloadLen int
+	var xor uint8          // Running checksum over the bytes between the start char and the checksum byte
+	var format FrameFormat // Layout of the frame in progress, fixed when its start char arrives
+	var retries int
+	var alloc rxAllocator
+	var lastRead time.Time // When the reader last finished with a buffer and went back to the line for more
 
 	for {
 		// We need to use serbufBacking because serbuf's start position is incremented in a long loop, thus losing
 		// its perspective of where "position 0" actually lives.
-		serbuf = serbufBacking[0:65536]
+		serbuf = serbufBacking
 		l, err := phy.Read(serbuf)
+		if err != nil && isTransientReadError(err) && retries < cfg.readRetries {
+			backoff := cfg.readBackoff << uint(retries)
+			retries++
+			log.Printf("npiPhyReader: transient read error (%v), retry %d/%d in %v", err, retries, cfg.readRetries, backoff)
+			cfg.stats.update(func(s *Stats) { s.RxTransientErrors++ })
+			select {
+			case <-halt:
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
 		if err != nil {
 			select {
 			case <-halt: // can't close an already-closed channel
@@ -107,7 +269,21 @@ func npiPhyReader(phy io.ReadWriteCloser, outFrame chan<- *NpiRadioFrame, ctrlRe
 			}
 			return
 		}
+		retries = 0
 		//log.Printf("npiPhyReader: Read %d", l)
+		if l > 0 {
+			// Only time spent waiting on the line counts as silence; bytes which arrived while this goroutine was
+			// busy (e.g. blocked handing a frame to RunNPI) come back from Read at once.
+			if gap := time.Since(lastRead); framePos > 0 && cfg.frameGap > 0 && gap > cfg.frameGap {
+				// The rest of the frame in progress isn't coming; don't build it out of whatever arrives next
+				log.Printf("npiPhyReader: abandoning %d-byte partial frame after %v of silence", framePos, gap)
+				cfg.stats.update(func(s *Stats) { s.RxTruncatedFrames++ })
+				frame = frame[0:maxFrameLen]
+				framePos = 0
+				payloadLen = 0
+				xor = 0
+			}
+		}
 		serbuf = serbuf[:l]
 		// Process the contents
 		var ui uint8
@@ -117,6 +293,7 @@ func npiPhyReader(phy io.ReadWriteCloser, outFrame chan<- *NpiRadioFrame, ctrlRe
 				if ui == 0xAE || ui == 0xBA {
 					frame[0] = ui
 					framePos = 1
+					format = cfg.rxFrameFormat()
 					/* advance serbuf and loop back around; if bytes remain in serbuf, the
 					 * next if block will do useful things
 					 */
@@ -126,100 +303,285 @@ func npiPhyReader(phy io.ReadWriteCloser, outFrame chan<- *NpiRadioFrame, ctrlRe
 				}
 			}
 			if framePos > 0 { // StartChar found; search for payloadLen
-				if payloadLen == 0 && (frame[0] == 0xAE && framePos == 8) {
-					payloadLen = 10 + int(ui)
+				if payloadLen == 0 && (frame[0] == 0xAE && framePos == format.lengthOffset()) {
+					payloadLen = framePos + 2 + int(ui)
 					//log.Printf("npiPhyReader: SC=%2x, dataLen=%d, payloadLen=%d", uint8(frame[0]), ui, payloadLen)
 				}
 				if payloadLen == 0 && (frame[0] == 0xBA && framePos == 3) {
 					payloadLen = 5 + int(ui)
 					//log.Printf("npiPhyReader: SC=%2x, dataLen=%d, payloadLen=%d", uint8(frame[0]), ui, payloadLen)
 				}
+				if payloadLen == 0 || framePos < payloadLen-1 {
+					xor ^= ui
+				}
 				frame[framePos] = ui
 				framePos++
 			}
 			if payloadLen > 0 && framePos == payloadLen {
 				// Completed frame; verify checksum and send it on its way
 				frame = frame[:framePos]
-				cksum := XorBuffer(frame[1 : len(frame)-1])
-				//log.Printf("npiPhyReader: Frame completed, cksum=%2x, frame[%d]=%2x, len(frame)=%d", cksum, len(frame)-1, uint8(frame[len(frame)-1]), len(frame))
-				if uint8(frame[len(frame)-1]) == cksum {
+				//log.Printf("npiPhyReader: Frame completed, frame[%d]=%2x, len(frame)=%d", len(frame)-1, uint8(frame[len(frame)-1]), len(frame))
+				if frame[framePos-1] == xor { // Same test as VerifyFrameChecksum, accumulated as the bytes arrived
 					// Valid frame; process
 					if frame[0] == 0xAE { // OTA recv radio frame
-						n := new(NpiRadioFrame)
-						var addr uint32
-						addr = uint32(frame[1])
-						addr |= uint32(frame[2]) << 8
-						addr |= uint32(frame[3]) << 16
-						addr |= uint32(frame[4]) << 24
-						var progID uint16
-						progID = uint16(frame[5])
-						progID |= uint16(frame[6]) << 8
-						var rssi int8
-						rssi = int8(frame[7])
-						var dataLen uint8
-						var payload, payloadCp []byte
-						dataLen = uint8(frame[8])
-						payload = frame[9 : 9+dataLen]
-						payloadCp = make([]byte, dataLen)
-						copy(payloadCp, payload) // Make a copy to avoid overloading []frame space
-
-						n.Address = addr
-						n.Program = progID
-						n.Data = payloadCp
-						n.Rssi = rssi
+						n := alloc.decodeRadioFrame(frame, format)
+						if cfg.rawFrames {
+							n.Raw = make([]byte, len(frame))
+							copy(n.Raw, frame)
+						}
+						cfg.stats.update(func(s *Stats) {
+							s.RxFrames++
+							s.LastRxFrame = time.Now()
+						})
 						outFrame <- n // send newly parsed packet on its way
 					}
 					if frame[0] == 0xBA { // Control cmd reply
-						replData := make([]byte, uint8(frame[3]))
-						copy(replData, frame[4:4+uint8(frame[3])])
-						ctlFrame := NpiControl{
-							Command: uint8(frame[1]),
-							Status:  uint8(frame[2]),
-							Reply:   replData,
+						ctlFrame, err := decodeControlReply(frame)
+						if err != nil {
+							log.Printf("npiPhyReader WARNING: %v; dropping", err)
+							cfg.stats.update(func(s *Stats) { s.RxLengthErrors++ })
+						} else {
+							cfg.stats.update(func(s *Stats) { s.RxCtrlReplies++ })
+							if ctlFrame.Command == CONTROL_SQUELCH_HOST || ctlFrame.Command == CONTROL_UNSQUELCH_HOST {
+								// Losing one of these would leave the writer squelched, or writing into a full MCU
+								select {
+								case ctrlReply <- ctlFrame:
+								case <-halt:
+									return
+								}
+							} else {
+								select {
+								case ctrlReply <- ctlFrame:
+								default:
+									// Never stall the serial reader (and with it, OTA reception) behind a busy RunNPI
+									log.Printf("npiPhyReader WARNING: control reply buffer full; dropping reply to Command=%02X", ctlFrame.Command)
+									cfg.stats.update(func(s *Stats) { s.CtrlReplyDrops++ })
+								}
+							}
 						}
-						ctrlReply <- ctlFrame
 					}
-				} // Else Checksum failed; ignore the whole frame
+				} else { // Checksum failed; ignore the whole frame
+					cfg.stats.update(func(s *Stats) { s.RxChecksumErrors++ })
+					// A frame never consumes more than payloadLen bytes, but a truncated one fills that budget from
+					// the start of the next frame.  Rescan what it consumed so that frame isn't lost along with it.
+					if i := nextStartChar(frame[1:]); i >= 0 {
+						rescan := append(append([]byte(nil), frame[1+i:]...), serbuf[1:]...)
+						frame = frame[0:maxFrameLen]
+						framePos = 0
+						payloadLen = 0
+						xor = 0
+						serbuf = rescan
+						continue
+					}
+				}
 				// Reset []frame buffer
-				frame = frame[0:256]
+				frame = frame[0:maxFrameLen]
 				framePos = 0
 				payloadLen = 0
+				xor = 0
 			}
 			serbuf = serbuf[1:]
 		}
+		if l > 0 {
+			lastRead = time.Now()
+		}
+	}
+}
+
+// nextStartChar returns the index of the first frame start character in b, or -1 if there is none
+func nextStartChar(b []byte) int {
+	for i, c := range b {
+		if c == 0xAE || c == 0xBA {
+			return i
+		}
+	}
+	return -1
+}
+
+// isTransientReadError reports whether a PHY read error is worth retrying rather than a sign the device is gone
+func isTransientReadError(err error) bool {
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	var t interface{ Timeout() bool }
+	if errors.As(err, &t) && t.Timeout() {
+		return true
+	}
+	var tmp interface{ Temporary() bool }
+	return errors.As(err, &tmp) && tmp.Temporary()
+}
+
+// decodeRadioFrame parses a complete, checksum-verified 0xAE frame laid out per format.  frame must have been
+// delimited by its own dataLen field, as npiPhyReader does, so its length always agrees with that field.
+func decodeRadioFrame(frame []byte, format FrameFormat) *NpiRadioFrame {
+	return (*rxAllocator)(nil).decodeRadioFrame(frame, format)
+}
+
+// rxAllocator carves received frames and their payloads out of larger slabs, so the reader's hot path costs a heap
+// allocation every few dozen frames rather than two per frame.  Nothing is ever recycled: handlers may keep a frame
+// or its Data indefinitely, which merely keeps that slab alive.  A nil *rxAllocator allocates each frame separately.
+type rxAllocator struct {
+	frames []NpiRadioFrame
+	data   []byte
+}
+
+// Slab sizes for rxAllocator
+const (
+	rxSlabFrames = 64
+	rxSlabBytes  = 4096
+)
+
+// frame returns a zeroed NpiRadioFrame
+func (a *rxAllocator) frame() *NpiRadioFrame {
+	if a == nil {
+		return new(NpiRadioFrame)
+	}
+	if len(a.frames) == 0 {
+		a.frames = make([]NpiRadioFrame, rxSlabFrames)
+	}
+	n := &a.frames[0]
+	a.frames = a.frames[1:]
+	return n
+}
+
+// bytes returns a zeroed slice of length n, capped so an append by its owner can't run into its neighbour
+func (a *rxAllocator) bytes(n int) []byte {
+	if a == nil {
+		return make([]byte, n)
 	}
+	if n > len(a.data) {
+		a.data = make([]byte, rxSlabBytes)
+	}
+	b := a.data[:n:n]
+	a.data = a.data[n:]
+	return b
+}
+
+// decodeRadioFrame is decodeRadioFrame, allocating from a
+func (a *rxAllocator) decodeRadioFrame(frame []byte, format FrameFormat) *NpiRadioFrame {
+	lenOffset := format.lengthOffset()
+	dataLen := int(frame[lenOffset])
+
+	n := a.frame()
+	n.Address = uint32(frame[1]) | (uint32(frame[2]) << 8) | (uint32(frame[3]) << 16) | (uint32(frame[4]) << 24)
+	n.Program = uint16(frame[5]) | (uint16(frame[6]) << 8)
+	n.Rssi = int8(frame[7])
+	if format == FrameFormatLQI {
+		n.LQI = frame[8]
+		n.HasLQI = true
+	}
+	n.Data = a.bytes(dataLen)
+	copy(n.Data, frame[lenOffset+1:lenOffset+1+dataLen]) // Make a copy to avoid overloading []frame space
+	return n
+}
+
+// decodeControlReply parses a complete, checksum-verified 0xBA frame, cross-checking the reply length field.
+func decodeControlReply(frame []byte) (NpiControl, error) {
+	if len(frame) < 5 {
+		return NpiControl{}, fmt.Errorf("Control reply too short (%d bytes)", len(frame))
+	}
+	replLen := int(frame[3])
+	if 4+replLen != len(frame)-1 {
+		return NpiControl{}, fmt.Errorf("Control reply length=%d disagrees with frame length %d", replLen, len(frame))
+	}
+
+	replData := make([]byte, replLen)
+	copy(replData, frame[4:4+replLen])
+	return NpiControl{
+		Command: uint8(frame[1]),
+		Status:  uint8(frame[2]),
+		Reply:   replData,
+	}, nil
 }
 
 // npiPhyWriter is a bit simpler than npiPhyReader, in that it just dumps data to the serial port.
-// The squelch feature is a neat one but it could lead to deadlocks if used without care.
+// The squelch feature is a neat one but it could lead to deadlocks if used without care; flow-state requests (flowXmit)
+// are still written while squelched, and WithMaxSquelch and LinkMgr.Unsquelch provide a way out when the MCU's
+// unsquelch never arrives.
 func npiPhyWriter(phy io.ReadWriteCloser, squelch <-chan bool,
-	frameXmit <-chan *NpiRadioFrame, ctrlXmit <-chan *NpiControl,
-	halt chan struct{}) {
+	frameXmit <-chan *NpiRadioFrame, ctrlXmit <-chan *NpiControl, flowXmit <-chan *NpiControl,
+	halt chan struct{}, started chan<- struct{}, cfg *npiOptions) {
 	var buf []byte
 	var xmitHalted bool
 	xmitHalted = false
+	var lastWrite time.Time
+
+	// writeCtrl commits a control frame, returning false if the PHY has faulted
+	writeCtrl := func(ctlFrame *NpiControl) bool {
+		if !waitInterFrameGap(halt, lastWrite, cfg.txGap) {
+			return false
+		}
+		buf = ctlFrame.Serialize()
+		err := phyWrite(phy, buf, cfg)
+		lastWrite = time.Now()
+		if err != nil {
+			cfg.stats.update(func(s *Stats) { s.TxWriteErrors++ })
+			select {
+			case <-halt: // can't close an already-closed channel
+			default:
+				close(halt) // Notify parent that something is wrong with the PHY
+			}
+			return false
+		}
+		//log.Printf("npiPhyWriter: Committed a Ctrl frame of writeLen=%d, Command=%02x", w, ctlFrame.Command)
+		return true
+	}
+
+	close(started)
 	for {
 		select {
 		case <-halt:
 			return
+		case <-cfg.unsquelch:
+			// Not squelched; nothing to clear
 		case s := <-squelch:
 			xmitHalted = s
 			log.Printf("npiPhyWriter: xmitHalted=%v", xmitHalted)
+			var timer *time.Timer
+			var expired <-chan time.Time
+			if xmitHalted && cfg.maxSquelch > 0 {
+				timer = time.NewTimer(cfg.maxSquelch)
+				expired = timer.C
+			}
 			for xmitHalted == true {
-				// While npiPhyWriter is squelched, ignore all channels except the squelch channel and
-				// the RunNPI halt request.
+				// While npiPhyWriter is squelched, ignore all channels except the squelch channel, flow-state requests
+				// (whose reply re-syncs the squelch), the host-side unsquelch/max-squelch escapes and the RunNPI halt
+				// request.
 				select {
 				case <-halt:
 					return
+				case ctlFrame := <-flowXmit:
+					if !writeCtrl(ctlFrame) {
+						return
+					}
 				case s := <-squelch:
 					xmitHalted = s
 					log.Printf("npiPhyWriter: xmitHalted=%v", xmitHalted)
+				case <-cfg.unsquelch:
+					xmitHalted = false
+					log.Printf("npiPhyWriter: squelch cleared by host")
+					cfg.stats.update(func(s *Stats) { s.SquelchTimeouts++ })
+				case <-expired:
+					xmitHalted = false
+					log.Printf("npiPhyWriter: WARNING: no unsquelch from MCU within %v, resuming writes", cfg.maxSquelch)
+					cfg.stats.update(func(s *Stats) { s.SquelchTimeouts++ })
 				}
 			}
+			if timer != nil {
+				timer.Stop()
+			}
 		case otaFrame := <-frameXmit:
-			buf = otaFrame.Serialize()
-			_, err := phy.Write(buf)
+			if !waitInterFrameGap(halt, lastWrite, cfg.txGap) {
+				return
+			}
+			buf = otaFrame.wireBytes()
+			err := phyWrite(phy, buf, cfg)
+			lastWrite = time.Now()
+			if otaFrame.TxDone != nil {
+				otaFrame.TxDone(err)
+			}
 			if err != nil {
+				cfg.stats.update(func(s *Stats) { s.TxWriteErrors++ })
 				select {
 				case <-halt: // can't close an already-closed channel
 				default:
@@ -227,19 +589,62 @@ func npiPhyWriter(phy io.ReadWriteCloser, squelch <-chan bool,
 				}
 				return
 			}
+			cfg.stats.update(func(s *Stats) { s.TxFrames++ })
 			//log.Printf("npiPhyWriter: Committed an OTA frame of writeLen=%d, dstAddr=%08x, program ID=%04x", w, otaFrame.Address, otaFrame.Program)
 		case ctlFrame := <-ctrlXmit:
-			buf = ctlFrame.Serialize()
-			_, err := phy.Write(buf)
-			if err != nil {
-				select {
-				case <-halt: // can't close an already-closed channel
-				default:
-					close(halt) // Notify parent that something is wrong with the PHY
-				}
+			if !writeCtrl(ctlFrame) {
+				return
+			}
+		case ctlFrame := <-flowXmit:
+			if !writeCtrl(ctlFrame) {
 				return
 			}
-			//log.Printf("npiPhyWriter: Committed a Ctrl frame of writeLen=%d, Command=%02x", w, ctlFrame.Command)
 		}
 	}
 }
+
+// ErrWriteTimeout is the error a PHY write fails with when it doesn't complete within WithWriteTimeout
+var ErrWriteTimeout = errors.New("PHY write timed out")
+
+// phyWrite writes buf to phy, giving up with ErrWriteTimeout (and counting it) after cfg.writeTimeout.  The serial
+// library offers no write deadline, so the write runs in its own goroutine; an abandoned one returns once RunNPI closes
+// the faulted PHY.
+func phyWrite(phy io.Writer, buf []byte, cfg *npiOptions) error {
+	if cfg.writeTimeout <= 0 {
+		_, err := phy.Write(buf)
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := phy.Write(buf)
+		done <- err
+	}()
+	timer := time.NewTimer(cfg.writeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		log.Printf("npiPhyWriter: WARNING: write of %d bytes still blocked after %v, declaring the PHY faulted", len(buf), cfg.writeTimeout)
+		cfg.stats.update(func(s *Stats) { s.TxWriteTimeouts++ })
+		return ErrWriteTimeout
+	}
+}
+
+// waitInterFrameGap delays until gap has passed since lastWrite (see WithTxInterFrameGap).  Returns false if halt was
+// closed while waiting.
+func waitInterFrameGap(halt chan struct{}, lastWrite time.Time, gap time.Duration) bool {
+	if gap <= 0 {
+		return true
+	}
+	wait := gap - time.Since(lastWrite)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-halt:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
@@ -0,0 +1,30 @@
+package smacbase
+
+// npi_programs.go - Program IDs of the standard SMac node programs
+//
+// Program IDs 0x2000 through 0x20FF are reserved for the standard programs below (and future ones); pick IDs outside
+// that range for application-specific programs.  0xFFFF carries free-form debug text.
+
+// Standard program IDs
+const (
+	ProgDeviceID     uint16 = 0x2000 // Device ID registration/inquiry: devID (LE16) [+ description]
+	ProgThermocouple uint16 = 0x2001 // Thermocouple and ambient temperature
+	ProgTempHum      uint16 = 0x2002 // Temperature and relative humidity
+	ProgPingReq      uint16 = 0x2003 // Ping echo-request: token (LE16), value (LE16)
+	ProgPingReply    uint16 = 0x2004 // Ping echo-reply: the request's token and value, echoed
+	ProgDebug        uint16 = 0xFFFF // Debug text
+)
+
+var programNames = map[uint16]string{
+	ProgDeviceID:     "DeviceID",
+	ProgThermocouple: "Thermocouple",
+	ProgTempHum:      "TempHum",
+	ProgPingReq:      "PingRequest",
+	ProgPingReply:    "PingReply",
+	ProgDebug:        "Debug",
+}
+
+// ProgramName returns the name of a standard program ID, or "" if progID isn't one
+func ProgramName(progID uint16) string {
+	return programNames[progID]
+}
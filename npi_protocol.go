@@ -2,16 +2,21 @@ package smacbase
 
 import (
 	"bytes"
+	"fmt"
 	"log"
+	"sync/atomic"
 )
 
 /* SMac NPI protocol
  *
  * OTA data:
  *   0xAE         - Start Character
- *   XX XX XX XX  - 4-byte Src/DstAddr, Little-Endian
+ *   XX XX XX XX  - 4-byte Src/DstAddr, Little-Endian.  MCU->Host (received) frames carry the sender's SrcAddr; the
+ *                  local address it was sent to (IEEE or alternate) is not reported.  Host->MCU (transmit) frames
+ *                  carry the DstAddr; there is no field selecting the source, which the firmware supplies itself.
  *   YY YY        - 2-byte Program ID, Little-Endian
  *   RR           - RSSI for received packet, 8-bit Signed Integer, 0 for Transmit Packets
+ *   [QQ]         - LQI for received packet, only present with FrameFormatLQI firmware (CapFrameLQI)
  *   ZZ           - 1-byte Payload Length
  *   [payload data...]
  *   CC           - 1-byte XOR checksum
@@ -30,6 +35,13 @@ import (
  *   ZZ           - 1-byte Reply Data Length
  *   [reply data...]
  *   CC           - 1-byte XOR checksum
+ *
+ * In every frame type, CC is the XOR of each byte after the Start Character up to but not including CC itself, i.e.
+ * frame[1:len(frame)-1].  The Start Character is not covered.
+ *
+ * The MCU may also send 0xBA frames nobody asked for.  Besides the SQUELCH/UNSQUELCH_HOST flow control, firmware
+ * diagnostics arrive this way as CONTROL_LOG_MESSAGE with Status OK and the message text (no terminator) as the
+ * reply data.
  */
 
 // SMACNPI Control Commands
@@ -46,6 +58,11 @@ const (
 	CONTROL_SET_TX_TICK        = 0x09
 	CONTROL_GET_IDENTIFIER     = 0x10
 	CONTROL_SET_LEDS           = 0x11
+	CONTROL_GET_CAPABILITIES   = 0x12
+	CONTROL_GET_FLOW_STATE     = 0x13
+	CONTROL_LOG_MESSAGE        = 0x14 // MCU->Host only, never requested: debug text, see LinkMgr.MCUMessages
+	CONTROL_GET_MODULATION     = 0x15
+	CONTROL_SET_MODULATION     = 0x16
 
 	CONTROL_STATUS_OK                      = 0x00
 	CONTROL_STATUS_UNKNOWN_CMD             = 0x01
@@ -85,6 +102,15 @@ func XorBuffer(buf []byte) uint8 {
 	return xor
 }
 
+// VerifyFrameChecksum reports whether a complete NPI frame (start char through checksum) carries a valid checksum,
+// i.e. its final byte is the XOR of every byte between the start char and the checksum.
+func VerifyFrameChecksum(frame []byte) bool {
+	if len(frame) < 2 {
+		return false
+	}
+	return frame[len(frame)-1] == XorBuffer(frame[1:len(frame)-1])
+}
+
 // NpiControl represents a command request and its reply.  To assist with synchronized wait-for-reply,
 //   a Pend channel is defined to wait for the MCU's reply.
 type NpiControl struct {
@@ -93,6 +119,18 @@ type NpiControl struct {
 	Data     []byte
 	Reply    []byte
 	PendChan chan struct{}
+
+	abandoned int32 // Set (atomically) once the requester has stopped waiting for the reply
+}
+
+// abandon records that nobody is waiting for n's reply any more, so RunNPI passes the next reply to this command on
+// to a later request instead (see popCtrlRequest)
+func (n *NpiControl) abandon() {
+	atomic.StoreInt32(&n.abandoned, 1)
+}
+
+func (n *NpiControl) isAbandoned() bool {
+	return atomic.LoadInt32(&n.abandoned) != 0
 }
 
 // NewControl is the canonical way to create a new command request object
@@ -132,16 +170,126 @@ func (n *NpiControl) Pend() {
 	}
 }
 
+// Capabilities is the feature bitfield returned by CONTROL_GET_CAPABILITIES (a 4-byte Little-Endian reply)
+type Capabilities uint32
+
+// Capability flags
+const (
+	CapHighPowerTX Capabilities = 1 << iota // TX power above 12dBm (boosted PA build)
+	CapCCA                                  // Clear-channel assessment before transmit
+	CapDutyCycle                            // Receiver duty-cycling
+	CapNVConfig                             // Radio configuration persisted in non-volatile storage
+	CapCRC16                                // CRC16-protected NPI frames
+	CapMCUHealth                            // MCU health/diagnostic reporting
+	CapFrameLQI                             // Received OTA frames carry LQI after the RSSI byte (FrameFormatLQI)
+)
+
+// Has reports whether every flag in c is set
+func (caps Capabilities) Has(c Capabilities) bool {
+	return caps&c == c
+}
+
+// FrameFormat selects the OTA frame layout the NPI firmware emits for received frames.  A LinkMgr picks it from
+// CapFrameLQI, unless told otherwise with WithFrameFormat.
+type FrameFormat uint8
+
+const (
+	FrameFormatBasic FrameFormat = iota // RSSI only; the original smac_npi layout
+	FrameFormatLQI                      // RSSI followed by a 1-byte LQI
+)
+
+// ModulationMode is a radio data rate/modulation setting, as carried by CONTROL_GET/SET_MODULATION (1 byte)
+type ModulationMode uint8
+
+const (
+	Modulation50kGFSK  ModulationMode = iota // 50kbps 2-GFSK; the firmware default
+	ModulationLRM5k                          // SimpleLink Long Range Mode, 5kbps
+	ModulationLRM625                         // SimpleLink Long Range Mode, 625bps
+	ModulationGFSK200k                       // 200kbps 2-GFSK
+)
+
+// Valid reports whether m is a mode the firmware defines
+func (m ModulationMode) Valid() bool {
+	return m <= ModulationGFSK200k
+}
+
+func (m ModulationMode) String() string {
+	switch m {
+	case Modulation50kGFSK:
+		return "50kbps GFSK"
+	case ModulationLRM5k:
+		return "Long Range 5kbps"
+	case ModulationLRM625:
+		return "Long Range 625bps"
+	case ModulationGFSK200k:
+		return "200kbps GFSK"
+	}
+	return fmt.Sprintf("ModulationMode(%d)", uint8(m))
+}
+
+// lengthOffset returns the position of the Payload Length byte within a received OTA frame
+func (f FrameFormat) lengthOffset() int {
+	if f == FrameFormatLQI {
+		return 9
+	}
+	return 8
+}
+
+// MaxPayload is the largest data payload an OTA frame can carry, limited by its 1-byte Payload Length field
+const MaxPayload = 255
+
 // NpiRadioFrame represents an OTA frame with Address representing the
 // SrcAddr if it's a received frame, and DstAddr if it's a frame-to-be-sent.
+// The NPI protocol gives the host no way to choose the source address of a transmitted frame, so frames can't be
+// sent "from" the alternate address; see the protocol description at the top of this file.
 type NpiRadioFrame struct {
 	Address uint32
 	Program uint16
 	Rssi    int8
 	Data    []byte
+	FrameMeta
+
+	// TxDone, if set on a frame submitted for transmission, is called by the PHY writer once the frame's bytes have
+	// been written (err == nil) or the write failed.  It runs on the writer goroutine and must not block.
+	TxDone func(err error)
+
+	// EmitRSSI makes Serialize write Rssi into the RSSI byte instead of 0, so test tooling can re-serialize a frame as
+	// it would arrive from the MCU.  Leave it false for real transmits.
+	EmitRSSI bool
+
+	raw []byte // Pre-serialized bytes written verbatim in place of Serialize() (LinkMgr.SendRaw)
+}
+
+// FrameMeta holds supplementary information about a received frame which isn't part of its decoded OTA fields.
+// There is deliberately no record of which local address (IEEE or alternate) the frame was sent to: the NPI firmware
+// doesn't report it, so the host can't tell.
+type FrameMeta struct {
+	Raw       []byte    // Exact frame bytes from start char through checksum; only populated when RunNPI has WithRawFrames(true)
+	LQI       uint8     // Link quality indicator, only valid if HasLQI
+	HasLQI    bool      // The firmware's frame format carries LQI (FrameFormatLQI)
+	Direction Direction // DirTX for a transmitted frame echoed into RX dispatch (LinkMgr.SetLoopbackTX)
+}
+
+// Direction tells received frames apart from transmitted ones where both can appear
+type Direction uint8
+
+const (
+	DirRX Direction = iota // Received over the air
+	DirTX                  // Transmitted by this base station
+)
+
+// String returns "RX" or "TX"
+func (d Direction) String() string {
+	switch d {
+	case DirRX:
+		return "RX"
+	case DirTX:
+		return "TX"
+	}
+	return fmt.Sprintf("Direction(%d)", uint8(d))
 }
 
-// NewRadioFrame is the canonical way to create a new SMac packet
+// NewRadioFrame is the canonical way to create a new SMac packet.  For a frame to be sent, addr is the destination.
 func NewRadioFrame(addr uint32, prog uint16, data []byte) *NpiRadioFrame {
 	n := new(NpiRadioFrame)
 	n.Address = addr
@@ -151,6 +299,14 @@ func NewRadioFrame(addr uint32, prog uint16, data []byte) *NpiRadioFrame {
 	return n
 }
 
+// wireBytes returns the bytes npiPhyWriter should commit for this frame
+func (n *NpiRadioFrame) wireBytes() []byte {
+	if n.raw != nil {
+		return n.raw
+	}
+	return n.Serialize()
+}
+
 // Serialize produces a bytestream for the radio frame in question
 func (n *NpiRadioFrame) Serialize() []byte {
 	var buf bytes.Buffer
@@ -162,7 +318,11 @@ func (n *NpiRadioFrame) Serialize() []byte {
 	buf.WriteByte(uint8((n.Address >> 24) & 0xFF))
 	buf.WriteByte(uint8(n.Program & 0xFF))
 	buf.WriteByte(uint8(n.Program >> 8))
-	buf.WriteByte(0) // RSSI field is empty for transmit packets
+	if n.EmitRSSI {
+		buf.WriteByte(uint8(n.Rssi))
+	} else {
+		buf.WriteByte(0) // RSSI field is empty for transmit packets
+	}
 	buf.WriteByte(uint8(len(n.Data)))
 	l, err := buf.Write(n.Data)
 	if err != nil {
@@ -0,0 +1,192 @@
+package smacbase
+
+import (
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// npi_reconnect.go - PHY session supervision and automatic reconnection
+//
+// Each PHY "session" is one run of RunNPI over one opened PHY, with its own fault channel.  The LinkMgr's channels
+// (FrameTX, FrameRX, CtrlTX) and handler registries outlive the session, so after a reconnect a new RunNPI picks
+// up right where the old one left off.  NpiDied is only closed by Close(), or by a PHY fault when auto-reconnect
+// is disabled.
+
+// RadioConfig bundles the radio settings a base station normally applies at startup
+type RadioConfig struct {
+	AlternateAddress uint32 // 0 disables the alternate address
+	Frequency        uint32 // RF center frequency in Hz
+	Power            int8   // TX power in dBm
+	RxOn             bool
+}
+
+// CenterFreqMHz returns Frequency in MHz
+func (c RadioConfig) CenterFreqMHz() float64 {
+	return float64(c.Frequency) / 1e6
+}
+
+// ReconnectBackoff is the policy for spacing out attempts to re-open a faulted PHY.  The first attempt comes Initial
+// after the fault; each failed attempt multiplies the wait by Multiplier, up to Max.  Each wait is then varied at
+// random by up to Jitter (a fraction, e.g. 0.2 for +/-20%) so several base stations on one host don't retry in
+// lockstep.  The zero value disables automatic reconnection.
+type ReconnectBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration // 0 = no limit
+	Multiplier float64       // Values below 1 are treated as 1, i.e. a fixed interval
+	Jitter     float64
+}
+
+// DefaultReconnectBackoff suits USB-serial adapters, which can take a few seconds to reappear after a replug
+var DefaultReconnectBackoff = ReconnectBackoff{
+	Initial:    500 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// ConstantBackoff retries every interval, without jitter
+func ConstantBackoff(interval time.Duration) ReconnectBackoff {
+	return ReconnectBackoff{Initial: interval, Max: interval, Multiplier: 1}
+}
+
+// delay returns the wait before reconnect attempt number attempt (0 for the first), given a random number in [0,1)
+func (b ReconnectBackoff) delay(attempt int, random float64) time.Duration {
+	mult := b.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	d := float64(b.Initial) * math.Pow(mult, float64(attempt))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	d *= 1 + b.Jitter*(2*random-1)
+	return time.Duration(d)
+}
+
+// EnableAutoReconnect makes the LinkMgr keep trying to re-open its PHY after a fault, spaced out per backoff (e.g.
+// DefaultReconnectBackoff), rather than closing NpiDied.  The backoff starts over after each successful reconnect.
+// Handler registrations are preserved; once the PHY is back the writer is re-synced with the MCU's flow control state
+// (see GetFlowControlState) and the last ApplyRadioConfig is re-applied.  Health reports the progress of an outage.
+// A zero ReconnectBackoff disables automatic reconnection.
+func (l *LinkMgr) EnableAutoReconnect(backoff ReconnectBackoff) {
+	l.sessionMutex.Lock()
+	l.reconnect = backoff
+	l.sessionMutex.Unlock()
+}
+
+// ApplyRadioConfig sets the alternate address, center frequency, TX power and RX on/off, retrying each step once on
+// a Ctrl timeout.  The configuration is remembered so it can be re-applied after an automatic reconnect.
+func (l *LinkMgr) ApplyRadioConfig(cfg RadioConfig) error {
+	steps := []func() error{
+		func() error { return l.SetAlternateAddress(cfg.AlternateAddress) },
+		func() error { return l.SetFrequency(cfg.Frequency) },
+		func() error { return l.SetPower(cfg.Power) },
+		func() error { return l.On(cfg.RxOn) },
+	}
+	for _, step := range steps {
+		err := step()
+		if _, ok := err.(CtrlTimeout); ok {
+			// Try once more
+			err = step()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	l.sessionMutex.Lock()
+	l.radioConfig = &cfg
+	l.sessionMutex.Unlock()
+	return nil
+}
+
+// startSession launches RunNPI over phy along with a supervisor goroutine watching for it to fault.  The returned
+// channel is closed once RunNPI is ready to accept frames and control requests.
+func (l *LinkMgr) startSession(phy io.ReadWriteCloser) <-chan struct{} {
+	faulted := make(chan struct{})
+	l.sessionMutex.Lock()
+	l.Phy = phy
+	l.sessionUp = true
+	l.sessionMutex.Unlock()
+
+	ready := make(chan struct{})
+	opts := append(append([]Option(nil), l.phyOpts...), WithReady(ready))
+	go RunNPI(phy, l.FrameTX, l.FrameRX, l.CtrlTX, faulted, opts...)
+	go l.superviseSession(faulted)
+	return ready
+}
+
+// superviseSession waits for either Close() or a PHY fault.  On a fault it either declares the link dead or, with
+// auto-reconnect enabled, keeps trying to re-open the PHY and start a new session.
+func (l *LinkMgr) superviseSession(faulted chan struct{}) {
+	select {
+	case <-l.NpiDied:
+		// Close() was called; bring down the RunNPI session
+		select {
+		case <-faulted:
+		default:
+			close(faulted)
+		}
+		return
+	case <-faulted:
+	}
+	l.sessionMutex.Lock()
+	l.sessionUp = false
+	l.sessionMutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		l.sessionMutex.Lock()
+		backoff := l.reconnect
+		l.sessionMutex.Unlock()
+		if backoff.Initial <= 0 {
+			select {
+			case <-l.NpiDied: // can't close an already-closed channel
+			default:
+				close(l.NpiDied)
+			}
+			return
+		}
+
+		wait := backoff.delay(attempt, rand.Float64())
+		l.sessionMutex.Lock()
+		l.reconnectAttempts = attempt
+		l.nextReconnect = time.Now().Add(wait)
+		l.sessionMutex.Unlock()
+		select {
+		case <-l.NpiDied:
+			return
+		case <-time.After(wait):
+		}
+		phy, err := l.openPhy()
+		if err != nil {
+			log.Printf("LinkMgr: reconnect attempt %d failed: %v", attempt+1, err)
+			continue
+		}
+		l.stats.update(func(s *Stats) { s.Reconnects++ })
+		l.sessionMutex.Lock()
+		l.reconnectAttempts = 0
+		l.nextReconnect = time.Time{}
+		l.sessionMutex.Unlock()
+		<-l.startSession(phy)
+
+		// The MCU may have been left squelched by the previous session; the new writer assumes it isn't
+		if _, err = l.GetFlowControlState(); err != nil {
+			log.Printf("LinkMgr: reading flow control state after reconnect failed: %v", err)
+		}
+		l.detectFrameFormat() // The device may have come back with different firmware
+
+		l.sessionMutex.Lock()
+		cfg := l.radioConfig
+		l.sessionMutex.Unlock()
+		if cfg != nil {
+			err = l.ApplyRadioConfig(*cfg)
+			if err != nil {
+				log.Printf("LinkMgr: re-applying radio config after reconnect failed: %v", err)
+			}
+		}
+		return
+	}
+}
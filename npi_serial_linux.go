@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package smacbase
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+// npi_serial_linux.go - Modem control line handling for serial PHYs on Linux (line speed is in npi_baud_linux.go)
+
+// setControlLines raises or lowers DTR/RTS on a serial port opened by NewSerialPHY; a nil setting is left alone.
+func setControlLines(phy io.ReadWriteCloser, dtr, rts *bool) error {
+	f, ok := phy.(interface{ Fd() uintptr })
+	if !ok {
+		return errors.New("PHY does not expose a file descriptor; cannot set DTR/RTS")
+	}
+	lines := []struct {
+		setting *bool
+		bit     int32
+	}{{dtr, syscall.TIOCM_DTR}, {rts, syscall.TIOCM_RTS}}
+	for _, line := range lines {
+		if line.setting == nil {
+			continue
+		}
+		req := uintptr(syscall.TIOCMBIC)
+		if *line.setting {
+			req = syscall.TIOCMBIS
+		}
+		bits := line.bit // ioctl takes a C int
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(&bits)))
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
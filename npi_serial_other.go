@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package smacbase
+
+import (
+	"errors"
+	"io"
+)
+
+// npi_serial_other.go - Modem control line handling is only implemented for Linux so far
+
+// setControlLines is unsupported on this platform
+func setControlLines(phy io.ReadWriteCloser, dtr, rts *bool) error {
+	return errors.New("Setting DTR/RTS is not supported on this platform")
+}
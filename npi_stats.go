@@ -0,0 +1,194 @@
+package smacbase
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// npi_stats.go - Counters collected by the NPI PHY goroutines and the LinkMgr
+
+// Stats is a point-in-time snapshot of the link counters
+type Stats struct {
+	RxFrames          uint64 // Valid OTA frames parsed and handed to the RX channel
+	RxCtrlReplies     uint64 // Valid control replies parsed
+	RxChecksumErrors  uint64 // Frames dropped due to a bad XOR checksum
+	RxLengthErrors    uint64 // Control replies dropped because the length field disagreed with the frame length
+	RxTruncatedFrames uint64 // Partial frames abandoned after the line went quiet mid-frame (see WithFrameGapTimeout)
+	RxTransientErrors uint64 // PHY read errors retried rather than faulting the link (see WithReadRetry)
+	CtrlReplyDrops    uint64 // Control replies dropped because RunNPI had fallen behind (see WithCtrlReplyBuffer)
+	TxFrames          uint64 // OTA frames written to the PHY
+	TxWriteErrors     uint64 // PHY writes (OTA or control) which failed, faulting the PHY
+	TxWriteTimeouts   uint64 // PHY writes abandoned for blocking too long (see WithWriteTimeout); included in TxWriteErrors
+
+	UnsolicitedCtrlReplies uint64 // Control replies which arrived with no Ctrl() waiting on them
+	Reconnects             uint64 // Successful PHY re-opens after a fault (see EnableAutoReconnect)
+	InboxDrops             uint64 // Frames dropped because an Inbox or Subscribe channel was full
+	CtrlObserverDrops      uint64 // Control replies not shown to control observers because they were falling behind
+	MCUMessageDrops        uint64 // Firmware log messages dropped because MCUMessages() was full
+	LoopbackDrops          uint64 // Transmitted frames not echoed into RX dispatch because FrameRX was full (see SetLoopbackTX)
+	DispatchTraceDrops     uint64 // Dispatch traces dropped because DispatchTraces() was full (see SetDispatchTrace)
+	SquelchTimeouts        uint64 // Squelches cleared by the host (WithMaxSquelch expiry or LinkMgr.Unsquelch) instead of the MCU
+	CtrlInFlight           int    // Ctrl requests currently awaiting their reply
+
+	RXBacklog int // Received frames queued for the handlers (LinkMgr.Stats only)
+	TXBacklog int // Frames queued for the PHY writer (LinkMgr.Stats only)
+
+	LastRxFrame   time.Time // When the most recent valid OTA frame was parsed
+	LastCtrlReply time.Time // When the most recent Ctrl() round-trip completed
+
+	CtrlLatency          LatencySummary           // Ctrl() round-trip times across all commands
+	CtrlLatencyByCommand map[uint8]LatencySummary // Ctrl() round-trip times per command code
+}
+
+// LatencySummary describes a distribution of round-trip times.  P95 is computed over the most recent
+// latencyWindow samples; the other fields cover every sample.
+type LatencySummary struct {
+	Count uint64
+	Min   time.Duration
+	Max   time.Duration
+	Mean  time.Duration
+	P95   time.Duration
+}
+
+// latencyWindow is the number of recent samples retained for percentile calculation
+const latencyWindow = 256
+
+// latencyTracker accumulates round-trip times for a LatencySummary
+type latencyTracker struct {
+	count    uint64
+	sum      time.Duration
+	min, max time.Duration
+	recent   [latencyWindow]time.Duration
+	pos      int
+}
+
+func (t *latencyTracker) record(d time.Duration) {
+	if t.count == 0 || d < t.min {
+		t.min = d
+	}
+	if d > t.max {
+		t.max = d
+	}
+	t.count++
+	t.sum += d
+	t.recent[t.pos] = d
+	t.pos = (t.pos + 1) % latencyWindow
+}
+
+func (t *latencyTracker) summary() LatencySummary {
+	if t.count == 0 {
+		return LatencySummary{}
+	}
+	n := latencyWindow
+	if t.count < latencyWindow {
+		n = int(t.count)
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, t.recent[:n])
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return LatencySummary{
+		Count: t.count,
+		Min:   t.min,
+		Max:   t.max,
+		Mean:  t.sum / time.Duration(t.count),
+		P95:   samples[(n*95+99)/100-1],
+	}
+}
+
+// HealthStatus summarizes the state of a LinkMgr for liveness probes, e.g. an HTTP /healthz endpoint
+type HealthStatus struct {
+	LinkUp             bool          // The PHY is open and the link hasn't been closed or declared dead
+	SinceLastRxFrame   time.Duration // -1 if no frame has been received yet
+	SinceLastCtrlReply time.Duration // -1 if no Ctrl() round-trip has completed yet
+	Reconnects         uint64
+	ReconnectAttempts  int       // Failed reconnect attempts in the current outage (see EnableAutoReconnect)
+	NextReconnect      time.Time // When the next reconnect attempt is due; zero unless one is pending
+	Stats              Stats
+}
+
+// NpiStats accumulates counters on behalf of RunNPI and its reader/writer goroutines.  It is safe for concurrent use.
+type NpiStats struct {
+	mutex       sync.Mutex
+	stats       Stats
+	ctrlLatency latencyTracker
+	ctrlByCmd   map[uint8]*latencyTracker
+}
+
+// NewNpiStats creates an empty set of counters
+func NewNpiStats() *NpiStats {
+	return new(NpiStats)
+}
+
+// Snapshot returns a copy of the current counters
+func (n *NpiStats) Snapshot() Stats {
+	if n == nil {
+		return Stats{}
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	s := n.stats
+	s.CtrlLatency = n.ctrlLatency.summary()
+	s.CtrlLatencyByCommand = make(map[uint8]LatencySummary)
+	for cmd, t := range n.ctrlByCmd {
+		s.CtrlLatencyByCommand[cmd] = t.summary()
+	}
+	return s
+}
+
+// recordCtrlLatency adds a Ctrl() round-trip time for command cmd
+func (n *NpiStats) recordCtrlLatency(cmd uint8, d time.Duration) {
+	if n == nil {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.ctrlLatency.record(d)
+	if n.ctrlByCmd == nil {
+		n.ctrlByCmd = make(map[uint8]*latencyTracker)
+	}
+	t := n.ctrlByCmd[cmd]
+	if t == nil {
+		t = new(latencyTracker)
+		n.ctrlByCmd[cmd] = t
+	}
+	t.record(d)
+}
+
+// update applies f to the counters under lock; a nil *NpiStats silently discards the update
+func (n *NpiStats) update(f func(s *Stats)) {
+	if n == nil {
+		return
+	}
+	n.mutex.Lock()
+	f(&n.stats)
+	n.mutex.Unlock()
+}
+
+// Health gathers the link state, recent-activity ages and counters into a single HealthStatus
+func (l *LinkMgr) Health() HealthStatus {
+	var h HealthStatus
+	h.Stats = l.Stats()
+	h.Reconnects = h.Stats.Reconnects
+
+	l.sessionMutex.Lock()
+	h.LinkUp = l.sessionUp
+	h.ReconnectAttempts = l.reconnectAttempts
+	h.NextReconnect = l.nextReconnect
+	l.sessionMutex.Unlock()
+	select {
+	case <-l.NpiDied:
+		h.LinkUp = false
+	default:
+	}
+
+	h.SinceLastRxFrame = -1
+	if !h.Stats.LastRxFrame.IsZero() {
+		h.SinceLastRxFrame = time.Since(h.Stats.LastRxFrame)
+	}
+	h.SinceLastCtrlReply = -1
+	if !h.Stats.LastCtrlReply.IsZero() {
+		h.SinceLastCtrlReply = time.Since(h.Stats.LastCtrlReply)
+	}
+	return h
+}
@@ -2,9 +2,17 @@ package smacbase
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -37,7 +45,7 @@ func TestNpiRadioFrameSerialize(t *testing.T) {
 	n.Address = 0xDEADBEEF
 	n.Program = 0x6933
 	n.Data = []byte("SIXTY NINE")
-	ExpectedSerializedLength := 19
+	ExpectedSerializedLength := 20
 
 	srl := n.Serialize()
 	var hexstream string
@@ -59,6 +67,7 @@ type TestLink struct {
 	Dump        bytes.Buffer
 	WaitForMore chan bool
 	IsActive    bool
+	ChunkSize   int // Largest number of bytes returned per Read; 0 means 10
 }
 
 func (l *TestLink) Read(p []byte) (int, error) {
@@ -71,9 +80,13 @@ func (l *TestLink) Read(p []byte) (int, error) {
 			break
 		}
 	}
+	chunk := l.ChunkSize
+	if chunk == 0 {
+		chunk = 10
+	}
 	maxLen := len(p)
-	if maxLen > 10 {
-		maxLen = 10
+	if maxLen > chunk {
+		maxLen = chunk
 	}
 	if maxLen < len(l.CannedData) {
 		copy(p, l.CannedData[:maxLen])
@@ -104,9 +117,192 @@ func (l *TestLink) Close() error {
 	return nil
 }
 
+// FakeMCU is an in-memory PHY which plays the part of the NPI microcontroller: it decodes frames written by the host,
+// answers control requests, and lets a test inject bytes for the host to read.
+type FakeMCU struct {
+	mutex    sync.Mutex
+	toHost   []byte
+	fromHost []byte
+	more     chan struct{}
+	closed   chan struct{}
+	readErr  error
+	writeErr error
+
+	Replies  map[uint8][]byte // Reply data by command; commands not listed get an empty reply
+	Status   map[uint8]uint8  // Status by command; commands not listed get CONTROL_STATUS_OK
+	Silent   bool             // When set, control requests are recorded but never answered
+	Commands []uint8          // Control commands received, in order
+	Requests [][]byte         // Config data of each control command received, in the same order
+	Frames   []*NpiRadioFrame // OTA frames received, in order
+}
+
+func NewFakeMCU() *FakeMCU {
+	m := new(FakeMCU)
+	m.more = make(chan struct{}, 1)
+	m.closed = make(chan struct{})
+	m.Replies = make(map[uint8][]byte)
+	m.Status = make(map[uint8]uint8)
+	return m
+}
+
+func (m *FakeMCU) Read(p []byte) (int, error) {
+	for {
+		m.mutex.Lock()
+		if m.readErr != nil {
+			err := m.readErr
+			m.mutex.Unlock()
+			return 0, err
+		}
+		if len(m.toHost) > 0 {
+			n := copy(p, m.toHost)
+			m.toHost = m.toHost[n:]
+			m.mutex.Unlock()
+			return n, nil
+		}
+		m.mutex.Unlock()
+		select {
+		case <-m.more:
+		case <-m.closed:
+			return 0, errors.New("FakeMCU closed")
+		}
+	}
+}
+
+func (m *FakeMCU) Write(p []byte) (int, error) {
+	select {
+	case <-m.closed:
+		return 0, errors.New("FakeMCU closed")
+	default:
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.writeErr != nil {
+		return 0, m.writeErr
+	}
+	m.fromHost = append(m.fromHost, p...)
+	for len(m.fromHost) > 0 {
+		var frameLen int
+		switch m.fromHost[0] {
+		case 0xBD:
+			if len(m.fromHost) < 3 {
+				return len(p), nil
+			}
+			frameLen = 4 + int(m.fromHost[2])
+		case 0xAE:
+			if len(m.fromHost) < 9 {
+				return len(p), nil
+			}
+			frameLen = 10 + int(m.fromHost[8])
+		default:
+			m.fromHost = m.fromHost[1:] // not a start char; resync
+			continue
+		}
+		if len(m.fromHost) < frameLen {
+			return len(p), nil
+		}
+		frame := m.fromHost[:frameLen]
+		m.fromHost = m.fromHost[frameLen:]
+		if frame[0] == 0xAE {
+			m.Frames = append(m.Frames, decodeRadioFrame(frame, FrameFormatBasic))
+			continue
+		}
+		cmd := frame[1]
+		m.Commands = append(m.Commands, cmd)
+		m.Requests = append(m.Requests, append([]byte(nil), frame[3:len(frame)-1]...))
+		if !m.Silent {
+			m.injectLocked(controlReplyBytes(cmd, m.Status[cmd], m.Replies[cmd]))
+		}
+	}
+	return len(p), nil
+}
+
+func (m *FakeMCU) Close() error {
+	select {
+	case <-m.closed:
+	default:
+		close(m.closed)
+	}
+	return nil
+}
+
+// Fail makes every subsequent Read return err, simulating a dead serial port
+func (m *FakeMCU) Fail(err error) {
+	m.mutex.Lock()
+	m.readErr = err
+	m.mutex.Unlock()
+	m.wake()
+}
+
+// FailWrites makes every subsequent Write return err, while reads keep working
+func (m *FakeMCU) FailWrites(err error) {
+	m.mutex.Lock()
+	m.writeErr = err
+	m.mutex.Unlock()
+}
+
+// Inject queues raw bytes for the host to read
+func (m *FakeMCU) Inject(b []byte) {
+	m.mutex.Lock()
+	m.injectLocked(b)
+	m.mutex.Unlock()
+}
+
+func (m *FakeMCU) injectLocked(b []byte) {
+	m.toHost = append(m.toHost, b...)
+	m.wake()
+}
+
+func (m *FakeMCU) wake() {
+	select {
+	case m.more <- struct{}{}:
+	default:
+	}
+}
+
+// InjectFrame queues an OTA frame for the host as if it were received over the air with the given RSSI
+func (m *FakeMCU) InjectFrame(f *NpiRadioFrame, rssi int8) {
+	rx := *f
+	rx.Rssi = rssi
+	rx.EmitRSSI = true
+	m.Inject(rx.Serialize())
+}
+
+// CommandsSeen returns a copy of the control commands received so far
+func (m *FakeMCU) CommandsSeen() []uint8 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]uint8(nil), m.Commands...)
+}
+
+// FramesSeen returns a copy of the OTA frames received so far
+func (m *FakeMCU) FramesSeen() []*NpiRadioFrame {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]*NpiRadioFrame(nil), m.Frames...)
+}
+
+// controlReplyBytes serializes a 0xBA MCU->Host control reply
+func controlReplyBytes(cmd, status uint8, reply []byte) []byte {
+	b := []byte{0xBA, cmd, status, uint8(len(reply))}
+	b = append(b, reply...)
+	return append(b, XorBuffer(b[1:]))
+}
+
+// waitFor polls cond until it's true or a second has passed
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
 var defaultReadData = []byte{'C', 'O', 'A', 'L', 'C', 'A', 'R', 'S',
-	0xAE, 0xEF, 0xBE, 0xAD, 0xDE, 0x33, 0x69, 0x0A,
-	'S', 'I', 'X', 'T', 'Y', ' ', 'N', 'I', 'N', 'E', 0x11,
+	0xAE, 0xEF, 0xBE, 0xAD, 0xDE, 0x33, 0x69, 0xD6, 0x0A,
+	'S', 'I', 'X', 'T', 'Y', ' ', 'N', 'I', 'N', 'E', 0xC7,
 	'D', 'E', 'R', 'A', 'I', 'L', 'E', 'D'}
 
 func TestRunNPI(t *testing.T) {
@@ -133,7 +329,7 @@ func TestRunNPI(t *testing.T) {
 			t.Errorf("RunNPI Fault detected")
 			return
 		case n := <-frameRecv:
-			fmt.Printf("Received frame: %q\n", *n)
+			fmt.Printf("Received frame: %+v\n", *n)
 			if n != nil {
 				frameCount++
 			}
@@ -148,9 +344,386 @@ func TestRunNPI(t *testing.T) {
 	}
 }
 
+func TestMultipleFramesPerRead(t *testing.T) {
+	var burst []byte
+	for i := 0; i < 3; i++ {
+		b := NewRadioFrame(0xDEAD0000+uint32(i), 0x2000+uint16(i), []byte{byte(i), 0xAE, 0xBA}).Serialize()
+		burst = append(burst, b...)
+		if i == 0 {
+			// A control reply wedged between OTA frames must not disturb the frames following it
+			burst = append(burst, controlReplyBytes(CONTROL_GET_RF, CONTROL_STATUS_OK, []byte{0x01})...)
+		}
+	}
+
+	TestPhy := new(TestLink)
+	TestPhy.IsActive = true
+	TestPhy.CannedData = burst
+	TestPhy.ChunkSize = len(burst) // Deliver the whole burst in a single Read
+	TestPhy.WaitForMore = make(chan bool)
+
+	frameRecv := make(chan *NpiRadioFrame, 4)
+	ctrlReply := make(chan NpiControl, 4)
+	halt := make(chan struct{})
+	defer close(halt)
+	go npiPhyReader(TestPhy, frameRecv, ctrlReply, halt, newNpiOptions(nil))
+
+	for i := 0; i < 3; i++ {
+		select {
+		case n := <-frameRecv:
+			if n.Address != 0xDEAD0000+uint32(i) || n.Program != 0x2000+uint16(i) || !bytes.Equal(n.Data, []byte{byte(i), 0xAE, 0xBA}) {
+				t.Errorf("Frame %d out of order or corrupt: %+v", i, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for frame %d", i)
+		}
+	}
+	select {
+	case rep := <-ctrlReply:
+		if rep.Command != CONTROL_GET_RF || !bytes.Equal(rep.Reply, []byte{0x01}) {
+			t.Errorf("Unexpected control reply: %+v", rep)
+		}
+	default:
+		t.Errorf("Control reply embedded in the burst was not emitted")
+	}
+}
+
+func TestRawFrames(t *testing.T) {
+	m := NewFakeMCU()
+	m.Inject(defaultReadData)
+
+	frameRecv := make(chan *NpiRadioFrame, 4)
+	npiFault := make(chan struct{})
+	go RunNPI(m, make(chan *NpiRadioFrame), frameRecv, make(chan *NpiControl), npiFault, WithRawFrames(true))
+	defer close(npiFault)
+
+	select {
+	case n := <-frameRecv:
+		if !bytes.Equal(n.Raw, defaultReadData[8:28]) {
+			t.Errorf("Raw frame mismatch: got % X", n.Raw)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Did not receive any valid frames")
+	}
+}
+
+func TestFrameFormatLQI(t *testing.T) {
+	// defaultReadData's frame with an LQI byte of 0x5A spliced in after the RSSI
+	lqiFrame := []byte{0xAE, 0xEF, 0xBE, 0xAD, 0xDE, 0x33, 0x69, 0xD6, 0x5A, 0x0A,
+		'S', 'I', 'X', 'T', 'Y', ' ', 'N', 'I', 'N', 'E', 0}
+	lqiFrame[len(lqiFrame)-1] = XorBuffer(lqiFrame[1 : len(lqiFrame)-1])
+	m := NewFakeMCU()
+	m.Inject(lqiFrame)
+
+	frameRecv := make(chan *NpiRadioFrame, 4)
+	npiFault := make(chan struct{})
+	go RunNPI(m, make(chan *NpiRadioFrame), frameRecv, make(chan *NpiControl), npiFault, WithFrameFormat(FrameFormatLQI))
+	defer close(npiFault)
+
+	select {
+	case n := <-frameRecv:
+		if !n.HasLQI || n.LQI != 0x5A || n.Rssi != -42 || string(n.Data) != "SIXTY NINE" {
+			t.Errorf("LQI frame misparsed: %+v", *n)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Did not receive any valid frames")
+	}
+}
+
+func TestFrameFormatDetection(t *testing.T) {
+	lqiFrame := []byte{0xAE, 0xEF, 0xBE, 0xAD, 0xDE, 0x33, 0x69, 0xD6, 0x5A, 0x02, 'h', 'i', 0}
+	lqiFrame[len(lqiFrame)-1] = XorBuffer(lqiFrame[1 : len(lqiFrame)-1])
+	basicFrame := []byte{0xAE, 0xEF, 0xBE, 0xAD, 0xDE, 0x33, 0x69, 0xD6, 0x02, 'h', 'i', 0}
+	basicFrame[len(basicFrame)-1] = XorBuffer(basicFrame[1 : len(basicFrame)-1])
+
+	cases := []struct {
+		name   string
+		status uint8  // GET_CAPABILITIES status
+		caps   []byte // GET_CAPABILITIES reply
+		frame  []byte
+		hasLQI bool
+	}{
+		{"LQI firmware", CONTROL_STATUS_OK, []byte{byte(CapFrameLQI), 0, 0, 0}, lqiFrame, true},
+		{"basic firmware", CONTROL_STATUS_OK, []byte{byte(CapCCA), 0, 0, 0}, basicFrame, false},
+		{"firmware without capabilities", CONTROL_STATUS_UNKNOWN_CMD, nil, basicFrame, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewFakeMCU()
+			m.Status[CONTROL_GET_CAPABILITIES] = c.status
+			m.Replies[CONTROL_GET_CAPABILITIES] = c.caps
+			l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+			if err != nil {
+				t.Fatalf("NewLinkMgrPHY error: %v", err)
+			}
+			defer l.Close()
+			frames, stop := l.Subscribe(4)
+			defer stop()
+
+			if err = l.Flush(); err != nil {
+				t.Fatalf("Flush error: %v", err)
+			}
+			m.Inject(c.frame)
+			select {
+			case n := <-frames:
+				if n.HasLQI != c.hasLQI || (c.hasLQI && n.LQI != 0x5A) || n.Rssi != -42 || string(n.Data) != "hi" {
+					t.Errorf("Frame misparsed: %+v", *n)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("Frame was not parsed")
+			}
+		})
+	}
+}
+
+// streamPHY replays a fixed byte stream to the reader, then reports io.EOF
+type streamPHY struct {
+	r *bytes.Reader
+}
+
+func (p *streamPHY) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *streamPHY) Write(b []byte) (int, error) { return len(b), nil }
+func (p *streamPHY) Close() error                { return nil }
+
+func FuzzNpiPhyReader(f *testing.F) {
+	f.Add(defaultReadData)
+	f.Add(defaultReadData[8:20])                                                    // truncated OTA frame
+	f.Add([]byte{0xAE, 0xEF, 0xBE, 0xAD, 0xDE, 0x33, 0x69, 0x00, 0xFF, 0x01, 0x02}) // claims a 255-byte payload
+	f.Add(controlReplyBytes(CONTROL_GET_RF, CONTROL_STATUS_OK, nil))                // zero-length control reply
+	f.Add(controlReplyBytes(CONTROL_GET_IDENTIFIER, CONTROL_STATUS_OK, bytes.Repeat([]byte{'X'}, 255)))
+	f.Add(append([]byte{0xBA, 0xBA, 0xAE, 0xAE}, defaultReadData...)) // start chars appearing as data
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frameRecv := make(chan *NpiRadioFrame, 4)
+		ctrlReply := make(chan NpiControl, 4)
+		done := make(chan struct{})
+		drained := make(chan struct{})
+		check := func(n *NpiRadioFrame) {
+			if !VerifyFrameChecksum(n.Raw) {
+				t.Errorf("Emitted frame fails checksum: % X", n.Raw)
+			}
+			if len(n.Raw) != 10+len(n.Data) {
+				t.Errorf("Emitted frame payload length %d disagrees with raw length %d", len(n.Data), len(n.Raw))
+			}
+		}
+		go func() {
+			defer close(drained)
+			for {
+				select {
+				case n := <-frameRecv:
+					check(n)
+				case <-ctrlReply:
+				case <-done:
+					for {
+						select {
+						case n := <-frameRecv:
+							check(n)
+						case <-ctrlReply:
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+
+		cfg := newNpiOptions([]Option{WithRawFrames(true)})
+		npiPhyReader(&streamPHY{bytes.NewReader(data)}, frameRecv, ctrlReply, make(chan struct{}), cfg)
+		close(done)
+		<-drained
+	})
+}
+
+// TestChecksumRoundTrip is a property test pinning down which bytes the checksum covers: whatever Serialize writes,
+// the reader must accept.  Both sides cover frame[1:len(frame)-1], i.e. everything after the start char up to but not
+// including the checksum byte itself.
+func TestChecksumRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	payload := func() []byte {
+		b := make([]byte, rng.Intn(256))
+		rng.Read(b)
+		return b
+	}
+	// readBack runs wire through the PHY reader, returning whatever it parsed
+	readBack := func(wire []byte) (*NpiRadioFrame, *NpiControl) {
+		frameRecv := make(chan *NpiRadioFrame, 1)
+		ctrlReply := make(chan NpiControl, 1)
+		npiPhyReader(&streamPHY{bytes.NewReader(wire)}, frameRecv, ctrlReply, make(chan struct{}), newNpiOptions(nil))
+		select {
+		case n := <-frameRecv:
+			return n, nil
+		case c := <-ctrlReply:
+			return nil, &c
+		default:
+			return nil, nil
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		f := NewRadioFrame(rng.Uint32(), uint16(rng.Intn(0x10000)), payload())
+		f.Rssi = int8(rng.Intn(256) - 128)
+		f.EmitRSSI = true
+		wire := f.Serialize()
+		if !VerifyFrameChecksum(wire) {
+			t.Fatalf("Radio frame %d: VerifyFrameChecksum rejected Serialize output % X", i, wire)
+		}
+		n, _ := readBack(wire)
+		if n == nil {
+			t.Fatalf("Radio frame %d: reader rejected Serialize output % X", i, wire)
+		}
+		if n.Address != f.Address || n.Program != f.Program || n.Rssi != f.Rssi || !bytes.Equal(n.Data, f.Data) {
+			t.Fatalf("Radio frame %d: reader misparsed % X as %+v", i, wire, *n)
+		}
+
+		// The reader only accepts 0xBA control frames, which add a status byte to the 0xBD layout.  XOR being
+		// order-independent, the reply's checksum is the request's with the status folded in, so a range mismatch
+		// on either side (say, Serialize also covering the start char) shows up as a rejected reply.
+		c := NewControl(uint8(rng.Intn(256)), payload())
+		req := c.Serialize()
+		if !VerifyFrameChecksum(req) {
+			t.Fatalf("Control frame %d: VerifyFrameChecksum rejected Serialize output % X", i, req)
+		}
+		status := uint8(rng.Intn(256))
+		reply := append([]byte{0xBA, c.Command, status}, req[2:len(req)-1]...)
+		reply = append(reply, req[len(req)-1]^status)
+		_, r := readBack(reply)
+		if r == nil {
+			t.Fatalf("Control frame %d: reader rejected reply % X derived from Serialize output", i, reply)
+		}
+		if r.Command != c.Command || r.Status != status || !bytes.Equal(r.Reply, c.Data) {
+			t.Fatalf("Control frame %d: reader misparsed % X as %+v", i, reply, *r)
+		}
+	}
+}
+
+// repeatPHY hands the reader the same chunk of bytes on every Read, reads times over, then reports io.EOF
+type repeatPHY struct {
+	chunk []byte
+	reads int
+}
+
+func (p *repeatPHY) Read(b []byte) (int, error) {
+	if p.reads == 0 {
+		return 0, io.EOF
+	}
+	p.reads--
+	return copy(b, p.chunk), nil
+}
+func (p *repeatPHY) Write(b []byte) (int, error) { return len(b), nil }
+func (p *repeatPHY) Close() error                { return nil }
+
+func TestTruncatedFrameRecovery(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithFrameGapTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	h := new(countingHandler)
+	l.RegisterProgramHandler(0x6933, h)
+
+	wire := NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")).Serialize()
+	m.Inject(wire[:8]) // The sender goes quiet mid-frame
+	time.Sleep(50 * time.Millisecond)
+	m.Inject(wire)
+	if !waitFor(func() bool { return h.Count() == 1 }) {
+		t.Fatalf("Frame following a truncated one was not received")
+	}
+	if n := l.Stats().RxTruncatedFrames; n != 1 {
+		t.Errorf("Expected 1 truncated frame, got %d", n)
+	}
+}
+
+func TestTruncatedFrameResync(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	h := new(countingHandler)
+	l.RegisterProgramHandler(0x6933, h)
+
+	cut := NewRadioFrame(0x01020304, 0x6933, []byte{0x01, 0x02}).Serialize()
+	wire := NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")).Serialize()
+	m.Inject(append(cut[:len(cut)-3:len(cut)-3], wire...)) // Cut short, with no pause before the next frame
+	if !waitFor(func() bool { return h.Count() == 1 }) {
+		t.Fatalf("Frame swallowed by a truncated one was not recovered")
+	}
+	if n := l.Stats().RxChecksumErrors; n != 1 {
+		t.Errorf("Expected 1 checksum error, got %d", n)
+	}
+}
+
+func TestFrameGapExcludesDeliveryStall(t *testing.T) {
+	m := NewFakeMCU()
+	frameRecv := make(chan *NpiRadioFrame) // Not read until the reader has been stalled past the frame gap
+	fault := make(chan struct{})
+	first := NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x01}).Serialize()
+	second := NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")).Serialize()
+	go RunNPI(m, make(chan *NpiRadioFrame), frameRecv, make(chan *NpiControl), fault,
+		WithFrameGapTimeout(20*time.Millisecond), WithReadBufferSize(len(first)+4))
+	defer close(fault)
+
+	m.Inject(append(first, second...)) // The first read ends partway into the second frame
+	time.Sleep(50 * time.Millisecond)
+	for i, want := range []int{1, 10} {
+		select {
+		case f := <-frameRecv:
+			if len(f.Data) != want {
+				t.Errorf("Frame %d: expected %d data bytes, got %d", i+1, want, len(f.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Frame %d was not received", i+1)
+		}
+	}
+}
+
+func TestRxAllocatorIsolation(t *testing.T) {
+	var a rxAllocator
+	first := a.bytes(3)
+	copy(first, "abc")
+	second := a.bytes(3)
+	copy(second, "xyz")
+	first = append(first, 'd')
+	if string(second) != "xyz" {
+		t.Errorf("Appending to one slab-allocated payload clobbered the next: %q", second)
+	}
+	if a.frame() == a.frame() {
+		t.Errorf("rxAllocator handed out the same frame twice")
+	}
+}
+
+// BenchmarkNpiPhyReader measures the reader's per-frame cost parsing a stream of typical sensor frames
+func BenchmarkNpiPhyReader(b *testing.B) {
+	const framesPerRead = 64
+	var chunk []byte
+	for i := 0; i < framesPerRead; i++ {
+		f := NewRadioFrame(0xDEAD0000+uint32(i), 0x2002, []byte{0x42, 0x00, 0xC4, 0x09, 0x9D, 0x13, 0x00})
+		f.Rssi = -60
+		f.EmitRSSI = true
+		chunk = append(chunk, f.Serialize()...)
+	}
+	frameRecv := make(chan *NpiRadioFrame, framesPerRead)
+	done := make(chan struct{})
+	go func() {
+		for range frameRecv {
+		}
+		close(done)
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(chunk) / framesPerRead))
+	b.ResetTimer()
+	phy := &repeatPHY{chunk: chunk, reads: (b.N + framesPerRead - 1) / framesPerRead}
+	npiPhyReader(phy, frameRecv, make(chan NpiControl), make(chan struct{}), newNpiOptions(nil))
+	b.StopTimer()
+	close(frameRecv)
+	<-done
+}
+
 type TestRxHandler struct{}
 
-func (h *TestRxHandler) Receive(l *LinkMgr, addr uint32, prog uint16, data []byte) bool {
+func (h *TestRxHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
 	fmt.Printf("Received packet: addr=0x%08X, prog=0x%04X, data=[%s]\n", addr, prog, string(data))
 	return true
 }
@@ -211,98 +784,2412 @@ func TestLinkMgr(t *testing.T) {
 	}
 }
 
-func TestUint32ToBuf(t *testing.T) {
-	var testLongWord uint32
-	buf := make([]byte, 4)
+// newTestLinkMgr builds a LinkMgr with its channels and registries initialized but no PHY attached
+func newTestLinkMgr() *LinkMgr {
+	l := new(LinkMgr)
+	l.FrameTX = make(chan *NpiRadioFrame)
+	l.FrameRX = make(chan *NpiRadioFrame)
+	l.CtrlTX = make(chan *NpiControl)
+	l.NpiDied = make(chan struct{})
+	l.RxRegistryProgram = make(map[uint16]FrameReceiver)
+	l.RxRegistryAddress = make(map[uint32]FrameReceiver)
+	return l
+}
 
-	testLongWord = 0xDEADBEEF
-	buf[0] = uint8(testLongWord)
-	buf[1] = uint8(testLongWord >> 8)
-	buf[2] = uint8(testLongWord >> 16)
-	buf[3] = uint8(testLongWord >> 24)
+func TestRegisterNilHandler(t *testing.T) {
+	l := newTestLinkMgr()
+	l.RegisterProgramHandler(0x6933, nil)
+	l.RegisterProgramRangeHandler(0x6900, 0x69FF, nil)
+	l.RegisterAddressHandler(0xDEADBEEF, nil)
+	l.RegisterAddressMaskHandler(0xDEAD0000, 0xFFFF0000, nil)
+	l.RegisterAllHandler(nil)
 
-	if buf[0] != 0xEF || buf[1] != 0xBE || buf[2] != 0xAD || buf[3] != 0xDE {
-		t.Errorf("[]byte composition was invalid: %08X = %02X %02X %02X %02X", testLongWord, buf[0], buf[1], buf[2], buf[3])
+	if _, ok := l.RxRegistryProgram[0x6933]; ok {
+		t.Errorf("RegisterProgramHandler stored a nil handler")
+	}
+	if len(l.RxRegistryRange) != 0 {
+		t.Errorf("RegisterProgramRangeHandler stored a nil handler")
+	}
+	if _, ok := l.RxRegistryAddress[0xDEADBEEF]; ok {
+		t.Errorf("RegisterAddressHandler stored a nil handler")
+	}
+	if len(l.RxRegistryMask) != 0 {
+		t.Errorf("RegisterAddressMaskHandler stored a nil handler")
 	}
+	if len(l.RxFirehose) != 0 {
+		t.Errorf("RegisterAllHandler stored a nil handler")
+	}
+
+	// Nil entries planted directly in the exported registries must be skipped by dispatch rather than panic
+	l.RxRegistryProgram[0x6933] = nil
+	l.RxRegistryAddress[0xDEADBEEF] = nil
+	l.RxFirehose = []FrameReceiver{nil}
+	l.dispatch(NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")))
 }
 
-func TestCC1310GetIdentifier(t *testing.T) {
-	l, err := NewLinkMgr(SerialPort, uint(SerialBaudRate))
-	if err != nil {
-		t.Errorf("Error starting NPI Link: %v", err)
-		return
+func TestAddressMaskHandler(t *testing.T) {
+	l := newTestLinkMgr()
+	subnet := new(countingHandler)
+	wide := new(countingHandler)
+	exact := new(countingHandler)
+	l.RegisterAddressMaskHandler(0xBACE1234, 0xFFFF0000, subnet)
+	l.RegisterAddressMaskHandler(0xBA000000, 0xFF000000, wide)
+	l.RegisterAddressHandler(0xBACE0001, exact)
+
+	l.dispatch(NewRadioFrame(0xBACE0002, 0x2000, nil)) // subnet + wide
+	l.dispatch(NewRadioFrame(0xBA110002, 0x2000, nil)) // wide only
+	l.dispatch(NewRadioFrame(0xBACE0001, 0x2000, nil)) // exact match suppresses the masks
+	l.dispatch(NewRadioFrame(0x12CE0002, 0x2000, nil)) // nobody
+
+	if subnet.Count() != 1 || wide.Count() != 2 || exact.Count() != 1 {
+		t.Errorf("Unexpected dispatch counts: subnet=%d wide=%d exact=%d", subnet.Count(), wide.Count(), exact.Count())
 	}
 
-	id, err := l.GetIdentifier()
-	if err != nil {
-		t.Errorf("Error getting NPI Identifier: %v", err)
-		return
+	if !l.DeregisterAddressMaskHandler(0xBACE0000, 0xFFFF0000) {
+		t.Errorf("DeregisterAddressMaskHandler did not find the subnet handler")
+	}
+	if !l.DeregisterHandler(wide) || len(l.RxRegistryMask) != 0 {
+		t.Errorf("DeregisterHandler did not remove the mask handler")
 	}
-	fmt.Printf("NPI identifier string: [%s]\n", id)
-	l.Close()
 }
 
-func TestCC1310GetRadio(t *testing.T) {
-	l, err := NewLinkMgr(SerialPort, uint(SerialBaudRate))
-	if err != nil {
-		t.Errorf("Error starting NPI Link: %v", err)
-		return
-	}
+// consumingHandler swallows every frame it sees
+type consumingHandler struct{}
 
-	rxOn, centerFreq, txPower, txTick, err := l.GetRadio()
-	if err != nil {
-		t.Errorf("Error getting Radio params: %v", err)
-		return
-	}
-	// 	return rxOn, cFreq, txPower, txTick, nil
-	fmt.Printf("RX: %v, Freq: %d, TXpower: %d dBm, TXtick: %d\n", rxOn, centerFreq, txPower, txTick)
-	l.Close()
+func (consumingHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
+	return false
 }
 
-func TestCC1310SendDebugFrame(t *testing.T) {
-	l, err := NewLinkMgr(SerialPort, uint(SerialBaudRate))
-	if err != nil {
-		t.Errorf("Error starting NPI Link: %v", err)
-		return
+func TestAuditHandler(t *testing.T) {
+	l := newTestLinkMgr()
+	audit := new(countingHandler)
+	firehose := new(countingHandler)
+	l.RegisterProgramHandler(0x2000, consumingHandler{})
+	l.RegisterAllHandler(firehose)
+	l.RegisterAuditHandler(audit)
+	l.RegisterAuditHandler(audit) // duplicate registration is ignored
+
+	l.dispatch(NewRadioFrame(0xDEAD0001, 0x2000, nil)) // consumed before the firehose
+	l.dispatch(NewRadioFrame(0xDEAD0001, 0x2001, nil))
+
+	if firehose.Count() != 1 {
+		t.Errorf("Expected firehose to see 1 frame, saw %d", firehose.Count())
+	}
+	if audit.Count() != 2 {
+		t.Errorf("Expected audit handler to see 2 frames, saw %d", audit.Count())
 	}
+	if !l.DeregisterHandler(audit) || len(l.RxAudit) != 0 {
+		t.Errorf("DeregisterHandler did not remove the audit handler")
+	}
+}
 
-	dbgText := "S.BOOGERY BUNZ!!"
-	l.Send(0xDEAD0001, 0xFFFF, []byte(dbgText))
-	err = l.RunTx()
+func TestRequest(t *testing.T) {
+	l := newTestLinkMgr()
+	go func() {
+		// Play the part of the MCU: accept the frame, acknowledge RUN_TX, then deliver the node's reply (preceded by an
+		// unrelated frame which must not satisfy the request)
+		req := <-l.FrameTX
+		ctl := <-l.CtrlTX
+		ctl.Status = CONTROL_STATUS_OK
+		close(ctl.PendChan)
+		l.dispatch(NewRadioFrame(req.Address, 0x2002, []byte{0x01}))
+		l.dispatch(NewRadioFrame(req.Address, 0x2004, req.Data))
+	}()
+
+	f, err := l.Request(0xDEAD0001, 0x2003, []byte{1, 2, 3, 4}, 0x2004, time.Second)
 	if err != nil {
-		t.Errorf("RunTx error: %v\n", err)
-		return
+		t.Fatalf("Request error: %v", err)
+	}
+	if f.Program != 0x2004 || !bytes.Equal(f.Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("Request returned the wrong frame: %+v", *f)
+	}
+	if len(l.waiters) != 0 {
+		t.Errorf("Request left %d waiters registered", len(l.waiters))
 	}
-	l.Close()
 }
 
-func TestCC1310ToggleRxOn(t *testing.T) {
-	l, err := NewLinkMgr(SerialPort, uint(SerialBaudRate))
-	if err != nil {
-		t.Errorf("Error starting NPI Link: %v", err)
-		return
+func TestRequestTimeout(t *testing.T) {
+	l := newTestLinkMgr()
+	go func() {
+		<-l.FrameTX
+		ctl := <-l.CtrlTX
+		ctl.Status = CONTROL_STATUS_OK
+		close(ctl.PendChan)
+	}()
+
+	_, err := l.Request(0xDEAD0001, 0x2003, nil, 0x2004, 10*time.Millisecond)
+	if _, ok := err.(RequestTimeout); !ok {
+		t.Errorf("Expected RequestTimeout, got %v", err)
 	}
+}
 
-	err = l.On(true)
+func TestWaitForFrame(t *testing.T) {
+	l := newTestLinkMgr()
+	go func() {
+		waitFor(func() bool { // Let WaitForFrame register first
+			l.registryMutex.Lock()
+			defer l.registryMutex.Unlock()
+			return len(l.waiters) == 1
+		})
+		l.dispatch(NewRadioFrame(0xDEAD0002, 0x2002, []byte{0x01}))
+		l.dispatch(NewRadioFrame(0xDEAD0001, 0x2002, []byte{0x02}))
+	}()
+
+	f, err := l.WaitForFrame(context.Background(), 0xDEAD0001)
 	if err != nil {
-		t.Errorf("Error issuing On(true): %v\n", err)
-		return
+		t.Fatalf("WaitForFrame error: %v", err)
 	}
-	tck := time.After(time.Second * 1)
-	select {
-	case <-tck:
+	if f.Address != 0xDEAD0001 || !bytes.Equal(f.Data, []byte{0x02}) {
+		t.Errorf("WaitForFrame returned the wrong frame: %+v", *f)
 	}
-	err = l.On(false)
-	if err != nil {
-		t.Errorf("Error issuing On(false): %v\n", err)
-		return
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = l.WaitForFrame(ctx, 0xDEAD0001); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
 	}
-	tck = time.After(time.Second * 1)
-	select {
-	case <-tck:
+	if len(l.waiters) != 0 {
+		t.Errorf("WaitForFrame left %d waiters registered", len(l.waiters))
 	}
-	err = l.On(true)
-	if err != nil {
+}
+
+func TestSendPayloadTooLarge(t *testing.T) {
+	l := newTestLinkMgr()
+	// FrameTX is unbuffered with no reader, so this would block if the oversized frame were enqueued
+	err := l.Send(0xDEAD0001, 0xFFFF, make([]byte, l.MaxPayloadSize()+1))
+	if err != ErrPayloadTooLarge {
+		t.Errorf("Expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+// countingHandler counts the frames it receives
+type countingHandler struct {
+	mutex sync.Mutex
+	count int
+	rssi  int8
+}
+
+func (h *countingHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
+	h.mutex.Lock()
+	h.count++
+	h.rssi = rssi
+	h.mutex.Unlock()
+	return true
+}
+
+func (h *countingHandler) Count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+func (h *countingHandler) Rssi() int8 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.rssi
+}
+
+func TestReceiveRSSI(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	byProg, byAddr, firehose := new(countingHandler), new(countingHandler), new(countingHandler)
+	l.RegisterProgramHandler(0x6933, byProg)
+	l.RegisterAddressHandler(0xDEADBEEF, byAddr)
+	l.RegisterAllHandler(firehose)
+
+	// Built by hand rather than with Serialize, so the RSSI byte is exactly where the MCU puts it
+	frame := []byte{0xAE, 0xEF, 0xBE, 0xAD, 0xDE, 0x33, 0x69, 0xA9, 0x02, 'h', 'i'} // RSSI 0xA9 = -87 dBm
+	frame = append(frame, XorBuffer(frame[1:]))
+	m.Inject(frame)
+	if !waitFor(func() bool { return firehose.Count() == 1 }) {
+		t.Fatalf("Frame was not dispatched")
+	}
+	for name, h := range map[string]*countingHandler{"program": byProg, "address": byAddr, "firehose": firehose} {
+		if h.Count() != 1 || h.Rssi() != -87 {
+			t.Errorf("%s handler: count=%d rssi=%d, expected 1 frame at -87", name, h.Count(), h.Rssi())
+		}
+	}
+}
+
+// fullHandler records the frames it is given through FrameReceiverFull, and counts any which arrive through Receive
+type fullHandler struct {
+	mutex   sync.Mutex
+	frames  []*NpiRadioFrame
+	scalars int
+	verdict bool
+}
+
+func (h *fullHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
+	h.mutex.Lock()
+	h.scalars++
+	h.mutex.Unlock()
+	return true
+}
+
+func (h *fullHandler) ReceiveFrame(l *LinkMgr, otaFrame *NpiRadioFrame) bool {
+	h.mutex.Lock()
+	h.frames = append(h.frames, otaFrame)
+	h.mutex.Unlock()
+	return h.verdict
+}
+
+func (h *fullHandler) Frames() ([]*NpiRadioFrame, int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]*NpiRadioFrame(nil), h.frames...), h.scalars
+}
+
+// scalarHandler records the fields a plain FrameReceiver is given
+type scalarHandler struct {
+	mutex sync.Mutex
+	seen  []NpiRadioFrame
+}
+
+func (h *scalarHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
+	h.mutex.Lock()
+	h.seen = append(h.seen, NpiRadioFrame{Address: addr, Program: prog, Rssi: rssi, Data: data})
+	h.mutex.Unlock()
+	return true
+}
+
+func (h *scalarHandler) Seen() []NpiRadioFrame {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]NpiRadioFrame(nil), h.seen...)
+}
+
+func TestFrameReceiverFull(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	full, scalar := &fullHandler{verdict: true}, new(scalarHandler)
+	l.RegisterAllHandler(full) // Firehose, as loopback echoes skip the program handlers
+	l.RegisterAllHandler(scalar)
+
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")), -42)
+	if !waitFor(func() bool { return len(scalar.Seen()) == 1 }) {
+		t.Fatalf("Frame was not dispatched")
+	}
+	l.SetLoopbackTX(true)
+	l.SendAck(0xDEAD0002, 0x6933, []byte{0x02})
+	if !waitFor(func() bool { return len(scalar.Seen()) == 2 }) {
+		t.Fatalf("Loopback frame was not dispatched")
+	}
+
+	frames, scalars := full.Frames()
+	if scalars != 0 || len(frames) != 2 {
+		t.Fatalf("Expected 2 frames via ReceiveFrame and none via Receive, got %d and %d", len(frames), scalars)
+	}
+	for i, want := range scalar.Seen() {
+		f := frames[i]
+		if f.Address != want.Address || f.Program != want.Program || f.Rssi != want.Rssi || !bytes.Equal(f.Data, want.Data) {
+			t.Errorf("Frame %d: ReceiveFrame got %+v, Receive got %+v", i, f, want)
+		}
+	}
+	if frames[0].Direction != DirRX || frames[1].Direction != DirTX {
+		t.Errorf("FrameMeta not passed through: directions %v, %v", frames[0].Direction, frames[1].Direction)
+	}
+
+	// ReceiveFrame's verdict ends processing just as Receive's does
+	full.mutex.Lock()
+	full.verdict = false
+	full.mutex.Unlock()
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, nil), -42)
+	if !waitFor(func() bool { f, _ := full.Frames(); return len(f) == 3 }) {
+		t.Fatalf("Third frame was not dispatched")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(scalar.Seen()); n != 2 {
+		t.Errorf("Later firehose handler saw a frame ReceiveFrame consumed (%d frames)", n)
+	}
+}
+
+func TestDeregisterFirehoseHandler(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	h := new(countingHandler)
+	sentinel := new(countingHandler) // Registered after h, so it sees each frame once h is done with it
+	l.RegisterAllHandler(h)
+	l.RegisterAllHandler(sentinel)
+
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x01}), -40)
+	if !waitFor(func() bool { return sentinel.Count() == 1 }) {
+		t.Fatalf("First frame was not dispatched")
+	}
+	if h.Count() != 1 {
+		t.Fatalf("Expected the firehose handler to see the first frame, count=%d", h.Count())
+	}
+
+	if !l.DeregisterHandler(h) {
+		t.Errorf("DeregisterHandler reported nothing purged")
+	}
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x02}), -40)
+	if !waitFor(func() bool { return sentinel.Count() == 2 }) {
+		t.Fatalf("Second frame was not dispatched")
+	}
+	if h.Count() != 1 {
+		t.Errorf("Deregistered firehose handler still received a frame, count=%d", h.Count())
+	}
+	if len(l.RxFirehose) != 1 {
+		t.Errorf("Expected 1 firehose entry after deregistration, got %d", len(l.RxFirehose))
+	}
+}
+
+func TestRegisterHandlerContext(t *testing.T) {
+	l := newTestLinkMgr()
+	ctx, cancel := context.WithCancel(context.Background())
+	h := new(countingHandler)
+	l.RegisterProgramHandlerContext(ctx, 0x6933, h)
+	l.RegisterProgramHandlerContext(ctx, 0x6934, h)
+	l.RegisterAddressHandlerContext(ctx, 0xDEADBEEF, h)
+	l.RegisterAllHandlerContext(ctx, h)
+	other := new(countingHandler)
+	l.RegisterAllHandler(other)
+	l.RegisterProgramHandler(0x6934, other) // Replaces h; must survive the cancel
+
+	l.dispatch(NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x01}))
+	if h.Count() != 3 {
+		t.Fatalf("Expected 3 deliveries before cancel, got %d", h.Count())
+	}
+
+	cancel()
+	gone := func() bool {
+		l.registryMutex.Lock()
+		defer l.registryMutex.Unlock()
+		return l.RxRegistryProgram[0x6933] == nil && l.RxRegistryAddress[0xDEADBEEF] == nil && len(l.RxFirehose) == 1
+	}
+	if !waitFor(gone) {
+		t.Fatalf("Handlers were not deregistered after cancel")
+	}
+	if l.RxRegistryProgram[0x6934] != FrameReceiver(other) || l.RxFirehose[0] != FrameReceiver(other) {
+		t.Errorf("Cancel removed a handler registered without the context")
+	}
+	l.dispatch(NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x02}))
+	if h.Count() != 3 {
+		t.Errorf("Deregistered handler still received a frame, count=%d", h.Count())
+	}
+}
+
+// valueHandler is a comparable value-type handler
+type valueHandler struct{ id int }
+
+func (h valueHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
+	return true
+}
+
+// sliceHandler is a value-type handler which can't be compared with ==
+type sliceHandler struct{ progs []uint16 }
+
+func (h sliceHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
+	return true
+}
+
+func TestRegisterHandlerContextValueTypes(t *testing.T) {
+	l := newTestLinkMgr()
+	ctx, cancel := context.WithCancel(context.Background())
+	l.RegisterProgramHandlerContext(ctx, 0x6933, valueHandler{1})
+	l.RegisterAddressHandlerContext(ctx, 0xDEADBEEF, valueHandler{1})
+	l.RegisterAllHandlerContext(ctx, valueHandler{1})
+	l.RegisterAllHandler(valueHandler{2}) // Equal type, different value; must survive the cancel
+	cancel()
+	gone := func() bool {
+		l.registryMutex.Lock()
+		defer l.registryMutex.Unlock()
+		return l.RxRegistryProgram[0x6933] == nil && l.RxRegistryAddress[0xDEADBEEF] == nil && len(l.RxFirehose) == 1
+	}
+	if !waitFor(gone) {
+		t.Fatalf("Value-type handlers were not deregistered after cancel")
+	}
+	if l.RxFirehose[0] != FrameReceiver(valueHandler{2}) {
+		t.Errorf("Cancel removed a handler registered without the context")
+	}
+
+	// A non-comparable handler is refused up front rather than panicking in the background on cancel
+	for name, register := range map[string]func(FrameReceiver){
+		"program": func(h FrameReceiver) { l.RegisterProgramHandlerContext(context.Background(), 0x6933, h) },
+		"address": func(h FrameReceiver) { l.RegisterAddressHandlerContext(context.Background(), 0xDEADBEEF, h) },
+		"all":     func(h FrameReceiver) { l.RegisterAllHandlerContext(context.Background(), h) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: registering a non-comparable handler did not panic", name)
+				}
+			}()
+			register(sliceHandler{})
+		}()
+	}
+	if l.RxRegistryProgram[0x6933] != nil || l.RxRegistryAddress[0xDEADBEEF] != nil || len(l.RxFirehose) != 1 {
+		t.Errorf("A refused non-comparable handler was registered")
+	}
+}
+
+func TestDispatchTrace(t *testing.T) {
+	l := newTestLinkMgr()
+	l.traces = make(chan DispatchTrace, 1)
+	l.stats = NewNpiStats()
+	counter := new(countingHandler)
+	l.RegisterProgramHandler(0x6933, counter)
+	l.RegisterAddressHandler(0xDEADBEEF, consumingHandler{})
+	l.RegisterAllHandler(counter) // Never reached: the address handler consumes the frame
+	l.RegisterAuditHandler(counter)
+
+	l.dispatch(NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x01}))
+	if len(l.traces) != 0 {
+		t.Fatalf("Frame traced while tracing was off")
+	}
+
+	l.SetDispatchTrace(true)
+	f := NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x02})
+	l.dispatch(f)
+	l.dispatch(f) // Doesn't fit in the channel
+	tr := <-l.DispatchTraces()
+	expected := []DispatchStep{
+		{Stage: "program", Handler: "*smacbase.countingHandler", Result: true},
+		{Stage: "address", Handler: "smacbase.consumingHandler", Result: false},
+		{Stage: "audit", Handler: "*smacbase.countingHandler", Result: true},
+	}
+	if tr.Frame != f || fmt.Sprint(tr.Steps) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected trace %+v, want steps %+v", tr, expected)
+	}
+	if l.stats.Snapshot().DispatchTraceDrops != 1 {
+		t.Errorf("Expected 1 dropped trace, got %d", l.stats.Snapshot().DispatchTraceDrops)
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	l := newTestLinkMgr()
+	l.traces = make(chan DispatchTrace, 1)
+	counter := new(countingHandler)
+	l.RegisterProgramHandler(0x6933, counter)
+	l.RegisterProgramRangeHandler(0x6900, 0x69FF, counter)
+	l.RegisterAddressHandler(0xDEADBEEF, counter)
+	l.RegisterAddressMaskHandler(0xDEAD0000, 0xFFFF0000, counter) // Skipped: there's an exact address handler
+	l.RegisterAllHandler(counter)
+	l.RegisterAuditHandler(counter)
+	l.SetDispatchTrace(true)
+
+	stages := func() string {
+		l.dispatch(NewRadioFrame(0xDEADBEEF, 0x6933, nil))
+		var s []string
+		for _, step := range (<-l.DispatchTraces()).Steps {
+			s = append(s, step.Stage)
+		}
+		return strings.Join(s, " ")
+	}
+	if got := stages(); got != "program range address firehose audit" {
+		t.Errorf("Default order: %s", got)
+	}
+	l.SetDispatchOrder(DispatchAddressFirst)
+	if got := stages(); got != "address program range firehose audit" {
+		t.Errorf("Address-first order: %s", got)
+	}
+
+	// A consuming handler skips everything after it bar the audit handlers
+	l.RegisterAddressHandler(0xDEADBEEF, consumingHandler{})
+	if got := stages(); got != "address audit" {
+		t.Errorf("Address-first order, address handler consuming: %s", got)
+	}
+	l.SetDispatchOrder(DispatchProgramFirst)
+	if got := stages(); got != "program range address audit" {
+		t.Errorf("Default order, address handler consuming: %s", got)
+	}
+}
+
+func TestReplaceRegistry(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	old := new(countingHandler)
+	l.RegisterProgramHandler(0x6933, old)
+	saved := l.Registrations()
+
+	h := new(countingHandler)
+	audit := new(countingHandler)
+	l.ReplaceRegistry(RegistrySnapshot{Address: map[uint32]FrameReceiver{0xDEADBEEF: h}, Audit: []FrameReceiver{audit}})
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x01}), -40)
+	if !waitFor(func() bool { return audit.Count() == 1 }) {
+		t.Fatalf("Frame was not dispatched to the replacement registry")
+	}
+	if h.Count() != 1 || old.Count() != 0 {
+		t.Errorf("Expected only the replacement handler to see the frame, new=%d old=%d", h.Count(), old.Count())
+	}
+
+	l.ReplaceRegistry(saved)
+	if len(l.RxRegistryAddress) != 0 || len(l.RxAudit) != 0 || l.RxRegistryProgram[0x6933] != FrameReceiver(old) {
+		t.Fatalf("Restoring the saved registrations did not restore the original registries")
+	}
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x02}), -40)
+	if !waitFor(func() bool { return old.Count() == 1 }) {
+		t.Errorf("Frame was not dispatched to the restored handler")
+	}
+	if h.Count() != 1 {
+		t.Errorf("Replaced handler still received a frame, count=%d", h.Count())
+	}
+}
+
+func TestAutoReconnect(t *testing.T) {
+	phys := []*FakeMCU{NewFakeMCU(), NewFakeMCU()}
+	var opens int
+	var opensMutex sync.Mutex
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) {
+		opensMutex.Lock()
+		defer opensMutex.Unlock()
+		if opens >= len(phys) {
+			return nil, errors.New("no more PHYs")
+		}
+		opens++
+		return phys[opens-1], nil
+	})
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	l.EnableAutoReconnect(ConstantBackoff(10 * time.Millisecond))
+
+	h := new(countingHandler)
+	l.RegisterProgramHandler(0x6933, h)
+	cfg := RadioConfig{AlternateAddress: 0xBACE0001, Frequency: 902800000, Power: 12, RxOn: true}
+	if err = l.ApplyRadioConfig(cfg); err != nil {
+		t.Fatalf("ApplyRadioConfig error: %v", err)
+	}
+
+	phys[0].Fail(errors.New("unplugged"))
+	if !waitFor(func() bool { return len(phys[1].CommandsSeen()) >= 6 }) {
+		t.Fatalf("Radio config was not re-applied after reconnect; saw commands %v", phys[1].CommandsSeen())
+	}
+	select {
+	case <-l.NpiDied:
+		t.Fatalf("NpiDied closed despite auto-reconnect")
+	default:
+	}
+	want := []uint8{CONTROL_GET_FLOW_STATE, CONTROL_GET_CAPABILITIES, CONTROL_SET_ALTERNATE_ADDR, CONTROL_SET_CENTERFREQ, CONTROL_SET_TXPOWER, CONTROL_SET_RF_ON}
+	if !bytes.Equal(phys[1].CommandsSeen(), want) {
+		t.Errorf("Expected commands %v after reconnect, got %v", want, phys[1].CommandsSeen())
+	}
+
+	phys[1].InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")), -42)
+	if !waitFor(func() bool { return h.Count() == 1 }) {
+		t.Errorf("Handler registered before the fault did not receive a frame after reconnect")
+	}
+	if l.Stats().Reconnects != 1 {
+		t.Errorf("Expected 1 reconnect, got %d", l.Stats().Reconnects)
+	}
+	if h := l.Health(); h.ReconnectAttempts != 0 || !h.NextReconnect.IsZero() {
+		t.Errorf("Backoff was not reset by the reconnect: %+v", h)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	b := ReconnectBackoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: 0.25}
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		if d := b.delay(attempt, 0.5); d != want {
+			t.Errorf("Attempt %d: expected %v without jitter, got %v", attempt, want, d)
+		}
+		lo, hi := b.delay(attempt, 0), b.delay(attempt, 0.999999)
+		if lo != want*3/4 || hi < want*124/100 || hi > want*5/4 {
+			t.Errorf("Attempt %d: jitter range %v-%v, expected %v +/-25%%", attempt, lo, hi, want)
+		}
+	}
+	if d := ConstantBackoff(time.Second).delay(10, 0.9); d != time.Second {
+		t.Errorf("ConstantBackoff varied: %v", d)
+	}
+
+	// Every reconnect fails; Health reports the outage's progress
+	phy := NewFakeMCU()
+	opened := false
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) {
+		if opened {
+			return nil, errors.New("unplugged")
+		}
+		opened = true
+		return phy, nil
+	})
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	l.EnableAutoReconnect(ReconnectBackoff{Initial: time.Millisecond, Max: 4 * time.Millisecond, Multiplier: 2})
+	phy.Fail(errors.New("unplugged"))
+	if !waitFor(func() bool { return l.Health().ReconnectAttempts >= 3 }) {
+		t.Fatalf("Reconnect attempts not reported: %+v", l.Health())
+	}
+	if h := l.Health(); h.LinkUp || h.NextReconnect.IsZero() || time.Until(h.NextReconnect) > 4*time.Millisecond {
+		t.Errorf("Unexpected health during outage: %+v", h)
+	}
+}
+
+func TestGetFlowControlState(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	m.Status[CONTROL_GET_FLOW_STATE] = CONTROL_STATUS_UNKNOWN_CMD
+	squelched, err := l.GetFlowControlState()
+	if err != nil || squelched {
+		t.Errorf("Expected old firmware to read as unsquelched, got %v, %v", squelched, err)
+	}
+
+	// A squelch the host never saw: the writer should hold frames until the MCU unsquelches it
+	m.mutex.Lock()
+	m.Status[CONTROL_GET_FLOW_STATE] = CONTROL_STATUS_OK
+	m.Replies[CONTROL_GET_FLOW_STATE] = []byte{1}
+	m.mutex.Unlock()
+	squelched, err = l.GetFlowControlState()
+	if err != nil || !squelched {
+		t.Fatalf("Expected squelched, got %v, %v", squelched, err)
+	}
+	l.Send(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	time.Sleep(20 * time.Millisecond)
+	if n := len(m.FramesSeen()); n != 0 {
+		t.Fatalf("Expected no frames written while squelched, got %d", n)
+	}
+	m.Inject(controlReplyBytes(CONTROL_UNSQUELCH_HOST, CONTROL_STATUS_OK, nil))
+	if !waitFor(func() bool { return len(m.FramesSeen()) == 1 }) {
+		t.Errorf("Frame was not written after unsquelch")
+	}
+}
+
+// squelchViaFlowState squelches l's writer deterministically: the GET_FLOW_STATE reply is applied before Ctrl returns
+func squelchViaFlowState(t *testing.T, l *LinkMgr, m *FakeMCU) {
+	m.mutex.Lock()
+	m.Replies[CONTROL_GET_FLOW_STATE] = []byte{1}
+	m.mutex.Unlock()
+	if squelched, err := l.GetFlowControlState(); err != nil || !squelched {
+		t.Fatalf("Expected squelched, got %v, %v", squelched, err)
+	}
+}
+
+func TestFlowStateRecoversMissedUnsquelch(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	l.DefaultCtrlTimeout = 500 * time.Millisecond
+
+	squelchViaFlowState(t, l, m)
+	l.Send(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	const queued = 10 // More than CtrlTX and RunNPI can hold, so CtrlTX backs up behind the squelched writer
+	go func() {
+		for i := 0; i < queued; i++ {
+			l.CtrlForget(CONTROL_GET_RF, nil)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if n := len(m.FramesSeen()); n != 0 {
+		t.Fatalf("Writer wrote %d frames while squelched", n)
+	}
+
+	// The MCU's unsquelch was lost; asking for the flow state must still get through, and its reply re-syncs the writer
+	m.mutex.Lock()
+	m.Replies[CONTROL_GET_FLOW_STATE] = []byte{0}
+	m.mutex.Unlock()
+	if squelched, err := l.GetFlowControlState(); err != nil || squelched {
+		t.Fatalf("Expected unsquelched, got %v, %v", squelched, err)
+	}
+	if !waitFor(func() bool { return len(m.FramesSeen()) == 1 }) {
+		t.Fatalf("Writer stayed squelched after the flow state re-sync")
+	}
+	getRF := func() int {
+		n := 0
+		for _, c := range m.CommandsSeen() {
+			if c == CONTROL_GET_RF {
+				n++
+			}
+		}
+		return n
+	}
+	if !waitFor(func() bool { return getRF() == queued }) {
+		t.Errorf("Expected %d queued GET_RF requests written, got %d", queued, getRF())
+	}
+	if n := l.Stats().SquelchTimeouts; n != 0 {
+		t.Errorf("Expected no squelch timeouts, got %d", n)
+	}
+}
+
+func TestTryCtrlForgetFlowState(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithCtrlQueueDepth(1))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	squelchViaFlowState(t, l, m)
+	// Back CtrlTX up behind the squelched writer until TryCtrlForget finds it full
+	go func() {
+		for i := 0; i < 10; i++ {
+			l.CtrlForget(CONTROL_GET_RF, nil)
+		}
+	}()
+	if !waitFor(func() bool { return l.TryCtrlForget(CONTROL_GET_RF, nil) == ErrCtrlQueueFull }) {
+		t.Fatalf("CtrlTX never filled up")
+	}
+
+	// A fire-and-forget flow-state request bypasses CtrlTX, and its reply still re-syncs the writer
+	m.mutex.Lock()
+	m.Replies[CONTROL_GET_FLOW_STATE] = []byte{0}
+	m.mutex.Unlock()
+	seen := len(m.CommandsSeen())
+	if err = l.TryCtrlForget(CONTROL_GET_FLOW_STATE, nil); err != nil {
+		t.Fatalf("TryCtrlForget(GET_FLOW_STATE) error: %v", err)
+	}
+	if !waitFor(func() bool { c := m.CommandsSeen(); return len(c) > seen && c[seen] == CONTROL_GET_FLOW_STATE }) {
+		t.Fatalf("Flow-state request did not reach the MCU while CtrlTX was backed up")
+	}
+	if !waitFor(func() bool { return len(m.CommandsSeen()) >= seen+10 }) {
+		t.Errorf("Writer stayed squelched after the flow state re-sync")
+	}
+}
+
+func TestMaxSquelch(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithMaxSquelch(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	squelchViaFlowState(t, l, m)
+	start := time.Now()
+	l.Send(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	if !waitFor(func() bool { return len(m.FramesSeen()) == 1 }) {
+		t.Fatalf("Writer stayed squelched past WithMaxSquelch")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Writer resumed after %v, before the max squelch expired", elapsed)
+	}
+	if n := l.Stats().SquelchTimeouts; n != 1 {
+		t.Errorf("Expected 1 squelch timeout, got %d", n)
+	}
+}
+
+func TestUnsquelch(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	squelchViaFlowState(t, l, m)
+	l.Send(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	time.Sleep(20 * time.Millisecond)
+	if n := len(m.FramesSeen()); n != 0 {
+		t.Fatalf("Expected no frames written while squelched, got %d", n)
+	}
+	l.Unsquelch()
+	if !waitFor(func() bool { return len(m.FramesSeen()) == 1 }) {
+		t.Fatalf("Frame was not written after Unsquelch")
+	}
+	if n := l.Stats().SquelchTimeouts; n != 1 {
+		t.Errorf("Expected 1 host-cleared squelch, got %d", n)
+	}
+}
+
+func TestMCUSquelch(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	// Control observers run once RunNPI has handed the flow control change to the writer
+	flow := make(chan uint8, 2)
+	l.RegisterControlObserver(func(rep NpiControl) { flow <- rep.Command })
+	awaitFlow := func(cmd uint8) {
+		select {
+		case c := <-flow:
+			if c != cmd {
+				t.Fatalf("Observed control %02X, want %02X", c, cmd)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Control %02X never processed", cmd)
+		}
+	}
+
+	m.Inject(controlReplyBytes(CONTROL_SQUELCH_HOST, CONTROL_STATUS_OK, nil))
+	awaitFlow(CONTROL_SQUELCH_HOST)
+	if err := l.Send(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(m.FramesSeen()); n != 0 {
+		t.Fatalf("Expected no frames written while the MCU has the host squelched, got %d", n)
+	}
+	if l.TXBacklog() != 1 {
+		t.Errorf("Expected the frame held in FrameTX while squelched, TXBacklog=%d", l.TXBacklog())
+	}
+
+	m.Inject(controlReplyBytes(CONTROL_UNSQUELCH_HOST, CONTROL_STATUS_OK, nil))
+	awaitFlow(CONTROL_UNSQUELCH_HOST)
+	if !waitFor(func() bool { return len(m.FramesSeen()) == 1 }) {
+		t.Fatalf("Queued frame was not written after the MCU unsquelched")
+	}
+	if f := m.FramesSeen()[0]; f.Address != 0xDEADBEEF || string(f.Data) != "SIXTY NINE" {
+		t.Errorf("Unexpected frame written: %+v", *f)
+	}
+	if n := l.Stats().SquelchTimeouts; n != 0 {
+		t.Errorf("MCU-cleared squelch counted as a host timeout: %d", n)
+	}
+}
+
+func TestTryCtrlForget(t *testing.T) {
+	l := new(LinkMgr)
+	l.CtrlTX = make(chan *NpiControl, 2) // Nothing consumes it, as if RunNPI were stuck
+	l.NpiDied = make(chan struct{})
+	for i := 0; i < 2; i++ {
+		if err := l.TryCtrlForget(CONTROL_UNSQUELCH_HOST, nil); err != nil {
+			t.Fatalf("TryCtrlForget #%d error: %v", i+1, err)
+		}
+	}
+	if err := l.TryCtrlForget(CONTROL_UNSQUELCH_HOST, nil); err != ErrCtrlQueueFull {
+		t.Errorf("Expected ErrCtrlQueueFull, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.CtrlForget(CONTROL_UNSQUELCH_HOST, nil) }()
+	close(l.NpiDied)
+	if err := <-done; err == nil {
+		t.Errorf("CtrlForget on a full queue did not fail once the link died")
+	}
+
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithCtrlQueueDepth(7))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	if cap(l.CtrlTX) != 7 {
+		t.Errorf("Expected a CtrlTX queue of 7, got %d", cap(l.CtrlTX))
+	}
+}
+
+func TestRunTxCount(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	if n, err := l.RunTx(); err != nil || n != RunTxUnknown {
+		t.Errorf("Expected RunTxUnknown from a count-less reply, got %d, %v", n, err)
+	}
+	m.mutex.Lock()
+	m.Replies[CONTROL_RUN_TX] = []byte{2}
+	m.mutex.Unlock()
+	if n, err := l.RunTx(); err != nil || n != 2 {
+		t.Errorf("Expected 2 transmitted, got %d, %v", n, err)
+	}
+	m.mutex.Lock()
+	m.Replies[CONTROL_RUN_TX] = []byte{1, 2, 3}
+	m.mutex.Unlock()
+	if _, err := l.RunTx(); err == nil {
+		t.Errorf("Expected an error for a malformed RUN_TX reply")
+	}
+}
+
+func TestControlObserver(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	seen := make(chan NpiControl, 4)
+	l.RegisterControlObserver(func(rep NpiControl) { seen <- rep })
+	m.Replies[CONTROL_GET_IDENTIFIER] = []byte("FAKE")
+	l.GetIdentifier()
+	m.Inject(controlReplyBytes(0x42, CONTROL_STATUS_OK, []byte{1}))
+	for _, want := range []uint8{CONTROL_GET_IDENTIFIER, 0x42} {
+		select {
+		case rep := <-seen:
+			if rep.Command != want {
+				t.Errorf("Expected observer to see command %02X, got %02X", want, rep.Command)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Observer never saw command %02X", want)
+		}
+	}
+
+	// A stuck observer must not hold up RunNPI
+	stuck := make(chan struct{})
+	defer close(stuck)
+	l.RegisterControlObserver(func(NpiControl) { <-stuck })
+	for i := 0; i < 100; i++ {
+		if _, _, err := l.Ctrl(CONTROL_GET_RF, nil); err != nil {
+			t.Fatalf("Ctrl %d failed behind a stuck observer: %v", i, err)
+		}
+		select {
+		case <-seen:
+		default:
+		}
+	}
+	if l.Stats().CtrlObserverDrops == 0 {
+		t.Errorf("Expected control replies to be dropped for the stuck observer")
+	}
+}
+
+func TestReplySizeError(t *testing.T) {
+	m := NewFakeMCU()
+	m.Replies[CONTROL_GET_RF] = []byte{1, 2, 3}
+	m.Replies[CONTROL_RUN_TX] = []byte{1, 2, 3}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	_, _, _, _, err = l.GetRadio()
+	var sizeErr *ReplySizeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("Expected a ReplySizeError, got %v", err)
+	}
+	if sizeErr.Command != CONTROL_GET_RF || sizeErr.Expected != 8 || sizeErr.Actual != 3 {
+		t.Errorf("Unexpected ReplySizeError contents: %+v", sizeErr)
+	}
+	if _, _, err = l.GetAddresses(); !errors.As(err, &sizeErr) || sizeErr.Actual != 0 {
+		t.Errorf("Expected a ReplySizeError for an empty GET_ADDRESSES reply, got %v", err)
+	}
+	if _, err = l.RunTx(); !errors.As(err, &sizeErr) || sizeErr.Command != CONTROL_RUN_TX || sizeErr.Expected != 2 ||
+		sizeErr.Actual != 3 {
+		t.Errorf("Expected a ReplySizeError for a 3-byte RUN_TX reply, got %v", err)
+	}
+}
+
+func TestExtendedReplies(t *testing.T) {
+	m := NewFakeMCU()
+	// Newer firmware appending fields the host doesn't know about yet
+	m.Replies[CONTROL_GET_RF] = []byte{1, 0x80, 0xA2, 0xCF, 0x35, 10, 100, 0, 0xAA, 0xBB}
+	m.Replies[CONTROL_GET_ADDRESSES] = []byte{0xEF, 0xBE, 0xAD, 0xDE, 0, 0, 0, 0, 0xCC}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	rxOn, freq, power, tick, err := l.GetRadio()
+	if err != nil || !rxOn || freq != 902800000 || power != 10 || tick != 100 {
+		t.Errorf("GetRadio() = %v, %d, %d, %d, %v", rxOn, freq, power, tick, err)
+	}
+	ieee, alt, err := l.GetAddresses()
+	if err != nil || ieee != 0xDEADBEEF || alt != 0 {
+		t.Errorf("GetAddresses() = %08X, %08X, %v", ieee, alt, err)
+	}
+}
+
+func TestModulation(t *testing.T) {
+	m := NewFakeMCU()
+	m.Replies[CONTROL_GET_MODULATION] = []byte{byte(ModulationLRM5k)}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	if mode, err := l.GetModulation(); err != nil || mode != ModulationLRM5k {
+		t.Errorf("GetModulation() = %v, %v", mode, err)
+	}
+	if err = l.SetModulation(ModulationLRM625); err != nil {
+		t.Errorf("SetModulation error: %v", err)
+	}
+	m.mutex.Lock()
+	got := m.Requests[len(m.Requests)-1]
+	m.mutex.Unlock()
+	if !bytes.Equal(got, []byte{byte(ModulationLRM625)}) {
+		t.Errorf("SetModulation sent %v", got)
+	}
+	sent := len(m.CommandsSeen())
+	if err = l.SetModulation(ModulationMode(42)); err == nil || len(m.CommandsSeen()) != sent {
+		t.Errorf("Invalid mode was not refused client-side: %v", err)
+	}
+
+	m.mutex.Lock()
+	m.Status[CONTROL_GET_MODULATION] = CONTROL_STATUS_UNKNOWN_CMD
+	m.Status[CONTROL_SET_MODULATION] = CONTROL_STATUS_FEATURE_NOT_IMPLEMENTED
+	m.mutex.Unlock()
+	if _, err = l.GetModulation(); err != ErrModulationUnsupported {
+		t.Errorf("GetModulation on old firmware returned %v", err)
+	}
+	if err = l.SetModulation(Modulation50kGFSK); err != ErrModulationUnsupported {
+		t.Errorf("SetModulation without the feature returned %v", err)
+	}
+}
+
+func TestCtrlStatusError(t *testing.T) {
+	m := NewFakeMCU()
+	m.Status[CONTROL_SET_TXPOWER] = CONTROL_STATUS_PARAMETER_OUT_OF_BOUNDS
+	m.Replies[CONTROL_SET_TXPOWER] = []byte{0x0E, 0x80}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	l.DebugCtrl = true
+	err = l.SetPower(20)
+	var statErr *CtrlStatusError
+	if !errors.As(err, &statErr) {
+		t.Fatalf("Expected a CtrlStatusError, got %v", err)
+	}
+	if statErr.Command != CONTROL_SET_TXPOWER || statErr.Status != CONTROL_STATUS_PARAMETER_OUT_OF_BOUNDS ||
+		!bytes.Equal(statErr.Reply, []byte{0x0E, 0x80}) {
+		t.Errorf("Unexpected CtrlStatusError contents: %+v", statErr)
+	}
+	if err.Error() != "SetPower error: PARAMETER OUT OF BOUNDS" {
+		t.Errorf("Unexpected error text %q", err.Error())
+	}
+}
+
+func TestInfo(t *testing.T) {
+	m := NewFakeMCU()
+	m.Replies[CONTROL_GET_IDENTIFIER] = []byte("SMac NPI v2")
+	m.Replies[CONTROL_GET_RF] = []byte{1, 0x80, 0xA2, 0xCF, 0x35, 10, 100, 0}
+	m.Replies[CONTROL_GET_ADDRESSES] = []byte{0xEF, 0xBE, 0xAD, 0xDE, 0, 0, 0, 0}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	info, err := l.Info()
+	if err != nil {
+		t.Fatalf("Info error: %v", err)
+	}
+	expected := "Firmware:  SMac NPI v2\nRadio:     902.800MHz, 10dBm, RX on, TX tick 100ms\nAddresses: DEADBEEF (alternate none)"
+	if info.String() != expected {
+		t.Errorf("Unexpected StationInfo:\n%s\nwant:\n%s", info, expected)
+	}
+
+	m.mutex.Lock()
+	m.Status[CONTROL_GET_RF] = CONTROL_STATUS_ERROR
+	m.mutex.Unlock()
+	info, err = l.Info()
+	var infoErr *StationInfoError
+	if !errors.As(err, &infoErr) || len(infoErr.Errs) != 1 {
+		t.Fatalf("Expected a StationInfoError for the failed GET_RF, got %v", err)
+	}
+	var statErr *CtrlStatusError
+	if !errors.As(err, &statErr) || statErr.Command != CONTROL_GET_RF {
+		t.Errorf("StationInfoError does not unwrap to the GetRadio failure: %v", err)
+	}
+	if info.Identifier != "SMac NPI v2" || info.IEEEAddress != 0xDEADBEEF || info.Frequency != 0 {
+		t.Errorf("Unexpected partial StationInfo: %+v", info)
+	}
+}
+
+func TestMHzToHz(t *testing.T) {
+	hz, err := MHzToHz(902.8)
+	if err != nil || hz != 902800000 {
+		t.Errorf("Expected 902800000Hz, got %d, %v", hz, err)
+	}
+	if hz, _ = MHzToHz(433.92); hz != 433920000 {
+		t.Errorf("Expected 433920000Hz, got %d", hz)
+	}
+	for _, mhz := range []float64{902800000, 0.9028, 600, -868} {
+		if _, err = MHzToHz(mhz); err == nil {
+			t.Errorf("%gMHz was accepted", mhz)
+		}
+	}
+	cfg := RadioConfig{Frequency: 915250000}
+	if cfg.CenterFreqMHz() != 915.25 {
+		t.Errorf("Expected 915.25MHz, got %g", cfg.CenterFreqMHz())
+	}
+}
+
+func TestSetFrequencyMHz(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	if err = l.SetFrequencyMHz(902.8); err != nil {
+		t.Fatalf("SetFrequencyMHz error: %v", err)
+	}
+	m.mutex.Lock()
+	cmd, got := m.Commands[len(m.Commands)-1], m.Requests[len(m.Requests)-1]
+	m.mutex.Unlock()
+	if cmd != CONTROL_SET_CENTERFREQ || !bytes.Equal(got, []byte{0x80, 0xA2, 0xCF, 0x35}) { // 902800000, little-endian
+		t.Errorf("SetFrequencyMHz sent command %02X [% X]", cmd, got)
+	}
+	sent := len(m.CommandsSeen())
+	if err = l.SetFrequencyMHz(600); err == nil || len(m.CommandsSeen()) != sent {
+		t.Errorf("Out-of-band frequency was not refused client-side: %v", err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+
+	h := l.Health()
+	if !h.LinkUp || h.SinceLastRxFrame != -1 || h.SinceLastCtrlReply != -1 {
+		t.Errorf("Unexpected initial health: %+v", h)
+	}
+
+	if err = l.On(true); err != nil {
+		t.Fatalf("On error: %v", err)
+	}
+	m.Inject(defaultReadData)
+	waitFor(func() bool { return l.Stats().RxFrames == 1 })
+	h = l.Health()
+	if h.SinceLastRxFrame < 0 || h.SinceLastCtrlReply < 0 || h.Stats.RxFrames != 1 {
+		t.Errorf("Health did not reflect link activity: %+v", h)
+	}
+	if _, err = json.Marshal(h); err != nil {
+		t.Errorf("HealthStatus did not marshal to JSON: %v", err)
+	}
+
+	l.Close()
+	if l.Health().LinkUp {
+		t.Errorf("Link reported up after Close")
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	if err = l.SendRaw([]byte{0xBD, 0x02}); err != ErrRawSendDisabled {
+		t.Errorf("Expected ErrRawSendDisabled, got %v", err)
+	}
+	l.AllowRawSend = true
+	// A GET_RF request split across two raw writes must be reassembled by the MCU's parser like any other
+	if err = l.SendRaw([]byte{0xBD, 0x02}); err != nil {
+		t.Fatalf("SendRaw error: %v", err)
+	}
+	if err = l.SendRaw([]byte{0x00, 0x02}); err != nil {
+		t.Fatalf("SendRaw error: %v", err)
+	}
+	if !waitFor(func() bool { return len(m.CommandsSeen()) == 1 }) {
+		t.Errorf("Raw bytes did not reach the PHY")
+	}
+}
+
+func TestSendRawAfterClose(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithQueueDepth(DefaultQueueDepth, 0))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	l.AllowRawSend = true
+	// With the writer squelched and FrameTX unbuffered, SendRaw waits for room until the link is closed
+	squelchViaFlowState(t, l, m)
+	result := make(chan error, 1)
+	go func() { result <- l.SendRaw([]byte{0xBD, 0x02, 0x00, 0x02}) }()
+	time.Sleep(20 * time.Millisecond)
+	l.Close()
+	select {
+	case err = <-result:
+		if err == nil {
+			t.Errorf("SendRaw succeeded on a closed link")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("SendRaw still blocked after Close")
+	}
+	if err = l.SendRaw([]byte{0xBD, 0x02, 0x00, 0x02}); err == nil {
+		t.Errorf("SendRaw after Close succeeded")
+	}
+}
+
+func TestSendMultiContiguous(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for _, tag := range []byte{'A', 'B', 'C'} {
+		wg.Add(1)
+		go func(tag byte) {
+			defer wg.Done()
+			payloads := [][]byte{{tag, 1}, {tag, 2}, {tag, 3}}
+			if err := l.SendMulti(0xDEAD0001, 0xFFFF, payloads); err != nil {
+				t.Errorf("SendMulti error: %v", err)
+			}
+		}(tag)
+	}
+	wg.Wait()
+
+	if !waitFor(func() bool { return len(m.FramesSeen()) == 9 }) {
+		t.Fatalf("Expected 9 frames, got %d", len(m.FramesSeen()))
+	}
+	frames := m.FramesSeen()
+	for i := 0; i < len(frames); i += 3 {
+		for j := 0; j < 3; j++ {
+			if frames[i+j].Data[0] != frames[i].Data[0] || frames[i+j].Data[1] != byte(j+1) {
+				t.Errorf("Multi-frame messages interleaved at frame %d: %v", i+j, frames[i+j].Data)
+			}
+		}
+	}
+	if len(l.destLocks) != 0 {
+		t.Errorf("Destination locks leaked: %d", len(l.destLocks))
+	}
+}
+
+func TestUnsolicitedControl(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	m.Inject(controlReplyBytes(0x42, CONTROL_STATUS_OK, []byte("BOOT")))
+	select {
+	case rep := <-l.UnsolicitedControl():
+		if rep.Command != 0x42 || string(rep.Reply) != "BOOT" {
+			t.Errorf("Unexpected unsolicited reply: %+v", rep)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Unsolicited control reply was not surfaced")
+	}
+	if l.Stats().UnsolicitedCtrlReplies != 1 {
+		t.Errorf("Expected 1 unsolicited reply counted, got %d", l.Stats().UnsolicitedCtrlReplies)
+	}
+}
+
+func TestCtrlReplyBurst(t *testing.T) {
+	m := NewFakeMCU()
+	phy := &gatedPHY{FakeMCU: m, entered: make(chan struct{}, 1), gate: make(chan struct{})}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return phy, nil }, WithCtrlReplyBuffer(8))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	// Wedge RunNPI: hold the writer in the middle of a write, then hand it a squelch
+	if err = l.CtrlForget(CONTROL_GET_RF, nil); err != nil {
+		t.Fatalf("CtrlForget error: %v", err)
+	}
+	select {
+	case <-phy.entered:
+	case <-time.After(time.Second):
+		t.Fatalf("Writer never started writing")
+	}
+	m.Inject(controlReplyBytes(CONTROL_SQUELCH_HOST, CONTROL_STATUS_OK, nil))
+	time.Sleep(20 * time.Millisecond)
+
+	var burst []byte
+	for i := 0; i < 40; i++ {
+		if i == 20 {
+			burst = append(burst, controlReplyBytes(CONTROL_UNSQUELCH_HOST, CONTROL_STATUS_OK, nil)...)
+		}
+		burst = append(burst, controlReplyBytes(0x42, CONTROL_STATUS_OK, []byte{uint8(i)})...)
+	}
+	m.Inject(burst)
+	if !waitFor(func() bool { return l.Stats().CtrlReplyDrops == 12 }) {
+		t.Errorf("Expected 12 replies dropped beyond the buffer of 8, got %d", l.Stats().CtrlReplyDrops)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := l.Stats().CtrlReplyDrops; n != 12 {
+		t.Errorf("Reader went on dropping replies (%d) rather than wait to deliver the unsquelch", n)
+	}
+
+	// Once RunNPI is free again, the unsquelch reaches the writer
+	close(phy.gate)
+	l.Send(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	if !waitFor(func() bool { return len(m.FramesSeen()) == 1 }) {
+		t.Errorf("Writer stayed squelched; the unsquelch in the burst was lost")
+	}
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte{0x01}), -40)
+	if !waitFor(func() bool { return l.Stats().RxFrames == 1 }) {
+		t.Errorf("Reader stalled behind the reply burst")
+	}
+}
+
+// gatedPHY holds every write until gate is closed, signaling entered (if there's room) as each one starts
+type gatedPHY struct {
+	*FakeMCU
+	entered chan struct{}
+	gate    chan struct{}
+
+	mutex  sync.Mutex
+	starts []byte // Start char of each write, in order
+}
+
+func (p *gatedPHY) Write(b []byte) (int, error) {
+	select {
+	case p.entered <- struct{}{}:
+	default:
+	}
+	<-p.gate
+	p.mutex.Lock()
+	p.starts = append(p.starts, b[0])
+	p.mutex.Unlock()
+	return p.FakeMCU.Write(b)
+}
+
+// Starts returns the start char of each write so far, in order
+func (p *gatedPHY) Starts() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]byte(nil), p.starts...)
+}
+
+func TestFlush(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	if err = l.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	want := []uint8{CONTROL_UNSQUELCH_HOST, CONTROL_GET_RF, CONTROL_GET_CAPABILITIES}
+	if !bytes.Equal(m.CommandsSeen(), want) {
+		t.Errorf("Expected commands %v, got %v", want, m.CommandsSeen())
+	}
+}
+
+func TestFlushLeavesNoPendingUnsquelch(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		if err = l.Flush(); err != nil {
+			t.Fatalf("Flush error: %v", err)
+		}
+	}
+	// Each Flush's fire-and-forget UNSQUELCH_HOST must be retired by its reply, not left queued ahead of this one
+	if st, _, err := l.CtrlWithTimeout(CONTROL_UNSQUELCH_HOST, nil, 500*time.Millisecond); err != nil || st != CONTROL_STATUS_OK {
+		t.Errorf("Expected UNSQUELCH_HOST to be answered, got status %s, error %v", Status(st), err)
+	}
+	if n := l.Stats().UnsolicitedCtrlReplies; n != 0 {
+		t.Errorf("Expected no unsolicited control replies, got %d", n)
+	}
+}
+
+func TestLatencySummary(t *testing.T) {
+	var lt latencyTracker
+	for i := 1; i <= 100; i++ {
+		lt.record(time.Duration(i) * time.Millisecond)
+	}
+	sum := lt.summary()
+	if sum.Count != 100 || sum.Min != time.Millisecond || sum.Max != 100*time.Millisecond {
+		t.Errorf("Unexpected count/min/max: %+v", sum)
+	}
+	if sum.Mean != 50500*time.Microsecond {
+		t.Errorf("Expected mean 50.5ms, got %v", sum.Mean)
+	}
+	if sum.P95 != 95*time.Millisecond {
+		t.Errorf("Expected p95 95ms, got %v", sum.P95)
+	}
+}
+
+func TestCtrlLatencyStats(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	l.On(true)
+	l.On(true)
+	l.RunTx()
+	st := l.Stats()
+	if st.CtrlLatency.Count != 3 {
+		t.Errorf("Expected 3 latency samples, got %d", st.CtrlLatency.Count)
+	}
+	if st.CtrlLatencyByCommand[CONTROL_SET_RF_ON].Count != 2 || st.CtrlLatencyByCommand[CONTROL_RUN_TX].Count != 1 {
+		t.Errorf("Unexpected per-command latency counts: %+v", st.CtrlLatencyByCommand)
+	}
+}
+
+func TestSendAck(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	if err := l.SendAck(0xDEAD0001, 0x2000, []byte{0x01}); err != nil {
+		t.Errorf("SendAck error: %v", err)
+	}
+	if len(m.FramesSeen()) != 1 || l.Stats().TxFrames != 1 {
+		t.Errorf("Frame not written before SendAck returned: frames=%d TxFrames=%d", len(m.FramesSeen()), l.Stats().TxFrames)
+	}
+
+	m.FailWrites(errors.New("cable unplugged"))
+	if err := l.SendAck(0xDEAD0001, 0x2000, []byte{0x02}); err == nil {
+		t.Errorf("SendAck did not report the failed write")
+	}
+	if !waitFor(func() bool { return l.Stats().TxWriteErrors == 1 }) {
+		t.Errorf("Expected TxWriteErrors=1, got %d", l.Stats().TxWriteErrors)
+	}
+}
+
+// wedgedPHY is a FakeMCU whose writes block until it is closed, like an adapter holding off flow control forever
+type wedgedPHY struct {
+	*FakeMCU
+}
+
+func (p wedgedPHY) Write(b []byte) (int, error) {
+	<-p.closed
+	return 0, errors.New("wedgedPHY closed")
+}
+
+func TestWriteTimeout(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return wedgedPHY{m}, nil }, WithWriteTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	if err = l.SendAck(0xDEAD0001, 0x2000, []byte{0x01}); !errors.Is(err, ErrWriteTimeout) {
+		t.Errorf("Expected ErrWriteTimeout from SendAck, got %v", err)
+	}
+	select {
+	case <-l.NpiDied:
+	case <-time.After(time.Second):
+		t.Fatalf("Link was not declared dead after the write timed out")
+	}
+	if st := l.Stats(); st.TxWriteTimeouts != 1 || st.TxWriteErrors != 1 {
+		t.Errorf("Expected TxWriteTimeouts=1 and TxWriteErrors=1, got %d and %d", st.TxWriteTimeouts, st.TxWriteErrors)
+	}
+}
+
+func TestSetControlLinesRequiresSerialPort(t *testing.T) {
+	assert := true
+	if err := setControlLines(NewFakeMCU(), &assert, nil); err == nil {
+		t.Errorf("setControlLines succeeded on a PHY with no serial port behind it")
+	}
+}
+
+func TestNewLinkMgrOpenError(t *testing.T) {
+	cases := []struct {
+		errno    syscall.Errno
+		sentinel error
+	}{
+		{syscall.ENOENT, ErrPortNotFound},
+		{syscall.EACCES, ErrPortPermission},
+		{syscall.EBUSY, ErrPortBusy},
+	}
+	for _, c := range cases {
+		_, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) {
+			return nil, &os.PathError{Op: "open", Path: "/dev/ttyACM0", Err: c.errno}
+		})
+		if !errors.Is(err, c.sentinel) {
+			t.Errorf("%v: expected errors.Is(err, %v), got %v", c.errno, c.sentinel, err)
+		}
+		var pathErr *os.PathError
+		if !errors.As(err, &pathErr) || pathErr.Err != c.errno {
+			t.Errorf("%v: underlying *os.PathError not reachable from %v", c.errno, err)
+		}
+		if DescribeOpenError(err, "/dev/ttyACM0") == "" {
+			t.Errorf("%v: no advice from DescribeOpenError", c.errno)
+		}
+	}
+
+	_, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return nil, errors.New("weird") })
+	if errors.Is(err, ErrPortNotFound) || errors.Is(err, ErrPortPermission) || errors.Is(err, ErrPortBusy) {
+		t.Errorf("Unrecognized open error matched a sentinel: %v", err)
+	}
+	if hint := DescribeOpenError(err, "/dev/ttyACM0"); hint != "" {
+		t.Errorf("Advice given for an unrecognized open error: %q", hint)
+	}
+}
+
+func TestSetBaudRateNonSerial(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	if err := l.SetBaudRate(230400); err == nil {
+		t.Errorf("SetBaudRate succeeded on a memory PHY")
+	}
+}
+
+func TestRunNPIReady(t *testing.T) {
+	m := NewFakeMCU()
+	frameXmit := make(chan *NpiRadioFrame)
+	ctrlXmit := make(chan *NpiControl)
+	fault := make(chan struct{})
+	ready := make(chan struct{})
+	go RunNPI(m, frameXmit, make(chan *NpiRadioFrame, 1), ctrlXmit, fault, WithReady(ready))
+	defer close(fault)
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatalf("RunNPI never signaled readiness")
+	}
+	select {
+	case frameXmit <- NewRadioFrame(0xDEAD0001, 0x2000, nil):
+	case <-time.After(time.Second):
+		t.Errorf("Writer not accepting frames after readiness")
+	}
+}
+
+func TestNewLinkMgrReady(t *testing.T) {
+	m := NewFakeMCU()
+	ready := make(chan struct{})
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithReady(ready))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	select {
+	case <-ready:
+	default:
+		t.Errorf("NewLinkMgrPHY returned without closing the caller's ready channel")
+	}
+}
+
+func TestSerializeEmitRSSI(t *testing.T) {
+	n := NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	n.Rssi = -42
+	if b := n.Serialize(); b[7] != 0 {
+		t.Errorf("Transmit frame carried RSSI byte %02X", b[7])
+	}
+
+	n.EmitRSSI = true
+	b := n.Serialize()
+	if int8(b[7]) != -42 || !VerifyFrameChecksum(b) {
+		t.Fatalf("EmitRSSI frame wrong: % X", b)
+	}
+	rx := decodeRadioFrame(b, FrameFormatBasic)
+	if rx.Rssi != -42 || rx.Address != n.Address || !bytes.Equal(rx.Data, n.Data) {
+		t.Errorf("Round trip failed: %+v", rx)
+	}
+}
+
+func TestStartBaseStation(t *testing.T) {
+	m := NewFakeMCU()
+	cfg := DefaultBaseStationConfig()
+	var setupCommands int
+	cfg.Setup = func(l *LinkMgr) { setupCommands = len(m.CommandsSeen()) }
+	l, err := startBaseStation(func() (io.ReadWriteCloser, error) { return m, nil }, cfg)
+	if err != nil {
+		t.Fatalf("startBaseStation error: %v", err)
+	}
+	defer l.Close()
+
+	seen := m.CommandsSeen()
+	want := []uint8{CONTROL_SET_ALTERNATE_ADDR, CONTROL_SET_CENTERFREQ, CONTROL_SET_TXPOWER, CONTROL_SET_RF_ON}
+	if len(seen) < len(want) || !bytes.Equal(seen[len(seen)-len(want):], want) {
+		t.Errorf("Expected radio configuration commands % X at the end, saw % X", want, seen)
+	}
+	if setupCommands != len(seen)-len(want) {
+		t.Errorf("Setup ran after %d commands, expected before the radio configuration (%d)", setupCommands, len(seen)-len(want))
+	}
+
+	m2 := NewFakeMCU()
+	m2.Status = map[uint8]uint8{CONTROL_SET_CENTERFREQ: CONTROL_STATUS_PARAMETER_OUT_OF_BOUNDS}
+	_, err = startBaseStation(func() (io.ReadWriteCloser, error) { return m2, nil }, cfg)
+	if err == nil {
+		t.Errorf("startBaseStation ignored a failed configuration step")
+	}
+}
+
+// blockingHandler holds up the RX dispatcher until release is closed
+type blockingHandler struct {
+	release chan struct{}
+}
+
+func (h blockingHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
+	<-h.release
+	return true
+}
+
+func TestDryRun(t *testing.T) {
+	var out bytes.Buffer
+	cfg := DefaultBaseStationConfig()
+	cfg.DryRun = &out
+	l, err := StartBaseStation("/dev/nonexistent", 115200, cfg)
+	if err != nil {
+		t.Fatalf("StartBaseStation dry run error: %v", err)
+	}
+	defer l.Close()
+	if err = l.SendAck(0xDEAD0001, 0x2000, []byte{0x42}); err != nil {
+		t.Errorf("SendAck error: %v", err)
+	}
+	if _, err = l.RunTx(); err != nil {
+		t.Errorf("RunTx error: %v", err)
+	}
+	if err = l.SetModulation(Modulation50kGFSK); err != nil {
+		t.Errorf("SetModulation error: %v", err)
+	}
+
+	log := out.String()
+	for _, want := range []string{
+		"dry-run: CTRL UNSQUELCH_HOST(00) data=[] wire=[BD 00 00 00]\n",
+		"dry-run: CTRL SET_CENTERFREQ(03) data=[80 A2 CF 35] wire=[BD 03 04 80 A2 CF 35 ",
+		"dry-run: OTA dst=DEAD0001 prog=2000 data=[42] wire=[AE 01 00 AD DE 00 20 00 01 42 ",
+		"dry-run: CTRL RUN_TX(08)",
+		"dry-run: CTRL SET_MODULATION(16) data=[00]",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("Dry run log lacks %q:\n%s", want, log)
+		}
+	}
+}
+
+func TestDryRunFlush(t *testing.T) {
+	var out bytes.Buffer
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return NewDryRunPHY(&out), nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	if err = l.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	// Flush's GetCapabilities must have been answered well-formed, else it only logs a warning
+	if caps, err := l.GetCapabilities(); err != nil || caps != 0 {
+		t.Errorf("Expected no capabilities, got %v, %v", caps, err)
+	}
+	if squelched, err := l.GetFlowControlState(); err != nil || squelched {
+		t.Errorf("Expected unsquelched, got %v, %v", squelched, err)
+	}
+}
+
+func TestRXBacklog(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithQueueDepth(8, 4))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	if cap(l.FrameRX) != 8 || cap(l.FrameTX) != 4 {
+		t.Errorf("WithQueueDepth not applied: rx=%d tx=%d", cap(l.FrameRX), cap(l.FrameTX))
+	}
+
+	h := blockingHandler{release: make(chan struct{})}
+	l.RegisterAllHandler(h)
+	for i := 0; i < 4; i++ {
+		m.InjectFrame(NewRadioFrame(0xDEAD0001, 0x2000, []byte{byte(i)}), -50)
+	}
+	// One frame is stuck in the blocked handler, the other three wait in FrameRX
+	if !waitFor(func() bool { return l.Stats().RXBacklog == 3 }) {
+		t.Errorf("Expected RXBacklog=3, got %d", l.RXBacklog())
+	}
+	close(h.release)
+	if !waitFor(func() bool { return l.RXBacklog() == 0 }) {
+		t.Errorf("Backlog did not drain, RXBacklog=%d", l.RXBacklog())
+	}
+}
+
+func TestInbox(t *testing.T) {
+	l := newTestLinkMgr()
+	l.stats = NewNpiStats()
+	inbox, stop := l.Inbox(0xBACE0002, 2)
+	other := new(countingHandler)
+	l.RegisterAllHandler(other)
+
+	for i := 0; i < 3; i++ {
+		l.dispatch(NewRadioFrame(0xBACE0002, 0x2000, []byte{byte(i)}))
+	}
+	l.dispatch(NewRadioFrame(0xBACE0003, 0x2000, nil))
+
+	for i := 0; i < 2; i++ {
+		n := <-inbox
+		if n.Address != 0xBACE0002 || n.Data[0] != byte(i) {
+			t.Errorf("Unexpected inbox frame %d: %+v", i, n)
+		}
+	}
+	if drops := l.Stats().InboxDrops; drops != 1 {
+		t.Errorf("Expected 1 inbox drop, got %d", drops)
+	}
+	if other.Count() != 4 {
+		t.Errorf("Inbox stopped frames reaching the firehose: %d", other.Count())
+	}
+
+	stop()
+	if _, ok := <-inbox; ok {
+		t.Errorf("Inbox channel not closed by stop")
+	}
+	l.dispatch(NewRadioFrame(0xBACE0002, 0x2000, nil)) // must not panic sending on the closed inbox
+	if _, ok := l.RxRegistryAddress[0xBACE0002]; ok {
+		t.Errorf("Inbox handler still registered after stop")
+	}
+}
+
+func TestCtrlTimeoutConfig(t *testing.T) {
+	m := NewFakeMCU()
+	m.Silent = true
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	start := time.Now()
+	_, _, err = l.CtrlWithTimeout(CONTROL_GET_RF, nil, 500*time.Microsecond)
+	if _, ok := err.(CtrlTimeout); !ok {
+		t.Errorf("Expected CtrlTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Sub-millisecond timeout took %v", elapsed)
+	}
+
+	// The high-level wrappers follow DefaultCtrlTimeout
+	l.DefaultCtrlTimeout = 10 * time.Millisecond
+	start = time.Now()
+	if _, _, _, _, err = l.GetRadio(); err == nil {
+		t.Errorf("GetRadio succeeded against a silent MCU")
+	} else if _, ok := err.(CtrlTimeout); !ok {
+		t.Errorf("Expected CtrlTimeout from GetRadio, got %v", err)
+	}
+	if err = l.SetFrequency(902800000); err == nil {
+		t.Errorf("SetFrequency succeeded against a silent MCU")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DefaultCtrlTimeout of 10ms took %v to expire twice", elapsed)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	m := NewFakeMCU()
+	m.Silent = true
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithQueueDepth(4, 1))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err = l.CtrlContext(ctx, CONTROL_GET_RF, nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from CtrlContext, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Canceled CtrlContext took %v to return", elapsed)
+	}
+
+	// With the writer squelched and FrameTX full, Send would block indefinitely
+	m.mutex.Lock()
+	m.Silent = false
+	m.mutex.Unlock()
+	squelchViaFlowState(t, l, m)
+	if err = l.Send(0xDEADBEEF, 0x6933, []byte{0x01}); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err = l.SendContext(ctx, 0xDEADBEEF, 0x6933, []byte{0x02}); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded from SendContext, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SendContext took %v to give up", elapsed)
+	}
+	if l.TXBacklog() != 1 {
+		t.Errorf("Abandoned frame was queued anyway; backlog %d", l.TXBacklog())
+	}
+
+	// A Send blocked on the full FrameTX holds the destination's lock; SendContext mustn't wait for it regardless
+	sent := make(chan error, 1)
+	go func() { sent <- l.Send(0xDEADBEEF, 0x6933, []byte{0x03}) }()
+	held := func() bool {
+		l.destMutex.Lock()
+		defer l.destMutex.Unlock()
+		d := l.destLocks[0xDEADBEEF]
+		return d != nil && len(d.held) == 1
+	}
+	if !waitFor(held) {
+		t.Fatalf("Send never took the destination lock")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err = l.SendContext(ctx, 0xDEADBEEF, 0x6933, []byte{0x04}); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded from SendContext behind another Send, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SendContext took %v to give up waiting for the destination", elapsed)
+	}
+	l.Unsquelch()
+	if err = <-sent; err != nil {
+		t.Errorf("Send error: %v", err)
+	}
+	if !waitFor(func() bool { l.destMutex.Lock(); defer l.destMutex.Unlock(); return len(l.destLocks) == 0 }) {
+		t.Errorf("Destination locks leaked")
+	}
+}
+
+func TestConcurrentIdenticalCtrl(t *testing.T) {
+	cases := []struct {
+		name      string
+		callers   int
+		abandoned int // Requests canceled before any reply arrives
+	}{
+		{"two callers", 2, 0},
+		{"four callers", 4, 0},
+		{"after an abandoned request", 1, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewFakeMCU()
+			m.Silent = true
+			l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+			if err != nil {
+				t.Fatalf("NewLinkMgrPHY error: %v", err)
+			}
+			defer l.Close()
+
+			for i := 0; i < c.abandoned; i++ {
+				go l.Ctrl(CONTROL_GET_RF, nil)
+			}
+			if !waitFor(func() bool { return len(m.CommandsSeen()) == c.abandoned }) {
+				t.Fatalf("Requests to abandon never reached the MCU")
+			}
+			l.CancelPendingControls()
+
+			replies := make(chan []byte, c.callers)
+			for i := 0; i < c.callers; i++ {
+				go func() {
+					_, rpl, err := l.Ctrl(CONTROL_GET_RF, nil)
+					if err != nil {
+						t.Errorf("Ctrl error: %v", err)
+					}
+					replies <- rpl
+				}()
+			}
+			if !waitFor(func() bool { return len(m.CommandsSeen()) == c.abandoned+c.callers }) {
+				t.Fatalf("Control requests never reached the MCU")
+			}
+			// Every request is queued before the MCU answers any of them
+			for i := 0; i < c.callers; i++ {
+				m.Inject(controlReplyBytes(CONTROL_GET_RF, CONTROL_STATUS_OK, []byte{byte(i)}))
+			}
+			got := make(map[byte]bool)
+			for i := 0; i < c.callers; i++ {
+				select {
+				case rpl := <-replies:
+					if len(rpl) == 1 {
+						got[rpl[0]] = true
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Only %d of %d callers got a reply", i, c.callers)
+				}
+			}
+			if len(got) != c.callers {
+				t.Errorf("Replies were not shared out one per caller: %v", got)
+			}
+		})
+	}
+}
+
+func TestCtrlRegistryBounded(t *testing.T) {
+	registry := make(map[uint8][]*NpiControl)
+	// A command the firmware never answers: every request times out without a reply
+	for i := 0; i < 100; i++ {
+		n := NewControl(CONTROL_GET_CAPABILITIES, nil)
+		pushCtrlRequest(registry, n)
+		n.abandon()
+	}
+	if n := len(registry[CONTROL_GET_CAPABILITIES]); n > 1 {
+		t.Errorf("Expected at most 1 abandoned request left queued, got %d", n)
+	}
+
+	// Requests still being waited on are kept, in order, behind which a late reply finds its way to a live caller
+	live := []*NpiControl{NewControl(CONTROL_GET_CAPABILITIES, nil), NewControl(CONTROL_GET_CAPABILITIES, nil)}
+	for _, n := range live {
+		pushCtrlRequest(registry, n)
+	}
+	for i, want := range live {
+		if got := popCtrlRequest(registry, CONTROL_GET_CAPABILITIES); got != want {
+			t.Errorf("Reply %d went to the wrong request", i)
+		}
+	}
+	if _, ok := registry[CONTROL_GET_CAPABILITIES]; ok {
+		t.Errorf("Registry entry left behind once every request was answered")
+	}
+}
+
+func TestCancelPendingControls(t *testing.T) {
+	m := NewFakeMCU()
+	m.Silent = true
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	result := make(chan error, 2)
+	for _, cmd := range []uint8{CONTROL_GET_RF, CONTROL_GET_ADDRESSES} {
+		go func(cmd uint8) {
+			_, _, err := l.Ctrl(cmd, nil)
+			result <- err
+		}(cmd)
+	}
+	if !waitFor(func() bool { return len(m.CommandsSeen()) == 2 }) {
+		t.Fatalf("Control requests never reached the MCU")
+	}
+	start := time.Now()
+	l.CancelPendingControls()
+	for i := 0; i < 2; i++ {
+		if err := <-result; err != ErrCanceled {
+			t.Errorf("Expected ErrCanceled, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Canceled Ctrl took %v to return", elapsed)
+	}
+
+	// Later requests are unaffected
+	m.mutex.Lock()
+	m.Silent = false
+	m.mutex.Unlock()
+	if _, _, err := l.Ctrl(CONTROL_GET_RF, nil); err != nil {
+		t.Errorf("Ctrl after cancel failed: %v", err)
+	}
+}
+
+func TestControlReplyLengthExtremes(t *testing.T) {
+	m := NewFakeMCU()
+	longID := bytes.Repeat([]byte{0xBA, 0xAE, 'x'}, 85) // 255 bytes, salted with start chars
+	m.Replies = map[uint8][]byte{CONTROL_GET_IDENTIFIER: longID}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	stat, rpl, err := l.Ctrl(CONTROL_SET_RF_ON, []byte{1})
+	if err != nil || stat != CONTROL_STATUS_OK {
+		t.Fatalf("Zero-length reply: stat=%s err=%v", Status(stat), err)
+	}
+	if rpl == nil || len(rpl) != 0 {
+		t.Errorf("Zero-length reply should be empty and non-nil, got %#v", rpl)
+	}
+	if _, _, _, _, err := l.GetRadio(); err == nil {
+		t.Errorf("GetRadio accepted a zero-length reply")
+	}
+	if _, _, err := l.GetAddresses(); err == nil {
+		t.Errorf("GetAddresses accepted a zero-length reply")
+	}
+
+	id, err := l.GetIdentifier()
+	if err != nil || id != string(longID) {
+		t.Errorf("Maximum-length reply mangled: len=%d err=%v", len(id), err)
+	}
+	if st := l.Stats(); st.RxLengthErrors != 0 || st.RxChecksumErrors != 0 {
+		t.Errorf("Reader rejected valid replies: %+v", st)
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	m := NewFakeMCU()
+	m.Replies = map[uint8][]byte{CONTROL_GET_CAPABILITIES: {byte(CapCCA | CapCRC16), 0, 0, 0}}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	// Before capabilities are known, SetPower leaves it to the firmware
+	if err := l.SetPower(14); err != nil {
+		t.Errorf("SetPower(14) refused before capabilities were known: %v", err)
+	}
+	caps, err := l.GetCapabilities()
+	if err != nil || !caps.Has(CapCCA|CapCRC16) || caps.Has(CapHighPowerTX) {
+		t.Fatalf("GetCapabilities returned %b, %v", caps, err)
+	}
+	sent := len(m.CommandsSeen())
+	if err := l.SetPower(14); err == nil {
+		t.Errorf("SetPower(14) allowed without CapHighPowerTX")
+	}
+	if len(m.CommandsSeen()) != sent {
+		t.Errorf("SetPower(14) reached the firmware despite the capability gate")
+	}
+	if err := l.SetPower(12); err != nil {
+		t.Errorf("SetPower(12) refused: %v", err)
+	}
+
+	old := NewFakeMCU()
+	old.Status = map[uint8]uint8{CONTROL_GET_CAPABILITIES: CONTROL_STATUS_UNKNOWN_CMD}
+	l2, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return old, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l2.Close()
+	if _, err := l2.GetCapabilities(); err != ErrCapabilitiesUnsupported {
+		t.Errorf("Expected ErrCapabilitiesUnsupported from old firmware, got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	l := newTestLinkMgr()
+	l.RegisterProgramHandler(0x2000, consumingHandler{})
+	frames, stop := l.Subscribe(4)
+	l.dispatch(NewRadioFrame(0xDEAD0001, 0x2000, []byte{0x01}))
+	l.dispatch(NewRadioFrame(0xDEAD0002, 0x2001, []byte{0x02}))
+	for _, want := range []uint32{0xDEAD0001, 0xDEAD0002} {
+		if n := <-frames; n.Address != want {
+			t.Errorf("Expected frame from %08X, got %+v", want, n)
+		}
+	}
+	stop()
+	if _, ok := <-frames; ok {
+		t.Errorf("Subscription channel not closed by stop")
+	}
+	if len(l.RxAudit) != 0 {
+		t.Errorf("Subscription still registered after stop")
+	}
+}
+
+func TestLoopbackTX(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	frames, stop := l.Subscribe(4)
+	defer stop()
+
+	l.SendAck(0xDEAD0001, 0x2000, []byte{0x01}) // Loopback off: not echoed
+	l.SetLoopbackTX(true)
+	payload := []byte{0x02}
+	l.SendAck(0xDEAD0002, 0x2001, payload)
+	payload[0] = 0xFF // Caller reusing its buffer mustn't alter the echo
+	select {
+	case n := <-frames:
+		if n.Address != 0xDEAD0002 || n.Program != 0x2001 || !bytes.Equal(n.Data, []byte{0x02}) || n.Direction != DirTX {
+			t.Errorf("Unexpected loopback frame %+v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Transmitted frame was not echoed into RX dispatch")
+	}
+	select {
+	case n := <-frames:
+		t.Errorf("Unexpected extra frame %+v", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestLoopbackTXSkipsReceivers(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	program, address, firehose := new(countingHandler), new(countingHandler), new(countingHandler)
+	l.RegisterProgramHandler(0x6933, program)
+	l.RegisterAddressHandler(0xDEADBEEF, address)
+	l.RegisterAllHandler(firehose)
+	frames, stop := l.Subscribe(4)
+	defer stop()
+	waited := make(chan *NpiRadioFrame, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	go func() {
+		f, _ := l.WaitForFrame(ctx, 0xDEADBEEF)
+		waited <- f
+	}()
+	time.Sleep(10 * time.Millisecond) // Let the waiter register
+
+	l.SetLoopbackTX(true)
+	l.SendAck(0xDEADBEEF, 0x6933, []byte("SIXTY NINE"))
+	select {
+	case n := <-frames:
+		if n.Direction != DirTX {
+			t.Errorf("Unexpected frame %+v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Transmitted frame was not echoed to Subscribe")
+	}
+	if !waitFor(func() bool { return firehose.Count() == 1 }) {
+		t.Errorf("Firehose handler did not see the echo")
+	}
+	if f := <-waited; f != nil {
+		t.Errorf("WaitForFrame returned the echo of our own send: %+v", f)
+	}
+	if program.Count() != 0 || address.Count() != 0 {
+		t.Errorf("Echo reached the program (%d) or address (%d) handler", program.Count(), address.Count())
+	}
+}
+
+func TestMaxPendingControls(t *testing.T) {
+	m := NewFakeMCU()
+	m.Silent = true
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	l.SetMaxPendingControls(1)
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := l.Ctrl(CONTROL_GET_RF, nil)
+		done <- err
+	}()
+	if !waitFor(func() bool { return l.Stats().CtrlInFlight == 1 }) {
+		t.Fatalf("Expected 1 Ctrl in flight, got %d", l.Stats().CtrlInFlight)
+	}
+	if _, _, err := l.TryCtrl(CONTROL_GET_ADDRESSES, nil); err != ErrTooManyPendingControls {
+		t.Errorf("Expected ErrTooManyPendingControls, got %v", err)
+	}
+
+	l.CancelPendingControls()
+	<-done
+	if !waitFor(func() bool { return l.Stats().CtrlInFlight == 0 }) {
+		t.Errorf("In-flight count not released, CtrlInFlight=%d", l.Stats().CtrlInFlight)
+	}
+	m.mutex.Lock()
+	m.Silent = false
+	m.mutex.Unlock()
+	if _, _, err := l.TryCtrl(CONTROL_GET_RF, nil); err != nil {
+		t.Errorf("TryCtrl failed with a free slot: %v", err)
+	}
+}
+
+// flakyPHY returns err from the first failures Reads before passing through to the FakeMCU
+type flakyPHY struct {
+	*FakeMCU
+	mutex    sync.Mutex
+	failures int
+	err      error
+}
+
+func (f *flakyPHY) Read(p []byte) (int, error) {
+	f.mutex.Lock()
+	if f.failures != 0 {
+		f.failures--
+		f.mutex.Unlock()
+		return 0, f.err
+	}
+	f.mutex.Unlock()
+	return f.FakeMCU.Read(p)
+}
+
+func TestTransientReadErrors(t *testing.T) {
+	m := &flakyPHY{FakeMCU: NewFakeMCU(), failures: 2, err: syscall.EINTR}
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithReadRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	h := new(countingHandler)
+	l.RegisterAllHandler(h)
+	m.InjectFrame(NewRadioFrame(0xDEAD0001, 0x2000, []byte{0x01}), -40)
+	if !waitFor(func() bool { return h.Count() == 1 }) {
+		t.Errorf("Frame not received after transient read errors")
+	}
+	if n := l.Stats().RxTransientErrors; n != 2 {
+		t.Errorf("Expected 2 transient errors, got %d", n)
+	}
+	if !l.Health().LinkUp {
+		t.Errorf("Transient read errors brought the link down")
+	}
+
+	// Retries exhausted: the link is declared dead
+	m2 := &flakyPHY{FakeMCU: NewFakeMCU(), failures: -1, err: syscall.EAGAIN}
+	l2, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m2, nil }, WithReadRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	select {
+	case <-l2.NpiDied:
+	case <-time.After(time.Second):
+		t.Errorf("Persistent transient errors never faulted the link")
+	}
+	if n := l2.Stats().RxTransientErrors; n != 2 {
+		t.Errorf("Expected 2 retries before faulting, got %d", n)
+	}
+}
+
+// timedPHY records when each Write arrives
+type timedPHY struct {
+	*FakeMCU
+	mutex  sync.Mutex
+	writes []time.Time
+}
+
+func (p *timedPHY) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	p.writes = append(p.writes, time.Now())
+	p.mutex.Unlock()
+	return p.FakeMCU.Write(b)
+}
+
+func TestTxInterFrameGap(t *testing.T) {
+	m := &timedPHY{FakeMCU: NewFakeMCU()}
+	gap := 20 * time.Millisecond
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil }, WithTxInterFrameGap(gap))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		l.SendAck(0xDEAD0001, 0x2000, []byte{byte(i)})
+	}
+	l.RunTx()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.writes) != 4 {
+		t.Fatalf("Expected 4 writes, got %d", len(m.writes))
+	}
+	for i := 1; i < len(m.writes); i++ {
+		if d := m.writes[i].Sub(m.writes[i-1]); d < gap {
+			t.Errorf("Writes %d and %d only %v apart", i-1, i, d)
+		}
+	}
+}
+
+func TestNoReconnectClosesNpiDied(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	m.Fail(errors.New("unplugged"))
+	select {
+	case <-l.NpiDied:
+	case <-time.After(time.Second):
+		t.Errorf("NpiDied was not closed after a PHY fault")
+	}
+}
+
+func TestUint32ToBuf(t *testing.T) {
+	var testLongWord uint32
+	buf := make([]byte, 4)
+
+	testLongWord = 0xDEADBEEF
+	buf[0] = uint8(testLongWord)
+	buf[1] = uint8(testLongWord >> 8)
+	buf[2] = uint8(testLongWord >> 16)
+	buf[3] = uint8(testLongWord >> 24)
+
+	if buf[0] != 0xEF || buf[1] != 0xBE || buf[2] != 0xAD || buf[3] != 0xDE {
+		t.Errorf("[]byte composition was invalid: %08X = %02X %02X %02X %02X", testLongWord, buf[0], buf[1], buf[2], buf[3])
+	}
+}
+
+func TestCC1310GetIdentifier(t *testing.T) {
+	l, err := NewLinkMgr(SerialPort, uint(SerialBaudRate))
+	if err != nil {
+		t.Errorf("Error starting NPI Link: %v", err)
+		return
+	}
+
+	id, err := l.GetIdentifier()
+	if err != nil {
+		t.Errorf("Error getting NPI Identifier: %v", err)
+		return
+	}
+	fmt.Printf("NPI identifier string: [%s]\n", id)
+	l.Close()
+}
+
+func TestCC1310GetRadio(t *testing.T) {
+	l, err := NewLinkMgr(SerialPort, uint(SerialBaudRate))
+	if err != nil {
+		t.Errorf("Error starting NPI Link: %v", err)
+		return
+	}
+
+	rxOn, centerFreq, txPower, txTick, err := l.GetRadio()
+	if err != nil {
+		t.Errorf("Error getting Radio params: %v", err)
+		return
+	}
+	// 	return rxOn, cFreq, txPower, txTick, nil
+	fmt.Printf("RX: %v, Freq: %d, TXpower: %d dBm, TXtick: %d\n", rxOn, centerFreq, txPower, txTick)
+	l.Close()
+}
+
+func TestCC1310SendDebugFrame(t *testing.T) {
+	l, err := NewLinkMgr(SerialPort, uint(SerialBaudRate))
+	if err != nil {
+		t.Errorf("Error starting NPI Link: %v", err)
+		return
+	}
+
+	dbgText := "S.BOOGERY BUNZ!!"
+	l.Send(0xDEAD0001, 0xFFFF, []byte(dbgText))
+	_, err = l.RunTx()
+	if err != nil {
+		t.Errorf("RunTx error: %v\n", err)
+		return
+	}
+	l.Close()
+}
+
+func TestCC1310ToggleRxOn(t *testing.T) {
+	l, err := NewLinkMgr(SerialPort, uint(SerialBaudRate))
+	if err != nil {
+		t.Errorf("Error starting NPI Link: %v", err)
+		return
+	}
+
+	err = l.On(true)
+	if err != nil {
+		t.Errorf("Error issuing On(true): %v\n", err)
+		return
+	}
+	tck := time.After(time.Second * 1)
+	select {
+	case <-tck:
+	}
+	err = l.On(false)
+	if err != nil {
+		t.Errorf("Error issuing On(false): %v\n", err)
+		return
+	}
+	tck = time.After(time.Second * 1)
+	select {
+	case <-tck:
+	}
+	err = l.On(true)
+	if err != nil {
 		t.Errorf("Error issuing On(true): %v\n", err)
 		return
 	}
@@ -325,3 +3212,246 @@ func TestCC1310ToggleRxOn(t *testing.T) {
 		return
 	}
 }
+
+func TestPauseDispatch(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	h := new(countingHandler)
+	l.RegisterProgramHandler(0x6933, h)
+
+	l.PauseDispatch()
+	l.PauseDispatch() // Pausing twice needs only one resume
+	for i := 0; i < 3; i++ {
+		m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")), -42)
+	}
+	if !waitFor(func() bool { return l.Stats().RxFrames == 3 }) {
+		t.Fatalf("Frames not received: %+v", l.Stats())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if h.Count() != 0 {
+		t.Fatalf("Handler called %d times while dispatch paused", h.Count())
+	}
+
+	l.ResumeDispatch()
+	if !waitFor(func() bool { return h.Count() == 3 }) {
+		t.Errorf("Handler called %d times after resume, want 3", h.Count())
+	}
+	l.ResumeDispatch() // Resuming when not paused is harmless
+}
+
+func TestPauseDispatchLongerThanFrameGap(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil },
+		WithQueueDepth(1, 1), WithFrameGapTimeout(20*time.Millisecond), WithReadBufferSize(8))
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	h := new(countingHandler)
+	l.RegisterProgramHandler(0x6933, h)
+
+	l.PauseDispatch()
+	for i := 0; i < 4; i++ { // More than FrameRX holds, so the reader stalls part-way through the bytes
+		m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")), -42)
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.ResumeDispatch()
+	if !waitFor(func() bool { return h.Count() == 4 }) {
+		t.Errorf("Handler called %d times after resume, want 4", h.Count())
+	}
+	if n := l.Stats().RxTruncatedFrames; n != 0 {
+		t.Errorf("Pause counted as a frame gap: %d truncated frames", n)
+	}
+}
+
+func TestMCUMessages(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	m.Inject(controlReplyBytes(CONTROL_LOG_MESSAGE, CONTROL_STATUS_OK, []byte("radio calibrated")))
+	select {
+	case msg := <-l.MCUMessages():
+		if msg != "radio calibrated" {
+			t.Errorf("MCU message = %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No MCU message received")
+	}
+	select {
+	case rep := <-l.UnsolicitedControl():
+		t.Errorf("Log message also reported as an unsolicited control reply: %+v", rep)
+	default:
+	}
+	if s := l.Stats(); s.UnsolicitedCtrlReplies != 0 {
+		t.Errorf("Log message counted as an unsolicited control reply: %+v", s)
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	first := NewRadioFrame(0xDEADBEEF, 0x6933, []byte("SIXTY NINE")).Serialize()
+	second := NewRadioFrame(0x12345678, 0x2002, make([]byte, 200)).Serialize()
+	var wire []byte
+	wire = append(wire, first...)
+	wire = append(wire, controlReplyBytes(CONTROL_GET_RF, CONTROL_STATUS_OK, []byte{1, 2, 3})...)
+	wire = append(wire, second...)
+
+	for _, size := range []int{1, 3, 7, 64} {
+		frameRecv := make(chan *NpiRadioFrame, 2)
+		ctrlReply := make(chan NpiControl, 1)
+		cfg := newNpiOptions([]Option{WithReadBufferSize(size)})
+		npiPhyReader(&streamPHY{bytes.NewReader(wire)}, frameRecv, ctrlReply, make(chan struct{}), cfg)
+		if len(frameRecv) != 2 || len(ctrlReply) != 1 {
+			t.Errorf("Buffer size %d: got %d frames and %d control replies, want 2 and 1", size, len(frameRecv), len(ctrlReply))
+			continue
+		}
+		if n := <-frameRecv; n.Address != 0xDEADBEEF || string(n.Data) != "SIXTY NINE" {
+			t.Errorf("Buffer size %d: first frame misparsed: %+v", size, *n)
+		}
+		if c := <-ctrlReply; c.Command != CONTROL_GET_RF || !bytes.Equal(c.Reply, []byte{1, 2, 3}) {
+			t.Errorf("Buffer size %d: control reply misparsed: %+v", size, c)
+		}
+		if n := <-frameRecv; n.Address != 0x12345678 || len(n.Data) != 200 {
+			t.Errorf("Buffer size %d: second frame misparsed: %+v", size, *n)
+		}
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	m := NewFakeMCU()
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+
+	// ledStates returns the SET_LEDS requests the MCU has seen since it was last called, as on/off
+	seen := 0
+	ledStates := func() []bool {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		var states []bool
+		for i := seen; i < len(m.Commands); i++ {
+			if m.Commands[i] == CONTROL_SET_LEDS {
+				states = append(states, m.Requests[i][0] != 0)
+			}
+		}
+		seen = len(m.Commands)
+		return states
+	}
+
+	start := time.Now()
+	if err := l.Identify(500 * time.Millisecond); err != nil {
+		t.Fatalf("Identify error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Identify took %v, want about 500ms", elapsed)
+	}
+	// One double blink (on, off, on, off) cut short at 500ms, then the LEDs are put back on
+	states := ledStates()
+	if fmt.Sprint(states) != "[true false true false true]" {
+		t.Errorf("SET_LEDS sequence %v", states)
+	}
+
+	if err := l.SetLEDs(false); err != nil {
+		t.Fatalf("SetLEDs error: %v", err)
+	}
+	ledStates()
+	if err := l.Identify(100 * time.Millisecond); err != nil {
+		t.Fatalf("Identify error: %v", err)
+	}
+	if states := ledStates(); len(states) == 0 || states[len(states)-1] {
+		t.Errorf("LEDs not left disabled after Identify: %v", states)
+	}
+}
+
+// replyingHandler answers every frame from inside Receive with SendAsync + RunTxAsync
+type replyingHandler struct {
+	results chan string
+}
+
+func (h replyingHandler) Receive(l *LinkMgr, rssi int8, addr uint32, prog uint16, data []byte) bool {
+	l.SendAsync(addr, prog+1, data, func(err error) { h.results <- fmt.Sprintf("send %v", err) })
+	l.RunTxAsync(func(sent int, err error) { h.results <- fmt.Sprintf("runtx %d %v", sent, err) })
+	return true
+}
+
+func TestSendAsync(t *testing.T) {
+	m := NewFakeMCU()
+	m.Silent = true // RUN_TX goes unanswered for now, so a blocking RunTx would stall dispatch
+	l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return m, nil })
+	if err != nil {
+		t.Fatalf("NewLinkMgrPHY error: %v", err)
+	}
+	defer l.Close()
+	h := replyingHandler{results: make(chan string, 4)}
+	l.RegisterProgramHandler(0x6933, h)
+	counter := new(countingHandler)
+	l.RegisterAllHandler(counter)
+
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x6933, []byte("PING")), -42)
+	m.InjectFrame(NewRadioFrame(0xDEADBEEF, 0x7777, nil), -42)
+	if !waitFor(func() bool { return counter.Count() == 2 }) {
+		t.Fatalf("Dispatch stalled behind the handler's reply")
+	}
+	if r := <-h.results; r != "send <nil>" {
+		t.Errorf("SendAsync result %q", r)
+	}
+	if !waitFor(func() bool { return len(m.CommandsSeen()) == 1 }) {
+		t.Fatalf("RUN_TX not sent: %v", m.CommandsSeen())
+	}
+	if !waitFor(func() bool { return len(m.FramesSeen()) == 1 }) {
+		t.Fatalf("Reply not transmitted")
+	}
+	if f := m.FramesSeen()[0]; f.Program != 0x6934 || string(f.Data) != "PING" {
+		t.Errorf("Unexpected reply %+v", *f)
+	}
+
+	m.Inject(controlReplyBytes(CONTROL_RUN_TX, CONTROL_STATUS_OK, []byte{1}))
+	select {
+	case r := <-h.results:
+		if r != "runtx 1 <nil>" {
+			t.Errorf("RunTxAsync result %q", r)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("RunTxAsync never completed")
+	}
+
+	if err := l.SendAsync(0xDEADBEEF, 0x6933, make([]byte, l.MaxPayloadSize()+1), nil); err != ErrPayloadTooLarge {
+		t.Errorf("Oversized SendAsync returned %v", err)
+	}
+}
+
+func TestRunTxAsyncAfterSendAsync(t *testing.T) {
+	for i := 0; i < 5; i++ { // The writer picks between a ready frame and control request at random
+		m := NewFakeMCU()
+		phy := &gatedPHY{FakeMCU: m, entered: make(chan struct{}, 1), gate: make(chan struct{})}
+		l, err := NewLinkMgrPHY(func() (io.ReadWriteCloser, error) { return phy, nil })
+		if err != nil {
+			t.Fatalf("NewLinkMgrPHY error: %v", err)
+		}
+
+		// Hold the writer, so both operations would be waiting for it if RunTxAsync didn't wait for the frame
+		l.CtrlForget(CONTROL_GET_RF, nil)
+		<-phy.entered
+		l.SendAsync(0xDEADBEEF, 0x6934, []byte("PING"), nil)
+		l.RunTxAsync(nil)
+		time.Sleep(10 * time.Millisecond)
+		close(phy.gate)
+
+		if !waitFor(func() bool { return len(phy.Starts()) == 3 }) {
+			t.Fatalf("Expected 3 writes, got % X", phy.Starts())
+		}
+		if got := phy.Starts(); !bytes.Equal(got, []byte{0xBD, 0xAE, 0xBD}) {
+			t.Fatalf("RUN_TX was written before the SendAsync frame: % X", got)
+		}
+		l.Close()
+	}
+}